@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"io"
 
 	"github.com/escalopa/chatterly/internal/app"
 	"github.com/escalopa/chatterly/internal/auth"
+	"github.com/escalopa/chatterly/internal/blob"
+	"github.com/escalopa/chatterly/internal/broker"
 	"github.com/escalopa/chatterly/internal/config"
 	"github.com/escalopa/chatterly/internal/db"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
 	"github.com/escalopa/chatterly/internal/log"
+	"github.com/escalopa/chatterly/internal/search"
 	"github.com/escalopa/chatterly/internal/service"
 )
 
@@ -27,9 +34,63 @@ func main() {
 	}
 	defer func() { database.Close(ctx) }()
 
+	msgBroker, err := broker.New(ctx, cfg.Broker.Servers)
+	if err != nil {
+		log.Fatal("init broker", log.Err(err))
+	}
+	defer msgBroker.Close()
+
 	userTokenProvider := auth.NewUserProvider(cfg.JWT.User)
 	chatTokenProvider := auth.NewChatProvider(cfg.JWT.Chat)
-	oauthProvider := auth.NewOAuthProvider(cfg.OAuth)
+	oauthProvider, err := auth.NewOAuthProvider(cfg.OAuth, cfg.OAuthState)
+	if err != nil {
+		log.Fatal("init oauth provider", log.Err(err))
+	}
+
+	urlSigner, err := auth.NewURLSigner(cfg.Attachment.URL)
+	if err != nil {
+		log.Fatal("init url signer", log.Err(err))
+	}
+
+	hub := gateway.New(msgBroker)
+
+	var searchIndex interface {
+		IndexMessage(ctx context.Context, msg *domain.Message) error
+		RemoveMessage(ctx context.Context, messageID string) error
+		SearchMessages(ctx context.Context, search *domain.MessageSearch) ([]*domain.SearchHit, error)
+	}
+
+	switch cfg.Search.Backend {
+	case "", "mongo":
+		searchIndex = search.NewMongo(database)
+	case "sqlite":
+		sqliteIndex, err := search.NewSQLite(ctx, cfg.Search.SQLitePath)
+		if err != nil {
+			log.Fatal("init search index", log.Err(err))
+		}
+		defer sqliteIndex.Close()
+		searchIndex = sqliteIndex
+	default:
+		log.Fatal("unknown search backend", log.String("backend", cfg.Search.Backend))
+	}
+
+	var blobStore interface {
+		Put(ctx context.Context, key string, r io.Reader) error
+		Open(ctx context.Context, key string) (io.ReadCloser, error)
+		Delete(ctx context.Context, key string) error
+	}
+
+	switch cfg.Attachment.Backend {
+	case "", "local":
+		blobStore, err = blob.NewLocal(cfg.Attachment.Dir)
+	case "nats":
+		blobStore, err = blob.NewObjectStore(ctx, msgBroker.JetStream(), cfg.Attachment.Bucket)
+	default:
+		log.Fatal("unknown attachment backend", log.String("backend", cfg.Attachment.Backend))
+	}
+	if err != nil {
+		log.Fatal("init blob store", log.Err(err))
+	}
 
 	s := app.New(
 		app.Config{
@@ -37,12 +98,24 @@ func main() {
 			AllowOrigins:    cfg.App.AllowOrigins,
 			AccessTokenTTL:  cfg.JWT.User.AccessTokenTTL,
 			RefreshTokenTTL: cfg.JWT.User.RefreshTokenTTL,
+			OAuthStateTTL:   cfg.OAuthState.TTL,
 		},
 		service.New(
+			service.Config{
+				DedupWindow:       cfg.Chat.DedupWindow,
+				MaxAttachmentSize: cfg.Attachment.MaxSize,
+				ImageWorkers:      cfg.Attachment.ImageWorkers,
+				SessionTTL:        cfg.JWT.User.RefreshTokenTTL,
+			},
 			database,
 			oauthProvider,
 			userTokenProvider,
 			chatTokenProvider,
+			hub,
+			msgBroker,
+			searchIndex,
+			blobStore,
+			urlSigner,
 		),
 	)
 
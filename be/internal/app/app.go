@@ -3,7 +3,9 @@ package app
 import (
 	"context"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
 	"slices"
 	"time"
 
@@ -15,9 +17,58 @@ import (
 )
 
 type service interface {
-	GetOAuthRedirectURL(provider string) (string, error)
-	RegisterUser(ctx context.Context, provider string, code string) (*domain.Token, error)
-	AuthenticateUser(ctx context.Context, token *domain.Token) (*domain.User, *domain.Token, error)
+	GetOAuthRedirectURL(ctx context.Context, provider string) (*domain.OAuthRedirect, error)
+	RegisterUser(ctx context.Context, provider string, callback *domain.OAuthCallback) (*domain.Token, error)
+	LinkIdentity(ctx context.Context, userID string, provider string, callback *domain.OAuthCallback) (*domain.User, error)
+	UnlinkIdentity(ctx context.Context, userID string, provider string, subject string) (*domain.User, error)
+	AuthenticateUser(ctx context.Context, token *domain.Token) (*domain.User, string, *domain.Token, error)
+	Logout(ctx context.Context, userID string, sessionID string) error
+	ListSessions(ctx context.Context, userID string) ([]*domain.Session, error)
+	RevokeSession(ctx context.Context, userID string, sessionID string) error
+	RevokeUserSessions(ctx context.Context, userID string, keepID string) (int64, error)
+
+	CreateRoomToken(ctx context.Context, userID string, sessionID string, roomID string) (string, error)
+	AuthenticateWS(ctx context.Context, token string, roomID string) (*domain.User, string, error)
+	HandleWS(ctx context.Context, user *domain.User, sessionID string, roomID string, conn *websocket.Conn)
+
+	OpenDM(ctx context.Context, userID string, peerID string) (*domain.DM, error)
+	ListDMs(ctx context.Context, userID string) ([]*domain.DM, error)
+
+	CreateRoom(ctx context.Context, userID string, name string, topic string, visibility string) (*domain.Room, error)
+	GetRoom(ctx context.Context, userID string, roomID string) (*domain.Room, error)
+	ListRooms(ctx context.Context, userID string) ([]*domain.Room, error)
+	InviteToRoom(ctx context.Context, userID string, roomID string, inviteeID string) error
+	JoinRoom(ctx context.Context, userID string, roomID string) error
+	LeaveRoom(ctx context.Context, userID string, roomID string) error
+	RemoveRoomMember(ctx context.Context, userID string, roomID string, memberID string) error
+
+	ListMessages(ctx context.Context, userID string, roomID string, before string, limit int) (*domain.MessagePage, error)
+	ListReplies(ctx context.Context, userID string, roomID string, parentID string, before string, limit int) (*domain.MessagePage, error)
+	EditMessage(ctx context.Context, userID string, roomID string, messageID string, body string) (*domain.Message, error)
+	DeleteMessage(ctx context.Context, userID string, roomID string, messageID string) (*domain.Message, error)
+	ListMessageRevisions(ctx context.Context, userID string, roomID string, messageID string) ([]domain.MessageRevision, error)
+	AddReaction(ctx context.Context, userID string, roomID string, messageID string, emoji string) ([]domain.Reaction, error)
+	RemoveReaction(ctx context.Context, userID string, roomID string, messageID string, emoji string) ([]domain.Reaction, error)
+	PinMessage(ctx context.Context, userID string, roomID string, messageID string) error
+	UnpinMessage(ctx context.Context, userID string, roomID string, messageID string) error
+	ListPins(ctx context.Context, userID string, roomID string) ([]domain.Pin, error)
+	ListReceipts(ctx context.Context, userID string, roomID string) ([]*domain.Receipt, error)
+	ListUnread(ctx context.Context, userID string) ([]*domain.Unread, error)
+
+	UploadAttachment(ctx context.Context, userID string, roomID string, name string, r io.Reader) (*domain.Attachment, error)
+	GetAttachmentURL(ctx context.Context, userID string, roomID string, attachmentID string) (*domain.AttachmentURL, error)
+	OpenAttachment(ctx context.Context, attachmentID string, variant string, q url.Values) (*domain.Attachment, io.ReadCloser, error)
+
+	UploadAvatar(ctx context.Context, userID string, r io.Reader) (*domain.User, error)
+	SetUsername(ctx context.Context, userID string, username string) (*domain.User, error)
+	OpenAvatar(ctx context.Context, avatarID string, size string) (io.ReadCloser, error)
+
+	GetPresence(ctx context.Context, callerID string, userID string) (*domain.Presence, error)
+
+	SearchMessages(ctx context.Context, userID string, search *domain.MessageSearch) ([]*domain.SearchHit, error)
+
+	ListNotifications(ctx context.Context, userID string, unreadOnly bool, before string, limit int) (*domain.NotificationPage, error)
+	MarkNotificationsRead(ctx context.Context, userID string, ids []string) (int64, error)
 }
 
 type Config struct {
@@ -26,6 +77,7 @@ type Config struct {
 
 	AccessTokenTTL  time.Duration
 	RefreshTokenTTL time.Duration
+	OAuthStateTTL   time.Duration
 
 	ShutdownTimeout time.Duration
 }
@@ -41,7 +93,7 @@ type App struct {
 func New(cfg Config, srv service) *App {
 	kors := cors.New(cors.Config{
 		AllowOrigins:     cfg.AllowOrigins,
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Accept", "Authorization", "Content-Type"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -110,14 +162,72 @@ func (a *App) setup() {
 	{
 		userRoutes.GET("/info", a.getUserInfo)
 		userRoutes.POST("/logout", a.logout)
+		userRoutes.GET("/:id/presence", a.getPresence)
+		userRoutes.PUT("/avatar", a.uploadAvatar)
+		userRoutes.PUT("/username", a.setUsername)
+		userRoutes.GET("/identities/:provider/link", a.oauthRedirect)
+		userRoutes.POST("/identities/:provider/callback", a.linkIdentity)
+		userRoutes.DELETE("/identities/:provider/:subject", a.unlinkIdentity)
 	}
 
-	//roomRoutes := a.r.Group("/api/room")
-	//roomRoutes.Use(a.authMiddleware)
-	//{
-	//	roomRoutes.POST("/join/:room_id", a.joinRoom)
-	//	roomRoutes.GET("/ws/:room_id", a.ws)
-	//}
+	meRoutes := a.r.Group("/api/me")
+	meRoutes.Use(a.authMiddleware)
+	{
+		meRoutes.GET("/unread", a.listUnread)
+		meRoutes.GET("/notifications", a.listNotifications)
+		meRoutes.POST("/notifications/read", a.markNotificationsRead)
+		meRoutes.GET("/sessions", a.listSessions)
+		meRoutes.DELETE("/sessions", a.revokeOtherSessions)
+		meRoutes.DELETE("/sessions/:session_id", a.revokeSession)
+	}
+
+	roomRoutes := a.r.Group("/api/room")
+	roomRoutes.Use(a.authMiddleware)
+	{
+		roomRoutes.GET("", a.listRooms)
+		roomRoutes.POST("", a.createRoom)
+		roomRoutes.GET("/:room_id", a.getRoom)
+		roomRoutes.POST("/:room_id/invites", a.inviteToRoom)
+		roomRoutes.POST("/:room_id/members", a.enterRoom)
+		roomRoutes.DELETE("/:room_id/members", a.leaveRoom)
+		roomRoutes.DELETE("/:room_id/members/:user_id", a.removeRoomMember)
+		roomRoutes.GET("/:room_id/messages", a.listMessages)
+		roomRoutes.PATCH("/:room_id/messages/:message_id", a.editMessage)
+		roomRoutes.DELETE("/:room_id/messages/:message_id", a.deleteMessage)
+		roomRoutes.GET("/:room_id/messages/:message_id/revisions", a.listMessageRevisions)
+		roomRoutes.GET("/:room_id/messages/:message_id/replies", a.listReplies)
+		roomRoutes.PUT("/:room_id/messages/:message_id/reactions/:emoji", a.addReaction)
+		roomRoutes.DELETE("/:room_id/messages/:message_id/reactions/:emoji", a.removeReaction)
+		roomRoutes.PUT("/:room_id/messages/:message_id/pin", a.pinMessage)
+		roomRoutes.DELETE("/:room_id/messages/:message_id/pin", a.unpinMessage)
+		roomRoutes.GET("/:room_id/pins", a.listPins)
+		roomRoutes.GET("/:room_id/receipts", a.listReceipts)
+		roomRoutes.POST("/:room_id/attachments", a.uploadAttachment)
+		roomRoutes.GET("/:room_id/attachments/:attachment_id", a.getAttachmentURL)
+		roomRoutes.POST("/join/:room_id", a.joinRoom)
+	}
+
+	dmRoutes := a.r.Group("/api/dm")
+	dmRoutes.Use(a.authMiddleware)
+	{
+		dmRoutes.GET("", a.listDMs)
+		dmRoutes.POST("", a.openDM)
+	}
+
+	searchRoutes := a.r.Group("/api/search")
+	searchRoutes.Use(a.authMiddleware)
+	{
+		searchRoutes.GET("/messages", a.searchMessages)
+	}
+
+	// the gateway is authenticated by the chat ticket passed in the query
+	a.r.GET("/api/room/ws/:room_id", a.ws)
+
+	// downloads are authenticated by the signature of the url
+	a.r.GET("/api/attachments/:attachment_id", a.downloadAttachment)
+
+	// avatars are public, their ids are random
+	a.r.GET("/api/avatars/:avatar_id", a.downloadAvatar)
 
 	oauthRoutes := a.r.Group("/api/oauth")
 	{
@@ -131,11 +241,18 @@ func (a *App) health(c *gin.Context) {
 }
 
 func (a *App) getUserInfo(c *gin.Context) {
-	user, _ := c.Get("user")
-	c.JSON(http.StatusOK, gin.H{"user": user})
+	user := a.user(c)
+	c.JSON(http.StatusOK, gin.H{"user": user, "identities": identities(user)})
 }
 
 func (a *App) logout(c *gin.Context) {
+	err := a.srv.Logout(c.Request.Context(), a.user(c).ID, a.session(c))
+	if err != nil {
+		log.Error("srv.Logout", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot logout user"})
+		return
+	}
+
 	a.setTokenCookie(c, nil)
 	c.JSON(http.StatusOK, gin.H{"message": "user logged out"})
 }
@@ -147,7 +264,7 @@ func (a *App) oauthRedirect(c *gin.Context) {
 		return
 	}
 
-	url, err := a.srv.GetOAuthRedirectURL(provider)
+	redirect, err := a.srv.GetOAuthRedirectURL(c.Request.Context(), provider)
 	if err != nil {
 		if errors.Is(err, domain.ErrOAuthUnsupportedProvider) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported oauth provider"})
@@ -158,41 +275,74 @@ func (a *App) oauthRedirect(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"url": url})
+	a.setStateCookie(c, redirect.Cookie)
+	c.JSON(http.StatusOK, gin.H{"url": redirect.URL})
 }
 
 type oauthCallbackBody struct {
-	Code string `json:"code"`
+	Code  string `json:"code"`
+	State string `json:"state"`
 }
 
 func (a *App) oauthCallback(c *gin.Context) {
+	provider, callback, ok := a.readOAuthCallback(c)
+	if !ok {
+		return
+	}
+
+	token, err := a.srv.RegisterUser(c.Request.Context(), provider, callback)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrOAuthUnsupportedProvider), errors.Is(err, domain.ErrOAuthStateInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.RegisterUser", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot register user"})
+		}
+		return
+	}
+
+	a.setTokenCookie(c, token)
+}
+
+// readOAuthCallback reads the callback of a login with the state cookie of
+// the browser, it replies on failure.
+func (a *App) readOAuthCallback(c *gin.Context) (string, *domain.OAuthCallback, bool) {
 	provider := c.Param("provider")
 	if provider == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "empty oauth provider"})
-		return
+		return "", nil, false
 	}
 
 	var body oauthCallbackBody
 	if err := c.ShouldBindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
-		return
+		return "", nil, false
 	}
 
 	if body.Code == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "empty code"})
-		return
+		return "", nil, false
 	}
 
-	token, err := a.srv.RegisterUser(c.Request.Context(), provider, body.Code)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot register user"})
-		return
+	if body.State == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty state"})
+		return "", nil, false
 	}
 
-	a.setTokenCookie(c, token)
+	// the state is good for a single attempt
+	cookie, _ := c.Cookie(oauthStateKey)
+	a.setStateCookie(c, "")
+
+	return provider, &domain.OAuthCallback{Code: body.Code, State: body.State, Cookie: cookie}, true
 }
 
 func (a *App) user(c *gin.Context) *domain.User {
 	data, _ := c.Get("user")
 	return data.(*domain.User)
 }
+
+// session returns the id of the login session of the request.
+func (a *App) session(c *gin.Context) string {
+	return c.GetString("session")
+}
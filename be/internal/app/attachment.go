@@ -0,0 +1,122 @@
+package app
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gin-gonic/gin"
+)
+
+// uploadAttachment streams the file part of a multipart form to the blob
+// store without buffering it.
+func (a *App) uploadAttachment(c *gin.Context) {
+	part, ok := filePart(c)
+	if !ok {
+		return
+	}
+	defer func() { _ = part.Close() }()
+
+	attachment, err := a.srv.UploadAttachment(c.Request.Context(), a.user(c).ID, c.Param("room_id"), part.FileName(), part)
+	if err != nil {
+		a.attachmentError(c, "srv.UploadAttachment", "temporary cannot upload attachment", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// filePart finds the part named file of a multipart form, it replies on
+// failure.
+func filePart(c *gin.Context) (*multipart.Part, bool) {
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return nil, false
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "missing file"})
+				return nil, false
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+			return nil, false
+		}
+
+		if part.FormName() == "file" {
+			return part, true
+		}
+		_ = part.Close()
+	}
+}
+
+func (a *App) getAttachmentURL(c *gin.Context) {
+	attachmentURL, err := a.srv.GetAttachmentURL(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("attachment_id"))
+	if err != nil {
+		a.attachmentError(c, "srv.GetAttachmentURL", "temporary cannot get attachment", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, attachmentURL)
+}
+
+// downloadAttachment serves a signed download url, the signature stands in
+// for the session so that the url works in img and a tags.
+func (a *App) downloadAttachment(c *gin.Context) {
+	attachment, rc, err := a.srv.OpenAttachment(c.Request.Context(), c.Param("attachment_id"), c.Query("variant"), c.Request.URL.Query())
+	if err != nil {
+		a.attachmentError(c, "srv.OpenAttachment", "temporary cannot download attachment", err)
+		return
+	}
+	defer func() { _ = rc.Close() }()
+
+	c.DataFromReader(http.StatusOK, attachment.Size, attachment.ContentType, rc, map[string]string{
+		"Content-Disposition":    contentDisposition(attachment),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=300",
+	})
+}
+
+// contentDisposition lets browsers show media in place, anything else is
+// downloaded so that no html or script is rendered from our origin.
+func contentDisposition(attachment *domain.Attachment) string {
+	typ := "attachment"
+
+	mediaType, _, _ := mime.ParseMediaType(attachment.ContentType)
+	switch {
+	case mediaType == "image/svg+xml":
+		// svg may carry scripts
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		mediaType == "application/pdf":
+		typ = "inline"
+	}
+
+	return mime.FormatMediaType(typ, map[string]string{"filename": attachment.Name})
+}
+
+// attachmentError replies with the status matching an attachment error.
+func (a *App) attachmentError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrAttachmentEmpty),
+		errors.Is(err, domain.ErrImageInvalid),
+		errors.Is(err, domain.ErrImageTooLarge):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrAttachmentTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrDBAttachmentNotFound), errors.Is(err, domain.ErrBlobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": domain.ErrDBAttachmentNotFound.Error()})
+	case errors.Is(err, domain.ErrURLSignatureInvalid), errors.Is(err, domain.ErrURLExpired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		a.roomError(c, op, msg, err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 const (
 	accessTokenKey  = "X-Access-Token"
 	refreshTokenKey = "X-Refresh-Token"
+	oauthStateKey   = "X-OAuth-State"
 )
 
 func (a *App) authMiddleware(c *gin.Context) {
@@ -33,8 +34,16 @@ func (a *App) authMiddleware(c *gin.Context) {
 	}
 
 	token := &domain.Token{Access: accessToken, Refresh: refreshToken}
-	user, token, err := a.srv.AuthenticateUser(c.Request.Context(), token)
+	user, sessionID, token, err := a.srv.AuthenticateUser(c.Request.Context(), token)
 	if err != nil {
+		if errors.Is(err, domain.ErrSessionRevoked) || errors.Is(err, domain.ErrTokenInvalid) || errors.Is(err, domain.ErrTokenExpired) {
+			// the cookies are of no use anymore, e.g. the refresh tokens issued
+			// before rotation whose users have to log in again
+			a.setTokenCookie(c, nil)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
 		log.Error("srv.AuthenticateUser", log.Err(err))
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "internal server error"})
 		return
@@ -46,13 +55,15 @@ func (a *App) authMiddleware(c *gin.Context) {
 	}
 
 	c.Set("user", user)
+	c.Set("session", sessionID)
 	c.Next()
 }
 
 const (
-	cookiePath     = "/"
-	cookieSecure   = true
-	cookieHttpOnly = true
+	cookiePath      = "/"
+	oauthCookiePath = "/api" // logins and identity links
+	cookieSecure    = true
+	cookieHttpOnly  = true
 )
 
 func (a *App) setTokenCookie(c *gin.Context, token *domain.Token) {
@@ -93,3 +104,23 @@ func (a *App) setTokenCookie(c *gin.Context, token *domain.Token) {
 		cookieHttpOnly,
 	)
 }
+
+// setStateCookie keeps the login state in the browser until the callback, an
+// empty state deletes the cookie. Without a ttl it lasts for the browser session.
+func (a *App) setStateCookie(c *gin.Context, state string) {
+	maxAge := int(a.cfg.OAuthStateTTL.Seconds())
+	if state == "" {
+		maxAge = -1
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		oauthStateKey,
+		state,
+		maxAge,
+		oauthCookiePath,
+		a.cfg.Domain,
+		cookieSecure,
+		cookieHttpOnly,
+	)
+}
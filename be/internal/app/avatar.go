@@ -0,0 +1,52 @@
+package app
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) uploadAvatar(c *gin.Context) {
+	part, ok := filePart(c)
+	if !ok {
+		return
+	}
+	defer func() { _ = part.Close() }()
+
+	user, err := a.srv.UploadAvatar(c.Request.Context(), a.user(c).ID, part)
+	if err != nil {
+		a.attachmentError(c, "srv.UploadAvatar", "temporary cannot upload avatar", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+func (a *App) downloadAvatar(c *gin.Context) {
+	rc, err := a.srv.OpenAvatar(c.Request.Context(), c.Param("avatar_id"), c.Query("size"))
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrAvatarSizeInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrAvatarNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			a.attachmentError(c, "srv.OpenAvatar", "temporary cannot download avatar", err)
+		}
+		return
+	}
+	defer func() { _ = rc.Close() }()
+
+	// avatars are stored as jpeg or png, the content tells which
+	br := bufio.NewReader(rc)
+	head, _ := br.Peek(512)
+
+	// a new avatar gets a new id, so the content never changes
+	c.DataFromReader(http.StatusOK, -1, http.DetectContentType(head), br, map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "public, max-age=31536000, immutable",
+	})
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+type openDMBody struct {
+	UserID string `json:"user_id"`
+}
+
+func (a *App) openDM(c *gin.Context) {
+	var body openDMBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return
+	}
+
+	if body.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty user id"})
+		return
+	}
+
+	dm, err := a.srv.OpenDM(c.Request.Context(), a.user(c).ID, body.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrDMSelf):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrDBUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.OpenDM", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot open dm"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dm": dm})
+}
+
+func (a *App) listDMs(c *gin.Context) {
+	dms, err := a.srv.ListDMs(c.Request.Context(), a.user(c).ID)
+	if err != nil {
+		log.Error("srv.ListDMs", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot list dms"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dms": dms})
+}
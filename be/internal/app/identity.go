@@ -0,0 +1,58 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) linkIdentity(c *gin.Context) {
+	provider, callback, ok := a.readOAuthCallback(c)
+	if !ok {
+		return
+	}
+
+	user, err := a.srv.LinkIdentity(c.Request.Context(), a.user(c).ID, provider, callback)
+	if err != nil {
+		a.identityError(c, "srv.LinkIdentity", "temporary cannot link identity", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "identities": identities(user)})
+}
+
+func (a *App) unlinkIdentity(c *gin.Context) {
+	user, err := a.srv.UnlinkIdentity(c.Request.Context(), a.user(c).ID, c.Param("provider"), c.Param("subject"))
+	if err != nil {
+		a.identityError(c, "srv.UnlinkIdentity", "temporary cannot unlink identity", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user, "identities": identities(user)})
+}
+
+// identities returns the provider accounts of the user, they are left out of
+// the user itself so that only the user sees them.
+func identities(user *domain.User) []domain.Identity {
+	if user.Identities == nil {
+		return []domain.Identity{}
+	}
+	return user.Identities
+}
+
+func (a *App) identityError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrOAuthUnsupportedProvider), errors.Is(err, domain.ErrOAuthStateInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrIdentityNotFound), errors.Is(err, domain.ErrDBUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrIdentityLinked), errors.Is(err, domain.ErrIdentityLast):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error(op, log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+	}
+}
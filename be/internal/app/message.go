@@ -0,0 +1,123 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) listMessages(c *gin.Context) {
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+
+	page, err := a.srv.ListMessages(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Query("before"), limit)
+	if err != nil {
+		a.pageError(c, "srv.ListMessages", "temporary cannot list messages", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+func (a *App) listReplies(c *gin.Context) {
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+
+	page, err := a.srv.ListReplies(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"), c.Query("before"), limit)
+	if err != nil {
+		a.pageError(c, "srv.ListReplies", "temporary cannot list replies", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// pageLimit reads the optional limit query, it replies on failure.
+func pageLimit(c *gin.Context) (int, bool) {
+	v := c.Query("limit")
+	if v == "" {
+		return 0, true
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": domain.ErrLimitInvalid.Error()})
+		return 0, false
+	}
+
+	return limit, true
+}
+
+func (a *App) pageError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrLimitInvalid), errors.Is(err, domain.ErrCursorInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrThreadParentInvalid):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		a.roomError(c, op, msg, err)
+	}
+}
+
+type editMessageBody struct {
+	Body string `json:"body"`
+}
+
+func (a *App) editMessage(c *gin.Context) {
+	var body editMessageBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return
+	}
+
+	msg, err := a.srv.EditMessage(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"), body.Body)
+	if err != nil {
+		a.messageError(c, "srv.EditMessage", "temporary cannot edit message", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+func (a *App) deleteMessage(c *gin.Context) {
+	msg, err := a.srv.DeleteMessage(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"))
+	if err != nil {
+		a.messageError(c, "srv.DeleteMessage", "temporary cannot delete message", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+func (a *App) listMessageRevisions(c *gin.Context) {
+	revisions, err := a.srv.ListMessageRevisions(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"))
+	if err != nil {
+		a.messageError(c, "srv.ListMessageRevisions", "temporary cannot list message revisions", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, revisions)
+}
+
+// messageError replies with the status matching a message error.
+func (a *App) messageError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrMessageEmpty), errors.Is(err, domain.ErrMessageTooLong):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrDBMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrMessageNotAuthor):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrMessageDeleted):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		a.roomError(c, op, msg, err)
+	}
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) listNotifications(c *gin.Context) {
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+
+	unreadOnly := c.Query("unread") == "true"
+
+	page, err := a.srv.ListNotifications(c.Request.Context(), a.user(c).ID, unreadOnly, c.Query("before"), limit)
+	if err != nil {
+		a.pageError(c, "srv.ListNotifications", "temporary cannot list notifications", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+type markNotificationsReadBody struct {
+	// IDs are the notifications to mark read, all of them when empty
+	IDs []string `json:"ids"`
+}
+
+func (a *App) markNotificationsRead(c *gin.Context) {
+	var body markNotificationsReadBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return
+	}
+
+	updated, err := a.srv.MarkNotificationsRead(c.Request.Context(), a.user(c).ID, body.IDs)
+	if err != nil {
+		if errors.Is(err, domain.ErrNotificationIDsInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		a.roomError(c, "srv.MarkNotificationsRead", "temporary cannot mark notifications read", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"updated": updated})
+}
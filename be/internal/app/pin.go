@@ -0,0 +1,48 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) listPins(c *gin.Context) {
+	pins, err := a.srv.ListPins(c.Request.Context(), a.user(c).ID, c.Param("room_id"))
+	if err != nil {
+		a.roomError(c, "srv.ListPins", "temporary cannot list pins", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"pins": pins})
+}
+
+func (a *App) pinMessage(c *gin.Context) {
+	err := a.srv.PinMessage(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"))
+	if err != nil {
+		a.pinError(c, "srv.PinMessage", "temporary cannot pin message", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "message pinned"})
+}
+
+func (a *App) unpinMessage(c *gin.Context) {
+	err := a.srv.UnpinMessage(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"))
+	if err != nil {
+		a.pinError(c, "srv.UnpinMessage", "temporary cannot unpin message", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "message unpinned"})
+}
+
+func (a *App) pinError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrPinLimit):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		a.messageError(c, op, msg, err)
+	}
+}
@@ -0,0 +1,28 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) getPresence(c *gin.Context) {
+	p, err := a.srv.GetPresence(c.Request.Context(), a.user(c).ID, c.Param("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrDBUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrUserIDInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.GetPresence", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot get presence"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, p)
+}
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) addReaction(c *gin.Context) {
+	reactions, err := a.srv.AddReaction(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"), c.Param("emoji"))
+	if err != nil {
+		a.reactionError(c, "srv.AddReaction", "temporary cannot add reaction", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, reactions)
+}
+
+func (a *App) removeReaction(c *gin.Context) {
+	reactions, err := a.srv.RemoveReaction(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("message_id"), c.Param("emoji"))
+	if err != nil {
+		a.reactionError(c, "srv.RemoveReaction", "temporary cannot remove reaction", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, reactions)
+}
+
+func (a *App) reactionError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrReactionInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrReactionLimit):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		a.messageError(c, op, msg, err)
+	}
+}
@@ -0,0 +1,27 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) listReceipts(c *gin.Context) {
+	receipts, err := a.srv.ListReceipts(c.Request.Context(), a.user(c).ID, c.Param("room_id"))
+	if err != nil {
+		a.roomError(c, "srv.ListReceipts", "temporary cannot list receipts", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, receipts)
+}
+
+func (a *App) listUnread(c *gin.Context) {
+	unreads, err := a.srv.ListUnread(c.Request.Context(), a.user(c).ID)
+	if err != nil {
+		a.roomError(c, "srv.ListUnread", "temporary cannot list unread counts", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, unreads)
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+const chatTicketKey = "token"
+
+type createRoomBody struct {
+	Name       string `json:"name"`
+	Topic      string `json:"topic"`
+	Visibility string `json:"visibility"`
+}
+
+func (a *App) createRoom(c *gin.Context) {
+	var body createRoomBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return
+	}
+
+	room, err := a.srv.CreateRoom(c.Request.Context(), a.user(c).ID, body.Name, body.Topic, body.Visibility)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrRoomNameEmpty),
+			errors.Is(err, domain.ErrRoomNameTooLong),
+			errors.Is(err, domain.ErrRoomTopicTooLong),
+			errors.Is(err, domain.ErrRoomVisibilityInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.CreateRoom", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot create room"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"room": room})
+}
+
+func (a *App) getRoom(c *gin.Context) {
+	room, err := a.srv.GetRoom(c.Request.Context(), a.user(c).ID, c.Param("room_id"))
+	if err != nil {
+		if errors.Is(err, domain.ErrDBRoomNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		log.Error("srv.GetRoom", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot get room"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+func (a *App) listRooms(c *gin.Context) {
+	rooms, err := a.srv.ListRooms(c.Request.Context(), a.user(c).ID)
+	if err != nil {
+		log.Error("srv.ListRooms", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot list rooms"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
+}
+
+type inviteToRoomBody struct {
+	UserID string `json:"user_id"`
+}
+
+func (a *App) inviteToRoom(c *gin.Context) {
+	var body inviteToRoomBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return
+	}
+
+	if body.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty user id"})
+		return
+	}
+
+	err := a.srv.InviteToRoom(c.Request.Context(), a.user(c).ID, c.Param("room_id"), body.UserID)
+	if err != nil {
+		a.roomError(c, "srv.InviteToRoom", "temporary cannot invite to room", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "user invited"})
+}
+
+func (a *App) enterRoom(c *gin.Context) {
+	err := a.srv.JoinRoom(c.Request.Context(), a.user(c).ID, c.Param("room_id"))
+	if err != nil {
+		a.roomError(c, "srv.JoinRoom", "temporary cannot join room", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "room joined"})
+}
+
+func (a *App) leaveRoom(c *gin.Context) {
+	err := a.srv.LeaveRoom(c.Request.Context(), a.user(c).ID, c.Param("room_id"))
+	if err != nil {
+		a.roomError(c, "srv.LeaveRoom", "temporary cannot leave room", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "room left"})
+}
+
+func (a *App) removeRoomMember(c *gin.Context) {
+	err := a.srv.RemoveRoomMember(c.Request.Context(), a.user(c).ID, c.Param("room_id"), c.Param("user_id"))
+	if err != nil {
+		a.roomError(c, "srv.RemoveRoomMember", "temporary cannot remove room member", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "member removed"})
+}
+
+// roomError replies with the status matching a room membership error.
+func (a *App) roomError(c *gin.Context, op string, msg string, err error) {
+	switch {
+	case errors.Is(err, domain.ErrDBRoomNotFound), errors.Is(err, domain.ErrDBUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrRoomNotMember),
+		errors.Is(err, domain.ErrRoomNotInvited),
+		errors.Is(err, domain.ErrRoomPermissionDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, domain.ErrRoomAlreadyMember), errors.Is(err, domain.ErrRoomOwnerLeave):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Error(op, log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": msg})
+	}
+}
+
+func (a *App) joinRoom(c *gin.Context) {
+	roomID := c.Param("room_id")
+	if roomID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty room id"})
+		return
+	}
+
+	token, err := a.srv.CreateRoomToken(c.Request.Context(), a.user(c).ID, a.session(c), roomID)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrDBRoomNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrRoomNotMember):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.CreateRoomToken", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot join room"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+func (a *App) ws(c *gin.Context) {
+	roomID := c.Param("room_id")
+	if roomID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "empty room id"})
+		return
+	}
+
+	token := c.Query(chatTicketKey)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "empty chat ticket"})
+		return
+	}
+
+	user, sessionID, err := a.srv.AuthenticateWS(c.Request.Context(), token, roomID)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrTokenExpired),
+			errors.Is(err, domain.ErrTokenInvalid),
+			errors.Is(err, domain.ErrSessionRevoked),
+			errors.Is(err, domain.ErrDBUserNotFound):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrRoomIDTokenMismatch):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.AuthenticateWS", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot join room"})
+		}
+		return
+	}
+
+	conn, err := a.upg.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		log.Warn("upg.Upgrade", log.UserID(user.ID), log.Err(err))
+		return
+	}
+
+	a.srv.HandleWS(c.Request.Context(), user, sessionID, roomID, conn)
+}
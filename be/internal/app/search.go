@@ -0,0 +1,61 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) searchMessages(c *gin.Context) {
+	limit, ok := pageLimit(c)
+	if !ok {
+		return
+	}
+
+	search := &domain.MessageSearch{
+		Query:  c.Query("q"),
+		UserID: c.Query("user_id"),
+		Limit:  limit,
+	}
+
+	if roomID := c.Query("room_id"); roomID != "" {
+		search.RoomIDs = []string{roomID}
+	}
+
+	for param, dst := range map[string]*time.Time{"after": &search.After, "before": &search.Before} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": domain.ErrSearchTimeInvalid.Error()})
+			return
+		}
+		*dst = t
+	}
+
+	hits, err := a.srv.SearchMessages(c.Request.Context(), a.user(c).ID, search)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrSearchQueryEmpty),
+			errors.Is(err, domain.ErrSearchQueryTooLong),
+			errors.Is(err, domain.ErrSearchTimeInvalid),
+			errors.Is(err, domain.ErrLimitInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrRoomNotMember):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.SearchMessages", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot search messages"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"hits": hits})
+}
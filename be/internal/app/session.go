@@ -0,0 +1,60 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+func (a *App) listSessions(c *gin.Context) {
+	sessions, err := a.srv.ListSessions(c.Request.Context(), a.user(c).ID)
+	if err != nil {
+		log.Error("srv.ListSessions", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot list sessions"})
+		return
+	}
+
+	current := a.session(c)
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+func (a *App) revokeSession(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	err := a.srv.RevokeSession(c.Request.Context(), a.user(c).ID, sessionID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		log.Error("srv.RevokeSession", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot revoke session"})
+		return
+	}
+
+	// revoking the current session is a logout
+	if sessionID == a.session(c) {
+		a.setTokenCookie(c, nil)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+func (a *App) revokeOtherSessions(c *gin.Context) {
+	count, err := a.srv.RevokeUserSessions(c.Request.Context(), a.user(c).ID, a.session(c))
+	if err != nil {
+		log.Error("srv.RevokeUserSessions", log.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": count})
+}
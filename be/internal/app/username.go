@@ -0,0 +1,38 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gin-gonic/gin"
+)
+
+type setUsernameBody struct {
+	Username string `json:"username"`
+}
+
+func (a *App) setUsername(c *gin.Context) {
+	var body setUsernameBody
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "corrupted request body"})
+		return
+	}
+
+	user, err := a.srv.SetUsername(c.Request.Context(), a.user(c).ID, body.Username)
+	if err != nil {
+		switch {
+		case errors.Is(err, domain.ErrUsernameInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, domain.ErrUsernameTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Error("srv.SetUsername", log.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "temporary cannot set username"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
@@ -17,7 +17,9 @@ type (
 	}
 
 	chatClaims struct {
-		UserID string `json:"user_id"`
+		UserID    string `json:"user_id"`
+		SessionID string `json:"session_id"`
+		RoomID    string `json:"room_id"`
 		jwt.RegisteredClaims
 	}
 )
@@ -29,10 +31,12 @@ func NewChatProvider(cfg config.JWTChat) *ChatProvider {
 	}
 }
 
-func (cp *ChatProvider) CreateToken(userID string, sessionID string) (string, error) {
+func (cp *ChatProvider) CreateToken(userID string, sessionID string, roomID string) (string, error) {
 	now := time.Now()
 	claims := chatClaims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID,
+		RoomID:    roomID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(now.Add(cp.tokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(now),
@@ -42,7 +46,8 @@ func (cp *ChatProvider) CreateToken(userID string, sessionID string) (string, er
 	return token.SignedString(cp.secretKey)
 }
 
-func (cp *ChatProvider) VerifyToken(tokenStr string) (*domain.ChatTokenPayload, error) {
+// VerifyToken parses the chat ticket and checks that it was issued for roomID.
+func (cp *ChatProvider) VerifyToken(tokenStr string, roomID string) (*domain.ChatTokenPayload, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &chatClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -61,7 +66,15 @@ func (cp *ChatProvider) VerifyToken(tokenStr string) (*domain.ChatTokenPayload,
 		return nil, domain.ErrTokenInvalid
 	}
 
-	p := &domain.ChatTokenPayload{UserID: claims.UserID}
+	if claims.RoomID != roomID {
+		return nil, domain.ErrRoomIDTokenMismatch
+	}
+
+	p := &domain.ChatTokenPayload{
+		UserID:    claims.UserID,
+		SessionID: claims.SessionID,
+		RoomID:    claims.RoomID,
+	}
 
 	return p, nil
 }
@@ -73,10 +86,14 @@ type (
 		refreshTokenTTL time.Duration
 	}
 
+	// userClaims of a refresh token set Refresh and carry the rotation id of
+	// the token in ID, access tokens are not accepted as refresh tokens nor
+	// the other way round.
 	userClaims struct {
 		UserID    string `json:"user_id"`
 		Email     string `json:"email"`
 		SessionID string `json:"session_id"`
+		Refresh   bool   `json:"refresh,omitempty"`
 		jwt.RegisteredClaims
 	}
 )
@@ -89,15 +106,20 @@ func NewUserProvider(cfg config.JWTUser) *UserProvider {
 	}
 }
 
-func (up *UserProvider) CreateToken(userID string, email string) (*domain.Token, error) {
+// CreateToken issues the token pair of the session, refreshID identifies the
+// refresh token so the session can tell a rotated one apart.
+func (up *UserProvider) CreateToken(userID string, email string, sessionID string, refreshID string) (*domain.Token, error) {
 	now := time.Now()
 
-	accessToken, err := up.createToken(userID, email, up.accessTokenTTL, now)
+	accessToken, err := up.createToken(userClaims{UserID: userID, Email: email, SessionID: sessionID}, up.accessTokenTTL, now)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken, err := up.createToken(userID, email, up.refreshTokenTTL, now)
+	refreshClaims := userClaims{UserID: userID, Email: email, SessionID: sessionID, Refresh: true}
+	refreshClaims.ID = refreshID
+
+	refreshToken, err := up.createToken(refreshClaims, up.refreshTokenTTL, now)
 	if err != nil {
 		return nil, err
 	}
@@ -110,20 +132,26 @@ func (up *UserProvider) CreateToken(userID string, email string) (*domain.Token,
 	return token, nil
 }
 
-func (up *UserProvider) createToken(userID string, email string, ttl time.Duration, now time.Time) (string, error) {
-	claims := userClaims{
-		UserID: userID,
-		Email:  email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
-			IssuedAt:  jwt.NewNumericDate(now),
-		},
-	}
+func (up *UserProvider) createToken(claims userClaims, ttl time.Duration, now time.Time) (string, error) {
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(up.secretKey)
 }
 
+// VerifyToken parses the access token.
 func (up *UserProvider) VerifyToken(tokenStr string) (*domain.UserTokenPayload, error) {
+	return up.verifyToken(tokenStr, false)
+}
+
+// VerifyRefreshToken parses the refresh token, the payload carries its
+// rotation id.
+func (up *UserProvider) VerifyRefreshToken(tokenStr string) (*domain.UserTokenPayload, error) {
+	return up.verifyToken(tokenStr, true)
+}
+
+func (up *UserProvider) verifyToken(tokenStr string, refresh bool) (*domain.UserTokenPayload, error) {
 	if tokenStr == "" {
 		return nil, domain.ErrTokenExpired // treat empty token as expired
 	}
@@ -142,13 +170,21 @@ func (up *UserProvider) VerifyToken(tokenStr string) (*domain.UserTokenPayload,
 	}
 
 	claims, ok := token.Claims.(*userClaims)
-	if !ok || !token.Valid {
+	if !ok || !token.Valid || claims.Refresh != refresh {
+		return nil, domain.ErrTokenInvalid
+	}
+
+	// refresh tokens issued before rotation carry no id, their sessions
+	// cannot be rotated and log in again
+	if refresh && claims.ID == "" {
 		return nil, domain.ErrTokenInvalid
 	}
 
 	p := &domain.UserTokenPayload{
-		UserID: claims.UserID,
-		Email:  claims.Email,
+		UserID:    claims.UserID,
+		Email:     claims.Email,
+		SessionID: claims.SessionID,
+		RefreshID: claims.ID,
 	}
 
 	return p, nil
@@ -14,6 +14,8 @@ const (
 	testUserID    = "6656e4cf03c748fe2b3a3f92"
 	testEmail     = "test@example.com"
 	testSessionID = "05dmJUrW0NJNkLrcFhW"
+	testRefreshID = "0e1c7d5e-5f4b-4b57-9a55-2f0c8b1c9f1e"
+	testRoomID    = "6656e4cf03c748fe2b3a3f93"
 )
 
 var (
@@ -34,6 +36,7 @@ func TestChatProvider(t *testing.T) {
 		name      string
 		userID    string
 		sessionID string
+		roomID    string
 		modify    func(token string) string
 		expectErr error
 	}{
@@ -41,6 +44,7 @@ func TestChatProvider(t *testing.T) {
 			name:      "valid_token",
 			userID:    testUserID,
 			sessionID: testSessionID,
+			roomID:    testRoomID,
 			modify:    func(token string) string { return token },
 			expectErr: nil,
 		},
@@ -48,6 +52,7 @@ func TestChatProvider(t *testing.T) {
 			name:      "expired_token",
 			userID:    testUserID,
 			sessionID: testSessionID,
+			roomID:    testRoomID,
 			modify:    func(_ string) string { return string(expiredToken) },
 			expectErr: domain.ErrTokenExpired,
 		},
@@ -55,26 +60,36 @@ func TestChatProvider(t *testing.T) {
 			name:      "invalid_token",
 			userID:    testUserID,
 			sessionID: testSessionID,
+			roomID:    testRoomID,
 			modify:    func(token string) string { return token + "invalid" },
 			expectErr: domain.ErrTokenInvalid,
 		},
+		{
+			name:      "room_mismatch_token",
+			userID:    testUserID,
+			sessionID: testSessionID,
+			roomID:    "another-room",
+			modify:    func(token string) string { return token },
+			expectErr: domain.ErrRoomIDTokenMismatch,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			token, err := cp.CreateToken(tt.userID, tt.sessionID)
+			token, err := cp.CreateToken(tt.userID, tt.sessionID, tt.roomID)
 			require.NoError(t, err)
 
 			token = tt.modify(token)
-			p, err := cp.VerifyToken(token)
+			p, err := cp.VerifyToken(token, testRoomID)
 
 			if tt.expectErr == nil {
 				require.NoError(t, err)
 				require.NotNil(t, p)
 				require.Equal(t, tt.userID, p.UserID)
 				require.Equal(t, tt.sessionID, p.SessionID)
+				require.Equal(t, tt.roomID, p.RoomID)
 			} else {
 				require.ErrorIs(t, err, tt.expectErr)
 				require.Nil(t, p)
@@ -127,7 +142,7 @@ func TestUserProvider(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 
-			token, err := up.CreateToken(tt.userID, tt.email)
+			token, err := up.CreateToken(tt.userID, tt.email, testSessionID, testRefreshID)
 			require.NoError(t, err)
 
 			token.Access = tt.modify(token.Access)
@@ -138,6 +153,7 @@ func TestUserProvider(t *testing.T) {
 				require.NotNil(t, p)
 				require.Equal(t, tt.userID, p.UserID)
 				require.Equal(t, tt.email, p.Email)
+				require.Equal(t, testSessionID, p.SessionID)
 			} else {
 				require.ErrorIs(t, err, tt.expectErr)
 				require.Nil(t, p)
@@ -145,3 +161,36 @@ func TestUserProvider(t *testing.T) {
 		})
 	}
 }
+
+func TestUserProvider_Refresh(t *testing.T) {
+	t.Parallel()
+
+	up := NewUserProvider(config.JWTUser{
+		SecretKey:       "test-secret",
+		AccessTokenTTL:  time.Minute,
+		RefreshTokenTTL: time.Hour,
+	})
+
+	token, err := up.CreateToken(testUserID, testEmail, testSessionID, testRefreshID)
+	require.NoError(t, err)
+
+	p, err := up.VerifyRefreshToken(token.Refresh)
+	require.NoError(t, err)
+	require.Equal(t, testUserID, p.UserID)
+	require.Equal(t, testSessionID, p.SessionID)
+	require.Equal(t, testRefreshID, p.RefreshID)
+
+	// the tokens are not interchangeable
+	_, err = up.VerifyRefreshToken(token.Access)
+	require.ErrorIs(t, err, domain.ErrTokenInvalid)
+
+	_, err = up.VerifyToken(token.Refresh)
+	require.ErrorIs(t, err, domain.ErrTokenInvalid)
+
+	// refresh tokens issued before rotation have no id
+	legacy, err := up.CreateToken(testUserID, testEmail, testSessionID, "")
+	require.NoError(t, err)
+
+	_, err = up.VerifyRefreshToken(legacy.Refresh)
+	require.ErrorIs(t, err, domain.ErrTokenInvalid)
+}
@@ -2,129 +2,105 @@ package auth
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
+	"errors"
+	"time"
 
 	"github.com/escalopa/chatterly/internal/config"
 	"github.com/escalopa/chatterly/internal/domain"
 	"github.com/escalopa/chatterly/internal/log"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/github"
-	"golang.org/x/oauth2/gitlab"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/yandex"
 )
 
+// OAuthProvider logs users in through the providers declared in the config.
 type OAuthProvider struct {
-	providers map[string]*provider
-}
+	providers map[string]provider
 
-func NewOAuthProvider(cfg config.OAuthConfig) *OAuthProvider {
-	op := &OAuthProvider{providers: make(map[string]*provider)}
-
-	var oauthProviderConfig config.OAuthProviderConfig
-
-	oauthProviderConfig = cfg[googleProvider]
-	op.providers[googleProvider] = &provider{
-		config: &oauth2.Config{
-			Scopes:       oauthProviderConfig.Scopes,
-			ClientID:     oauthProviderConfig.ClientID,
-			ClientSecret: oauthProviderConfig.ClientSecret,
-			RedirectURL:  oauthProviderConfig.RedirectURL,
-			Endpoint:     google.Endpoint,
-		},
-		endpoint: oauthProviderConfig.UserEndpoint,
-		payload:  func() payload { return &googlePayload{} },
-	}
+	secretKey []byte
+	stateTTL  time.Duration
+}
 
-	oauthProviderConfig = cfg[yandexProvider]
-	op.providers[yandexProvider] = &provider{
-		config: &oauth2.Config{
-			Scopes:       oauthProviderConfig.Scopes,
-			ClientID:     oauthProviderConfig.ClientID,
-			ClientSecret: oauthProviderConfig.ClientSecret,
-			RedirectURL:  oauthProviderConfig.RedirectURL,
-			Endpoint:     yandex.Endpoint,
-		},
-		endpoint: oauthProviderConfig.UserEndpoint,
-		payload:  func() payload { return &yandexPayload{} },
+func NewOAuthProvider(cfg config.OAuthConfig, stateCfg config.OAuthStateConfig) (*OAuthProvider, error) {
+	if stateCfg.SecretKey == "" {
+		return nil, errors.New("oauth provider: missing state secret key")
 	}
 
-	oauthProviderConfig = cfg[gitlabProvider]
-	op.providers[gitlabProvider] = &provider{
-		config: &oauth2.Config{
-			Scopes:       oauthProviderConfig.Scopes,
-			ClientID:     oauthProviderConfig.ClientID,
-			ClientSecret: oauthProviderConfig.ClientSecret,
-			RedirectURL:  oauthProviderConfig.RedirectURL,
-			Endpoint:     gitlab.Endpoint,
-		},
-		endpoint: oauthProviderConfig.UserEndpoint,
-		payload:  func() payload { return &gitlabPayload{} },
+	op := &OAuthProvider{
+		providers: make(map[string]provider, len(cfg)),
+		secretKey: []byte(stateCfg.SecretKey),
+		stateTTL:  stateCfg.TTL,
 	}
-
-	oauthProviderConfig = cfg[githubProvider]
-	op.providers[githubProvider] = &provider{
-		config: &oauth2.Config{
-			Scopes:       oauthProviderConfig.Scopes,
-			ClientID:     oauthProviderConfig.ClientID,
-			ClientSecret: oauthProviderConfig.ClientSecret,
-			RedirectURL:  oauthProviderConfig.RedirectURL,
-			Endpoint:     github.Endpoint,
-		},
-		endpoint: oauthProviderConfig.UserEndpoint,
-		payload:  func() payload { return &githubPayload{} },
+	if op.stateTTL <= 0 {
+		op.stateTTL = defaultStateTTL
 	}
-	return op
-}
 
-func (op *OAuthProvider) GetRedirectURL(provider string) (string, error) {
-	p, exists := op.providers[provider]
-	if !exists {
-		return "", domain.ErrOAuthUnsupportedProvider
+	for name, providerCfg := range cfg {
+		p, err := newProvider(name, providerCfg)
+		if err != nil {
+			return nil, err
+		}
+		op.providers[name] = p
 	}
 
-	return p.config.AuthCodeURL(provider), nil
+	return op, nil
 }
 
-func (op *OAuthProvider) HandleCallback(ctx context.Context, provider string, code string) (*domain.User, error) {
+// GetRedirectURL starts a login with a fresh state and pkce code verifier,
+// the returned cookie must be presented on the callback.
+func (op *OAuthProvider) GetRedirectURL(ctx context.Context, provider string) (*domain.OAuthRedirect, error) {
 	p, exists := op.providers[provider]
 	if !exists {
 		return nil, domain.ErrOAuthUnsupportedProvider
 	}
 
-	// get unique token for user's data retrieval
-	token, err := p.config.Exchange(ctx, code)
+	cfg, err := p.oauthConfig(ctx)
 	if err != nil {
-		log.Error("oauthConfig.Exchange", log.Err(err))
-		return nil, domain.ErrOAuthExchange
+		return nil, err
 	}
 
-	// fetch user's data
-	client := p.config.Client(ctx, token)
-	resp, err := client.Get(p.endpoint)
+	state, cookie, err := op.createState(provider)
 	if err != nil {
+		log.Error("op.createState", log.Err(err))
 		return nil, err
 	}
-	defer func(b io.ReadCloser) { _ = b.Close() }(resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("fetch user info: %s", resp.Status)
+	url := cfg.AuthCodeURL(
+		state.State,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(state.Verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("nonce", state.Nonce),
+	)
+
+	return &domain.OAuthRedirect{URL: url, Cookie: cookie}, nil
+}
+
+// HandleCallback checks the state before the code is exchanged together with
+// the code verifier of the login.
+func (op *OAuthProvider) HandleCallback(ctx context.Context, provider string, callback *domain.OAuthCallback) (*domain.OAuthProfile, error) {
+	p, exists := op.providers[provider]
+	if !exists {
+		return nil, domain.ErrOAuthUnsupportedProvider
 	}
 
-	// parse user's data
-	body, err := io.ReadAll(resp.Body)
+	state, err := op.verifyState(provider, callback)
 	if err != nil {
 		return nil, err
 	}
 
-	dst := p.payload()
-	err = json.Unmarshal(body, dst)
+	cfg, err := p.oauthConfig(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return dst.ToUser(), nil
+	// get unique token for user's data retrieval
+	token, err := cfg.Exchange(
+		context.WithValue(ctx, oauth2.HTTPClient, httpClient),
+		callback.Code,
+		oauth2.SetAuthURLParam("code_verifier", state.Verifier),
+	)
+	if err != nil {
+		log.Error("oauthConfig.Exchange", log.Err(err))
+		return nil, domain.ErrOAuthExchange
+	}
+
+	return p.profile(ctx, token, state.Nonce)
 }
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+const testCode = "test-code"
+
+// newTestOAuthServer serves the token and user info endpoints, the token is
+// only issued for the code verifier matching the challenge of the redirect.
+func newTestOAuthServer(t *testing.T, challenge func() string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != testCode || codeChallenge(r.FormValue("code_verifier")) != challenge() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "test-access-token", "token_type": "bearer"}`))
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id": 12345678901, "name": "Test", "email": "` + testEmail + `", "avatar_id": "1/abc"}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestNewOAuthProvider(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		cfg       config.OAuthProviderConfig
+		state     *config.OAuthStateConfig
+		expectErr bool
+	}{
+		{
+			name: "oidc",
+			cfg:  config.OAuthProviderConfig{Type: "oidc", Issuer: "https://idp.example.com", ClientID: "client"},
+		},
+		{
+			name: "oauth2",
+			cfg: config.OAuthProviderConfig{
+				Type:         "oauth2",
+				AuthURL:      "https://idp.example.com/auth",
+				TokenURL:     "https://idp.example.com/token",
+				UserEndpoint: "https://idp.example.com/user",
+				ClientID:     "client",
+			},
+		},
+		{
+			name:      "oidc_without_issuer",
+			cfg:       config.OAuthProviderConfig{Type: "oidc", ClientID: "client"},
+			expectErr: true,
+		},
+		{
+			name:      "oauth2_without_endpoints",
+			cfg:       config.OAuthProviderConfig{Type: "oauth2", ClientID: "client"},
+			expectErr: true,
+		},
+		{
+			name: "avatar_url",
+			cfg: config.OAuthProviderConfig{
+				Type:     "oidc",
+				Issuer:   "https://idp.example.com",
+				ClientID: "client",
+				Claims:   config.OAuthClaimsConfig{AvatarURL: "https://avatars.example.com/%s/200"},
+			},
+		},
+		{
+			name: "avatar_url_without_placeholder",
+			cfg: config.OAuthProviderConfig{
+				Type:     "oidc",
+				Issuer:   "https://idp.example.com",
+				ClientID: "client",
+				Claims:   config.OAuthClaimsConfig{AvatarURL: "https://avatars.example.com/200"},
+			},
+			expectErr: true,
+		},
+		{
+			name:      "missing_state_secret",
+			cfg:       config.OAuthProviderConfig{Type: "oidc", Issuer: "https://idp.example.com", ClientID: "client"},
+			state:     &config.OAuthStateConfig{},
+			expectErr: true,
+		},
+		{
+			name:      "unknown_type",
+			cfg:       config.OAuthProviderConfig{Type: "saml", ClientID: "client"},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			state := config.OAuthStateConfig{SecretKey: "test-secret"}
+			if tt.state != nil {
+				state = *tt.state
+			}
+
+			_, err := NewOAuthProvider(config.OAuthConfig{"test": tt.cfg}, state)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestOAuthProvider_Callback(t *testing.T) {
+	t.Parallel()
+
+	var challenge string
+	srv := newTestOAuthServer(t, func() string { return challenge })
+
+	op, err := NewOAuthProvider(config.OAuthConfig{
+		"github": {
+			Type:         "oauth2",
+			AuthURL:      srv.URL + "/auth",
+			TokenURL:     srv.URL + "/token",
+			UserEndpoint: srv.URL + "/user",
+			ClientID:     "test-client",
+			Claims: config.OAuthClaimsConfig{
+				Subject:   "id",
+				Avatar:    "avatar_id",
+				AvatarURL: "https://avatars.example.com/get/%s/200",
+			},
+		},
+	}, config.OAuthStateConfig{SecretKey: "test-secret", TTL: time.Minute})
+	require.NoError(t, err)
+
+	other, err := NewOAuthProvider(config.OAuthConfig{}, config.OAuthStateConfig{SecretKey: "other-secret"})
+	require.NoError(t, err)
+
+	expired, err := NewOAuthProvider(config.OAuthConfig{}, config.OAuthStateConfig{SecretKey: "test-secret"})
+	require.NoError(t, err)
+	expired.stateTTL = -time.Minute
+
+	tests := []struct {
+		name      string
+		provider  string
+		modify    func(callback *domain.OAuthCallback)
+		expectErr error
+	}{
+		{
+			name:     "valid_state",
+			provider: "github",
+			modify:   func(*domain.OAuthCallback) {},
+		},
+		{
+			name:      "other_state",
+			provider:  "github",
+			modify:    func(callback *domain.OAuthCallback) { callback.State = "other" },
+			expectErr: domain.ErrOAuthStateInvalid,
+		},
+		{
+			name:      "missing_cookie",
+			provider:  "github",
+			modify:    func(callback *domain.OAuthCallback) { callback.Cookie = "" },
+			expectErr: domain.ErrOAuthStateInvalid,
+		},
+		{
+			name:     "other_provider",
+			provider: "github",
+			modify: func(callback *domain.OAuthCallback) {
+				state, cookie, err := op.createState("gitlab")
+				require.NoError(t, err)
+				callback.State, callback.Cookie = state.State, cookie
+			},
+			expectErr: domain.ErrOAuthStateInvalid,
+		},
+		{
+			name:     "forged_cookie",
+			provider: "github",
+			modify: func(callback *domain.OAuthCallback) {
+				state, cookie, err := other.createState("github")
+				require.NoError(t, err)
+				callback.State, callback.Cookie = state.State, cookie
+			},
+			expectErr: domain.ErrOAuthStateInvalid,
+		},
+		{
+			name:     "expired_cookie",
+			provider: "github",
+			modify: func(callback *domain.OAuthCallback) {
+				state, cookie, err := expired.createState("github")
+				require.NoError(t, err)
+				callback.State, callback.Cookie = state.State, cookie
+			},
+			expectErr: domain.ErrOAuthStateInvalid,
+		},
+		{
+			name:     "other_verifier",
+			provider: "github",
+			modify: func(callback *domain.OAuthCallback) {
+				// a login started elsewhere has its own code verifier
+				state, cookie, err := op.createState("github")
+				require.NoError(t, err)
+				callback.State, callback.Cookie = state.State, cookie
+			},
+			expectErr: domain.ErrOAuthExchange,
+		},
+		{
+			name:      "unsupported_provider",
+			provider:  "unknown",
+			modify:    func(*domain.OAuthCallback) {},
+			expectErr: domain.ErrOAuthUnsupportedProvider,
+		},
+	}
+
+	// the subtests share the challenge of the fake server and run in order
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redirect, err := op.GetRedirectURL(context.Background(), "github")
+			require.NoError(t, err)
+
+			u, err := url.Parse(redirect.URL)
+			require.NoError(t, err)
+			require.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+			challenge = u.Query().Get("code_challenge")
+
+			callback := &domain.OAuthCallback{
+				Code:   testCode,
+				State:  u.Query().Get("state"),
+				Cookie: redirect.Cookie,
+			}
+			tt.modify(callback)
+
+			profile, err := op.HandleCallback(context.Background(), tt.provider, callback)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, testEmail, profile.Email)
+			require.Equal(t, "12345678901", profile.Subject)
+			require.Equal(t, "https://avatars.example.com/get/1%2Fabc/200", profile.Avatar)
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+// keysRefreshInterval limits how often the keys are refetched for an unknown
+// key id, providers rotate their keys rarely.
+const keysRefreshInterval = time.Minute
+
+// idTokenMethods are the accepted id token signatures, symmetric ones would
+// let the client secret sign tokens.
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// oidcProvider finds its endpoints through the discovery document of the
+// issuer and reads the claims from the verified id token. The document and
+// the keys are fetched on first use so an unreachable provider does not
+// prevent startup.
+type oidcProvider struct {
+	issuer string
+	config oauth2.Config
+	claims config.OAuthClaimsConfig
+
+	mu         sync.Mutex
+	discovered *oauth2.Config
+	jwksURI    string
+	keys       map[string]crypto.PublicKey
+	keysAt     time.Time
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(cfg config.OAuthProviderConfig) *oidcProvider {
+	scopes := cfg.Scopes
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	return &oidcProvider{
+		issuer: cfg.Issuer,
+		config: oauth2.Config{
+			Scopes:       scopes,
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+		},
+		claims: claimNames(cfg.Claims),
+	}
+}
+
+// oauthConfig returns the config with the endpoints of the discovery
+// document, the document is fetched without holding the lock so a slow
+// provider only delays its own logins.
+func (p *oidcProvider) oauthConfig(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	discovered := p.discovered
+	p.mu.Unlock()
+
+	if discovered != nil {
+		return discovered, nil
+	}
+
+	var doc discoveryDocument
+	if err := getJSON(ctx, strings.TrimSuffix(p.issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		log.Error("oidcProvider.oauthConfig", log.String("issuer", p.issuer), log.Err(err))
+		return nil, domain.ErrOAuthDiscovery
+	}
+
+	if doc.Issuer != p.issuer || doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		log.Error("oidcProvider.oauthConfig: invalid discovery document", log.String("issuer", p.issuer))
+		return nil, domain.ErrOAuthDiscovery
+	}
+
+	cfg := p.config
+	cfg.Endpoint = oauth2.Endpoint{
+		AuthURL:  doc.AuthorizationEndpoint,
+		TokenURL: doc.TokenEndpoint,
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// a concurrent login may have discovered it first
+	if p.discovered == nil {
+		p.discovered = &cfg
+		p.jwksURI = doc.JWKSURI
+	}
+
+	return p.discovered, nil
+}
+
+func (p *oidcProvider) profile(ctx context.Context, token *oauth2.Token, nonce string) (*domain.OAuthProfile, error) {
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		return nil, domain.ErrOAuthIDTokenInvalid
+	}
+
+	c, err := p.verifyIDToken(ctx, raw, nonce)
+	if err != nil {
+		log.Error("oidcProvider.verifyIDToken", log.String("issuer", p.issuer), log.Err(err))
+		return nil, domain.ErrOAuthIDTokenInvalid
+	}
+
+	return c.profile(p.claims)
+}
+
+// verifyIDToken checks the signature of the id token against the keys of the
+// issuer and that it was issued by the issuer to this client for this login.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw string, nonce string) (claims, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenMethods), jwt.WithJSONNumber())
+
+	mc := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(raw, mc, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !mc.VerifyIssuer(p.issuer, true):
+		return nil, errors.New("issuer mismatch")
+	case !mc.VerifyAudience(p.config.ClientID, true):
+		return nil, errors.New("audience mismatch")
+	case !mc.VerifyExpiresAt(time.Now().Unix(), true):
+		return nil, errors.New("token expired")
+	}
+
+	// a token for several audiences must name this client as its holder
+	if aud, ok := mc["aud"].([]interface{}); ok && len(aud) > 1 {
+		if azp, _ := mc["azp"].(string); azp != p.config.ClientID {
+			return nil, errors.New("authorized party mismatch")
+		}
+	}
+
+	got, _ := mc["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	return claims(mc), nil
+}
+
+// key returns the signing key with the id, the keys are refetched when the
+// id is unknown as the provider may have rotated them. The keys are fetched
+// without holding the lock, lookups racing a refetch see the old keys.
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	if key, ok := p.lookupKey(kid); ok {
+		p.mu.Unlock()
+		return key, nil
+	}
+
+	prevAt := p.keysAt
+	if time.Since(prevAt) < keysRefreshInterval {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	// claim the refetch so concurrent lookups do not fetch the keys as well
+	p.keysAt = time.Now()
+	jwksURI := p.jwksURI
+	p.mu.Unlock()
+
+	keys, err := fetchKeys(ctx, jwksURI)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err != nil {
+		// let the next lookup retry
+		if p.keysAt.After(prevAt) {
+			p.keysAt = prevAt
+		}
+		return nil, err
+	}
+
+	p.keys = keys
+	p.keysAt = time.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// fetchKeys returns the signing keys of the json web key set by id.
+func fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warn("oidcProvider.key: skip key", log.String("kid", k.Kid), log.Err(err))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+// lookupKey finds the key by id, tokens without an id are accepted when the
+// issuer has a single key.
+func (p *oidcProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok && kid != ""
+}
+
+// jwk is a public key of a json web key set.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exp.IsInt64() || exp.Int64() < 2 || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var (
+			curve elliptic.Curve
+			ecdhc ecdh.Curve
+		)
+		switch k.Crv {
+		case "P-256":
+			curve, ecdhc = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhc = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhc = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid ec key")
+		}
+		// the point must lie on the curve
+		if _, err = ecdhc.NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
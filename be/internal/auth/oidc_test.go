@@ -0,0 +1,369 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testClientID     = "test-client"
+	testClientSecret = "test-client-secret"
+)
+
+// fakeOIDC is an in-process oidc provider, the id token of the login is built
+// from the nonce and challenge of the last redirect.
+type fakeOIDC struct {
+	*httptest.Server
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	challenge string
+	nonce     string
+
+	// sign builds the id token returned by the token endpoint
+	sign func(f *fakeOIDC, c jwt.MapClaims) string
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	f := &fakeOIDC{rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	// the discovery document of another issuer
+	mux.HandleFunc("/other/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		writeJSON(w, map[string]any{"keys": []map[string]string{
+			{
+				"kid": "rsa",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   b64(rsaKey.N.Bytes()),
+				"e":   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+			},
+			{
+				"kid": "ec",
+				"kty": "EC",
+				"crv": "P-256",
+				"x":   b64(ecKey.X.FillBytes(make([]byte, 32))),
+				"y":   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+			},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != testCode || codeChallenge(r.FormValue("code_verifier")) != f.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		now := time.Now()
+		c := jwt.MapClaims{
+			"iss":            f.URL,
+			"aud":            testClientID,
+			"sub":            "248289761001",
+			"exp":            now.Add(time.Minute).Unix(),
+			"iat":            now.Unix(),
+			"nonce":          f.nonce,
+			"name":           "Test",
+			"email":          testEmail,
+			"email_verified": true,
+			"picture":        "https://idp.example.com/avatar.png",
+			"profile":        map[string]any{"display_name": "Test User"},
+		}
+
+		writeJSON(w, map[string]any{
+			"access_token": "test-access-token",
+			"token_type":   "Bearer",
+			"id_token":     f.sign(f, c),
+		})
+	})
+
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func signRSA(f *fakeOIDC, c jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	token.Header["kid"] = "rsa"
+	raw, _ := token.SignedString(f.rsaKey)
+	return raw
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestOIDCProvider(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeOIDC(t)
+
+	providerCfg := config.OAuthProviderConfig{
+		Type:         "oidc",
+		Issuer:       f.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+	}
+
+	corpCfg := providerCfg
+	corpCfg.Claims = config.OAuthClaimsConfig{Name: "profile.display_name"}
+
+	otherCfg := providerCfg
+	otherCfg.Issuer = f.URL + "/other"
+
+	op, err := NewOAuthProvider(config.OAuthConfig{
+		"keycloak": providerCfg,
+		"corp":     corpCfg,
+		"other":    otherCfg,
+	}, config.OAuthStateConfig{SecretKey: "test-secret"})
+	require.NoError(t, err)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		provider  string
+		sign      func(f *fakeOIDC, c jwt.MapClaims) string
+		expect    *domain.OAuthProfile
+		expectErr error
+	}{
+		{
+			name:     "valid_token",
+			provider: "keycloak",
+			sign:     signRSA,
+			expect: &domain.OAuthProfile{
+				Subject:       "248289761001",
+				Name:          "Test",
+				Email:         testEmail,
+				EmailVerified: true,
+				Avatar:        "https://idp.example.com/avatar.png",
+			},
+		},
+		{
+			name:     "ec_key",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodES256, c)
+				token.Header["kid"] = "ec"
+				raw, _ := token.SignedString(f.ecKey)
+				return raw
+			},
+			expect: &domain.OAuthProfile{
+				Subject:       "248289761001",
+				Name:          "Test",
+				Email:         testEmail,
+				EmailVerified: true,
+				Avatar:        "https://idp.example.com/avatar.png",
+			},
+		},
+		{
+			name:     "mapped_claims",
+			provider: "corp",
+			sign:     signRSA,
+			expect: &domain.OAuthProfile{
+				Subject:       "248289761001",
+				Name:          "Test User",
+				Email:         testEmail,
+				EmailVerified: true,
+				Avatar:        "https://idp.example.com/avatar.png",
+			},
+		},
+		{
+			name:     "other_audience",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				c["aud"] = "other-client"
+				return signRSA(f, c)
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:     "several_audiences",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				c["aud"] = []string{"other-client", testClientID}
+				c["azp"] = "other-client"
+				return signRSA(f, c)
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:     "other_issuer",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				c["iss"] = "https://evil.example.com"
+				return signRSA(f, c)
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:     "expired_token",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				c["exp"] = time.Now().Add(-time.Minute).Unix()
+				return signRSA(f, c)
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:     "other_nonce",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				c["nonce"] = "replayed"
+				return signRSA(f, c)
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:     "unknown_key",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+				token.Header["kid"] = "rsa"
+				raw, _ := token.SignedString(otherKey)
+				return raw
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:     "client_secret_signature",
+			provider: "keycloak",
+			sign: func(f *fakeOIDC, c jwt.MapClaims) string {
+				raw, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(testClientSecret))
+				return raw
+			},
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:      "missing_id_token",
+			provider:  "keycloak",
+			sign:      func(*fakeOIDC, jwt.MapClaims) string { return "" },
+			expectErr: domain.ErrOAuthIDTokenInvalid,
+		},
+		{
+			name:      "issuer_mismatch",
+			provider:  "other",
+			sign:      signRSA,
+			expectErr: domain.ErrOAuthDiscovery,
+		},
+	}
+
+	// the subtests share the fake provider and run in order
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f.sign = tt.sign
+
+			redirect, err := op.GetRedirectURL(ctx, tt.provider)
+			if err != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+
+			u, err := url.Parse(redirect.URL)
+			require.NoError(t, err)
+			require.Equal(t, f.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+			require.Contains(t, u.Query().Get("scope"), "openid")
+
+			f.challenge = u.Query().Get("code_challenge")
+			f.nonce = u.Query().Get("nonce")
+
+			profile, err := op.HandleCallback(ctx, tt.provider, &domain.OAuthCallback{
+				Code:   testCode,
+				State:  u.Query().Get("state"),
+				Cookie: redirect.Cookie,
+			})
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, profile)
+		})
+	}
+}
+
+func TestOIDCProvider_KeyRefetch(t *testing.T) {
+	t.Parallel()
+
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fetching)
+		<-release
+		writeJSON(w, map[string]any{"keys": []any{}})
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := newOIDCProvider(config.OAuthProviderConfig{Issuer: srv.URL, ClientID: testClientID})
+	p.jwksURI = srv.URL
+	p.keys = map[string]crypto.PublicKey{"rsa": &key.PublicKey}
+
+	// a lookup of an unknown key refetches the keys from the slow provider
+	go func() { _, _ = p.key(context.Background(), "rotated") }()
+	<-fetching
+
+	// lookups of known keys are not held up by the refetch
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.key(context.Background(), "rsa")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("key lookup waited for the refetch")
+	}
+}
@@ -1,83 +1,188 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/escalopa/chatterly/internal/config"
 	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
 	"golang.org/x/oauth2"
 )
 
 const (
-	googleProvider = "google"
-	yandexProvider = "yandex"
-	gitlabProvider = "gitlab"
-	githubProvider = "github"
+	providerTypeOIDC   = "oidc"
+	providerTypeOAuth2 = "oauth2"
 )
 
-type payload interface {
-	ToUser() *domain.User
+// httpClient fetches discovery documents, keys and user info.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+type provider interface {
+	// oauthConfig returns the client config with the endpoints of the provider.
+	oauthConfig(ctx context.Context) (*oauth2.Config, error)
+	// profile reads the user from the token response, nonce is the one sent
+	// with the login.
+	profile(ctx context.Context, token *oauth2.Token, nonce string) (*domain.OAuthProfile, error)
+}
+
+func newProvider(name string, cfg config.OAuthProviderConfig) (provider, error) {
+	if cfg.Claims.AvatarURL != "" && strings.Count(cfg.Claims.AvatarURL, "%s") != 1 {
+		return nil, fmt.Errorf("oauth provider %q: avatar url must hold a single %%s", name)
+	}
+
+	switch cfg.Type {
+	case providerTypeOIDC:
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("oauth provider %q: issuer and client id are required", name)
+		}
+		return newOIDCProvider(cfg), nil
+	case providerTypeOAuth2:
+		if cfg.AuthURL == "" || cfg.TokenURL == "" || cfg.UserEndpoint == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("oauth provider %q: auth url, token url, user endpoint and client id are required", name)
+		}
+		return newOAuth2Provider(cfg), nil
+	default:
+		return nil, fmt.Errorf("oauth provider %q: unknown type %q", name, cfg.Type)
+	}
 }
 
-type provider struct {
+// oauth2Provider reads the claims from the user endpoint, for providers that
+// do not implement oidc.
+type oauth2Provider struct {
 	config   *oauth2.Config
 	endpoint string
-	payload  func() payload
+	claims   config.OAuthClaimsConfig
 }
 
-type (
-	googlePayload struct {
-		Name   string `json:"name"`
-		Email  string `json:"email"`
-		Avatar string `json:"picture"`
+func newOAuth2Provider(cfg config.OAuthProviderConfig) *oauth2Provider {
+	return &oauth2Provider{
+		config: &oauth2.Config{
+			Scopes:       cfg.Scopes,
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.AuthURL,
+				TokenURL: cfg.TokenURL,
+			},
+		},
+		endpoint: cfg.UserEndpoint,
+		claims:   claimNames(cfg.Claims),
 	}
+}
+
+func (p *oauth2Provider) oauthConfig(context.Context) (*oauth2.Config, error) {
+	return p.config, nil
+}
 
-	yandexPayload struct {
-		Name   string `json:"real_name"`
-		Email  string `json:"default_email"`
-		Avatar string `json:"default_avatar_id"`
+func (p *oauth2Provider) profile(ctx context.Context, token *oauth2.Token, _ string) (*domain.OAuthProfile, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
+	// fetch user's data
+	resp, err := p.config.Client(ctx, token).Get(p.endpoint)
+	if err != nil {
+		log.Error("oauth2Provider.profile", log.Err(err))
+		return nil, domain.ErrOAuthGetUserInfo
 	}
+	defer func() { _ = resp.Body.Close() }()
 
-	gitlabPayload struct {
-		Name   string `json:"name"`
-		Email  string `json:"email"`
-		Avatar string `json:"avatar_url"`
+	if resp.StatusCode != http.StatusOK {
+		log.Error("oauth2Provider.profile", log.String("status", resp.Status))
+		return nil, domain.ErrOAuthGetUserInfo
 	}
 
-	githubPayload struct {
-		Name   string `json:"name"`
-		Email  string `json:"email"`
-		Avatar string `json:"avatar_url"`
+	// numbers are kept as is, ids of some providers are numeric
+	c := claims{}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err = dec.Decode(&c); err != nil {
+		log.Error("oauth2Provider.profile", log.Err(err))
+		return nil, domain.ErrOAuthGetUserInfo
 	}
-)
 
-func (p *googlePayload) ToUser() *domain.User {
-	return &domain.User{
-		Name:   p.Name,
-		Email:  p.Email,
-		Avatar: p.Avatar,
+	return c.profile(p.claims)
+}
+
+// claimNames fills in the standard oidc claims for the unset names.
+func claimNames(cfg config.OAuthClaimsConfig) config.OAuthClaimsConfig {
+	set := func(name *string, def string) {
+		if *name == "" {
+			*name = def
+		}
+	}
+	set(&cfg.Subject, "sub")
+	set(&cfg.Name, "name")
+	set(&cfg.Email, "email")
+	set(&cfg.EmailVerified, "email_verified")
+	set(&cfg.Avatar, "picture")
+	return cfg
+}
+
+type claims map[string]any
+
+func (c claims) profile(names config.OAuthClaimsConfig) (*domain.OAuthProfile, error) {
+	p := &domain.OAuthProfile{
+		Subject:       c.string(names.Subject),
+		Name:          c.string(names.Name),
+		Email:         c.string(names.Email),
+		EmailVerified: c.bool(names.EmailVerified),
+		Avatar:        c.string(names.Avatar),
 	}
+
+	if names.AvatarURL != "" && p.Avatar != "" {
+		p.Avatar = strings.Replace(names.AvatarURL, "%s", url.PathEscape(p.Avatar), 1)
+	}
+
+	if p.Subject == "" {
+		log.Error("claims.profile: missing subject", log.String("claim", names.Subject))
+		return nil, domain.ErrOAuthGetUserInfo
+	}
+
+	return p, nil
 }
 
-func (p *yandexPayload) ToUser() *domain.User {
-	return &domain.User{
-		Name:   p.Name,
-		Email:  p.Email,
-		Avatar: fmt.Sprintf("https://avatars.yandex.net/get-yapic/%s/islands-200", p.Avatar),
+// lookup walks the dot separated path of nested claims.
+func (c claims) lookup(path string) any {
+	var v any = map[string]any(c)
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
 	}
+	return v
 }
 
-func (p *gitlabPayload) ToUser() *domain.User {
-	return &domain.User{
-		Name:   p.Name,
-		Email:  p.Email,
-		Avatar: p.Avatar,
+func (c claims) string(path string) string {
+	switch v := c.lookup(path).(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
 	}
 }
 
-func (p *githubPayload) ToUser() *domain.User {
-	return &domain.User{
-		Name:   p.Name,
-		Email:  p.Email,
-		Avatar: p.Avatar,
+// bool accepts strings as well, some providers send "true".
+func (c claims) bool(path string) bool {
+	switch v := c.lookup(path).(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	default:
+		return false
 	}
 }
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const defaultStateTTL = 10 * time.Minute
+
+// stateClaims seal the login state, the pkce code verifier and the oidc nonce
+// in the cookie of the browser that started the login, only that browser can
+// complete it.
+type stateClaims struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+func (op *OAuthProvider) createState(provider string) (*stateClaims, string, error) {
+	state, err := randomString()
+	if err != nil {
+		return nil, "", err
+	}
+
+	verifier, err := randomString()
+	if err != nil {
+		return nil, "", err
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	claims := &stateClaims{
+		Provider: provider,
+		State:    state,
+		Verifier: verifier,
+		Nonce:    nonce,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(op.stateTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(op.secretKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return claims, cookie, nil
+}
+
+// verifyState checks the state returned by the provider against the cookie
+// and returns the sealed claims of the login.
+func (op *OAuthProvider) verifyState(provider string, callback *domain.OAuthCallback) (*stateClaims, error) {
+	token, err := jwt.ParseWithClaims(callback.Cookie, &stateClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return op.secretKey, nil
+	})
+	if err != nil {
+		return nil, domain.ErrOAuthStateInvalid
+	}
+
+	claims, ok := token.Claims.(*stateClaims)
+	if !ok || !token.Valid {
+		return nil, domain.ErrOAuthStateInvalid
+	}
+
+	if claims.Provider != provider || claims.State == "" ||
+		subtle.ConstantTimeCompare([]byte(claims.State), []byte(callback.State)) != 1 {
+		return nil, domain.ErrOAuthStateInvalid
+	}
+
+	return claims, nil
+}
+
+// codeChallenge derives the S256 pkce challenge sent with the redirect.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// randomString returns 32 random bytes encoded into 43 url safe characters,
+// the minimum length of a pkce code verifier.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+const defaultURLTTL = 15 * time.Minute
+
+// URLSigner signs download urls, the signature binds the resource to the
+// user it was issued to and to its expiry.
+type URLSigner struct {
+	secretKey []byte
+	ttl       time.Duration
+}
+
+func NewURLSigner(cfg config.URLConfig) (*URLSigner, error) {
+	if cfg.SecretKey == "" {
+		return nil, errors.New("url signer: missing secret key")
+	}
+
+	s := &URLSigner{
+		secretKey: []byte(cfg.SecretKey),
+		ttl:       cfg.TTL,
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultURLTTL
+	}
+
+	return s, nil
+}
+
+// Sign returns the query parameters that authorize the user to the resource.
+func (s *URLSigner) Sign(resource string, userID string) (url.Values, time.Time) {
+	expiresAt := time.Now().Add(s.ttl).Truncate(time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("user", userID)
+	q.Set("expires", expires)
+	q.Set("sig", s.signature(resource, userID, expires))
+
+	return q, expiresAt
+}
+
+// Verify checks the query parameters of a signed url for the resource and
+// returns the user it was issued to.
+func (s *URLSigner) Verify(resource string, q url.Values) (string, error) {
+	userID, expires, sig := q.Get("user"), q.Get("expires"), q.Get("sig")
+
+	if !hmac.Equal([]byte(sig), []byte(s.signature(resource, userID, expires))) {
+		return "", domain.ErrURLSignatureInvalid
+	}
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", domain.ErrURLSignatureInvalid
+	}
+
+	if time.Now().After(time.Unix(unix, 0)) {
+		return "", domain.ErrURLExpired
+	}
+
+	return userID, nil
+}
+
+func (s *URLSigner) signature(resource string, userID string, expires string) string {
+	mac := hmac.New(sha256.New, s.secretKey)
+	mac.Write([]byte(resource + "\n" + userID + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
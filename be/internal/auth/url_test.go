@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewURLSigner(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		cfg       config.URLConfig
+		expectTTL time.Duration
+		expectErr bool
+	}{
+		{
+			name:      "configured",
+			cfg:       config.URLConfig{SecretKey: "test-secret", TTL: time.Minute},
+			expectTTL: time.Minute,
+		},
+		{
+			name:      "default_ttl",
+			cfg:       config.URLConfig{SecretKey: "test-secret"},
+			expectTTL: defaultURLTTL,
+		},
+		{
+			name:      "missing_secret",
+			cfg:       config.URLConfig{TTL: time.Minute},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, err := NewURLSigner(tt.cfg)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectTTL, s.ttl)
+		})
+	}
+}
+
+func TestURLSigner(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewURLSigner(config.URLConfig{SecretKey: "test-secret", TTL: time.Minute})
+	require.NoError(t, err)
+
+	const resource = "attachments/1"
+
+	tests := []struct {
+		name      string
+		resource  string
+		modify    func(q url.Values)
+		expectErr error
+	}{
+		{
+			name:     "valid_url",
+			resource: resource,
+			modify:   func(url.Values) {},
+		},
+		{
+			name:      "other_resource",
+			resource:  "attachments/2",
+			modify:    func(url.Values) {},
+			expectErr: domain.ErrURLSignatureInvalid,
+		},
+		{
+			name:      "other_user",
+			resource:  resource,
+			modify:    func(q url.Values) { q.Set("user", "eve") },
+			expectErr: domain.ErrURLSignatureInvalid,
+		},
+		{
+			name:      "extended_expiry",
+			resource:  resource,
+			modify:    func(q url.Values) { q.Set("expires", "9999999999") },
+			expectErr: domain.ErrURLSignatureInvalid,
+		},
+		{
+			name:      "missing_signature",
+			resource:  resource,
+			modify:    func(q url.Values) { q.Del("sig") },
+			expectErr: domain.ErrURLSignatureInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			q, expiresAt := s.Sign(resource, testUserID)
+			require.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 2*time.Second)
+
+			tt.modify(q)
+
+			userID, err := s.Verify(tt.resource, q)
+			require.ErrorIs(t, err, tt.expectErr)
+			if tt.expectErr == nil {
+				require.Equal(t, testUserID, userID)
+			}
+		})
+	}
+
+	t.Run("expired_url", func(t *testing.T) {
+		t.Parallel()
+
+		expired, err := NewURLSigner(config.URLConfig{SecretKey: "test-secret"})
+		require.NoError(t, err)
+		expired.ttl = -time.Minute
+		q, _ := expired.Sign(resource, testUserID)
+
+		_, err = s.Verify(resource, q)
+		require.ErrorIs(t, err, domain.ErrURLExpired)
+	})
+}
@@ -0,0 +1,119 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/require"
+)
+
+type store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+func newTestObjectStore(t *testing.T) *ObjectStore {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+
+	go ns.Start()
+	require.True(t, ns.ReadyForConnections(5*time.Second))
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	require.NoError(t, err)
+
+	o, err := NewObjectStore(context.Background(), js, "attachments")
+	require.NoError(t, err)
+
+	return o
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, domain.ErrAttachmentTooLarge
+}
+
+func TestStore(t *testing.T) {
+	t.Parallel()
+
+	local, err := NewLocal(t.TempDir())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		store func(t *testing.T) store
+	}{
+		{name: "local", store: func(*testing.T) store { return local }},
+		{name: "object_store", store: func(t *testing.T) store { return newTestObjectStore(t) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			s := tt.store(t)
+
+			_, err := s.Open(ctx, "missing")
+			require.ErrorIs(t, err, domain.ErrBlobNotFound)
+
+			require.NoError(t, s.Put(ctx, "blob-1", strings.NewReader("hello")))
+
+			rc, err := s.Open(ctx, "blob-1")
+			require.NoError(t, err)
+			b, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			require.Equal(t, "hello", string(b))
+
+			// a failing reader stores nothing
+			err = s.Put(ctx, "blob-2", io.MultiReader(strings.NewReader("partial"), failingReader{}))
+			require.ErrorIs(t, err, domain.ErrAttachmentTooLarge)
+			_, err = s.Open(ctx, "blob-2")
+			require.ErrorIs(t, err, domain.ErrBlobNotFound)
+
+			require.NoError(t, s.Delete(ctx, "blob-1"))
+			require.NoError(t, s.Delete(ctx, "blob-1"))
+			_, err = s.Open(ctx, "blob-1")
+			require.ErrorIs(t, err, domain.ErrBlobNotFound)
+		})
+	}
+}
+
+func TestLocal_InvalidKey(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	l, err := NewLocal(t.TempDir())
+	require.NoError(t, err)
+
+	for _, key := range []string{"", "../escape", "dir/file", ".upload-1"} {
+		require.ErrorIs(t, l.Put(ctx, key, strings.NewReader("x")), domain.ErrBlobNotFound)
+
+		_, err = l.Open(ctx, key)
+		require.ErrorIs(t, err, domain.ErrBlobNotFound)
+	}
+}
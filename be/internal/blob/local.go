@@ -0,0 +1,117 @@
+// Package blob stores the content of attachments. Local keeps it on the
+// filesystem of a single node, ObjectStore in a JetStream object store shared
+// by every instance.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// Local stores every blob as a file of dir named after its key.
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, errors.New("create blob dir: " + err.Error())
+	}
+	return &Local{dir: dir}, nil
+}
+
+// Put writes to a temporary file first so that a failed upload never
+// leaves a partial blob behind.
+func (l *Local) Put(_ context.Context, key string, r io.Reader) error {
+	if !validKey(key) {
+		return domain.ErrBlobNotFound
+	}
+
+	f, err := os.CreateTemp(l.dir, ".upload-*")
+	if err != nil {
+		log.Error("blob.Local.Put", log.Err(err))
+		return domain.ErrBlobStore
+	}
+	defer func() { _ = os.Remove(f.Name()) }() // no-op once renamed
+
+	src := &reader{r: r}
+	if _, err = io.Copy(f, src); err != nil {
+		_ = f.Close()
+		if src.err != nil {
+			return src.err // the reader failed, e.g. the upload is too large
+		}
+		log.Error("blob.Local.Put", log.Err(err))
+		return domain.ErrBlobStore
+	}
+
+	if err = f.Close(); err != nil {
+		log.Error("blob.Local.Put", log.Err(err))
+		return domain.ErrBlobStore
+	}
+
+	if err = os.Rename(f.Name(), filepath.Join(l.dir, key)); err != nil {
+		log.Error("blob.Local.Put", log.Err(err))
+		return domain.ErrBlobStore
+	}
+
+	return nil
+}
+
+func (l *Local) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, domain.ErrBlobNotFound
+	}
+
+	f, err := os.Open(filepath.Join(l.dir, key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, domain.ErrBlobNotFound
+		}
+		log.Error("blob.Local.Open", log.Err(err))
+		return nil, domain.ErrBlobStore
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(_ context.Context, key string) error {
+	if !validKey(key) {
+		return nil
+	}
+
+	err := os.Remove(filepath.Join(l.dir, key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error("blob.Local.Delete", log.Err(err))
+		return domain.ErrBlobStore
+	}
+
+	return nil
+}
+
+// validKey rejects keys that would escape the directory or hit a temporary
+// file.
+func validKey(key string) bool {
+	return key != "" && key[0] != '.' && filepath.Base(key) == key
+}
+
+// reader records the error of the source so that it is told apart from a
+// failure of the store.
+type reader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
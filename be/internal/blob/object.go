@@ -0,0 +1,65 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ObjectStore stores the blobs in a JetStream object store bucket.
+type ObjectStore struct {
+	store jetstream.ObjectStore
+}
+
+func NewObjectStore(ctx context.Context, js jetstream.JetStream, bucket string) (*ObjectStore, error) {
+	store, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:  bucket,
+		Storage: jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, errors.New("create object store: " + err.Error())
+	}
+
+	return &ObjectStore{store: store}, nil
+}
+
+func (o *ObjectStore) Put(ctx context.Context, key string, r io.Reader) error {
+	src := &reader{r: r}
+	_, err := o.store.Put(ctx, jetstream.ObjectMeta{Name: key}, src)
+	if err != nil {
+		if src.err != nil {
+			return src.err // the reader failed, e.g. the upload is too large
+		}
+		log.Error("blob.ObjectStore.Put", log.Err(err))
+		return domain.ErrBlobStore
+	}
+
+	return nil
+}
+
+func (o *ObjectStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := o.store.Get(ctx, key)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrObjectNotFound) {
+			return nil, domain.ErrBlobNotFound
+		}
+		log.Error("blob.ObjectStore.Open", log.Err(err))
+		return nil, domain.ErrBlobStore
+	}
+
+	return res, nil
+}
+
+func (o *ObjectStore) Delete(ctx context.Context, key string) error {
+	err := o.store.Delete(ctx, key)
+	if err != nil && !errors.Is(err, jetstream.ErrObjectNotFound) {
+		log.Error("blob.ObjectStore.Delete", log.Err(err))
+		return domain.ErrBlobStore
+	}
+
+	return nil
+}
@@ -0,0 +1,391 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	appName = "chatterly"
+
+	streamName         = "CHAT"
+	subjectPrefix      = "chat.room."
+	eventSubjectPrefix = "chat.event." // outside of the stream, events are not persisted
+	userSubjectPrefix  = "chat.user."
+
+	// presence keys are <user id>.<instance id>, an instance that dies
+	// without clearing its keys is forgotten once they expire
+	presenceBucket    = "presence"
+	presenceTTL       = 90 * time.Second
+	presenceHeartbeat = 30 * time.Second
+
+	streamMaxAge      = 7 * 24 * time.Hour
+	consumerInactive  = 5 * time.Minute
+	connectionTimeout = 10 * time.Second
+)
+
+type Broker struct {
+	id     string
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	stream jetstream.Stream
+	kv     jetstream.KeyValue
+
+	// presence set by this instance, refreshed before it expires
+	mu       sync.Mutex
+	presence map[string]string
+	done     chan struct{}
+
+	closeOnce sync.Once
+}
+
+func New(ctx context.Context, servers []string) (*Broker, error) {
+	nc, err := nats.Connect(
+		strings.Join(servers, ","),
+		nats.Name(appName),
+		nats.Timeout(connectionTimeout),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, errors.New("connect to nats: " + err.Error())
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, errors.New("init jetstream: " + err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, connectionTimeout)
+	defer cancel()
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     streamName,
+		Subjects: []string{subjectPrefix + ">"},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   streamMaxAge,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, errors.New("create stream: " + err.Error())
+	}
+
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  presenceBucket,
+		TTL:     presenceTTL,
+		Storage: jetstream.MemoryStorage,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, errors.New("create presence bucket: " + err.Error())
+	}
+
+	b := &Broker{
+		id:       uuid.NewString(),
+		nc:       nc,
+		js:       js,
+		stream:   stream,
+		kv:       kv,
+		presence: make(map[string]string),
+		done:     make(chan struct{}),
+	}
+
+	go b.heartbeat()
+
+	return b, nil
+}
+
+// PublishMessage stores the message in the chat stream.
+func (b *Broker) PublishMessage(ctx context.Context, msg *domain.Message) error {
+	subject, err := messageSubject(msg.RoomID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Error("broker.PublishMessage", log.Err(err))
+		return domain.ErrBrokerPublish
+	}
+
+	// the message id lets jetstream drop duplicates of a retried publish
+	_, err = b.js.Publish(ctx, subject, data, jetstream.WithMsgID(msg.ID))
+	if err != nil {
+		log.Error("broker.PublishMessage", log.ChatID(msg.RoomID), log.Err(err))
+		return domain.ErrBrokerPublish
+	}
+
+	return nil
+}
+
+// SubscribeMessages delivers the messages of the room published from now on
+// to fn, the returned func stops the delivery. Every subscription gets its
+// own ordered consumer, messages published while nobody was subscribed are
+// left to resume and history.
+func (b *Broker) SubscribeMessages(ctx context.Context, roomID string, fn func(*domain.Message)) (func(), error) {
+	subject, err := messageSubject(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	cons, err := b.stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects:    []string{subject},
+		DeliverPolicy:     jetstream.DeliverNewPolicy,
+		InactiveThreshold: consumerInactive,
+	})
+	if err != nil {
+		log.Error("broker.SubscribeMessages", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrBrokerSubscribe
+	}
+
+	cc, err := cons.Consume(func(m jetstream.Msg) {
+		msg := &domain.Message{}
+		if err := json.Unmarshal(m.Data(), msg); err != nil {
+			log.Error("broker: decode message", log.ChatID(roomID), log.Err(err))
+			return
+		}
+
+		fn(msg)
+	})
+	if err != nil {
+		log.Error("broker.SubscribeMessages", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrBrokerSubscribe
+	}
+
+	return cc.Stop, nil
+}
+
+// PublishEvent fans the event out to the current subscribers of its room,
+// nothing is stored so subscribers that are offline miss it.
+func (b *Broker) PublishEvent(_ context.Context, event *domain.Event) error {
+	subject, err := eventSubject(event.RoomID)
+	if err != nil {
+		return err
+	}
+
+	return b.publishEvent(subject, event)
+}
+
+// SubscribeEvents delivers the events of the room to fn, the returned func
+// stops the delivery.
+func (b *Broker) SubscribeEvents(_ context.Context, roomID string, fn func(*domain.Event)) (func(), error) {
+	subject, err := eventSubject(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.subscribeEvents(subject, fn)
+}
+
+// PublishUserEvent fans the event out to the current subscribers of the
+// user in event.UserID, whatever room they are connected to.
+func (b *Broker) PublishUserEvent(_ context.Context, event *domain.Event) error {
+	subject, err := userSubject(event.UserID)
+	if err != nil {
+		return err
+	}
+
+	return b.publishEvent(subject, event)
+}
+
+// SubscribeUserEvents delivers the events of the user to fn, the returned
+// func stops the delivery.
+func (b *Broker) SubscribeUserEvents(_ context.Context, userID string, fn func(*domain.Event)) (func(), error) {
+	subject, err := userSubject(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.subscribeEvents(subject, fn)
+}
+
+func (b *Broker) publishEvent(subject string, event *domain.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error("broker.PublishEvent", log.Err(err))
+		return domain.ErrBrokerPublish
+	}
+
+	if err = b.nc.Publish(subject, data); err != nil {
+		log.Error("broker.PublishEvent", log.String("subject", subject), log.Err(err))
+		return domain.ErrBrokerPublish
+	}
+
+	return nil
+}
+
+func (b *Broker) subscribeEvents(subject string, fn func(*domain.Event)) (func(), error) {
+	sub, err := b.nc.Subscribe(subject, func(m *nats.Msg) {
+		event := &domain.Event{}
+		if err := json.Unmarshal(m.Data, event); err != nil {
+			log.Error("broker: decode event", log.String("subject", subject), log.Err(err))
+			return
+		}
+
+		fn(event)
+	})
+	if err != nil {
+		log.Error("broker.SubscribeEvents", log.String("subject", subject), log.Err(err))
+		return nil, domain.ErrBrokerSubscribe
+	}
+
+	return func() { _ = sub.Unsubscribe() }, nil
+}
+
+// SetPresence records the status the user has on this instance.
+func (b *Broker) SetPresence(ctx context.Context, userID string, status string) error {
+	if !validUserID(userID) {
+		return domain.ErrUserIDInvalid
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.kv.PutString(ctx, userID+"."+b.id, status); err != nil {
+		log.Error("broker.SetPresence", log.UserID(userID), log.Err(err))
+		return domain.ErrBrokerPresence
+	}
+	b.presence[userID] = status
+
+	return nil
+}
+
+// ClearPresence removes the user from this instance.
+func (b *Broker) ClearPresence(ctx context.Context, userID string) error {
+	if !validUserID(userID) {
+		return domain.ErrUserIDInvalid
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.presence, userID)
+	if err := b.kv.Delete(ctx, userID+"."+b.id); err != nil {
+		log.Error("broker.ClearPresence", log.UserID(userID), log.Err(err))
+		return domain.ErrBrokerPresence
+	}
+
+	return nil
+}
+
+// ListPresence returns the statuses the user has across all instances.
+func (b *Broker) ListPresence(ctx context.Context, userID string) ([]string, error) {
+	if !validUserID(userID) {
+		return nil, domain.ErrUserIDInvalid
+	}
+
+	w, err := b.kv.Watch(ctx, userID+".*", jetstream.IgnoreDeletes())
+	if err != nil {
+		log.Error("broker.ListPresence", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrBrokerPresence
+	}
+	defer func() { _ = w.Stop() }()
+
+	statuses := make([]string, 0)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case entry := <-w.Updates():
+			// nil marks the end of the current values
+			if entry == nil {
+				return statuses, nil
+			}
+			statuses = append(statuses, string(entry.Value()))
+		}
+	}
+}
+
+// heartbeat keeps the presence of this instance from expiring.
+func (b *Broker) heartbeat() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.refreshPresence()
+		}
+	}
+}
+
+func (b *Broker) refreshPresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+	defer cancel()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for userID, status := range b.presence {
+		if _, err := b.kv.PutString(ctx, userID+"."+b.id, status); err != nil {
+			log.Error("broker.refreshPresence", log.UserID(userID), log.Err(err))
+		}
+	}
+}
+
+// JetStream exposes the context of the connection to other jetstream backed
+// stores, such as the attachment blobs.
+func (b *Broker) JetStream() jetstream.JetStream {
+	return b.js
+}
+
+// Close drains the connection, calls after the first do nothing.
+func (b *Broker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+
+		if err := b.nc.Drain(); err != nil {
+			log.Error("broker.Close", log.Err(err))
+			return
+		}
+		log.Warn("broker connection closed")
+	})
+}
+
+// messageSubject maps the room to its subject, room ids must be a single
+// subject token.
+func messageSubject(roomID string) (string, error) {
+	if !validRoomID(roomID) {
+		return "", domain.ErrRoomIDInvalid
+	}
+	return subjectPrefix + roomID + ".messages", nil
+}
+
+func eventSubject(roomID string) (string, error) {
+	if !validRoomID(roomID) {
+		return "", domain.ErrRoomIDInvalid
+	}
+	return eventSubjectPrefix + roomID, nil
+}
+
+func userSubject(userID string) (string, error) {
+	if !validUserID(userID) {
+		return "", domain.ErrUserIDInvalid
+	}
+	return userSubjectPrefix + userID, nil
+}
+
+func validRoomID(roomID string) bool {
+	return validToken(roomID)
+}
+
+func validUserID(userID string) bool {
+	return validToken(userID)
+}
+
+// validToken reports whether s can be used as a single subject or key token.
+func validToken(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+	return connectTestBroker(t, newTestServer(t))
+}
+
+func newTestServer(t *testing.T) string {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+
+	go ns.Start()
+	require.True(t, ns.ReadyForConnections(5*time.Second))
+	t.Cleanup(ns.Shutdown)
+
+	return ns.ClientURL()
+}
+
+func connectTestBroker(t *testing.T, url string) *Broker {
+	t.Helper()
+
+	b, err := New(context.Background(), []string{url})
+	require.NoError(t, err)
+	t.Cleanup(b.Close)
+
+	return b
+}
+
+func TestBroker_Messages(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBroker(t)
+
+	received := make(chan *domain.Message, 10)
+	stop, err := b.SubscribeMessages(ctx, "room-1", func(msg *domain.Message) {
+		received <- msg
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	other := make(chan *domain.Message, 10)
+	stopOther, err := b.SubscribeMessages(ctx, "room-2", func(msg *domain.Message) {
+		other <- msg
+	})
+	require.NoError(t, err)
+	defer stopOther()
+
+	msg := &domain.Message{
+		ID:        "message-1",
+		RoomID:    "room-1",
+		UserID:    "user-1",
+		Body:      "hello",
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	require.NoError(t, b.PublishMessage(ctx, msg))
+
+	select {
+	case got := <-received:
+		require.Equal(t, msg, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	select {
+	case got := <-other:
+		t.Fatalf("message delivered to another room: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroker_Resubscribe(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBroker(t)
+
+	received := make(chan *domain.Message, 10)
+	handler := func(msg *domain.Message) { received <- msg }
+
+	stop, err := b.SubscribeMessages(ctx, "room-1", handler)
+	require.NoError(t, err)
+	stop()
+
+	// published while nobody consumes, left to resume and history
+	require.NoError(t, b.PublishMessage(ctx, &domain.Message{ID: "message-1", RoomID: "room-1"}))
+
+	stop, err = b.SubscribeMessages(ctx, "room-1", handler)
+	require.NoError(t, err)
+	defer stop()
+
+	require.NoError(t, b.PublishMessage(ctx, &domain.Message{ID: "message-2", RoomID: "room-1"}))
+
+	select {
+	case got := <-received:
+		require.Equal(t, "message-2", got.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	select {
+	case got := <-received:
+		t.Fatalf("message delivered twice or out of order: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroker_InvalidRoomID(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBroker(t)
+
+	for _, roomID := range []string{"", "room.1", "room*", "room>", "room 1"} {
+		err := b.PublishMessage(ctx, &domain.Message{RoomID: roomID})
+		require.ErrorIs(t, err, domain.ErrRoomIDInvalid)
+
+		_, err = b.SubscribeMessages(ctx, roomID, func(*domain.Message) {})
+		require.ErrorIs(t, err, domain.ErrRoomIDInvalid)
+	}
+}
+
+func TestBroker_Events(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBroker(t)
+
+	received := make(chan *domain.Event, 10)
+	stop, err := b.SubscribeEvents(ctx, "room-1", func(event *domain.Event) {
+		received <- event
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	other := make(chan *domain.Event, 10)
+	stopOther, err := b.SubscribeEvents(ctx, "room-2", func(event *domain.Event) {
+		other <- event
+	})
+	require.NoError(t, err)
+	defer stopOther()
+
+	event := &domain.Event{Type: "receipt", RoomID: "room-1", Data: []byte(`{"read_seq":1}`)}
+	require.NoError(t, b.PublishEvent(ctx, event))
+
+	select {
+	case got := <-received:
+		require.Equal(t, event, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+
+	select {
+	case got := <-other:
+		t.Fatalf("event delivered to another room: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBroker_UserEvents(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b := newTestBroker(t)
+
+	received := make(chan *domain.Event, 10)
+	stop, err := b.SubscribeUserEvents(ctx, "user-1", func(event *domain.Event) {
+		received <- event
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	// room events do not reach user subscribers
+	require.NoError(t, b.PublishEvent(ctx, &domain.Event{Type: "receipt", RoomID: "user-1"}))
+
+	event := &domain.Event{Type: "notification", RoomID: "room-1", UserID: "user-1", Data: []byte(`{"id":"1"}`)}
+	require.NoError(t, b.PublishUserEvent(ctx, event))
+
+	select {
+	case got := <-received:
+		require.Equal(t, event, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+
+	err = b.PublishUserEvent(ctx, &domain.Event{UserID: "user.1"})
+	require.ErrorIs(t, err, domain.ErrUserIDInvalid)
+}
+
+func TestBroker_Presence(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	url := newTestServer(t)
+
+	// two instances sharing the server
+	b := connectTestBroker(t, url)
+	other := connectTestBroker(t, url)
+
+	statuses, err := b.ListPresence(ctx, "user-1")
+	require.NoError(t, err)
+	require.Empty(t, statuses)
+
+	require.NoError(t, b.SetPresence(ctx, "user-1", domain.PresenceAway))
+	require.NoError(t, other.SetPresence(ctx, "user-1", domain.PresenceOnline))
+	require.NoError(t, b.SetPresence(ctx, "user-2", domain.PresenceOnline))
+
+	statuses, err = b.ListPresence(ctx, "user-1")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{domain.PresenceAway, domain.PresenceOnline}, statuses)
+
+	require.NoError(t, other.ClearPresence(ctx, "user-1"))
+
+	statuses, err = b.ListPresence(ctx, "user-1")
+	require.NoError(t, err)
+	require.Equal(t, []string{domain.PresenceAway}, statuses)
+
+	_, err = b.ListPresence(ctx, "user.1")
+	require.ErrorIs(t, err, domain.ErrUserIDInvalid)
+}
+
+func TestBroker_CloseTwice(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+
+	// the cleanup closes it once more
+	b.Close()
+	require.NotPanics(t, b.Close)
+}
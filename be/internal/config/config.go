@@ -9,13 +9,18 @@ import (
 )
 
 type Config struct {
-	App AppConfig `mapstructure:"APP" json:"app" yaml:"app"`
-	JWT JWTConfig `mapstructure:"JWT" json:"jwt" yaml:"jwt"`
+	App  AppConfig  `mapstructure:"APP" json:"app" yaml:"app"`
+	JWT  JWTConfig  `mapstructure:"JWT" json:"jwt" yaml:"jwt"`
+	Chat ChatConfig `mapstructure:"CHAT" json:"chat" yaml:"chat"`
 
 	DB     DBConfig     `mapstructure:"DB" json:"db" yaml:"db"`
 	Broker BrokerConfig `mapstructure:"BROKER" json:"broker" yaml:"broker"`
+	Search SearchConfig `mapstructure:"SEARCH" json:"search" yaml:"search"`
 
-	OAuth OAuthConfig `mapstructure:"OAUTH" json:"oauth" yaml:"oauth"`
+	Attachment AttachmentConfig `mapstructure:"ATTACHMENT" json:"attachment" yaml:"attachment"`
+
+	OAuth      OAuthConfig      `mapstructure:"OAUTH" json:"oauth" yaml:"oauth"`
+	OAuthState OAuthStateConfig `mapstructure:"OAUTH_STATE" json:"oauth_state" yaml:"oauth_state"`
 }
 
 type AppConfig struct {
@@ -41,6 +46,10 @@ type JWTChat struct {
 	TokenTTL  time.Duration `mapstructure:"TOKEN_TTL" json:"token_ttl" yaml:"token_ttl"`
 }
 
+type ChatConfig struct {
+	DedupWindow time.Duration `mapstructure:"DEDUP_WINDOW" json:"dedup_window" yaml:"dedup_window"`
+}
+
 type DBConfig struct {
 	URI string `mapstructure:"URI" json:"uri" yaml:"uri"`
 }
@@ -49,14 +58,65 @@ type BrokerConfig struct {
 	Servers []string `mapstructure:"SERVERS" json:"servers" yaml:"servers"`
 }
 
+type SearchConfig struct {
+	Backend    string `mapstructure:"BACKEND" json:"backend" yaml:"backend"`
+	SQLitePath string `mapstructure:"SQLITE_PATH" json:"sqlite_path" yaml:"sqlite_path"`
+}
+
+type AttachmentConfig struct {
+	Backend string    `mapstructure:"BACKEND" json:"backend" yaml:"backend"`
+	Dir     string    `mapstructure:"DIR" json:"dir" yaml:"dir"`
+	Bucket  string    `mapstructure:"BUCKET" json:"bucket" yaml:"bucket"`
+	MaxSize int64     `mapstructure:"MAX_SIZE" json:"max_size" yaml:"max_size"`
+	URL     URLConfig `mapstructure:"URL" json:"url" yaml:"url"`
+	// ImageWorkers is how many images are processed at once
+	ImageWorkers int `mapstructure:"IMAGE_WORKERS" json:"image_workers" yaml:"image_workers"`
+}
+
+type URLConfig struct {
+	SecretKey string        `mapstructure:"SECRET_KEY" json:"secret_key" yaml:"secret_key"`
+	TTL       time.Duration `mapstructure:"TTL" json:"ttl" yaml:"ttl"`
+}
+
+// OAuthConfig declares the login providers by name, the name is part of the
+// login urls.
 type OAuthConfig map[string]OAuthProviderConfig
 
+// OAuthProviderConfig describes an oidc provider found through the discovery
+// document of Issuer, or a plain oauth2 provider with explicit endpoints whose
+// user endpoint returns the claims.
 type OAuthProviderConfig struct {
+	Type         string   `mapstructure:"TYPE" json:"type" yaml:"type"`
+	Issuer       string   `mapstructure:"ISSUER" json:"issuer" yaml:"issuer"`
+	AuthURL      string   `mapstructure:"AUTH_URL" json:"auth_url" yaml:"auth_url"`
+	TokenURL     string   `mapstructure:"TOKEN_URL" json:"token_url" yaml:"token_url"`
+	UserEndpoint string   `mapstructure:"USER_ENDPOINT" json:"user_endpoint" yaml:"user_endpoint"`
 	Scopes       []string `mapstructure:"SCOPES" json:"scopes" yaml:"scopes"`
 	ClientID     string   `mapstructure:"CLIENT_ID" json:"client_id" yaml:"client_id"`
 	ClientSecret string   `mapstructure:"CLIENT_SECRET" json:"client_secret" yaml:"client_secret"`
 	RedirectURL  string   `mapstructure:"REDIRECT_URL" json:"redirect_url" yaml:"redirect_url"`
-	UserEndpoint string   `mapstructure:"USER_ENDPOINT" json:"user_endpoint" yaml:"user_endpoint"`
+
+	Claims OAuthClaimsConfig `mapstructure:"CLAIMS" json:"claims" yaml:"claims"`
+}
+
+// OAuthClaimsConfig names the claims holding the user's fields, nested claims
+// are separated by dots. Empty names default to the standard oidc claims.
+type OAuthClaimsConfig struct {
+	Subject       string `mapstructure:"SUBJECT" json:"subject" yaml:"subject"`
+	Name          string `mapstructure:"NAME" json:"name" yaml:"name"`
+	Email         string `mapstructure:"EMAIL" json:"email" yaml:"email"`
+	EmailVerified string `mapstructure:"EMAIL_VERIFIED" json:"email_verified" yaml:"email_verified"`
+	Avatar        string `mapstructure:"AVATAR" json:"avatar" yaml:"avatar"`
+	// AvatarURL builds the avatar url from the avatar claim in place of its
+	// %s, for providers that only send an id
+	AvatarURL string `mapstructure:"AVATAR_URL" json:"avatar_url" yaml:"avatar_url"`
+}
+
+// OAuthStateConfig signs the login state kept by the browser between the
+// redirect to the provider and the callback.
+type OAuthStateConfig struct {
+	SecretKey string        `mapstructure:"SECRET_KEY" json:"secret_key" yaml:"secret_key"`
+	TTL       time.Duration `mapstructure:"TTL" json:"ttl" yaml:"ttl"`
 }
 
 func LoadConfig(file string) (*Config, error) {
@@ -16,35 +16,65 @@ app:
   domain: "http://localhost:8080/api/health"
   allow_origins:
     - "http://localhost"
+  shutdown_timeout: 5s
+
+chat:
+  dedup_window: 2m
 
 db:
-  file: "./database.db"
+  uri: "mongodb://localhost:27017"
+
+broker:
+  servers:
+    - "localhost:4222"
+
+search:
+  backend: "sqlite"
+  sqlite_path: "search.db"
+
+attachment:
+  backend: "local"
+  dir: "data/attachments"
+  bucket: "attachments"
+  max_size: 1024
+  url:
+    secret_key: "your_url_secret_key"
+    ttl: 15m
 
 jwt:
-  room:
-    secret_key: "your_room_secret_key"
+  chat:
+    secret_key: "your_chat_secret_key"
     token_ttl: 1m
-  auth:
-    secret_key: "your_auth_secret_key"
+  user:
+    secret_key: "your_user_secret_key"
     access_token_ttl: 1h
     refresh_token_ttl: 720h
 
 oauth:
   google:
+    type: "oidc"
+    issuer: "https://accounts.google.com"
+    scopes:
+      - "email"
+      - "profile"
     client_id: "your-google-client-id"
     client_secret: "your-google-client-secret"
     redirect_url: "http://localhost:8080/api/oauth/google/callback"
-    user_endpoint: "https://www.googleapis.com/oauth2/v2/userinfo"
   github:
+    type: "oauth2"
+    auth_url: "https://github.com/login/oauth/authorize"
+    token_url: "https://github.com/login/oauth/access_token"
+    user_endpoint: "https://api.github.com/user"
     client_id: "your-github-client-id"
     client_secret: "your-github-client-secret"
     redirect_url: "http://localhost:8080/api/oauth/github/callback"
-    user_endpoint: "https://api.github.com/user"
-  yandex:
-    client_id: "your-yandex-client-id"
-    client_secret: "your-yandex-client-secret"
-    redirect_url: "http://localhost:8080/api/oauth/yandex/callback"
-    user_endpoint: "https://login.yandex.ru/info?format=json"
+    claims:
+      subject: "id"
+      avatar: "avatar_url"
+
+oauth_state:
+  secret_key: "your_oauth_state_secret_key"
+  ttl: 10m
 `)
 
 	tmpFile, err := os.CreateTemp("/tmp", "config*.yml")
@@ -60,46 +90,74 @@ oauth:
 	config, err := LoadConfig(tmpFile.Name())
 	require.NoError(t, err)
 
-	expectedConfig := Config{
+	expectedConfig := &Config{
 		App: AppConfig{
-			Addr:         ":8080",
-			Domain:       "http://localhost:8080/api/health",
-			AllowOrigins: []string{"http://localhost"},
+			Addr:            ":8080",
+			Domain:          "http://localhost:8080/api/health",
+			AllowOrigins:    []string{"http://localhost"},
+			ShutdownTimeout: 5 * time.Second,
+		},
+		Chat: ChatConfig{
+			DedupWindow: 2 * time.Minute,
 		},
 		DB: DBConfig{
-			File: "./database.db",
+			URI: "mongodb://localhost:27017",
+		},
+		Broker: BrokerConfig{
+			Servers: []string{"localhost:4222"},
+		},
+		Search: SearchConfig{
+			Backend:    "sqlite",
+			SQLitePath: "search.db",
+		},
+		Attachment: AttachmentConfig{
+			Backend: "local",
+			Dir:     "data/attachments",
+			Bucket:  "attachments",
+			MaxSize: 1024,
+			URL: URLConfig{
+				SecretKey: "your_url_secret_key",
+				TTL:       15 * time.Minute,
+			},
 		},
 		JWT: JWTConfig{
-			Room: JWTRoom{
-				SecretKey: "your_room_secret_key",
+			Chat: JWTChat{
+				SecretKey: "your_chat_secret_key",
 				TokenTTL:  1 * time.Minute,
 			},
 			User: JWTUser{
-				SecretKey:       "your_auth_secret_key",
+				SecretKey:       "your_user_secret_key",
 				AccessTokenTTL:  1 * time.Hour,
 				RefreshTokenTTL: 720 * time.Hour,
 			},
 		},
 		OAuth: OAuthConfig{
-			Google: OAuthProviderConfig{
+			"google": OAuthProviderConfig{
+				Type:         "oidc",
+				Issuer:       "https://accounts.google.com",
+				Scopes:       []string{"email", "profile"},
 				ClientID:     "your-google-client-id",
 				ClientSecret: "your-google-client-secret",
 				RedirectURL:  "http://localhost:8080/api/oauth/google/callback",
-				UserEndpoint: "https://www.googleapis.com/oauth2/v2/userinfo",
 			},
-			GitHub: OAuthProviderConfig{
+			"github": OAuthProviderConfig{
+				Type:         "oauth2",
+				AuthURL:      "https://github.com/login/oauth/authorize",
+				TokenURL:     "https://github.com/login/oauth/access_token",
+				UserEndpoint: "https://api.github.com/user",
 				ClientID:     "your-github-client-id",
 				ClientSecret: "your-github-client-secret",
 				RedirectURL:  "http://localhost:8080/api/oauth/github/callback",
-				UserEndpoint: "https://api.github.com/user",
-			},
-			Yandex: OAuthProviderConfig{
-				ClientID:     "your-yandex-client-id",
-				ClientSecret: "your-yandex-client-secret",
-				RedirectURL:  "http://localhost:8080/api/oauth/yandex/callback",
-				UserEndpoint: "https://login.yandex.ru/info?format=json",
+				Claims: OAuthClaimsConfig{
+					Subject: "id",
+					Avatar:  "avatar_url",
+				},
 			},
 		},
+		OAuthState: OAuthStateConfig{
+			SecretKey: "your_oauth_state_secret_key",
+			TTL:       10 * time.Minute,
+		},
 	}
 
 	require.Empty(t, cmp.Diff(expectedConfig, config))
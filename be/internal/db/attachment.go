@@ -0,0 +1,76 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func (db *DB) CreateAttachment(ctx context.Context, attachment *domain.Attachment) error {
+	_, err := db.attachments.InsertOne(ctx, attachment)
+	if err != nil {
+		log.Error("db.CreateAttachment", log.ChatID(attachment.RoomID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+func (db *DB) GetAttachment(ctx context.Context, attachmentID string) (*domain.Attachment, error) {
+	f := bson.M{"_id": attachmentID}
+	attachment := &domain.Attachment{}
+
+	err := db.attachments.FindOne(ctx, f).Decode(attachment)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBAttachmentNotFound
+		}
+		log.Error("db.GetAttachment", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return attachment, nil
+}
+
+// ListAttachments returns the attachments found among the ids, missing ones
+// are skipped.
+func (db *DB) ListAttachments(ctx context.Context, attachmentIDs []string) ([]*domain.Attachment, error) {
+	f := bson.M{"_id": bson.M{"$in": attachmentIDs}}
+
+	cur, err := db.attachments.Find(ctx, f)
+	if err != nil {
+		log.Error("db.ListAttachments", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	var attachments []*domain.Attachment
+	if err = cur.All(ctx, &attachments); err != nil {
+		log.Error("db.ListAttachments", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return attachments, nil
+}
+
+// DeleteAttachments marks the attachments of the room as deleted, their
+// content can no longer be downloaded.
+func (db *DB) DeleteAttachments(ctx context.Context, roomID string, attachmentIDs []string, deletedAt time.Time) error {
+	f := bson.M{
+		"_id":        bson.M{"$in": attachmentIDs},
+		"room_id":    roomID,
+		"deleted_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"deleted_at": deletedAt}}
+
+	if _, err := db.attachments.UpdateMany(ctx, f, update); err != nil {
+		log.Error("db.DeleteAttachments", log.ChatID(roomID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// cursor points at the last entry of a page ordered by creation time, it is
+// handed to clients as an opaque string.
+type cursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func encodeCursor(createdAt time.Time, id string) string {
+	b, _ := json.Marshal(cursor{CreatedAt: createdAt, ID: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, domain.ErrCursorInvalid
+	}
+
+	c := &cursor{}
+	if err = json.Unmarshal(b, c); err != nil || c.ID == "" || c.CreatedAt.IsZero() {
+		return nil, domain.ErrCursorInvalid
+	}
+
+	return c, nil
+}
+
+// beforeCursor narrows the filter to the entries after the cursor in newest
+// first order.
+func beforeCursor(f bson.M, before string) error {
+	if before == "" {
+		return nil
+	}
+
+	c, err := decodeCursor(before)
+	if err != nil {
+		return err
+	}
+
+	f["$or"] = bson.A{
+		bson.M{"created_at": bson.M{"$lt": c.CreatedAt}},
+		bson.M{"created_at": c.CreatedAt, "_id": bson.M{"$lt": c.ID}},
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestCursor(t *testing.T) {
+	t.Parallel()
+
+	msg := &domain.Message{
+		ID:        "3f1c7a2e-8d7b-4b7e-9f59-0c7f1d1c2a10",
+		CreatedAt: time.Date(2025, 5, 30, 12, 0, 0, 123000000, time.UTC),
+	}
+
+	c, err := decodeCursor(encodeCursor(msg.CreatedAt, msg.ID))
+	require.NoError(t, err)
+	require.Equal(t, msg.ID, c.ID)
+	require.True(t, msg.CreatedAt.Equal(c.CreatedAt))
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "not_base64", cursor: "!!!"},
+		{name: "not_json", cursor: "bm90LWpzb24"},
+		{name: "empty_object", cursor: "e30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := decodeCursor(tt.cursor)
+			require.ErrorIs(t, err, domain.ErrCursorInvalid)
+		})
+	}
+}
+
+func TestBeforeCursor(t *testing.T) {
+	t.Parallel()
+
+	createdAt := time.Date(2025, 5, 30, 12, 0, 0, 123000000, time.UTC)
+
+	f := bson.M{"room_id": "room"}
+	require.NoError(t, beforeCursor(f, ""))
+	require.Equal(t, bson.M{"room_id": "room"}, f)
+
+	require.NoError(t, beforeCursor(f, encodeCursor(createdAt, "b")))
+	require.Equal(t, bson.M{
+		"room_id": "room",
+		// messages created at the same time are ordered by id
+		"$or": bson.A{
+			bson.M{"created_at": bson.M{"$lt": createdAt}},
+			bson.M{"created_at": createdAt, "_id": bson.M{"$lt": "b"}},
+		},
+	}, f)
+
+	require.ErrorIs(t, beforeCursor(bson.M{}, "!!!"), domain.ErrCursorInvalid)
+}
@@ -14,10 +14,25 @@ import (
 
 const (
 	appName = "chatterly"
+
+	// server error codes
+	namespaceNotFound = 26
+	indexNotFound     = 27
+	duplicateKey      = 11000
 )
 
 type DB struct {
-	users *mongo.Collection
+	users    *mongo.Collection
+	dms      *mongo.Collection
+	rooms    *mongo.Collection
+	messages *mongo.Collection
+	dedup    *mongo.Collection
+	receipts *mongo.Collection
+	unreads  *mongo.Collection
+
+	attachments   *mongo.Collection
+	notifications *mongo.Collection
+	sessions      *mongo.Collection
 
 	close func(ctx context.Context) error
 }
@@ -36,23 +51,129 @@ func New(ctx context.Context, uri string) (*DB, error) {
 	defer cancel()
 
 	var res bson.M
-	err = database.RunCommand(ctx, bson.D{{"ping", 1}}).Decode(&res)
+	err = database.RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Decode(&res)
 	if err != nil {
 		return nil, errors.New("ping mongodb: " + err.Error())
 	}
 
 	users := database.Collection("users")
+	dms := database.Collection("dms")
+	rooms := database.Collection("rooms")
+	messages := database.Collection("messages")
+	dedup := database.Collection("dedup")
+	receipts := database.Collection("receipts")
+	unreads := database.Collection("unreads")
+	attachments := database.Collection("attachments")
+	notifications := database.Collection("notifications")
+	sessions := database.Collection("sessions")
 
 	db := &DB{
-		users: users,
+		users:    users,
+		dms:      dms,
+		rooms:    rooms,
+		messages: messages,
+		dedup:    dedup,
+		receipts: receipts,
+		unreads:  unreads,
+
+		attachments:   attachments,
+		notifications: notifications,
+		sessions:      sessions,
+
 		close: func(ctx context.Context) error {
 			return client.Disconnect(ctx)
 		},
 	}
 
+	if err = db.createIndexes(ctx); err != nil {
+		return nil, errors.New("create indexes: " + err.Error())
+	}
+
 	return db, nil
 }
 
+func (db *DB) createIndexes(ctx context.Context) error {
+	indexes := map[*mongo.Collection][]mongo.IndexModel{
+		db.users: {
+			{
+				// a mention names a single user, users without a username
+				// are left out
+				Keys: bson.D{{Key: "username", Value: 1}},
+				Options: options.Index().
+					SetName("username_unique").
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"username": bson.M{"$gt": ""}}),
+			},
+			{
+				// an identity belongs to a single user
+				Keys: bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+				Options: options.Index().
+					SetUnique(true).
+					SetPartialFilterExpression(bson.M{"identities.subject": bson.M{"$exists": true}}),
+			},
+			{Keys: bson.D{{Key: "identities.email", Value: 1}}},
+			{Keys: bson.D{{Key: "email", Value: 1}, {Key: "provider", Value: 1}}},
+		},
+		db.dms: {
+			{Keys: bson.D{{Key: "pair", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{Keys: bson.D{{Key: "members", Value: 1}, {Key: "last_message.created_at", Value: -1}}},
+		},
+		db.rooms: {
+			{Keys: bson.D{{Key: "members.user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		},
+		db.messages: {
+			{Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "seq", Value: 1}}, Options: options.Index().SetUnique(true)},
+			{
+				Keys:    bson.D{{Key: "parent_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}},
+				Options: options.Index().SetPartialFilterExpression(bson.M{"parent_id": bson.M{"$exists": true}}),
+			},
+			{
+				// changes replayed on resume
+				Keys:    bson.D{{Key: "room_id", Value: 1}, {Key: "edit_seq", Value: 1}},
+				Options: options.Index().SetPartialFilterExpression(bson.M{"edit_seq": bson.M{"$exists": true}}),
+			},
+			{Keys: bson.D{{Key: "body", Value: "text"}}},
+		},
+		db.dedup: {
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+		db.receipts: {
+			{Keys: bson.D{{Key: "room_id", Value: 1}}},
+		},
+		db.unreads: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "room_id", Value: 1}}},
+			{Keys: bson.D{{Key: "room_id", Value: 1}}},
+		},
+		db.notifications: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "read_at", Value: 1}, {Key: "created_at", Value: -1}}},
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "room_id", Value: 1}, {Key: "seq", Value: 1}}},
+			{Keys: bson.D{{Key: "message_id", Value: 1}}},
+		},
+		db.sessions: {
+			{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}}},
+			// revoked sessions are kept until they would have expired
+			{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+		},
+	}
+
+	// the plain username index is replaced by the unique one
+	err := db.users.Indexes().DropOne(ctx, "username_1")
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.HasErrorCode(indexNotFound) || cmdErr.HasErrorCode(namespaceNotFound))) {
+		return err
+	}
+
+	for coll, models := range indexes {
+		if _, err := coll.Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (db *DB) GetUser(ctx context.Context, userID string) (*domain.User, error) {
 	f := bson.M{"_id": userID}
 	user := &domain.User{}
@@ -69,36 +190,99 @@ func (db *DB) GetUser(ctx context.Context, userID string) (*domain.User, error)
 	return user, nil
 }
 
-func (db *DB) CreateUser(ctx context.Context, user *domain.User, provider string) (string, error) {
-	f := bson.M{
-		"email":    user.Email,
-		"provider": provider,
+// CreateUser stores a new user, it fails with ErrIdentityLinked when one of
+// the identities is owned by another user already.
+func (db *DB) CreateUser(ctx context.Context, user *domain.User) error {
+	_, err := db.users.InsertOne(ctx, user)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return domain.ErrIdentityLinked
+		}
+		log.Error("db.CreateUser", log.Err(err))
+		return domain.ErrDBQuery
 	}
 
+	return nil
+}
+
+// ListUsersByUsername returns the users holding any of the usernames.
+func (db *DB) ListUsersByUsername(ctx context.Context, usernames []string) ([]*domain.User, error) {
+	f := bson.M{"username": bson.M{"$in": usernames}}
+
+	cur, err := db.users.Find(ctx, f)
+	if err != nil {
+		log.Error("db.ListUsersByUsername", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	var users []*domain.User
+	if err = cur.All(ctx, &users); err != nil {
+		log.Error("db.ListUsersByUsername", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return users, nil
+}
+
+// SetAvatar replaces the avatar of the user with a custom one and returns
+// the id of the previous custom avatar.
+func (db *DB) SetAvatar(ctx context.Context, userID string, avatarID string, avatar string) (string, error) {
+	f := bson.M{"_id": userID}
 	update := bson.M{"$set": bson.M{
-		"name":   user.Name,
-		"avatar": user.Avatar,
+		"avatar_id": avatarID,
+		"avatar":    avatar,
 	}}
 
-	var res domain.User
+	var prev domain.User
 
-	opts := options.FindOneAndUpdate().SetUpsert(true)
-	err := db.users.FindOneAndUpdate(ctx, f, update, opts).Decode(&res)
+	err := db.users.FindOneAndUpdate(ctx, f, update).Decode(&prev)
 	if err != nil {
-		log.Error("db.CreateUser", log.Err(err))
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return "", domain.ErrDBUserNotFound
+		}
+		log.Error("db.SetAvatar", log.UserID(userID), log.Err(err))
 		return "", domain.ErrDBQuery
 	}
 
-	return res.ID, nil
+	return prev.AvatarID, nil
 }
 
-func (db *DB) SetUsername(ctx context.Context, userID, username string) error {
+// SetProfile refreshes the name and avatar of the user as reported by the
+// provider they logged in with, a custom avatar is not replaced.
+func (db *DB) SetProfile(ctx context.Context, userID string, name string, avatar string) (*domain.User, error) {
 	f := bson.M{"_id": userID}
-	update := bson.M{"$set": bson.M{"username": username}}
+	update := bson.A{bson.M{"$set": bson.M{
+		"name": bson.M{"$literal": name},
+		"avatar": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$avatar_id", nil}},
+			"$avatar",
+			bson.M{"$literal": avatar},
+		}},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	user := &domain.User{}
+
+	err := db.users.FindOneAndUpdate(ctx, f, update, opts).Decode(user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBUserNotFound
+		}
+		log.Error("db.SetProfile", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return user, nil
+}
+
+// SetLastSeen records when the user was last connected.
+func (db *DB) SetLastSeen(ctx context.Context, userID string, lastSeen time.Time) error {
+	f := bson.M{"_id": userID}
+	update := bson.M{"$max": bson.M{"last_seen": lastSeen}}
 
 	res, err := db.users.UpdateOne(ctx, f, update)
 	if err != nil {
-		log.Error("db.SetUsername", log.Err(err))
+		log.Error("db.SetLastSeen", log.UserID(userID), log.Err(err))
 		return domain.ErrDBQuery
 	}
 
@@ -109,6 +293,30 @@ func (db *DB) SetUsername(ctx context.Context, userID, username string) error {
 	return nil
 }
 
+// SetUsername sets the username of the user, it fails with
+// ErrUsernameTaken when another user holds it.
+func (db *DB) SetUsername(ctx context.Context, userID string, username string) (*domain.User, error) {
+	f := bson.M{"_id": userID}
+	update := bson.M{"$set": bson.M{"username": username}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	user := &domain.User{}
+
+	err := db.users.FindOneAndUpdate(ctx, f, update, opts).Decode(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, domain.ErrDBUserNotFound
+		case mongo.IsDuplicateKeyError(err):
+			return nil, domain.ErrUsernameTaken
+		}
+		log.Error("db.SetUsername", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return user, nil
+}
+
 func (db *DB) Close(ctx context.Context) {
 	if err := db.close(ctx); err != nil {
 		log.Error("db.Close", log.Err(err))
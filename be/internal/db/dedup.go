@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func dedupKey(roomID string, userID string, clientID string) string {
+	return roomID + ":" + userID + ":" + clientID
+}
+
+// ReserveClientID claims the user's client id in the room for messageID
+// until the window passes. If the client id is already claimed the claiming
+// message id is returned along with false.
+func (db *DB) ReserveClientID(ctx context.Context, roomID string, userID string, clientID string, messageID string, window time.Duration) (string, bool, error) {
+	key := dedupKey(roomID, userID, clientID)
+	now := time.Now().UTC()
+
+	doc := bson.M{
+		"_id":        key,
+		"message_id": messageID,
+		"expires_at": now.Add(window),
+	}
+
+	// the second attempt follows the removal of an expired claim
+	for range 2 {
+		_, err := db.dedup.InsertOne(ctx, doc)
+		if err == nil {
+			return messageID, true, nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Error("db.ReserveClientID", log.ChatID(roomID), log.Err(err))
+			return "", false, domain.ErrDBQuery
+		}
+
+		var res struct {
+			MessageID string `bson:"message_id"`
+		}
+
+		err = db.dedup.FindOne(ctx, bson.M{"_id": key, "expires_at": bson.M{"$gt": now}}).Decode(&res)
+		if err == nil {
+			return res.MessageID, false, nil
+		}
+
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Error("db.ReserveClientID", log.ChatID(roomID), log.Err(err))
+			return "", false, domain.ErrDBQuery
+		}
+
+		// the claim expired but the ttl monitor has not removed it yet
+		_, err = db.dedup.DeleteOne(ctx, bson.M{"_id": key, "expires_at": bson.M{"$lte": now}})
+		if err != nil {
+			log.Error("db.ReserveClientID", log.ChatID(roomID), log.Err(err))
+			return "", false, domain.ErrDBQuery
+		}
+	}
+
+	return "", false, domain.ErrDBQuery
+}
+
+// ReleaseClientID drops the claim of messageID so that a retry is accepted.
+func (db *DB) ReleaseClientID(ctx context.Context, roomID string, userID string, clientID string, messageID string) error {
+	f := bson.M{
+		"_id":        dedupKey(roomID, userID, clientID),
+		"message_id": messageID,
+	}
+
+	_, err := db.dedup.DeleteOne(ctx, f)
+	if err != nil {
+		log.Error("db.ReleaseClientID", log.ChatID(roomID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
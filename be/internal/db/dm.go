@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// OpenDM returns the dm between both users, creating it on first use.
+func (db *DB) OpenDM(ctx context.Context, userID string, peerID string) (*domain.DM, error) {
+	members := []string{userID, peerID}
+	if peerID < userID {
+		members = []string{peerID, userID}
+	}
+
+	f := bson.M{"pair": members[0] + ":" + members[1]}
+	update := bson.M{"$setOnInsert": bson.M{
+		"_id":        uuid.NewString(),
+		"members":    members,
+		"created_at": time.Now().UTC(),
+	}}
+
+	dm := &domain.DM{}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := db.dms.FindOneAndUpdate(ctx, f, update, opts).Decode(dm)
+	if err != nil {
+		log.Error("db.OpenDM", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return dm, nil
+}
+
+func (db *DB) GetDM(ctx context.Context, dmID string) (*domain.DM, error) {
+	f := bson.M{"_id": dmID}
+	dm := &domain.DM{}
+
+	err := db.dms.FindOne(ctx, f).Decode(dm)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBDMNotFound
+		}
+		log.Error("db.GetDM", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return dm, nil
+}
+
+// ListDMs returns the user's dms, most recently active first.
+func (db *DB) ListDMs(ctx context.Context, userID string) ([]*domain.DM, error) {
+	f := bson.M{"members": userID}
+	opts := options.Find().SetSort(bson.D{
+		{Key: "last_message.created_at", Value: -1},
+		{Key: "created_at", Value: -1},
+	})
+
+	cur, err := db.dms.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListDMs", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	dms := make([]*domain.DM, 0)
+	if err = cur.All(ctx, &dms); err != nil {
+		log.Error("db.ListDMs", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return dms, nil
+}
+
+// SetDMLastMessage records msg as the latest message of its dm, messages of
+// other rooms are ignored.
+func (db *DB) SetDMLastMessage(ctx context.Context, msg *domain.Message) error {
+	f := bson.M{
+		"_id": msg.RoomID,
+		"$or": bson.A{
+			bson.M{"last_message": bson.M{"$exists": false}},
+			bson.M{"last_message.created_at": bson.M{"$lte": msg.CreatedAt}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"last_message": msg}}
+
+	_, err := db.dms.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.SetDMLastMessage", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+// UpdateDMLastMessage refreshes the copy of msg kept as the latest message of
+// its dm after an edit or delete.
+func (db *DB) UpdateDMLastMessage(ctx context.Context, msg *domain.Message) error {
+	f := bson.M{
+		"_id":              msg.RoomID,
+		"last_message._id": msg.ID,
+	}
+	update := bson.M{"$set": bson.M{"last_message": msg}}
+
+	_, err := db.dms.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.UpdateDMLastMessage", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func identityFilter(provider string, subject string) bson.M {
+	return bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"provider": provider,
+		"subject":  subject,
+	}}}
+}
+
+// GetUserByIdentity returns the user owning the identity.
+func (db *DB) GetUserByIdentity(ctx context.Context, provider string, subject string) (*domain.User, error) {
+	user := &domain.User{}
+
+	err := db.users.FindOne(ctx, identityFilter(provider, subject)).Decode(user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBUserNotFound
+		}
+		log.Error("db.GetUserByIdentity", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return user, nil
+}
+
+// UpdateIdentity refreshes the email of the identity as last reported by the
+// provider.
+func (db *DB) UpdateIdentity(ctx context.Context, identity *domain.Identity) error {
+	update := bson.M{"$set": bson.M{
+		"identities.$.email":          identity.Email,
+		"identities.$.email_verified": identity.EmailVerified,
+	}}
+
+	res, err := db.users.UpdateOne(ctx, identityFilter(identity.Provider, identity.Subject), update)
+	if err != nil {
+		log.Error("db.UpdateIdentity", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	if res.MatchedCount == 0 {
+		return domain.ErrIdentityNotFound
+	}
+
+	return nil
+}
+
+// ClaimLegacyUser attaches the identity to the user created by the provider
+// for the email before users had identities, such a user is claimed once.
+func (db *DB) ClaimLegacyUser(ctx context.Context, email string, identity *domain.Identity) (*domain.User, error) {
+	f := bson.M{
+		"email":      email,
+		"provider":   identity.Provider,
+		"identities": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"identities": bson.A{identity}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	user := &domain.User{}
+
+	err := db.users.FindOneAndUpdate(ctx, f, update, opts).Decode(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return nil, domain.ErrDBUserNotFound
+		case mongo.IsDuplicateKeyError(err):
+			return nil, domain.ErrIdentityLinked
+		}
+		log.Error("db.ClaimLegacyUser", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return user, nil
+}
+
+// ListUsersByVerifiedEmail returns up to limit users owning an identity with
+// the email verified by its provider.
+func (db *DB) ListUsersByVerifiedEmail(ctx context.Context, email string, limit int) ([]*domain.User, error) {
+	f := bson.M{"identities": bson.M{"$elemMatch": bson.M{
+		"email":          email,
+		"email_verified": true,
+	}}}
+	opts := options.Find().SetLimit(int64(limit))
+
+	cur, err := db.users.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListUsersByVerifiedEmail", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	var users []*domain.User
+	if err = cur.All(ctx, &users); err != nil {
+		log.Error("db.ListUsersByVerifiedEmail", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return users, nil
+}
+
+// LinkIdentity adds the identity to the user and returns the user, linking
+// an identity the user owns already changes nothing.
+func (db *DB) LinkIdentity(ctx context.Context, userID string, identity *domain.Identity) (*domain.User, error) {
+	f := bson.M{
+		"_id": userID,
+		"identities": bson.M{"$not": bson.M{"$elemMatch": bson.M{
+			"provider": identity.Provider,
+			"subject":  identity.Subject,
+		}}},
+	}
+	update := bson.M{"$push": bson.M{"identities": identity}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	user := &domain.User{}
+
+	err := db.users.FindOneAndUpdate(ctx, f, update, opts).Decode(user)
+	if err == nil {
+		return user, nil
+	}
+
+	switch {
+	case mongo.IsDuplicateKeyError(err):
+		return nil, domain.ErrIdentityLinked
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		log.Error("db.LinkIdentity", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	// either the user is gone or owns the identity already
+	return db.GetUser(ctx, userID)
+}
+
+// UnlinkIdentity removes the identity from the user, the last identity is
+// kept so the user can still log in.
+func (db *DB) UnlinkIdentity(ctx context.Context, userID string, provider string, subject string) (*domain.User, error) {
+	f := identityFilter(provider, subject)
+	f["_id"] = userID
+	f["identities.1"] = bson.M{"$exists": true}
+	update := bson.M{"$pull": bson.M{"identities": bson.M{
+		"provider": provider,
+		"subject":  subject,
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	user := &domain.User{}
+
+	err := db.users.FindOneAndUpdate(ctx, f, update, opts).Decode(user)
+	if err == nil {
+		return user, nil
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		log.Error("db.UnlinkIdentity", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	user, err = db.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, identity := range user.Identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return nil, domain.ErrIdentityLast
+		}
+	}
+
+	return nil, domain.ErrIdentityNotFound
+}
@@ -0,0 +1,353 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const seqRetries = 16
+
+// listProjection leaves the edit history out of message listings.
+var listProjection = bson.M{"revisions": 0}
+
+func (db *DB) GetMessage(ctx context.Context, messageID string) (*domain.Message, error) {
+	f := bson.M{"_id": messageID}
+	msg := &domain.Message{}
+
+	err := db.messages.FindOne(ctx, f).Decode(msg)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBMessageNotFound
+		}
+		log.Error("db.GetMessage", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return msg, nil
+}
+
+// CreateMessage stores the message and assigns its seq. The seq is the room's
+// latest seq plus one and the unique (room_id, seq) index rejects concurrent
+// writers, who retry with a fresh seq. Unlike a separate counter no seq is
+// ever burned by a failed insert and seq N+1 exists only once N is stored, so
+// the sequence of stored messages has no gaps.
+func (db *DB) CreateMessage(ctx context.Context, msg *domain.Message) error {
+	for range seqRetries {
+		seq, err := db.LastSeq(ctx, msg.RoomID)
+		if err != nil {
+			return err
+		}
+
+		msg.Seq = seq + 1
+
+		_, err = db.messages.InsertOne(ctx, msg)
+		if err == nil {
+			return nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Error("db.CreateMessage", log.ChatID(msg.RoomID), log.Err(err))
+			return domain.ErrDBQuery
+		}
+	}
+
+	log.Error("db.CreateMessage: seq contention", log.ChatID(msg.RoomID))
+	return domain.ErrDBQuery
+}
+
+// EditMessage replaces the body of a message that is not deleted and keeps
+// the previous body as a revision.
+func (db *DB) EditMessage(ctx context.Context, messageID string, body string, editedAt time.Time, editSeq int64) (*domain.Message, error) {
+	f := bson.M{
+		"_id":        messageID,
+		"deleted_at": bson.M{"$exists": false},
+	}
+
+	msg := &domain.Message{}
+
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(listProjection)
+	err := db.messages.FindOneAndUpdate(ctx, f, editUpdate(body, editedAt, editSeq), opts).Decode(msg)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBMessageNotFound
+		}
+		log.Error("db.EditMessage", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return msg, nil
+}
+
+// editUpdate is a pipeline update, it reads the current body before
+// replacing it.
+func editUpdate(body string, editedAt time.Time, editSeq int64) bson.A {
+	return bson.A{
+		bson.M{"$set": bson.M{
+			"revisions": bson.M{"$concatArrays": bson.A{
+				bson.M{"$ifNull": bson.A{"$revisions", bson.A{}}},
+				bson.A{bson.M{
+					"body":       "$body",
+					"created_at": bson.M{"$ifNull": bson.A{"$edited_at", "$created_at"}},
+				}},
+			}},
+			"body":      bson.M{"$literal": body},
+			"edited_at": editedAt,
+			"edit_seq":  editSeq,
+		}},
+	}
+}
+
+// DeleteMessage turns the message into a tombstone, its body, history,
+// reactions, attachments and mentions are dropped while its place in the
+// sequence stays.
+func (db *DB) DeleteMessage(ctx context.Context, messageID string, deletedBy string, deletedAt time.Time, editSeq int64) (*domain.Message, error) {
+	f := bson.M{
+		"_id":        messageID,
+		"deleted_at": bson.M{"$exists": false},
+	}
+
+	msg := &domain.Message{}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := db.messages.FindOneAndUpdate(ctx, f, deleteUpdate(deletedBy, deletedAt, editSeq), opts).Decode(msg)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBMessageNotFound
+		}
+		log.Error("db.DeleteMessage", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return msg, nil
+}
+
+func deleteUpdate(deletedBy string, deletedAt time.Time, editSeq int64) bson.M {
+	return bson.M{
+		"$set": bson.M{
+			"body":       "",
+			"deleted_at": deletedAt,
+			"deleted_by": deletedBy,
+			"edit_seq":   editSeq,
+		},
+		"$unset": bson.M{
+			"revisions":      "",
+			"reactions":      "",
+			"attachment_ids": "",
+			"mention_ids":    "",
+		},
+	}
+}
+
+// LastSeq returns the seq of the room's latest message, 0 for an empty room.
+func (db *DB) LastSeq(ctx context.Context, roomID string) (int64, error) {
+	f := bson.M{"room_id": roomID}
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "seq", Value: -1}}).
+		SetProjection(bson.M{"seq": 1})
+
+	var res struct {
+		Seq int64 `bson:"seq"`
+	}
+
+	err := db.messages.FindOne(ctx, f, opts).Decode(&res)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		log.Error("db.LastSeq", log.ChatID(roomID), log.Err(err))
+		return 0, domain.ErrDBQuery
+	}
+
+	return res.Seq, nil
+}
+
+// ListMessageAuthors returns the distinct authors of the messages of the
+// room with a seq in (from, to].
+func (db *DB) ListMessageAuthors(ctx context.Context, roomID string, from int64, to int64) ([]string, error) {
+	f := bson.M{"room_id": roomID, "seq": bson.M{"$gt": from, "$lte": to}}
+
+	authors := make([]string, 0)
+	if err := db.messages.Distinct(ctx, "user_id", f).Decode(&authors); err != nil {
+		log.Error("db.ListMessageAuthors", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return authors, nil
+}
+
+// ListMessagesAfter returns up to limit messages of the room with a seq
+// greater than seq, oldest first.
+func (db *DB) ListMessagesAfter(ctx context.Context, roomID string, seq int64, limit int) ([]*domain.Message, error) {
+	f := bson.M{
+		"room_id": roomID,
+		"seq":     bson.M{"$gt": seq},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "seq", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(listProjection)
+
+	cur, err := db.messages.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListMessagesAfter", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	messages := make([]*domain.Message, 0, limit)
+	if err = cur.All(ctx, &messages); err != nil {
+		log.Error("db.ListMessagesAfter", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return messages, nil
+}
+
+// ListMessageChanges returns up to limit messages of the room with a seq in
+// (after, seq] that were edited or deleted since the last seq of the room was
+// seq, ordered by seq. Changes made while the last seq was seq are included
+// as the client may not have seen them.
+func (db *DB) ListMessageChanges(ctx context.Context, roomID string, seq int64, after int64, limit int) ([]*domain.Message, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "seq", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(listProjection)
+
+	cur, err := db.messages.Find(ctx, changesFilter(roomID, seq, after), opts)
+	if err != nil {
+		log.Error("db.ListMessageChanges", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	messages := make([]*domain.Message, 0, limit)
+	if err = cur.All(ctx, &messages); err != nil {
+		log.Error("db.ListMessageChanges", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return messages, nil
+}
+
+func changesFilter(roomID string, seq int64, after int64) bson.M {
+	return bson.M{
+		"room_id":  roomID,
+		"edit_seq": bson.M{"$gte": seq},
+		"seq":      bson.M{"$gt": after, "$lte": seq},
+	}
+}
+
+// ListMessages returns up to limit messages of the room older than the
+// cursor before, newest first. An empty cursor starts from the latest message.
+// Thread replies are left out.
+func (db *DB) ListMessages(ctx context.Context, roomID string, before string, limit int) (*domain.MessagePage, error) {
+	f := bson.M{
+		"room_id":   roomID,
+		"parent_id": bson.M{"$exists": false},
+	}
+
+	page, err := db.listPage(ctx, f, before, limit)
+	if err != nil && !errors.Is(err, domain.ErrCursorInvalid) {
+		log.Error("db.ListMessages", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return page, err
+}
+
+// ListReplies pages through the replies of the thread like ListMessages.
+func (db *DB) ListReplies(ctx context.Context, parentID string, before string, limit int) (*domain.MessagePage, error) {
+	f := bson.M{"parent_id": parentID}
+
+	page, err := db.listPage(ctx, f, before, limit)
+	if err != nil && !errors.Is(err, domain.ErrCursorInvalid) {
+		log.Error("db.ListReplies", log.String("parent_id", parentID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return page, err
+}
+
+// AddReply counts a new reply of the thread started by the parent message.
+func (db *DB) AddReply(ctx context.Context, parentID string, repliedAt time.Time) error {
+	f := bson.M{"_id": parentID}
+	update := bson.M{
+		"$inc": bson.M{"reply_count": 1},
+		"$max": bson.M{"last_reply_at": repliedAt},
+	}
+
+	_, err := db.messages.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.AddReply", log.String("parent_id", parentID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+// listPage returns up to limit messages matching f older than the cursor
+// before, newest first.
+func (db *DB) listPage(ctx context.Context, f bson.M, before string, limit int) (*domain.MessagePage, error) {
+	if err := beforeCursor(f, before); err != nil {
+		return nil, err
+	}
+
+	// fetch one extra message to know whether there is a next page
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit + 1)).
+		SetProjection(listProjection)
+
+	cur, err := db.messages.Find(ctx, f, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*domain.Message, 0, limit+1)
+	if err = cur.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return newPage(messages, limit), nil
+}
+
+// newPage cuts the messages fetched with one extra down to limit, the extra
+// one tells that a next page exists.
+func newPage(messages []*domain.Message, limit int) *domain.MessagePage {
+	page := &domain.MessagePage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		last := messages[limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	return page
+}
+
+// ListMessagesByID returns the messages with the ids in no particular order,
+// missing ones are left out.
+func (db *DB) ListMessagesByID(ctx context.Context, messageIDs []string) ([]*domain.Message, error) {
+	f := bson.M{"_id": bson.M{"$in": messageIDs}}
+	opts := options.Find().SetProjection(listProjection)
+
+	cur, err := db.messages.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListMessagesByID", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	messages := make([]*domain.Message, 0, len(messageIDs))
+	if err = cur.All(ctx, &messages); err != nil {
+		log.Error("db.ListMessagesByID", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return messages, nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestEditUpdate(t *testing.T) {
+	t.Parallel()
+
+	editedAt := time.Now().UTC()
+
+	set := editUpdate("$body", editedAt, 42)[0].(bson.M)["$set"].(bson.M)
+
+	// a body starting with $ is not taken for a field path
+	require.Equal(t, bson.M{"$literal": "$body"}, set["body"])
+	require.Equal(t, editedAt, set["edited_at"])
+	require.Equal(t, int64(42), set["edit_seq"])
+
+	// the current body is kept as the latest revision
+	revisions := set["revisions"].(bson.M)["$concatArrays"].(bson.A)
+	require.Equal(t, bson.A{bson.M{
+		"body":       "$body",
+		"created_at": bson.M{"$ifNull": bson.A{"$edited_at", "$created_at"}},
+	}}, revisions[1])
+}
+
+func TestChangesFilter(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, bson.M{
+		"room_id":  "room",
+		"edit_seq": bson.M{"$gte": int64(41)},
+		"seq":      bson.M{"$gt": int64(7), "$lte": int64(41)},
+	}, changesFilter("room", 41, 7))
+}
+
+func TestNewPage(t *testing.T) {
+	t.Parallel()
+
+	createdAt := time.Date(2025, 5, 30, 12, 0, 0, 0, time.UTC)
+
+	messages := make([]*domain.Message, 4)
+	for i := range messages {
+		messages[i] = &domain.Message{ID: fmt.Sprint(i), CreatedAt: createdAt.Add(-time.Duration(i) * time.Minute)}
+	}
+
+	tests := []struct {
+		name         string
+		fetched      int
+		limit        int
+		expectLen    int
+		expectCursor string
+	}{
+		{
+			name:      "empty",
+			fetched:   0,
+			limit:     3,
+			expectLen: 0,
+		},
+		{
+			name:      "last_page",
+			fetched:   3,
+			limit:     3,
+			expectLen: 3,
+		},
+		{
+			name:         "next_page",
+			fetched:      4,
+			limit:        3,
+			expectLen:    3,
+			expectCursor: encodeCursor(messages[2].CreatedAt, messages[2].ID),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			page := newPage(messages[:tt.fetched], tt.limit)
+			require.Len(t, page.Messages, tt.expectLen)
+			require.Equal(t, tt.expectCursor, page.NextCursor)
+		})
+	}
+}
+
+func TestDeleteUpdate(t *testing.T) {
+	t.Parallel()
+
+	deletedAt := time.Now().UTC()
+
+	require.Equal(t, bson.M{
+		"$set": bson.M{
+			"body":       "",
+			"deleted_at": deletedAt,
+			"deleted_by": "alice",
+			"edit_seq":   int64(42),
+		},
+		// nothing the message referenced is kept
+		"$unset": bson.M{
+			"revisions":      "",
+			"reactions":      "",
+			"attachment_ids": "",
+			"mention_ids":    "",
+		},
+	}, deleteUpdate("alice", deletedAt, 42))
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func (db *DB) CreateNotifications(ctx context.Context, notifications []*domain.Notification) error {
+	_, err := db.notifications.InsertMany(ctx, notifications, options.InsertMany().SetOrdered(false))
+	if err != nil {
+		log.Error("db.CreateNotifications", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+// ListNotifications returns up to limit notifications of the user older than
+// the cursor before, newest first.
+func (db *DB) ListNotifications(ctx context.Context, userID string, unreadOnly bool, before string, limit int) (*domain.NotificationPage, error) {
+	f := bson.M{"user_id": userID}
+	if unreadOnly {
+		f["read_at"] = nil
+	}
+
+	if err := beforeCursor(f, before); err != nil {
+		return nil, err
+	}
+
+	// fetch one extra notification to know whether there is a next page
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(limit + 1))
+
+	cur, err := db.notifications.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListNotifications", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	notifications := make([]*domain.Notification, 0, limit+1)
+	if err = cur.All(ctx, &notifications); err != nil {
+		log.Error("db.ListNotifications", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	page := &domain.NotificationPage{Notifications: notifications}
+	if len(notifications) > limit {
+		page.Notifications = notifications[:limit]
+		last := notifications[limit-1]
+		page.NextCursor = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	page.UnreadCount, err = db.notifications.CountDocuments(ctx, bson.M{"user_id": userID, "read_at": nil})
+	if err != nil {
+		log.Error("db.ListNotifications", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return page, nil
+}
+
+// MarkNotificationsRead marks the unread notifications of the user with the
+// ids read, or all of them when ids is empty. It returns how many changed.
+func (db *DB) MarkNotificationsRead(ctx context.Context, userID string, ids []string, readAt time.Time) (int64, error) {
+	f := bson.M{"user_id": userID, "read_at": nil}
+	if len(ids) > 0 {
+		f["_id"] = bson.M{"$in": ids}
+	}
+
+	update := bson.M{"$set": bson.M{"read_at": readAt}}
+
+	res, err := db.notifications.UpdateMany(ctx, f, update)
+	if err != nil {
+		log.Error("db.MarkNotificationsRead", log.UserID(userID), log.Err(err))
+		return 0, domain.ErrDBQuery
+	}
+
+	return res.ModifiedCount, nil
+}
+
+// SetNotificationSnippet replaces the snippet of the notifications of the
+// message, keeping them in line with its edits.
+func (db *DB) SetNotificationSnippet(ctx context.Context, messageID string, snippet string) error {
+	f := bson.M{"message_id": messageID}
+	update := bson.M{"$set": bson.M{"snippet": snippet}}
+
+	if _, err := db.notifications.UpdateMany(ctx, f, update); err != nil {
+		log.Error("db.SetNotificationSnippet", log.String("message_id", messageID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// PinMessage pins the message to the top of the room's pins, it reports
+// false when the message is already pinned.
+func (db *DB) PinMessage(ctx context.Context, roomID string, pin domain.Pin) (bool, error) {
+	res, err := db.rooms.UpdateOne(ctx, pinFilter(roomID, pin.MessageID), pinUpdate(pin))
+	if err != nil {
+		log.Error("db.PinMessage", log.Err(err))
+		return false, domain.ErrDBQuery
+	}
+
+	if res.MatchedCount > 0 {
+		return true, nil
+	}
+
+	room, err := db.GetRoom(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+
+	if room.Pin(pin.MessageID) != nil {
+		return false, nil
+	}
+
+	return false, domain.ErrPinLimit
+}
+
+// pinFilter matches the room while the message is not pinned and it has
+// room for another pin.
+func pinFilter(roomID string, messageID string) bson.M {
+	return bson.M{
+		"_id":             roomID,
+		"pins.message_id": bson.M{"$ne": messageID},
+		// the array is shorter than the maximum
+		"pins." + strconv.Itoa(domain.RoomMaxPins-1): bson.M{"$exists": false},
+	}
+}
+
+// pinUpdate puts the pin first, keeping the pins newest first.
+func pinUpdate(pin domain.Pin) bson.M {
+	return bson.M{"$push": bson.M{"pins": bson.M{
+		"$each":     bson.A{pin},
+		"$position": 0,
+	}}}
+}
+
+// UnpinMessage removes the message from the room's pins, it reports false
+// when the message was not pinned.
+func (db *DB) UnpinMessage(ctx context.Context, roomID string, messageID string) (bool, error) {
+	f := bson.M{"_id": roomID}
+	update := bson.M{"$pull": bson.M{"pins": bson.M{"message_id": messageID}}}
+
+	res, err := db.rooms.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.UnpinMessage", log.Err(err))
+		return false, domain.ErrDBQuery
+	}
+
+	if res.MatchedCount == 0 {
+		return false, domain.ErrDBRoomNotFound
+	}
+
+	return res.ModifiedCount > 0, nil
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestPinFilter(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, bson.M{
+		"_id":             "room",
+		"pins.message_id": bson.M{"$ne": "message"},
+		// a 50th pin is not there yet
+		"pins.49": bson.M{"$exists": false},
+	}, pinFilter("room", "message"))
+}
+
+func TestPinUpdate(t *testing.T) {
+	t.Parallel()
+
+	pin := domain.Pin{MessageID: "message", PinnedBy: "alice", PinnedAt: time.Now().UTC()}
+
+	require.Equal(t, bson.M{"$push": bson.M{"pins": bson.M{
+		"$each":     bson.A{pin},
+		"$position": 0,
+	}}}, pinUpdate(pin))
+}
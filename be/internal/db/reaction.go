@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// reactionProjection loads what is needed to announce a reaction change.
+var reactionProjection = bson.M{"room_id": 1, "seq": 1, "reactions": 1}
+
+// AddReaction adds the user to the reaction with the emoji, creating the
+// reaction unless the message already has the maximum of distinct ones.
+func (db *DB) AddReaction(ctx context.Context, messageID string, emoji string, userID string) (*domain.Message, error) {
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(reactionProjection)
+
+	// the reaction may be created concurrently between the two updates, the
+	// second round then joins it
+	for range 2 {
+		msg := &domain.Message{}
+
+		f := bson.M{
+			"_id":             messageID,
+			"deleted_at":      bson.M{"$exists": false},
+			"reactions.emoji": emoji,
+		}
+		update := bson.M{"$addToSet": bson.M{"reactions.$.user_ids": userID}}
+
+		err := db.messages.FindOneAndUpdate(ctx, f, update, opts).Decode(msg)
+		if err == nil {
+			return msg, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Error("db.AddReaction", log.Err(err))
+			return nil, domain.ErrDBQuery
+		}
+
+		update = bson.M{"$push": bson.M{"reactions": domain.Reaction{Emoji: emoji, UserIDs: []string{userID}}}}
+
+		err = db.messages.FindOneAndUpdate(ctx, newReactionFilter(messageID, emoji), update, opts).Decode(msg)
+		if err == nil {
+			return msg, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Error("db.AddReaction", log.Err(err))
+			return nil, domain.ErrDBQuery
+		}
+
+		msg, err = db.GetMessage(ctx, messageID)
+		switch {
+		case err != nil:
+			return nil, err
+		case msg.DeletedAt != nil:
+			return nil, domain.ErrMessageDeleted
+		case msg.Reaction(emoji) == nil:
+			return nil, domain.ErrReactionLimit
+		}
+	}
+
+	log.Error("db.AddReaction: reaction contention", log.String("message_id", messageID))
+	return nil, domain.ErrDBQuery
+}
+
+// newReactionFilter matches the message while the emoji is new to it and it
+// has room for another reaction.
+func newReactionFilter(messageID string, emoji string) bson.M {
+	return bson.M{
+		"_id":             messageID,
+		"deleted_at":      bson.M{"$exists": false},
+		"reactions.emoji": bson.M{"$ne": emoji},
+		// the array is shorter than the maximum
+		"reactions." + strconv.Itoa(domain.MessageMaxReactions-1): bson.M{"$exists": false},
+	}
+}
+
+// RemoveReaction removes the user from the reaction with the emoji, the
+// reaction is dropped once nobody is left.
+func (db *DB) RemoveReaction(ctx context.Context, messageID string, emoji string, userID string) (*domain.Message, error) {
+	f := bson.M{
+		"_id":             messageID,
+		"reactions.emoji": emoji,
+	}
+	update := bson.M{"$pull": bson.M{"reactions.$.user_ids": userID}}
+
+	msg := &domain.Message{}
+
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(reactionProjection)
+	err := db.messages.FindOneAndUpdate(ctx, f, update, opts).Decode(msg)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// nobody reacted with the emoji
+			return db.GetMessage(ctx, messageID)
+		}
+		log.Error("db.RemoveReaction", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	if r := msg.Reaction(emoji); r != nil && len(r.UserIDs) == 0 {
+		f = bson.M{"_id": messageID}
+		update = bson.M{"$pull": bson.M{"reactions": bson.M{"emoji": emoji, "user_ids": bson.M{"$size": 0}}}}
+
+		if _, err = db.messages.UpdateOne(ctx, f, update); err != nil {
+			log.Error("db.RemoveReaction", log.Err(err))
+			return nil, domain.ErrDBQuery
+		}
+
+		msg.Reactions = slices.DeleteFunc(msg.Reactions, func(r domain.Reaction) bool { return r.Emoji == emoji })
+	}
+
+	return msg, nil
+}
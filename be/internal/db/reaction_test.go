@@ -0,0 +1,20 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestNewReactionFilter(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, bson.M{
+		"_id":             "message",
+		"deleted_at":      bson.M{"$exists": false},
+		"reactions.emoji": bson.M{"$ne": "👍"},
+		// a 20th reaction is not there yet
+		"reactions.19": bson.M{"$exists": false},
+	}, newReactionFilter("message", "👍"))
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// AdvanceReceipt moves the member's watermarks forward, they never go back.
+// It returns the receipt before and after the move, nils when neither
+// watermark moved.
+func (db *DB) AdvanceReceipt(ctx context.Context, roomID string, userID string, deliveredSeq int64, readSeq int64) (*domain.Receipt, *domain.Receipt, error) {
+	// reading a message implies it was delivered
+	deliveredSeq = max(deliveredSeq, readSeq)
+	now := time.Now().UTC()
+
+	f := bson.M{
+		"_id": roomID + ":" + userID,
+		"$or": bson.A{
+			bson.M{"delivered_seq": bson.M{"$lt": deliveredSeq}},
+			bson.M{"read_seq": bson.M{"$lt": readSeq}},
+		},
+	}
+	update := bson.M{
+		"$max": bson.M{
+			"delivered_seq": deliveredSeq,
+			"read_seq":      readSeq,
+		},
+		"$set": bson.M{"updated_at": now},
+		"$setOnInsert": bson.M{
+			"room_id": roomID,
+			"user_id": userID,
+		},
+	}
+
+	prev := &domain.Receipt{}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+	err := db.receipts.FindOneAndUpdate(ctx, f, update, opts).Decode(prev)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		// the receipt was created
+		prev = &domain.Receipt{RoomID: roomID, UserID: userID}
+	case mongo.IsDuplicateKeyError(err):
+		// the receipt exists but is already ahead, so the upsert collides on _id
+		return nil, nil, nil
+	case err != nil:
+		log.Error("db.AdvanceReceipt", log.ChatID(roomID), log.Err(err))
+		return nil, nil, domain.ErrDBQuery
+	}
+
+	next := &domain.Receipt{
+		RoomID:       roomID,
+		UserID:       userID,
+		DeliveredSeq: max(prev.DeliveredSeq, deliveredSeq),
+		ReadSeq:      max(prev.ReadSeq, readSeq),
+		UpdatedAt:    now,
+	}
+
+	return prev, next, nil
+}
+
+func (db *DB) ListReceipts(ctx context.Context, roomID string) ([]*domain.Receipt, error) {
+	f := bson.M{"room_id": roomID}
+
+	cur, err := db.receipts.Find(ctx, f)
+	if err != nil {
+		log.Error("db.ListReceipts", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	receipts := make([]*domain.Receipt, 0)
+	if err = cur.All(ctx, &receipts); err != nil {
+		log.Error("db.ListReceipts", log.ChatID(roomID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return receipts, nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func (db *DB) CreateRoom(ctx context.Context, room *domain.Room) error {
+	_, err := db.rooms.InsertOne(ctx, room)
+	if err != nil {
+		log.Error("db.CreateRoom", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+func (db *DB) GetRoom(ctx context.Context, roomID string) (*domain.Room, error) {
+	f := bson.M{"_id": roomID}
+	room := &domain.Room{}
+
+	err := db.rooms.FindOne(ctx, f).Decode(room)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBRoomNotFound
+		}
+		log.Error("db.GetRoom", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return room, nil
+}
+
+// ListRooms returns the rooms the user is a member of, newest first.
+func (db *DB) ListRooms(ctx context.Context, userID string) ([]*domain.Room, error) {
+	f := bson.M{"members.user_id": userID}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	cur, err := db.rooms.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListRooms", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	rooms := make([]*domain.Room, 0)
+	if err = cur.All(ctx, &rooms); err != nil {
+		log.Error("db.ListRooms", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return rooms, nil
+}
+
+func (db *DB) AddRoomInvite(ctx context.Context, roomID string, userID string) error {
+	f := bson.M{"_id": roomID}
+	update := bson.M{"$addToSet": bson.M{"invites": userID}}
+
+	res, err := db.rooms.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.AddRoomInvite", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	if res.MatchedCount == 0 {
+		return domain.ErrDBRoomNotFound
+	}
+
+	return nil
+}
+
+// AddRoomMember adds the member and consumes their invite if any.
+func (db *DB) AddRoomMember(ctx context.Context, roomID string, member domain.RoomMember) error {
+	f := bson.M{
+		"_id":             roomID,
+		"members.user_id": bson.M{"$ne": member.UserID},
+	}
+	update := bson.M{
+		"$push": bson.M{"members": member},
+		"$pull": bson.M{"invites": member.UserID},
+	}
+
+	res, err := db.rooms.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.AddRoomMember", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	if res.MatchedCount == 0 {
+		return domain.ErrRoomAlreadyMember
+	}
+
+	return nil
+}
+
+func (db *DB) RemoveRoomMember(ctx context.Context, roomID string, userID string) error {
+	f := bson.M{"_id": roomID}
+	update := bson.M{"$pull": bson.M{"members": bson.M{"user_id": userID}}}
+
+	res, err := db.rooms.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.RemoveRoomMember", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	if res.ModifiedCount == 0 {
+		return domain.ErrRoomNotMember
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// SearchMessages matches the bodies through the text index, search.Query
+// uses the mongo text search syntax. The best matches come first.
+func (db *DB) SearchMessages(ctx context.Context, search *domain.MessageSearch) ([]*domain.Message, error) {
+	f := bson.M{
+		"$text":      bson.M{"$search": search.Query},
+		"room_id":    bson.M{"$in": search.RoomIDs},
+		"deleted_at": bson.M{"$exists": false},
+	}
+
+	if search.UserID != "" {
+		f["user_id"] = search.UserID
+	}
+
+	createdAt := bson.M{}
+	if !search.After.IsZero() {
+		createdAt["$gt"] = search.After
+	}
+	if !search.Before.IsZero() {
+		createdAt["$lt"] = search.Before
+	}
+	if len(createdAt) > 0 {
+		f["created_at"] = createdAt
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"revisions": 0, "score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}}).
+		SetLimit(int64(search.Limit))
+
+	cur, err := db.messages.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.SearchMessages", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	messages := make([]*domain.Message, 0, search.Limit)
+	if err = cur.All(ctx, &messages); err != nil {
+		log.Error("db.SearchMessages", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return messages, nil
+}
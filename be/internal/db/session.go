@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func (db *DB) CreateSession(ctx context.Context, session *domain.Session) error {
+	_, err := db.sessions.InsertOne(ctx, session)
+	if err != nil {
+		log.Error("db.CreateSession", log.UserID(session.UserID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+func (db *DB) GetSession(ctx context.Context, sessionID string) (*domain.Session, error) {
+	f := bson.M{"_id": sessionID}
+	session := &domain.Session{}
+
+	err := db.sessions.FindOne(ctx, f).Decode(session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, domain.ErrDBSessionNotFound
+		}
+		log.Error("db.GetSession", log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return session, nil
+}
+
+// RotateSession replaces the refresh token id of the active session, it fails
+// with ErrDBSessionNotFound once refreshID was rotated or the session revoked.
+func (db *DB) RotateSession(ctx context.Context, sessionID string, refreshID string, nextID string, rotatedAt time.Time) error {
+	f := bson.M{
+		"_id":        sessionID,
+		"refresh_id": refreshID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{
+		"refresh_id":      nextID,
+		"prev_refresh_id": refreshID,
+		"rotated_at":      rotatedAt,
+	}}
+
+	res, err := db.sessions.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.RotateSession", log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	if res.MatchedCount == 0 {
+		return domain.ErrDBSessionNotFound
+	}
+
+	return nil
+}
+
+// ListSessions returns the active sessions of the user, newest first.
+func (db *DB) ListSessions(ctx context.Context, userID string, now time.Time) ([]*domain.Session, error) {
+	f := bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+
+	cur, err := db.sessions.Find(ctx, f, opts)
+	if err != nil {
+		log.Error("db.ListSessions", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	sessions := make([]*domain.Session, 0)
+	if err = cur.All(ctx, &sessions); err != nil {
+		log.Error("db.ListSessions", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession revokes the session of the user, revoking it again fails
+// with ErrDBSessionNotFound.
+func (db *DB) RevokeSession(ctx context.Context, userID string, sessionID string, revokedAt time.Time) error {
+	f := bson.M{
+		"_id":        sessionID,
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"revoked_at": revokedAt}}
+
+	res, err := db.sessions.UpdateOne(ctx, f, update)
+	if err != nil {
+		log.Error("db.RevokeSession", log.UserID(userID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	if res.MatchedCount == 0 {
+		return domain.ErrDBSessionNotFound
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes every session of the user but keepID and
+// returns the ids of the revoked ones.
+func (db *DB) RevokeUserSessions(ctx context.Context, userID string, keepID string, revokedAt time.Time) ([]string, error) {
+	f := bson.M{
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+	if keepID != "" {
+		f["_id"] = bson.M{"$ne": keepID}
+	}
+
+	ids, err := db.revokeSessions(ctx, f, revokedAt)
+	if err != nil {
+		log.Error("db.RevokeUserSessions", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return ids, nil
+}
+
+// RevokeIdentitySessions revokes the sessions of the user logged in with the
+// identity and returns their ids.
+func (db *DB) RevokeIdentitySessions(ctx context.Context, userID string, provider string, subject string, revokedAt time.Time) ([]string, error) {
+	f := bson.M{
+		"user_id":    userID,
+		"provider":   provider,
+		"subject":    subject,
+		"revoked_at": bson.M{"$exists": false},
+	}
+
+	ids, err := db.revokeSessions(ctx, f, revokedAt)
+	if err != nil {
+		log.Error("db.RevokeIdentitySessions", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return ids, nil
+}
+
+// revokeSessions revokes the sessions matching f and returns their ids, the
+// ids are read first as an update does not report what it changed.
+func (db *DB) revokeSessions(ctx context.Context, f bson.M, revokedAt time.Time) ([]string, error) {
+	cur, err := db.sessions.Find(ctx, f, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []struct {
+		ID string `bson:"_id"`
+	}
+	if err = cur.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+
+	if len(ids) == 0 {
+		return ids, nil
+	}
+
+	f = bson.M{
+		"_id":        bson.M{"$in": ids},
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"revoked_at": revokedAt}}
+
+	if _, err = db.sessions.UpdateMany(ctx, f, update); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,201 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// CountUnread counts the message as unread for the members other than its
+// sender who have not read past it yet. The counters keep the seqs of the
+// messages they count rather than numbers, counting a message twice or
+// racing a read or a deletion cannot make them drift.
+func (db *DB) CountUnread(ctx context.Context, msg *domain.Message, memberIDs []string) error {
+	var models []mongo.WriteModel
+	for _, userID := range memberIDs {
+		if userID == msg.UserID {
+			continue
+		}
+
+		update, ok := countUnreadUpdate(msg, userID)
+		if !ok {
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(countUnreadFilter(msg, userID)).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := db.unreads.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil && !duplicateKeysOnly(err) {
+		log.Error("db.CountUnread", log.ChatID(msg.RoomID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+// countUnreadFilter matches the counters of the member that do not count the
+// message yet. A counter the member has read past does not match, the upsert
+// then fails on its id and is skipped.
+func countUnreadFilter(msg *domain.Message, userID string) bson.M {
+	return bson.M{
+		"_id":          unreadID(msg.RoomID, userID),
+		"read_seq":     bson.M{"$lt": msg.Seq},
+		"unread_seqs":  bson.M{"$ne": msg.Seq},
+		"mention_seqs": bson.M{"$ne": msg.Seq},
+	}
+}
+
+// countUnreadUpdate adds the message to the counters of the member, it
+// reports false when the message does not count for them.
+func countUnreadUpdate(msg *domain.Message, userID string) (bson.M, bool) {
+	seq := bson.M{"$each": bson.A{msg.Seq}, "$sort": 1, "$slice": -domain.UnreadMaxCount}
+
+	push := bson.M{}
+	if msg.ParentID == "" {
+		push["unread_seqs"] = seq
+	}
+	if msg.MentionsRoom || slices.Contains(msg.MentionIDs, userID) {
+		push["mention_seqs"] = seq
+	}
+	if len(push) == 0 {
+		return nil, false
+	}
+
+	return bson.M{
+		"$push": push,
+		"$max":  bson.M{"last_seq": msg.Seq},
+		"$setOnInsert": bson.M{
+			"room_id":  msg.RoomID,
+			"user_id":  userID,
+			"read_seq": int64(0),
+		},
+	}, true
+}
+
+// ReadUnread moves the read seq of the counters of the member forward and
+// drops the messages up to it.
+func (db *DB) ReadUnread(ctx context.Context, roomID string, userID string, readSeq int64) error {
+	f := bson.M{"_id": unreadID(roomID, userID)}
+	opts := options.UpdateOne().SetUpsert(true)
+
+	_, err := db.unreads.UpdateOne(ctx, f, readUnreadUpdate(roomID, userID, readSeq), opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent upsert created the counters, they match now
+		_, err = db.unreads.UpdateOne(ctx, f, readUnreadUpdate(roomID, userID, readSeq), opts)
+	}
+	if err != nil {
+		log.Error("db.ReadUnread", log.ChatID(roomID), log.UserID(userID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+func readUnreadUpdate(roomID string, userID string, readSeq int64) bson.M {
+	read := bson.M{"$lte": readSeq}
+
+	return bson.M{
+		"$max":         bson.M{"read_seq": readSeq},
+		"$pull":        bson.M{"unread_seqs": read, "mention_seqs": read},
+		"$setOnInsert": bson.M{"room_id": roomID, "user_id": userID},
+	}
+}
+
+// UncountUnread drops a deleted message from the counters of the room.
+func (db *DB) UncountUnread(ctx context.Context, roomID string, seq int64) error {
+	f := bson.M{
+		"room_id": roomID,
+		"$or": bson.A{
+			bson.M{"unread_seqs": seq},
+			bson.M{"mention_seqs": seq},
+		},
+	}
+	update := bson.M{"$pull": bson.M{"unread_seqs": seq, "mention_seqs": seq}}
+
+	_, err := db.unreads.UpdateMany(ctx, f, update)
+	if err != nil {
+		log.Error("db.UncountUnread", log.ChatID(roomID), log.Err(err))
+		return domain.ErrDBQuery
+	}
+
+	return nil
+}
+
+// ListUnread returns the counts of the conversations of the user with
+// anything unread, sorted by room.
+func (db *DB) ListUnread(ctx context.Context, userID string, roomIDs []string) ([]*domain.Unread, error) {
+	if len(roomIDs) == 0 {
+		return []*domain.Unread{}, nil
+	}
+
+	opts := options.Find().
+		SetProjection(unreadProjection()).
+		SetSort(bson.D{{Key: "room_id", Value: 1}})
+
+	cur, err := db.unreads.Find(ctx, listUnreadFilter(userID, roomIDs), opts)
+	if err != nil {
+		log.Error("db.ListUnread", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	unreads := make([]*domain.Unread, 0)
+	if err = cur.All(ctx, &unreads); err != nil {
+		log.Error("db.ListUnread", log.UserID(userID), log.Err(err))
+		return nil, domain.ErrDBQuery
+	}
+
+	return unreads, nil
+}
+
+func listUnreadFilter(userID string, roomIDs []string) bson.M {
+	return bson.M{
+		"user_id": userID,
+		"room_id": bson.M{"$in": roomIDs},
+		"$or": bson.A{
+			bson.M{"unread_seqs.0": bson.M{"$exists": true}},
+			bson.M{"mention_seqs.0": bson.M{"$exists": true}},
+		},
+	}
+}
+
+func unreadProjection() bson.M {
+	return bson.M{
+		"_id":           0,
+		"room_id":       1,
+		"last_seq":      1,
+		"read_seq":      1,
+		"unread_count":  bson.M{"$size": bson.M{"$ifNull": bson.A{"$unread_seqs", bson.A{}}}},
+		"mention_count": bson.M{"$size": bson.M{"$ifNull": bson.A{"$mention_seqs", bson.A{}}}},
+	}
+}
+
+func unreadID(roomID string, userID string) string {
+	return roomID + ":" + userID
+}
+
+// duplicateKeysOnly reports whether every write of a bulk write failed on a
+// duplicate key.
+func duplicateKeysOnly(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+
+	return !slices.ContainsFunc(bulkErr.WriteErrors, func(e mongo.BulkWriteError) bool {
+		return e.Code != duplicateKey
+	})
+}
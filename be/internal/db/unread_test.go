@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestCountUnreadUpdate(t *testing.T) {
+	t.Parallel()
+
+	seq := bson.M{"$each": bson.A{int64(7)}, "$sort": 1, "$slice": -domain.UnreadMaxCount}
+
+	tests := []struct {
+		name       string
+		msg        *domain.Message
+		expectPush bson.M
+	}{
+		{
+			name:       "message",
+			msg:        &domain.Message{RoomID: "room", Seq: 7},
+			expectPush: bson.M{"unread_seqs": seq},
+		},
+		{
+			name:       "mention",
+			msg:        &domain.Message{RoomID: "room", Seq: 7, MentionIDs: []string{"alice"}},
+			expectPush: bson.M{"unread_seqs": seq, "mention_seqs": seq},
+		},
+		{
+			name:       "room_mention",
+			msg:        &domain.Message{RoomID: "room", Seq: 7, MentionsRoom: true},
+			expectPush: bson.M{"unread_seqs": seq, "mention_seqs": seq},
+		},
+		{
+			name:       "mentioned_in_reply",
+			msg:        &domain.Message{RoomID: "room", Seq: 7, ParentID: "parent", MentionIDs: []string{"alice"}},
+			expectPush: bson.M{"mention_seqs": seq},
+		},
+		{
+			name: "reply",
+			msg:  &domain.Message{RoomID: "room", Seq: 7, ParentID: "parent", MentionIDs: []string{"bob"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			update, ok := countUnreadUpdate(tt.msg, "alice")
+			if tt.expectPush == nil {
+				require.False(t, ok)
+				return
+			}
+
+			require.True(t, ok)
+			require.Equal(t, bson.M{
+				"$push": tt.expectPush,
+				"$max":  bson.M{"last_seq": int64(7)},
+				"$setOnInsert": bson.M{
+					"room_id":  "room",
+					"user_id":  "alice",
+					"read_seq": int64(0),
+				},
+			}, update)
+		})
+	}
+}
+
+func TestCountUnreadFilter(t *testing.T) {
+	t.Parallel()
+
+	// counters read past the message or counting it already do not match
+	require.Equal(t, bson.M{
+		"_id":          "room:alice",
+		"read_seq":     bson.M{"$lt": int64(7)},
+		"unread_seqs":  bson.M{"$ne": int64(7)},
+		"mention_seqs": bson.M{"$ne": int64(7)},
+	}, countUnreadFilter(&domain.Message{RoomID: "room", Seq: 7}, "alice"))
+}
+
+func TestReadUnreadUpdate(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, bson.M{
+		"$max": bson.M{"read_seq": int64(7)},
+		"$pull": bson.M{
+			"unread_seqs":  bson.M{"$lte": int64(7)},
+			"mention_seqs": bson.M{"$lte": int64(7)},
+		},
+		"$setOnInsert": bson.M{"room_id": "room", "user_id": "alice"},
+	}, readUnreadUpdate("room", "alice", 7))
+}
+
+func TestDuplicateKeysOnly(t *testing.T) {
+	t.Parallel()
+
+	writeErr := func(code int) mongo.BulkWriteError {
+		return mongo.BulkWriteError{WriteError: mongo.WriteError{Code: code}}
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		expect bool
+	}{
+		{
+			name:   "duplicate_keys",
+			err:    mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(duplicateKey), writeErr(duplicateKey)}},
+			expect: true,
+		},
+		{
+			name: "other_write_error",
+			err:  mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(duplicateKey), writeErr(2)}},
+		},
+		{
+			name: "write_concern",
+			err: mongo.BulkWriteException{
+				WriteConcernError: &mongo.WriteConcernError{Code: 64},
+				WriteErrors:       []mongo.BulkWriteError{writeErr(duplicateKey)},
+			},
+		},
+		{
+			name: "not_bulk",
+			err:  errors.New("connection reset"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.expect, duplicateKeysOnly(tt.err))
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package domain
+
+import "time"
+
+const AttachmentNameMaxLength = 255
+
+type (
+	// Attachment describes an uploaded file, its content is kept in the blob
+	// store under the attachment id.
+	Attachment struct {
+		ID          string    `json:"id" bson:"_id"`
+		RoomID      string    `json:"room_id" bson:"room_id"`
+		UserID      string    `json:"user_id" bson:"user_id"`
+		Name        string    `json:"name" bson:"name"`
+		ContentType string    `json:"content_type" bson:"content_type"`
+		Size        int64     `json:"size" bson:"size"`
+		CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+
+		// set for images, which are stored without their metadata
+		Width    int                 `json:"width,omitempty" bson:"width,omitempty"`
+		Height   int                 `json:"height,omitempty" bson:"height,omitempty"`
+		Variants []AttachmentVariant `json:"variants,omitempty" bson:"variants,omitempty"`
+
+		// DeletedAt is set once the message it was sent with is deleted
+		DeletedAt *time.Time `json:"-" bson:"deleted_at,omitempty"`
+	}
+
+	// AttachmentVariant is a resized copy of an image attachment, it is kept
+	// in the blob store next to the original.
+	AttachmentVariant struct {
+		Name        string `json:"name" bson:"name"`
+		Width       int    `json:"width" bson:"width"`
+		Height      int    `json:"height" bson:"height"`
+		ContentType string `json:"content_type" bson:"content_type"`
+		Size        int64  `json:"size" bson:"size"`
+	}
+
+	// AttachmentURL is a signed download url of the attachment.
+	AttachmentURL struct {
+		Attachment *Attachment `json:"attachment"`
+		URL        string      `json:"url"`
+		ExpiresAt  time.Time   `json:"expires_at"`
+
+		// VariantURLs maps the variant names to their download urls
+		VariantURLs map[string]string `json:"variant_urls,omitempty"`
+	}
+)
+
+// Variant returns the variant with the name or nil.
+func (a *Attachment) Variant(name string) *AttachmentVariant {
+	for i := range a.Variants {
+		if a.Variants[i].Name == name {
+			return &a.Variants[i]
+		}
+	}
+	return nil
+}
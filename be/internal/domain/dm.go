@@ -0,0 +1,20 @@
+package domain
+
+import (
+	"slices"
+	"time"
+)
+
+type (
+	// DM is a private conversation between exactly two users.
+	DM struct {
+		ID          string    `json:"id" bson:"_id"`
+		Members     []string  `json:"members" bson:"members"`
+		LastMessage *Message  `json:"last_message,omitempty" bson:"last_message,omitempty"`
+		CreatedAt   time.Time `json:"created_at" bson:"created_at"`
+	}
+)
+
+func (dm *DM) HasMember(userID string) bool {
+	return slices.Contains(dm.Members, userID)
+}
@@ -5,15 +5,103 @@ import "errors"
 var (
 	ErrTokenInvalid = errors.New("token invalid")
 	ErrTokenExpired = errors.New("token expired")
+
+	ErrSessionRevoked = errors.New("session revoked")
+
+	ErrURLSignatureInvalid = errors.New("invalid url signature")
+	ErrURLExpired          = errors.New("url expired")
+
+	ErrRoomIDTokenMismatch = errors.New("token issued for another room")
+	ErrRoomIDInvalid       = errors.New("invalid room id")
+	ErrUserIDInvalid       = errors.New("invalid user id")
 )
 
 var (
 	ErrOAuthUnsupportedProvider = errors.New("unsupported oauth provider")
 	ErrOAuthExchange            = errors.New("oauth exchange error")
+	ErrOAuthStateInvalid        = errors.New("invalid oauth state")
+	ErrOAuthDiscovery           = errors.New("oauth discovery error")
+	ErrOAuthIDTokenInvalid      = errors.New("invalid oauth id token")
 	ErrOAuthGetUserInfo         = errors.New("oauth get user info error")
 )
 
 var (
-	ErrDBUserNotFound = errors.New("user not found")
-	ErrDBQuery        = errors.New("database query error")
+	ErrDBUserNotFound       = errors.New("user not found")
+	ErrDBDMNotFound         = errors.New("dm not found")
+	ErrDBRoomNotFound       = errors.New("room not found")
+	ErrDBMessageNotFound    = errors.New("message not found")
+	ErrDBAttachmentNotFound = errors.New("attachment not found")
+	ErrDBSessionNotFound    = errors.New("session not found")
+	ErrDBQuery              = errors.New("database query error")
+)
+
+var (
+	ErrDMSelf = errors.New("cannot open dm with yourself")
+
+	ErrRoomNameEmpty         = errors.New("room name is empty")
+	ErrRoomNameTooLong       = errors.New("room name is too long")
+	ErrRoomTopicTooLong      = errors.New("room topic is too long")
+	ErrRoomVisibilityInvalid = errors.New("invalid room visibility")
+	ErrRoomNotMember         = errors.New("not a member of the room")
+	ErrRoomAlreadyMember     = errors.New("already a member of the room")
+	ErrRoomNotInvited        = errors.New("not invited to the room")
+	ErrRoomPermissionDenied  = errors.New("room permission denied")
+	ErrRoomOwnerLeave        = errors.New("room owner cannot leave the room")
+)
+
+var (
+	ErrSearchIndex = errors.New("search index error")
+
+	ErrBlobNotFound = errors.New("blob not found")
+	ErrBlobStore    = errors.New("blob store error")
+)
+
+var (
+	ErrBrokerPublish   = errors.New("broker publish error")
+	ErrBrokerSubscribe = errors.New("broker subscribe error")
+	ErrBrokerPresence  = errors.New("broker presence error")
+)
+
+var (
+	ErrFrameInvalid        = errors.New("invalid frame")
+	ErrFrameUnknown        = errors.New("unknown frame type")
+	ErrClientClosed        = errors.New("client connection closed")
+	ErrMessageEmpty        = errors.New("message body is empty")
+	ErrMessageTooLong      = errors.New("message body is too long")
+	ErrMessagePending      = errors.New("message with the same client id is still being processed")
+	ErrClientIDInvalid     = errors.New("client id must be a uuid")
+	ErrPresenceInvalid     = errors.New("invalid presence status")
+	ErrMessageDeleted      = errors.New("message is deleted")
+	ErrMessageNotAuthor    = errors.New("not the author of the message")
+	ErrReactionInvalid     = errors.New("invalid reaction")
+	ErrReactionLimit       = errors.New("too many reactions on the message")
+	ErrThreadParentInvalid = errors.New("message cannot start a thread")
+	ErrThreadLimit         = errors.New("too many thread subscriptions")
+	ErrPinLimit            = errors.New("too many pinned messages in the room")
+
+	ErrCursorInvalid = errors.New("invalid cursor")
+	ErrLimitInvalid  = errors.New("invalid limit")
+
+	ErrAttachmentEmpty    = errors.New("attachment is empty")
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	ErrAttachmentInvalid  = errors.New("invalid attachment")
+	ErrAttachmentLimit    = errors.New("too many attachments on the message")
+
+	ErrImageInvalid      = errors.New("invalid image")
+	ErrImageTooLarge     = errors.New("image dimensions are too large")
+	ErrAvatarNotFound    = errors.New("avatar not found")
+	ErrAvatarSizeInvalid = errors.New("invalid avatar size")
+
+	ErrNotificationIDsInvalid = errors.New("too many notification ids")
+
+	ErrIdentityLinked   = errors.New("identity is linked to another user")
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrIdentityLast     = errors.New("cannot unlink the last identity")
+
+	ErrUsernameInvalid = errors.New("invalid username")
+	ErrUsernameTaken   = errors.New("username is taken")
+
+	ErrSearchQueryEmpty   = errors.New("search query is empty")
+	ErrSearchQueryTooLong = errors.New("search query is too long")
+	ErrSearchTimeInvalid  = errors.New("invalid search time range")
 )
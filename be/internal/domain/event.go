@@ -0,0 +1,18 @@
+package domain
+
+import "encoding/json"
+
+type (
+	// Event is an ephemeral notification fanned out to the gateway
+	// connections of a room, or of a user when UserID is set. It is never
+	// persisted. Type and Data become the frame sent to the clients.
+	Event struct {
+		Type   string          `json:"type"`
+		RoomID string          `json:"room_id"`
+		UserID string          `json:"user_id,omitempty"`
+		Data   json.RawMessage `json:"data"`
+
+		// ExcludeUserID skips the connections of that user, e.g. the sender.
+		ExcludeUserID string `json:"exclude_user_id,omitempty"`
+	}
+)
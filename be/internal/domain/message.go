@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const MessageMaxLength = 4096
+
+const MessageMaxAttachments = 10
+
+const MessageMaxMentions = 20 // distinct usernames resolved per message
+
+const (
+	ReactionMaxLength   = 32 // bytes, enough for emoji sequences and short codes
+	MessageMaxReactions = 20 // distinct reactions per message
+)
+
+const (
+	MessagePageDefaultLimit = 50
+	MessagePageMaxLimit     = 100
+)
+
+type (
+	Message struct {
+		ID        string    `json:"id" bson:"_id"`
+		RoomID    string    `json:"room_id" bson:"room_id"`
+		UserID    string    `json:"user_id" bson:"user_id"`
+		ClientID  string    `json:"client_id,omitempty" bson:"client_id,omitempty"`
+		Seq       int64     `json:"seq" bson:"seq"`
+		Body      string    `json:"body" bson:"body"`
+		CreatedAt time.Time `json:"created_at" bson:"created_at"`
+
+		AttachmentIDs []string `json:"attachment_ids,omitempty" bson:"attachment_ids,omitempty"`
+
+		// MentionIDs are the members mentioned by username, MentionsRoom is
+		// set when an admin of the room mentions @room.
+		MentionIDs   []string `json:"mention_ids,omitempty" bson:"mention_ids,omitempty"`
+		MentionsRoom bool     `json:"mentions_room,omitempty" bson:"mentions_room,omitempty"`
+
+		// ParentID is set on thread replies, ReplyCount and LastReplyAt on
+		// messages that started a thread.
+		ParentID    string     `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+		ReplyCount  int        `json:"reply_count,omitempty" bson:"reply_count,omitempty"`
+		LastReplyAt *time.Time `json:"last_reply_at,omitempty" bson:"last_reply_at,omitempty"`
+
+		EditedAt  *time.Time `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+		DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+		DeletedBy string     `json:"deleted_by,omitempty" bson:"deleted_by,omitempty"`
+		// EditSeq is the last seq of the room when the message was last
+		// edited or deleted, resume replays the changes by it.
+		EditSeq int64 `json:"edit_seq,omitempty" bson:"edit_seq,omitempty"`
+
+		Reactions []Reaction `json:"reactions,omitempty" bson:"reactions,omitempty"`
+
+		// Revisions holds the prior bodies oldest first, it is only loaded
+		// when the history is requested.
+		Revisions []MessageRevision `json:"revisions,omitempty" bson:"revisions,omitempty"`
+	}
+
+	// MessageRevision is a body the message had since CreatedAt.
+	MessageRevision struct {
+		Body      string    `json:"body" bson:"body"`
+		CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	}
+
+	// Reaction groups the users who reacted to a message with the same emoji.
+	Reaction struct {
+		Emoji   string   `json:"emoji" bson:"emoji"`
+		UserIDs []string `json:"user_ids" bson:"user_ids"`
+	}
+
+	// MessagePage holds messages or thread replies newest first, NextCursor
+	// is empty on the last page.
+	MessagePage struct {
+		Messages   []*Message `json:"messages"`
+		NextCursor string     `json:"next_cursor,omitempty"`
+	}
+)
+
+// Reaction returns the reaction with the emoji, nil if nobody reacted with it.
+func (m *Message) Reaction(emoji string) *Reaction {
+	for i := range m.Reactions {
+		if m.Reactions[i].Emoji == emoji {
+			return &m.Reactions[i]
+		}
+	}
+	return nil
+}
+
+// MarshalJSON adds the count, it is not stored as it is the number of users.
+func (r Reaction) MarshalJSON() ([]byte, error) {
+	type reaction Reaction
+	return json.Marshal(struct {
+		reaction
+		Count int `json:"count"`
+	}{reaction(r), len(r.UserIDs)})
+}
@@ -0,0 +1,40 @@
+package domain
+
+import "time"
+
+const (
+	NotificationMention     = "mention"      // the user was mentioned by username
+	NotificationRoomMention = "room_mention" // the message mentioned @room
+)
+
+const (
+	NotificationPageDefaultLimit = 50
+	NotificationPageMaxLimit     = 100
+
+	NotificationSnippetLength = 140 // runes of the message body kept
+)
+
+type (
+	// Notification is an entry of the inbox of a user.
+	Notification struct {
+		ID        string     `json:"id" bson:"_id"`
+		UserID    string     `json:"user_id" bson:"user_id"`
+		Type      string     `json:"type" bson:"type"`
+		RoomID    string     `json:"room_id" bson:"room_id"`
+		MessageID string     `json:"message_id" bson:"message_id"`
+		Seq       int64      `json:"seq" bson:"seq"`
+		ParentID  string     `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+		ActorID   string     `json:"actor_id" bson:"actor_id"`
+		Snippet   string     `json:"snippet" bson:"snippet"`
+		CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+		ReadAt    *time.Time `json:"read_at,omitempty" bson:"read_at,omitempty"`
+	}
+
+	// NotificationPage holds notifications newest first, NextCursor is empty
+	// on the last page.
+	NotificationPage struct {
+		Notifications []*Notification `json:"notifications"`
+		NextCursor    string          `json:"next_cursor,omitempty"`
+		UnreadCount   int64           `json:"unread_count"`
+	}
+)
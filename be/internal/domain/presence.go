@@ -0,0 +1,32 @@
+package domain
+
+import "time"
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+type (
+	Presence struct {
+		UserID   string     `json:"user_id"`
+		Status   string     `json:"status"`
+		LastSeen *time.Time `json:"last_seen,omitempty"`
+	}
+)
+
+// MergePresence combines the statuses a user has on several connections or
+// instances, online wins over away and nothing means offline.
+func MergePresence(statuses ...string) string {
+	status := PresenceOffline
+	for _, s := range statuses {
+		switch s {
+		case PresenceOnline:
+			return PresenceOnline
+		case PresenceAway:
+			status = PresenceAway
+		}
+	}
+	return status
+}
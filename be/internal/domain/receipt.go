@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+type (
+	// Receipt holds the watermarks of a member in a room, every message with
+	// a seq up to DeliveredSeq reached one of the member's devices and every
+	// message up to ReadSeq was read.
+	Receipt struct {
+		RoomID       string    `json:"room_id" bson:"room_id"`
+		UserID       string    `json:"user_id" bson:"user_id"`
+		DeliveredSeq int64     `json:"delivered_seq" bson:"delivered_seq"`
+		ReadSeq      int64     `json:"read_seq" bson:"read_seq"`
+		UpdatedAt    time.Time `json:"updated_at" bson:"updated_at"`
+	}
+)
@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	RoomNameMaxLength  = 64
+	RoomTopicMaxLength = 256
+)
+
+const RoomMaxPins = 50
+
+const (
+	RoomVisibilityPublic  = "public"
+	RoomVisibilityPrivate = "private"
+)
+
+const (
+	RoomRoleMember = "member"
+	RoomRoleAdmin  = "admin"
+	RoomRoleOwner  = "owner"
+)
+
+type (
+	// Room is a group conversation, public rooms can be joined by anyone
+	// while private rooms require an invite.
+	Room struct {
+		ID         string       `json:"id" bson:"_id"`
+		Name       string       `json:"name" bson:"name"`
+		Topic      string       `json:"topic" bson:"topic"`
+		Visibility string       `json:"visibility" bson:"visibility"`
+		Members    []RoomMember `json:"members" bson:"members"`
+		Invites    []string     `json:"invites" bson:"invites"`
+		CreatedBy  string       `json:"created_by" bson:"created_by"`
+		CreatedAt  time.Time    `json:"created_at" bson:"created_at"`
+
+		// Pins are the pinned messages newest first, they are listed
+		// separately.
+		Pins []Pin `json:"-" bson:"pins,omitempty"`
+	}
+
+	RoomMember struct {
+		UserID   string    `json:"user_id" bson:"user_id"`
+		Role     string    `json:"role" bson:"role"`
+		JoinedAt time.Time `json:"joined_at" bson:"joined_at"`
+	}
+
+	// Pin is a message pinned by a room admin, Message is loaded when the
+	// pins are listed.
+	Pin struct {
+		MessageID string    `json:"message_id" bson:"message_id"`
+		PinnedBy  string    `json:"pinned_by" bson:"pinned_by"`
+		PinnedAt  time.Time `json:"pinned_at" bson:"pinned_at"`
+		Message   *Message  `json:"message,omitempty" bson:"-"`
+	}
+)
+
+// Member returns the membership of the user or nil if they are not a member.
+func (r *Room) Member(userID string) *RoomMember {
+	for i := range r.Members {
+		if r.Members[i].UserID == userID {
+			return &r.Members[i]
+		}
+	}
+	return nil
+}
+
+// Pin returns the pin of the message or nil if it is not pinned.
+func (r *Room) Pin(messageID string) *Pin {
+	for i := range r.Pins {
+		if r.Pins[i].MessageID == messageID {
+			return &r.Pins[i]
+		}
+	}
+	return nil
+}
+
+func (r *Room) IsInvited(userID string) bool {
+	return slices.Contains(r.Invites, userID)
+}
+
+// IsAdmin reports whether the member can manage the room.
+func (m *RoomMember) IsAdmin() bool {
+	return m.Role == RoomRoleAdmin || m.Role == RoomRoleOwner
+}
+
+// Outranks reports whether the member can act on other, e.g. remove them.
+func (m *RoomMember) Outranks(other *RoomMember) bool {
+	return roomRoleRank(m.Role) > roomRoleRank(other.Role)
+}
+
+func roomRoleRank(role string) int {
+	switch role {
+	case RoomRoleOwner:
+		return 2
+	case RoomRoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
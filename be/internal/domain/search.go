@@ -0,0 +1,33 @@
+package domain
+
+import "time"
+
+const (
+	SearchQueryMaxLength = 256
+	SearchDefaultLimit   = 20
+	SearchMaxLimit       = 50
+)
+
+type (
+	// MessageSearch selects messages whose body contains every term of Query.
+	MessageSearch struct {
+		Query string
+
+		// RoomIDs limits the search to these conversations, it is never empty.
+		RoomIDs []string
+		// UserID selects the messages of one author when set.
+		UserID string
+		// After and Before bound created_at when set, both exclusive.
+		After  time.Time
+		Before time.Time
+
+		Limit int
+	}
+
+	// SearchHit is a matched message, Snippet is an HTML escaped excerpt of
+	// its body with the matched terms wrapped in <mark> tags.
+	SearchHit struct {
+		Message *Message `json:"message"`
+		Snippet string   `json:"snippet"`
+	}
+)
@@ -0,0 +1,29 @@
+package domain
+
+import "time"
+
+type (
+	// Session is a login of a user, the tokens of the login carry its id and
+	// are only accepted while it is neither revoked nor expired. Its refresh
+	// token is single use, RefreshID is the id of the one to present next.
+	Session struct {
+		ID        string     `json:"id" bson:"_id"`
+		UserID    string     `json:"user_id" bson:"user_id"`
+		Provider  string     `json:"provider" bson:"provider"`
+		Subject   string     `json:"-" bson:"subject"` // of the identity logged in with
+		CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+		ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+		RevokedAt *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+
+		RefreshID     string     `json:"-" bson:"refresh_id"`
+		PrevRefreshID string     `json:"-" bson:"prev_refresh_id,omitempty"`
+		RotatedAt     *time.Time `json:"-" bson:"rotated_at,omitempty"`
+
+		Current bool `json:"current" bson:"-"` // session of the request
+	}
+)
+
+// Active reports whether tokens of the session are accepted at now.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,17 @@
+package domain
+
+// UnreadMaxCount caps the unread and mention counts of a conversation.
+const UnreadMaxCount = 999
+
+type (
+	// Unread counts the messages of a conversation a member has not read,
+	// those of others after their read seq. Thread replies only count when
+	// they mention the member, deleted messages stop counting.
+	Unread struct {
+		RoomID       string `json:"room_id" bson:"room_id"`
+		UnreadCount  int64  `json:"unread_count" bson:"unread_count"`
+		MentionCount int64  `json:"mention_count" bson:"mention_count"`
+		LastSeq      int64  `json:"last_seq" bson:"last_seq"` // the latest message counted
+		ReadSeq      int64  `json:"read_seq" bson:"read_seq"`
+	}
+)
@@ -1,23 +1,75 @@
 package domain
 
+import "time"
+
+const (
+	UsernameMinLength = 3
+	UsernameMaxLength = 32
+)
+
 type (
 	User struct {
-		ID       string `json:"id" bson:"_id"`
-		Name     string `json:"name" bson:"name"`
-		Email    string `json:"email" bson:"email"`
-		Avatar   string `json:"avatar" bson:"avatar"`
-		Provider string `json:"provider" bson:"provider"`
-		Username string `json:"username" bson:"username"`
+		ID       string     `json:"id" bson:"_id"`
+		Name     string     `json:"name" bson:"name"`
+		Email    string     `json:"email" bson:"email"`
+		Avatar   string     `json:"avatar" bson:"avatar"`
+		AvatarID string     `json:"-" bson:"avatar_id,omitempty"` // set once a custom avatar is uploaded
+		Provider string     `json:"provider" bson:"provider"`
+		Username string     `json:"username" bson:"username,omitempty"` // lowercase, unique once set
+		LastSeen *time.Time `json:"last_seen,omitempty" bson:"last_seen,omitempty"`
+
+		// Identities are the provider accounts the user logs in with, users
+		// from before account linking have none until their next login. They
+		// are only ever shown to the user themself.
+		Identities []Identity `json:"-" bson:"identities,omitempty"`
+	}
+
+	// Identity is an account of the user at an oauth provider, Subject
+	// identifies it at the provider.
+	Identity struct {
+		Provider      string    `json:"provider" bson:"provider"`
+		Subject       string    `json:"subject" bson:"subject"`
+		Email         string    `json:"email" bson:"email"`
+		EmailVerified bool      `json:"email_verified" bson:"email_verified"`
+		LinkedAt      time.Time `json:"linked_at" bson:"linked_at"`
 	}
 
 	UserTokenPayload struct {
-		UserID string `json:"user_id"`
-		Email  string `json:"email"`
+		UserID    string `json:"user_id"`
+		Email     string `json:"email"`
+		SessionID string `json:"session_id"`
+		RefreshID string `json:"refresh_id"` // of refresh tokens only
+	}
+
+	// OAuthProfile is the user as described by an oauth provider, Subject
+	// identifies them at the provider.
+	OAuthProfile struct {
+		Subject       string
+		Name          string
+		Email         string
+		EmailVerified bool
+		Avatar        string
+	}
+
+	// OAuthRedirect is the login url of the provider and the signed login
+	// state the browser keeps in a cookie until the callback.
+	OAuthRedirect struct {
+		URL    string
+		Cookie string
+	}
+
+	// OAuthCallback is what the provider sent back with the browser, the
+	// state must match the one sealed in the cookie.
+	OAuthCallback struct {
+		Code   string
+		State  string
+		Cookie string
 	}
 
 	ChatTokenPayload struct {
 		UserID    string `json:"user_id"`
 		SessionID string `json:"session_id"`
+		RoomID    string `json:"room_id"`
 	}
 
 	Token struct {
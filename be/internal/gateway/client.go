@@ -0,0 +1,326 @@
+package gateway
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxFrameSize   = 64 * 1024 // 64KB
+	sendBufferSize = 256
+
+	maxThreads = 100 // thread subscriptions per client
+)
+
+type Client struct {
+	conn      *websocket.Conn
+	user      *domain.User
+	roomID    string
+	sessionID string
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	evicted   atomic.Bool
+
+	// replay state, see StartReplay
+	mu        sync.Mutex
+	replaying bool
+	held      []heldMessage
+	replayed  int64
+
+	threadsMu sync.RWMutex
+	threads   map[string]struct{}
+}
+
+type heldMessage struct {
+	seq int64
+	b   []byte
+}
+
+func NewClient(conn *websocket.Conn, user *domain.User, roomID string, sessionID string) *Client {
+	return &Client{
+		conn:      conn,
+		user:      user,
+		roomID:    roomID,
+		sessionID: sessionID,
+		send:      make(chan []byte, sendBufferSize),
+		done:      make(chan struct{}),
+		threads:   make(map[string]struct{}),
+	}
+}
+
+func (c *Client) User() *domain.User {
+	return c.user
+}
+
+func (c *Client) RoomID() string {
+	return c.roomID
+}
+
+func (c *Client) SessionID() string {
+	return c.sessionID
+}
+
+// SubscribeThread delivers the replies of the thread to the client in full.
+func (c *Client) SubscribeThread(parentID string) error {
+	c.threadsMu.Lock()
+	defer c.threadsMu.Unlock()
+
+	if _, ok := c.threads[parentID]; !ok && len(c.threads) >= maxThreads {
+		return domain.ErrThreadLimit
+	}
+	c.threads[parentID] = struct{}{}
+
+	return nil
+}
+
+func (c *Client) UnsubscribeThread(parentID string) {
+	c.threadsMu.Lock()
+	defer c.threadsMu.Unlock()
+
+	delete(c.threads, parentID)
+}
+
+func (c *Client) inThread(parentID string) bool {
+	c.threadsMu.RLock()
+	defer c.threadsMu.RUnlock()
+
+	_, ok := c.threads[parentID]
+	return ok
+}
+
+// Send queues the frame for delivery to the client.
+func (c *Client) Send(f *Frame) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		log.Error("gateway.Client.Send", log.Err(err))
+		return
+	}
+	c.write(b)
+}
+
+// SendError queues an error frame carrying err's message.
+func (c *Client) SendError(err error) {
+	f, _ := NewFrame(FrameError, ErrorData{Error: err.Error()})
+	c.Send(f)
+}
+
+// write queues an encoded frame, a client that cannot keep up with its
+// buffer is disconnected instead of blocking the sender.
+func (c *Client) write(b []byte) {
+	select {
+	case <-c.done:
+	case c.send <- b:
+	default:
+		log.Warn("gateway: slow client disconnected", log.UserID(c.user.ID), log.ChatID(c.roomID))
+		c.close()
+	}
+}
+
+// evict queues the frame and closes the connection once it is written, the
+// frames the client sends meanwhile are ignored.
+func (c *Client) evict(b []byte) {
+	c.evicted.Store(true)
+	c.write(b)
+	c.write(nil)
+}
+
+// StartReplay holds back live messages until FinishReplay is called.
+func (c *Client) StartReplay() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replaying = true
+}
+
+// ReplayMessage queues a replayed message.
+func (c *Client) ReplayMessage(msg *domain.Message) error {
+	b, err := encodeFrame(FrameMessageNew, msg)
+	if err != nil {
+		return err
+	}
+
+	return c.enqueue(b)
+}
+
+// ReplayChange queues the current state of a message the client has which
+// was edited or deleted since.
+func (c *Client) ReplayChange(msg *domain.Message) error {
+	typ := FrameMessageEdited
+	if msg.DeletedAt != nil {
+		typ = FrameMessageDeleted
+	}
+
+	b, err := encodeFrame(typ, msg)
+	if err != nil {
+		return err
+	}
+
+	return c.enqueue(b)
+}
+
+// FinishReplay sends resume.done and releases the held back live messages,
+// live messages up to seq were replayed and are dropped from now on.
+func (c *Client) FinishReplay(seq int64) {
+	f, _ := NewFrame(FrameResumeDone, ResumeData{Seq: seq})
+	b, _ := json.Marshal(f)
+	if err := c.enqueue(b); err != nil {
+		return
+	}
+
+	c.release(seq)
+}
+
+// AbortReplay releases the held back live messages of a replay that failed
+// after seq without sending resume.done, the client resumes again.
+func (c *Client) AbortReplay(seq int64) {
+	c.release(seq)
+}
+
+// release ends the replay up to seq and sends the held back live messages.
+func (c *Client) release(seq int64) {
+
+	// keep holding while flushing so that live messages stay behind resume.done
+	for {
+		c.mu.Lock()
+		held := c.held
+		c.held = nil
+		if len(held) == 0 {
+			c.replaying = false
+			c.replayed = max(c.replayed, seq)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		slices.SortFunc(held, func(a, b heldMessage) int { return cmp.Compare(a.seq, b.seq) })
+		for _, m := range held {
+			if m.seq <= seq {
+				continue
+			}
+			if err := c.enqueue(m.b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// deliver queues a live message unless it was already replayed.
+func (c *Client) deliver(seq int64, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case c.replaying:
+		c.held = append(c.held, heldMessage{seq: seq, b: b})
+	case seq > c.replayed:
+		c.write(b)
+	}
+}
+
+// reject replies with an error frame and closes the connection, it is used
+// before the client is served so the frame is written directly.
+func (c *Client) reject(err error) {
+	f, _ := NewFrame(FrameError, ErrorData{Error: err.Error()})
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	_ = c.conn.WriteJSON(f)
+	_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, ""))
+	c.close()
+}
+
+// enqueue waits for buffer space instead of dropping the client, a replay
+// may well exceed the buffer.
+func (c *Client) enqueue(b []byte) error {
+	select {
+	case <-c.done:
+		return domain.ErrClientClosed
+	case c.send <- b:
+		return nil
+	}
+}
+
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *Client) readPump(ctx context.Context, handler Handler) {
+	c.conn.SetReadLimit(maxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		typ, b, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Warn("gateway: read frame", log.UserID(c.user.ID), log.ChatID(c.roomID), log.Err(err))
+			}
+			return
+		}
+
+		if typ != websocket.TextMessage {
+			c.SendError(domain.ErrFrameInvalid)
+			continue
+		}
+
+		if c.evicted.Load() {
+			continue
+		}
+
+		var f Frame
+		if err = json.Unmarshal(b, &f); err != nil || f.Type == "" {
+			c.SendError(domain.ErrFrameInvalid)
+			continue
+		}
+
+		handler(ctx, c, &f)
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case b := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if b == nil {
+				// queued by evict behind its frame
+				_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+				c.close()
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package gateway implements the WebSocket chat gateway.
+//
+// Every frame exchanged over the socket is a JSON text message of the form
+//
+//	{"type": "<frame type>", "data": {...}}
+//
+// Frames sent by the client:
+//
+//	message.send       {"body": "hello", "client_id": "<uuid>", "parent_id": "...", "attachment_ids": ["..."]}
+//	resume             {"seq": 41}
+//	receipt.delivered  {"seq": 42}
+//	receipt.read       {"seq": 42}
+//	typing.start       {}
+//	typing.stop        {}
+//	presence           {"status": "away"}
+//	thread.subscribe   {"parent_id": "..."}
+//	thread.unsubscribe {"parent_id": "..."}
+//
+// Frames sent by the server:
+//
+//	message.new      {"id": "...", "room_id": "...", "user_id": "...", "client_id": "<uuid>", "seq": 42, "body": "hello", "created_at": "..."}
+//	message.ack      {"client_id": "<uuid>", "id": "...", "seq": 42, "duplicate": false}
+//	message.edited   {"id": "...", "seq": 42, "body": "hello!", "edited_at": "...", "edit_seq": 57, ...}
+//	message.deleted  {"id": "...", "seq": 42, "body": "", "deleted_at": "...", "deleted_by": "...", "edit_seq": 57, ...}
+//	reaction.added   {"message_id": "...", "seq": 42, "emoji": "👍", "user_id": "...", "count": 3}
+//	reaction.removed {"message_id": "...", "seq": 42, "emoji": "👍", "user_id": "...", "count": 2}
+//	pin.added        {"message_id": "...", "user_id": "...", "pinned_at": "..."}
+//	pin.removed      {"message_id": "...", "user_id": "..."}
+//	thread.updated   {"parent_id": "...", "id": "...", "seq": 43, "user_id": "...", "created_at": "..."}
+//	resume.done      {"seq": 57}
+//	receipt          {"room_id": "...", "user_id": "...", "delivered_seq": 42, "read_seq": 40, "updated_at": "..."}
+//	typing.start     {"user_id": "...", "ttl_ms": 5000}
+//	typing.stop      {"user_id": "..."}
+//	presence         {"user_id": "...", "status": "offline", "last_seen": "..."}
+//	notification     {"id": "...", "type": "mention", "room_id": "...", "message_id": "...", "actor_id": "...", "snippet": "hi @bob", ...}
+//	session.revoked  {"session_ids": ["..."]}
+//	room.removed     {"room_id": "..."}
+//	error            {"error": "message body is empty"}
+//
+// Unknown or malformed frames are answered with an error frame, the
+// connection stays open.
+//
+// Every accepted message.send is answered with message.ack. The optional
+// client_id makes sends idempotent: a retry carrying the client_id of an
+// already accepted message within the dedup window is not stored again, it
+// is acknowledged with the original id and seq and duplicate set to true.
+//
+// Messages of a room are numbered by a gap-free sequence starting at 1. A
+// client reconnecting after a drop sends resume with the last seq it has
+// seen, the server then replays every newer message in order followed by
+// resume.done carrying the last replayed seq. Live messages are held back
+// during the replay and never duplicate replayed ones. Live messages from
+// concurrent senders may arrive slightly out of order, clients order them by
+// seq and resume again if a seq is still missing. A replay that fails ends
+// with an error in place of resume.done, the client then resumes again.
+//
+// A message.send with parent_id replies in the thread of that message, only
+// messages outside of threads can start one. Replies are numbered with the
+// other messages of the room. They are delivered as message.new to clients
+// subscribed to the thread with thread.subscribe and as thread.updated to
+// the rest, which announces the new reply and carries its seq. Replays on
+// resume always contain the replies in full.
+//
+// Files are uploaded through the REST api first, a message.send references
+// up to 10 of them in attachment_ids and may leave the body empty then. Only
+// attachments the sender uploaded to the same room can be referenced.
+//
+// Messages are edited and deleted through the REST api, the new state of the
+// message is pushed to the room as message.edited or message.deleted. A
+// deleted message stays in the sequence as a tombstone without a body. A
+// resume replays the changes to the messages up to its seq made since, as
+// message.edited or message.deleted before the newer messages. Changes may
+// be replayed more than once, clients keep the state with the latest
+// edited_at and never undo a deletion.
+//
+// Reactions are changed through the REST api as well, the change is pushed
+// as reaction.added or reaction.removed carrying the new count.
+//
+// Room admins pin messages through the REST api, up to 50 per room. Pins and
+// unpins are pushed as pin.added and pin.removed, deleting a pinned message
+// unpins it.
+//
+// Clients report receipts with the highest seq they received or read,
+// receipts only move forward and reading implies delivery. Every change is
+// pushed as a receipt frame to every connection of the authors of the
+// messages it covers, unchanged receipts are not.
+//
+// Typing frames are relayed to the other members of the room and never
+// stored. A client keeps sending typing.start while the user types, a user
+// is reported as stopped after ttl_ms without a new typing.start, on
+// typing.stop, on sending a message or on disconnect. Clients should expire
+// the indicator after ttl_ms on their own as well.
+//
+// A user is online while one of their connections on any instance is, away
+// while all of them reported away through the presence frame and offline
+// without connections. Status changes are pushed as presence frames to the
+// rooms and dms of the user.
+//
+// Mentions of a user by @username, or of every member by @room, land in the
+// inbox of the mentioned users. Users pick their username through the REST
+// api, it is matched whatever the case. Only owners and admins of a room may
+// mention @room. Each new entry is pushed as a notification frame to every
+// connection of the user, whatever room it is in. The inbox is listed and
+// marked read through the REST api, the snippets of its entries follow the
+// edits of their messages and are emptied once the message is deleted.
+//
+// A connection belongs to the login session its chat ticket was issued for.
+// Once the session ends by logout or revocation its connections receive
+// session.revoked and are closed. A user who leaves or is removed from a
+// room gets room.removed on their connections to the room, which are closed
+// as well.
+package gateway
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	FrameMessageSend = "message.send"
+	FrameMessageNew  = "message.new"
+	FrameMessageAck  = "message.ack"
+
+	FrameMessageEdited  = "message.edited"
+	FrameMessageDeleted = "message.deleted"
+
+	FrameReactionAdded   = "reaction.added"
+	FrameReactionRemoved = "reaction.removed"
+
+	FramePinAdded   = "pin.added"
+	FramePinRemoved = "pin.removed"
+
+	FrameThreadSubscribe   = "thread.subscribe"
+	FrameThreadUnsubscribe = "thread.unsubscribe"
+	FrameThreadUpdated     = "thread.updated"
+
+	FrameResume      = "resume"
+	FrameResumeDone  = "resume.done"
+	FrameDelivered   = "receipt.delivered"
+	FrameRead        = "receipt.read"
+	FrameReceipt     = "receipt"
+	FrameTypingStart = "typing.start"
+	FrameTypingStop  = "typing.stop"
+	FramePresence    = "presence"
+	FrameError       = "error"
+
+	FrameNotification   = "notification"
+	FrameSessionRevoked = "session.revoked"
+	FrameRoomRemoved    = "room.removed"
+)
+
+type Frame struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type (
+	MessageSendData struct {
+		Body     string `json:"body"`
+		ClientID string `json:"client_id"`
+		ParentID string `json:"parent_id"`
+
+		AttachmentIDs []string `json:"attachment_ids"`
+	}
+
+	MessageAckData struct {
+		ClientID  string `json:"client_id,omitempty"`
+		ID        string `json:"id"`
+		Seq       int64  `json:"seq"`
+		Duplicate bool   `json:"duplicate"`
+	}
+
+	ReactionData struct {
+		MessageID string `json:"message_id"`
+		Seq       int64  `json:"seq"`
+		Emoji     string `json:"emoji"`
+		UserID    string `json:"user_id"`
+		Count     int    `json:"count"`
+	}
+
+	PinData struct {
+		MessageID string     `json:"message_id"`
+		UserID    string     `json:"user_id"`
+		PinnedAt  *time.Time `json:"pinned_at,omitempty"`
+	}
+
+	ThreadData struct {
+		ParentID string `json:"parent_id"`
+	}
+
+	ThreadUpdatedData struct {
+		ParentID  string    `json:"parent_id"`
+		ID        string    `json:"id"`
+		Seq       int64     `json:"seq"`
+		UserID    string    `json:"user_id"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	ResumeData struct {
+		Seq int64 `json:"seq"`
+	}
+
+	ReceiptData struct {
+		Seq int64 `json:"seq"`
+	}
+
+	TypingData struct {
+		UserID string `json:"user_id"`
+		TTLMs  int64  `json:"ttl_ms,omitempty"`
+	}
+
+	PresenceData struct {
+		Status string `json:"status"`
+	}
+
+	SessionRevokedData struct {
+		SessionIDs []string `json:"session_ids"`
+	}
+
+	RoomRemovedData struct {
+		RoomID string `json:"room_id"`
+	}
+
+	ErrorData struct {
+		Error string `json:"error"`
+	}
+)
+
+func NewFrame(typ string, data any) (*Frame, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Frame{Type: typ, Data: raw}, nil
+}
+
+func (f *Frame) Decode(dst any) error {
+	if len(f.Data) == 0 {
+		return json.Unmarshal([]byte("{}"), dst)
+	}
+	return json.Unmarshal(f.Data, dst)
+}
@@ -0,0 +1,293 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// Handler is called for every frame received from a client.
+type Handler func(ctx context.Context, c *Client, f *Frame)
+
+type broker interface {
+	SubscribeMessages(ctx context.Context, roomID string, fn func(*domain.Message)) (func(), error)
+	SubscribeEvents(ctx context.Context, roomID string, fn func(*domain.Event)) (func(), error)
+	SubscribeUserEvents(ctx context.Context, userID string, fn func(*domain.Event)) (func(), error)
+}
+
+// room holds the clients of a room or of a user.
+type room struct {
+	clients map[*Client]struct{}
+	stop    []func()
+}
+
+// Hub tracks the clients connected to this instance, a room is subscribed
+// to the broker while at least one of its clients is connected here, and so
+// is a user.
+type Hub struct {
+	broker broker
+
+	mu    sync.RWMutex
+	rooms map[string]*room
+	users map[string]*room
+}
+
+func New(broker broker) *Hub {
+	return &Hub{
+		broker: broker,
+		rooms:  make(map[string]*room),
+		users:  make(map[string]*room),
+	}
+}
+
+// Handle serves the client until its connection is closed.
+func (h *Hub) Handle(ctx context.Context, c *Client, handler Handler) {
+	if err := h.register(ctx, c); err != nil {
+		c.reject(err)
+		return
+	}
+	defer h.unregister(c)
+
+	go c.writePump()
+	defer c.close()
+
+	c.readPump(ctx, handler)
+}
+
+// deliver writes the message to the clients of r, the room whose
+// subscription received it. Every subscription has its own consumer, the
+// loser of a race in register has no clients and delivers nothing.
+func (h *Hub) deliver(r *room, msg *domain.Message) {
+	b, err := encodeFrame(FrameMessageNew, msg)
+	if err != nil {
+		log.Error("gateway.Hub.deliver", log.Err(err))
+		return
+	}
+
+	// clients outside the thread get a summary of the reply, it carries the
+	// seq so that they see no gap
+	var summary []byte
+	if msg.ParentID != "" {
+		summary, err = encodeFrame(FrameThreadUpdated, ThreadUpdatedData{
+			ParentID:  msg.ParentID,
+			ID:        msg.ID,
+			Seq:       msg.Seq,
+			UserID:    msg.UserID,
+			CreatedAt: msg.CreatedAt,
+		})
+		if err != nil {
+			log.Error("gateway.Hub.deliver", log.Err(err))
+			return
+		}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range r.clients {
+		if summary != nil && !c.inThread(msg.ParentID) {
+			c.deliver(msg.Seq, summary)
+			continue
+		}
+		c.deliver(msg.Seq, b)
+	}
+}
+
+// deliverEvent writes the event to the clients of r, the room whose
+// subscription received it.
+func (h *Hub) deliverEvent(r *room, event *domain.Event) {
+	b, err := json.Marshal(Frame{Type: event.Type, Data: event.Data})
+	if err != nil {
+		log.Error("gateway.Hub.deliverEvent", log.Err(err))
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range r.clients {
+		if event.ExcludeUserID != "" && c.user.ID == event.ExcludeUserID {
+			continue
+		}
+		c.write(b)
+	}
+}
+
+// deliverUserEvent writes the event to every client of the user, whatever
+// room they are connected to. A revoked session or a removal from a room
+// instead closes the clients of the session or room after telling them.
+func (h *Hub) deliverUserEvent(u *room, event *domain.Event) {
+	b, err := json.Marshal(Frame{Type: event.Type, Data: event.Data})
+	if err != nil {
+		log.Error("gateway.Hub.deliverUserEvent", log.Err(err))
+		return
+	}
+
+	var evict func(c *Client) bool
+	switch event.Type {
+	case FrameSessionRevoked:
+		var data SessionRevokedData
+		if err = json.Unmarshal(event.Data, &data); err != nil {
+			log.Error("gateway.Hub.deliverUserEvent", log.Err(err))
+			return
+		}
+		evict = func(c *Client) bool { return slices.Contains(data.SessionIDs, c.sessionID) }
+	case FrameRoomRemoved:
+		evict = func(c *Client) bool { return c.roomID == event.RoomID }
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range u.clients {
+		switch {
+		case evict == nil:
+			c.write(b)
+		case evict(c):
+			c.evict(b)
+		}
+	}
+}
+
+// register adds the client to its room and user. Missing subscriptions are
+// made outside the lock so that a slow broker holds up no other client, the
+// loser of a race to subscribe drops its subscription again.
+func (h *Hub) register(ctx context.Context, c *Client) error {
+	// subscribed by this call, they receive no events until registered
+	var u, r *room
+
+	for {
+		h.mu.Lock()
+		curU, uok := h.users[c.user.ID]
+		curR, rok := h.rooms[c.roomID]
+
+		if (uok || u != nil) && (rok || r != nil) {
+			var unused []func()
+			if uok {
+				unused = append(unused, u.stopFuncs()...)
+			} else {
+				curU = u
+				h.users[c.user.ID] = u
+			}
+			if rok {
+				unused = append(unused, r.stopFuncs()...)
+			} else {
+				curR = r
+				h.rooms[c.roomID] = r
+			}
+			curU.clients[c] = struct{}{}
+			curR.clients[c] = struct{}{}
+			h.mu.Unlock()
+
+			for _, stop := range unused {
+				stop()
+			}
+			return nil
+		}
+		h.mu.Unlock()
+
+		// a subscription seen before may be gone by the next round, the
+		// loop subscribes again then
+		var err error
+		if !uok && u == nil {
+			if u, err = h.subscribeUser(ctx, c.user.ID); err != nil {
+				r.stopAll()
+				return err
+			}
+		}
+		if !rok && r == nil {
+			if r, err = h.subscribeRoom(ctx, c.roomID); err != nil {
+				u.stopAll()
+				return err
+			}
+		}
+	}
+}
+
+func (h *Hub) subscribeUser(ctx context.Context, userID string) (*room, error) {
+	u := &room{clients: make(map[*Client]struct{})}
+
+	stop, err := h.broker.SubscribeUserEvents(ctx, userID, func(event *domain.Event) { h.deliverUserEvent(u, event) })
+	if err != nil {
+		return nil, err
+	}
+	u.stop = []func(){stop}
+
+	return u, nil
+}
+
+func (h *Hub) subscribeRoom(ctx context.Context, roomID string) (*room, error) {
+	r := &room{clients: make(map[*Client]struct{})}
+
+	stopMessages, err := h.broker.SubscribeMessages(ctx, roomID, func(msg *domain.Message) { h.deliver(r, msg) })
+	if err != nil {
+		return nil, err
+	}
+
+	stopEvents, err := h.broker.SubscribeEvents(ctx, roomID, func(event *domain.Event) { h.deliverEvent(r, event) })
+	if err != nil {
+		stopMessages()
+		return nil, err
+	}
+	r.stop = []func(){stopMessages, stopEvents}
+
+	return r, nil
+}
+
+func (h *Hub) unregister(c *Client) {
+	h.mu.Lock()
+
+	var stop []func()
+	stop = append(stop, leave(h.rooms, c.roomID, c)...)
+	stop = append(stop, leave(h.users, c.user.ID, c)...)
+
+	h.mu.Unlock()
+
+	// stop outside the lock, in-flight deliveries take it to broadcast
+	for _, fn := range stop {
+		fn()
+	}
+}
+
+// leave removes the client from the room under key, the room is dropped
+// with its last client and its stop funcs are returned.
+func leave(rooms map[string]*room, key string, c *Client) []func() {
+	r, ok := rooms[key]
+	if !ok {
+		return nil
+	}
+
+	delete(r.clients, c)
+	if len(r.clients) > 0 {
+		return nil
+	}
+
+	delete(rooms, key)
+	return r.stop
+}
+
+// stopFuncs returns the stop funcs of a room that may be nil.
+func (r *room) stopFuncs() []func() {
+	if r == nil {
+		return nil
+	}
+	return r.stop
+}
+
+func (r *room) stopAll() {
+	for _, stop := range r.stopFuncs() {
+		stop()
+	}
+}
+
+func encodeFrame(typ string, data any) ([]byte, error) {
+	f, err := NewFrame(typ, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(f)
+}
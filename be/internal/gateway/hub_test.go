@@ -0,0 +1,553 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroker fans events and messages out to every subscription like core
+// nats and ordered consumers do.
+type fakeBroker struct {
+	mu     sync.Mutex
+	subs   map[string][]*func(*domain.Message)
+	events map[string][]*func(*domain.Event)
+	users  map[string][]*func(*domain.Event)
+
+	// subscribing runs before every subscription, outside of the lock
+	subscribing func(key string)
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		subs:   make(map[string][]*func(*domain.Message)),
+		events: make(map[string][]*func(*domain.Event)),
+		users:  make(map[string][]*func(*domain.Event)),
+	}
+}
+
+func (b *fakeBroker) SubscribeMessages(_ context.Context, roomID string, fn func(*domain.Message)) (func(), error) {
+	return subscribe(b, b.subs, roomID, fn), nil
+}
+
+func (b *fakeBroker) SubscribeEvents(_ context.Context, roomID string, fn func(*domain.Event)) (func(), error) {
+	return subscribe(b, b.events, roomID, fn), nil
+}
+
+func (b *fakeBroker) SubscribeUserEvents(_ context.Context, userID string, fn func(*domain.Event)) (func(), error) {
+	return subscribe(b, b.users, userID, fn), nil
+}
+
+func subscribe[T any](b *fakeBroker, subs map[string][]*func(T), key string, fn func(T)) func() {
+	if b.subscribing != nil {
+		b.subscribing(key)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &fn
+	subs[key] = append(subs[key], sub)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		subs[key] = slices.DeleteFunc(subs[key], func(s *func(T)) bool { return s == sub })
+		if len(subs[key]) == 0 {
+			delete(subs, key)
+		}
+	}
+}
+
+func (b *fakeBroker) publishUserEvent(event *domain.Event) {
+	b.mu.Lock()
+	subs := slices.Clone(b.users[event.UserID])
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		(*fn)(event)
+	}
+}
+
+func (b *fakeBroker) userSubscribed(userID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.users[userID]
+	return ok
+}
+
+func (b *fakeBroker) publishEvent(event *domain.Event) {
+	b.mu.Lock()
+	subs := slices.Clone(b.events[event.RoomID])
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		(*fn)(event)
+	}
+}
+
+func (b *fakeBroker) publish(msg *domain.Message) {
+	b.mu.Lock()
+	subs := slices.Clone(b.subs[msg.RoomID])
+	b.mu.Unlock()
+
+	for _, fn := range subs {
+		(*fn)(msg)
+	}
+}
+
+func (b *fakeBroker) subscribed(roomID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.subs[roomID]
+	_, okEvents := b.events[roomID]
+	return ok && okEvents
+}
+
+// subscriptions counts the subscriptions of the room.
+func (b *fakeBroker) subscriptions(roomID string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs[roomID]) + len(b.events[roomID])
+}
+
+func newTestServer(t *testing.T, h *Hub, handler Handler) string {
+	t.Helper()
+
+	upg := &websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		user := &domain.User{ID: r.URL.Query().Get("user_id")}
+		q := r.URL.Query()
+		h.Handle(context.Background(), NewClient(conn, user, q.Get("room_id"), q.Get("session_id")), handler)
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url string, userID string, roomID string) *websocket.Conn {
+	t.Helper()
+
+	return dialSession(t, url, userID, roomID, "")
+}
+
+func dialSession(t *testing.T, url string, userID string, roomID string, sessionID string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?user_id="+userID+"&room_id="+roomID+"&session_id="+sessionID, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) *Frame {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	var f Frame
+	require.NoError(t, conn.ReadJSON(&f))
+
+	return &f
+}
+
+func TestHub(t *testing.T) {
+	t.Parallel()
+
+	var seq atomic.Int64
+
+	b := newFakeBroker()
+	h := New(b)
+	url := newTestServer(t, h, func(_ context.Context, c *Client, f *Frame) {
+		if f.Type != FrameMessageSend {
+			c.SendError(domain.ErrFrameUnknown)
+			return
+		}
+
+		var data MessageSendData
+		require.NoError(t, f.Decode(&data))
+
+		b.publish(&domain.Message{RoomID: c.RoomID(), UserID: c.User().ID, Seq: seq.Add(1), Body: data.Body})
+	})
+
+	alice := dial(t, url, "alice", "room-1")
+	bob := dial(t, url, "bob", "room-1")
+	eve := dial(t, url, "eve", "room-2")
+
+	require.Eventually(t, func() bool {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return len(h.rooms) == 2 && len(h.rooms["room-1"].clients) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	require.True(t, b.subscribed("room-1"))
+	require.True(t, b.subscribed("room-2"))
+
+	t.Run("broadcast_to_room", func(t *testing.T) {
+		f, err := NewFrame(FrameMessageSend, MessageSendData{Body: "hello"})
+		require.NoError(t, err)
+		require.NoError(t, alice.WriteJSON(f))
+
+		for _, conn := range []*websocket.Conn{alice, bob} {
+			out := readFrame(t, conn)
+			require.Equal(t, FrameMessageNew, out.Type)
+
+			var msg domain.Message
+			require.NoError(t, out.Decode(&msg))
+			require.Equal(t, "alice", msg.UserID)
+			require.Equal(t, "room-1", msg.RoomID)
+			require.Equal(t, "hello", msg.Body)
+		}
+
+		require.NoError(t, eve.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		_, _, err = eve.ReadMessage()
+		require.Error(t, err)
+	})
+
+	t.Run("event_to_room", func(t *testing.T) {
+		b.publishEvent(&domain.Event{Type: FrameReceipt, RoomID: "room-1", Data: []byte(`{"user_id":"bob"}`)})
+
+		for _, conn := range []*websocket.Conn{alice, bob} {
+			out := readFrame(t, conn)
+			require.Equal(t, FrameReceipt, out.Type)
+			require.JSONEq(t, `{"user_id":"bob"}`, string(out.Data))
+		}
+	})
+
+	t.Run("event_excludes_user", func(t *testing.T) {
+		b.publishEvent(&domain.Event{Type: FrameReceipt, RoomID: "room-1", Data: []byte(`{}`), ExcludeUserID: "alice"})
+
+		out := readFrame(t, bob)
+		require.Equal(t, FrameReceipt, out.Type)
+
+		require.NoError(t, alice.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		_, _, err := alice.ReadMessage()
+		require.Error(t, err)
+	})
+
+	t.Run("user_event_across_rooms", func(t *testing.T) {
+		carol := dial(t, url, "carol", "room-1")
+		carol2 := dial(t, url, "carol", "room-3")
+		require.Eventually(t, func() bool {
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			u, ok := h.users["carol"]
+			return ok && len(u.clients) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		b.publishUserEvent(&domain.Event{Type: FrameNotification, UserID: "carol", Data: []byte(`{"id":"1"}`)})
+
+		for _, conn := range []*websocket.Conn{carol, carol2} {
+			out := readFrame(t, conn)
+			require.Equal(t, FrameNotification, out.Type)
+			require.JSONEq(t, `{"id":"1"}`, string(out.Data))
+		}
+
+		require.NoError(t, carol2.Close())
+		require.Eventually(t, func() bool { return !b.subscribed("room-3") }, time.Second, 10*time.Millisecond)
+		require.True(t, b.userSubscribed("carol"))
+
+		require.NoError(t, carol.Close())
+		require.Eventually(t, func() bool { return !b.userSubscribed("carol") }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("invalid_frame", func(t *testing.T) {
+		require.NoError(t, bob.WriteMessage(websocket.TextMessage, []byte("not json")))
+
+		out := readFrame(t, bob)
+		require.Equal(t, FrameError, out.Type)
+
+		var data ErrorData
+		require.NoError(t, out.Decode(&data))
+		require.Equal(t, domain.ErrFrameInvalid.Error(), data.Error)
+	})
+
+	t.Run("unknown_frame", func(t *testing.T) {
+		require.NoError(t, bob.WriteJSON(Frame{Type: "unknown"}))
+
+		out := readFrame(t, bob)
+		require.Equal(t, FrameError, out.Type)
+	})
+
+	t.Run("unsubscribe_on_close", func(t *testing.T) {
+		require.NoError(t, eve.Close())
+
+		require.Eventually(t, func() bool {
+			return !b.subscribed("room-2") && !b.userSubscribed("eve")
+		}, time.Second, 10*time.Millisecond)
+		require.True(t, b.subscribed("room-1"))
+		require.True(t, b.userSubscribed("alice"))
+	})
+}
+
+func TestHub_Register(t *testing.T) {
+	t.Parallel()
+
+	echo := func(_ context.Context, c *Client, f *Frame) { c.Send(f) }
+
+	t.Run("slow_subscribe", func(t *testing.T) {
+		t.Parallel()
+
+		release := make(chan struct{})
+		defer close(release)
+
+		b := newFakeBroker()
+		b.subscribing = func(key string) {
+			if key == "room-slow" {
+				<-release
+			}
+		}
+		h := New(b)
+		url := newTestServer(t, h, echo)
+
+		dial(t, url, "alice", "room-slow")
+
+		// served while the other client still waits for its subscription
+		fast := dial(t, url, "bob", "room-fast")
+		f, err := NewFrame(FrameTypingStart, struct{}{})
+		require.NoError(t, err)
+		require.NoError(t, fast.WriteJSON(f))
+		require.Equal(t, FrameTypingStart, readFrame(t, fast).Type)
+	})
+
+	t.Run("racing_subscribe", func(t *testing.T) {
+		t.Parallel()
+
+		var waiting atomic.Int64
+		release := make(chan struct{})
+
+		b := newFakeBroker()
+		b.subscribing = func(key string) {
+			if key == "room-1" {
+				waiting.Add(1)
+				<-release
+			}
+		}
+		h := New(b)
+		url := newTestServer(t, h, echo)
+
+		alice := dial(t, url, "alice", "room-1")
+		bob := dial(t, url, "bob", "room-1")
+
+		// both clients subscribe to the room at once
+		require.Eventually(t, func() bool { return waiting.Load() == 2 }, time.Second, 10*time.Millisecond)
+		close(release)
+
+		// the loser drops its subscriptions
+		require.Eventually(t, func() bool {
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			r, ok := h.rooms["room-1"]
+			return ok && len(r.clients) == 2 && b.subscriptions("room-1") == 2
+		}, time.Second, 10*time.Millisecond)
+
+		b.publish(&domain.Message{ID: "1", RoomID: "room-1", Seq: 1})
+		b.publishEvent(&domain.Event{Type: FrameTypingStart, RoomID: "room-1", Data: []byte(`{}`)})
+
+		for _, conn := range []*websocket.Conn{alice, bob} {
+			require.Equal(t, FrameMessageNew, readFrame(t, conn).Type)
+			require.Equal(t, FrameTypingStart, readFrame(t, conn).Type)
+		}
+	})
+
+	t.Run("loser_subscribed", func(t *testing.T) {
+		t.Parallel()
+
+		b := newFakeBroker()
+		h := New(b)
+		url := newTestServer(t, h, echo)
+
+		alice := dial(t, url, "alice", "room-1")
+		require.Eventually(t, func() bool { return b.subscribed("room-1") }, time.Second, 10*time.Millisecond)
+
+		// a subscription that lost the race and is not dropped yet gets
+		// the message as well, it has no clients to write it to
+		loser, err := h.subscribeRoom(context.Background(), "room-1")
+		require.NoError(t, err)
+		defer loser.stopAll()
+
+		b.publish(&domain.Message{ID: "1", RoomID: "room-1", Seq: 1})
+		b.publishEvent(&domain.Event{Type: FrameTypingStart, RoomID: "room-1", Data: []byte(`{}`)})
+
+		require.Equal(t, FrameMessageNew, readFrame(t, alice).Type)
+		require.Equal(t, FrameTypingStart, readFrame(t, alice).Type)
+	})
+}
+
+func TestHub_Resume(t *testing.T) {
+	t.Parallel()
+
+	b := newFakeBroker()
+	h := New(b)
+	url := newTestServer(t, h, func(_ context.Context, c *Client, f *Frame) {
+		require.Equal(t, FrameResume, f.Type)
+
+		var data ResumeData
+		require.NoError(t, f.Decode(&data))
+
+		c.StartReplay()
+
+		// live messages published while the replay is running
+		b.publish(&domain.Message{RoomID: c.RoomID(), Seq: 5})
+		b.publish(&domain.Message{RoomID: c.RoomID(), Seq: 3})
+
+		seq := data.Seq
+		for _, s := range []int64{2, 3, 4} {
+			require.NoError(t, c.ReplayMessage(&domain.Message{RoomID: c.RoomID(), Seq: s}))
+			seq = s
+		}
+
+		c.FinishReplay(seq)
+	})
+
+	conn := dial(t, url, "alice", "room-1")
+	require.Eventually(t, func() bool { return b.subscribed("room-1") }, time.Second, 10*time.Millisecond)
+
+	f, err := NewFrame(FrameResume, ResumeData{Seq: 1})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(f))
+
+	readSeq := func() (string, int64) {
+		out := readFrame(t, conn)
+
+		var data ResumeData
+		require.NoError(t, out.Decode(&data))
+
+		return out.Type, data.Seq
+	}
+
+	expected := []struct {
+		typ string
+		seq int64
+	}{
+		{FrameMessageNew, 2},
+		{FrameMessageNew, 3},
+		{FrameMessageNew, 4},
+		{FrameResumeDone, 4},
+		{FrameMessageNew, 5},
+	}
+
+	for _, e := range expected {
+		typ, seq := readSeq()
+		require.Equal(t, e.typ, typ)
+		require.Equal(t, e.seq, seq)
+	}
+
+	// already replayed messages are not delivered twice
+	b.publish(&domain.Message{RoomID: "room-1", Seq: 4})
+	b.publish(&domain.Message{RoomID: "room-1", Seq: 6})
+
+	typ, seq := readSeq()
+	require.Equal(t, FrameMessageNew, typ)
+	require.Equal(t, int64(6), seq)
+}
+
+func TestHub_Thread(t *testing.T) {
+	t.Parallel()
+
+	b := newFakeBroker()
+	h := New(b)
+	url := newTestServer(t, h, func(_ context.Context, c *Client, f *Frame) {
+		var data ThreadData
+		require.NoError(t, f.Decode(&data))
+		require.NoError(t, c.SubscribeThread(data.ParentID))
+		c.Send(f) // tells the test the subscription is in place
+	})
+
+	alice := dial(t, url, "alice", "room-1")
+	bob := dial(t, url, "bob", "room-1")
+
+	require.Eventually(t, func() bool {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		r, ok := h.rooms["room-1"]
+		return ok && len(r.clients) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	f, err := NewFrame(FrameThreadSubscribe, ThreadData{ParentID: "parent-1"})
+	require.NoError(t, err)
+	require.NoError(t, alice.WriteJSON(f))
+	require.Equal(t, FrameThreadSubscribe, readFrame(t, alice).Type)
+
+	b.publish(&domain.Message{ID: "reply-1", RoomID: "room-1", UserID: "bob", ParentID: "parent-1", Seq: 2, Body: "reply"})
+
+	out := readFrame(t, alice)
+	require.Equal(t, FrameMessageNew, out.Type)
+
+	var msg domain.Message
+	require.NoError(t, out.Decode(&msg))
+	require.Equal(t, "reply", msg.Body)
+
+	out = readFrame(t, bob)
+	require.Equal(t, FrameThreadUpdated, out.Type)
+
+	var data ThreadUpdatedData
+	require.NoError(t, out.Decode(&data))
+	require.Equal(t, "parent-1", data.ParentID)
+	require.Equal(t, "reply-1", data.ID)
+	require.Equal(t, int64(2), data.Seq)
+}
+
+func TestHub_SessionRevoked(t *testing.T) {
+	t.Parallel()
+
+	var handled atomic.Int64
+
+	b := newFakeBroker()
+	h := New(b)
+	url := newTestServer(t, h, func(_ context.Context, c *Client, f *Frame) {
+		handled.Add(1)
+		c.Send(f)
+	})
+
+	revoked := dialSession(t, url, "alice", "room-1", "session-1")
+	other := dialSession(t, url, "alice", "room-2", "session-2")
+
+	require.Eventually(t, func() bool {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		u, ok := h.users["alice"]
+		return ok && len(u.clients) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	b.publishUserEvent(&domain.Event{
+		Type:   FrameSessionRevoked,
+		UserID: "alice",
+		Data:   []byte(`{"session_ids":["session-1"]}`),
+	})
+
+	out := readFrame(t, revoked)
+	require.Equal(t, FrameSessionRevoked, out.Type)
+
+	// the connection is closed right after the frame
+	require.NoError(t, revoked.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err := revoked.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+
+	require.Eventually(t, func() bool { return !b.subscribed("room-1") }, time.Second, 10*time.Millisecond)
+
+	// the other session of the user is neither told nor closed
+	f, err := NewFrame(FrameTypingStart, struct{}{})
+	require.NoError(t, err)
+	require.NoError(t, other.WriteJSON(f))
+	require.Equal(t, FrameTypingStart, readFrame(t, other).Type)
+	require.Equal(t, int64(1), handled.Load())
+}
@@ -0,0 +1,226 @@
+// Package media processes uploaded images in pure Go: it strips their
+// metadata and renders the resized variants served in place of the original.
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+const (
+	// MaxPixels bounds the decoded size of an image, a small file can
+	// decompress to gigabytes otherwise.
+	MaxPixels = 16_000_000
+
+	jpegQuality = 85
+)
+
+type (
+	// Size is a variant fitting into a square of Max pixels.
+	Size struct {
+		Name string
+		Max  int
+	}
+
+	Variant struct {
+		Name        string
+		Width       int
+		Height      int
+		ContentType string
+		Data        []byte
+	}
+
+	// Image is a processed image, Data is the original without metadata.
+	Image struct {
+		Width       int
+		Height      int
+		ContentType string
+		Data        []byte
+		Variants    []Variant
+	}
+)
+
+// Supported tells whether images of the content type are processed.
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Process strips the metadata of the image and renders a variant per size,
+// images are never scaled up. The variants of an image carrying an exif
+// orientation are rotated upright, the original is too since the tag is
+// dropped with the rest of the metadata. Gifs are reencoded with all their
+// frames, the variants are of the first one.
+func Process(b []byte, sizes []Size) (*Image, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, domain.ErrImageInvalid
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, domain.ErrImageInvalid
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, domain.ErrImageTooLarge
+	}
+
+	if format == "gif" {
+		pixels, err := gifPixels(b)
+		if err != nil {
+			return nil, err
+		}
+		if pixels > MaxPixels {
+			return nil, domain.ErrImageTooLarge
+		}
+	}
+
+	var (
+		img  image.Image
+		anim *gif.GIF
+	)
+	if format == "gif" {
+		anim, err = gif.DecodeAll(bytes.NewReader(b))
+		if err == nil {
+			img = anim.Image[0]
+		}
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, domain.ErrImageInvalid
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(b)
+	}
+
+	rgba := upright(img, orientation)
+
+	res := &Image{
+		Width:       rgba.Rect.Dx(),
+		Height:      rgba.Rect.Dy(),
+		ContentType: "image/" + format,
+	}
+
+	switch {
+	case format == "jpeg" && orientation != 1:
+		res.Data, err = encode(rgba, format)
+	case format == "jpeg":
+		res.Data, err = stripJPEG(b)
+	case format == "png":
+		res.Data, err = stripPNG(b)
+	default:
+		// the decoder drops the comments and application extensions
+		var buf bytes.Buffer
+		err = gif.EncodeAll(&buf, anim)
+		res.Data = buf.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, size := range sizes {
+		v := fit(rgba, size.Max)
+
+		data, err := encode(v, format)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Variants = append(res.Variants, Variant{
+			Name:        size.Name,
+			Width:       v.Rect.Dx(),
+			Height:      v.Rect.Dy(),
+			ContentType: variantType(format),
+			Data:        data,
+		})
+	}
+
+	return res, nil
+}
+
+// fit scales img down to fit into a square of size pixels.
+func fit(img *image.RGBA, size int) *image.RGBA {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+
+	return resize(img, w, h)
+}
+
+// toRGBA returns the image as rgba at the origin, decoded rgba images are
+// used as they are.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
+
+// upright returns the image as rgba turned upright for the exif orientation.
+// Jpegs decode to ycbcr and are converted while being turned, other images
+// are converted first.
+func upright(img image.Image, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return toRGBA(img)
+	}
+
+	src, ok := img.(*image.YCbCr)
+	if !ok {
+		return orient(toRGBA(img), orientation)
+	}
+
+	b := src.Rect
+	return orientFunc(b.Dx(), b.Dy(), orientation, func(x int, y int, pix []uint8) {
+		c := src.YCbCrAt(b.Min.X+x, b.Min.Y+y)
+		pix[0], pix[1], pix[2] = color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+		pix[3] = 0xff
+	})
+}
+
+// variantType keeps transparency for formats that may have it.
+func variantType(format string) string {
+	if format == "jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func encode(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var err error
+	if variantType(format) == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
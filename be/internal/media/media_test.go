@@ -0,0 +1,207 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func testImage(w int, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	// marks the top left corner to check the orientation
+	for y := range 16 {
+		for x := range 16 {
+			img.Set(x, y, color.RGBA{R: 255, A: 255})
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}))
+	return buf.Bytes()
+}
+
+// withExif inserts an exif segment carrying the orientation after the soi.
+func withExif(b []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // one entry
+	tiff = binary.BigEndian.AppendUint16(tiff, tagOrientation)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // short
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	tiff = append(tiff, 0, 0, 0, 0) // no next ifd
+
+	payload := append(append([]byte{}, exifHeader...), tiff...)
+
+	seg := []byte{0xff, markerAPP1}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	seg = append(seg, payload...)
+
+	out := append([]byte{}, b[:2]...)
+	out = append(out, seg...)
+	return append(out, b[2:]...)
+}
+
+func TestProcess(t *testing.T) {
+	t.Parallel()
+
+	sizes := []Size{{Name: "small", Max: 40}, {Name: "large", Max: 400}}
+
+	t.Run("jpeg", func(t *testing.T) {
+		t.Parallel()
+
+		b := withExif(encodeJPEG(t, testImage(200, 100)), 1)
+		require.Equal(t, 1, jpegOrientation(b))
+
+		res, err := Process(b, sizes)
+		require.NoError(t, err)
+		require.Equal(t, "image/jpeg", res.ContentType)
+		require.Equal(t, 200, res.Width)
+		require.Equal(t, 100, res.Height)
+		require.NotContains(t, string(res.Data), string(exifHeader))
+
+		require.Len(t, res.Variants, 2)
+		require.Equal(t, Variant{Name: "small", Width: 40, Height: 20, ContentType: "image/jpeg"}, withoutData(res.Variants[0]))
+		// never scaled up
+		require.Equal(t, Variant{Name: "large", Width: 200, Height: 100, ContentType: "image/jpeg"}, withoutData(res.Variants[1]))
+
+		img, err := jpeg.Decode(bytes.NewReader(res.Variants[0].Data))
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 40, 20), img.Bounds())
+	})
+
+	t.Run("jpeg_rotated", func(t *testing.T) {
+		t.Parallel()
+
+		b := withExif(encodeJPEG(t, testImage(200, 100)), 6)
+		require.Equal(t, 6, jpegOrientation(b))
+
+		res, err := Process(b, sizes)
+		require.NoError(t, err)
+		require.Equal(t, 100, res.Width)
+		require.Equal(t, 200, res.Height)
+		require.NotContains(t, string(res.Data), string(exifHeader))
+
+		img, err := jpeg.Decode(bytes.NewReader(res.Data))
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 100, 200), img.Bounds())
+
+		// the top left corner moved to the top right
+		r, g, _, _ := img.At(95, 4).RGBA()
+		require.Greater(t, r>>8, uint32(200))
+		require.Less(t, g>>8, uint32(50))
+	})
+
+	t.Run("png", func(t *testing.T) {
+		t.Parallel()
+
+		var buf bytes.Buffer
+		require.NoError(t, png.Encode(&buf, testImage(100, 300)))
+		b := buf.Bytes()
+
+		// a text chunk before the end
+		iend := len(b) - 12
+		text := binary.BigEndian.AppendUint32(nil, 7)
+		text = append(text, "tEXtkey\x00val"...)
+		text = binary.BigEndian.AppendUint32(text, crc32.ChecksumIEEE([]byte("tEXtkey\x00val")))
+		b = append(append(append([]byte{}, b[:iend]...), text...), b[iend:]...)
+
+		res, err := Process(b, sizes)
+		require.NoError(t, err)
+		require.Equal(t, "image/png", res.ContentType)
+		require.NotContains(t, string(res.Data), "tEXt")
+		require.Equal(t, Variant{Name: "small", Width: 13, Height: 40, ContentType: "image/png"}, withoutData(res.Variants[0]))
+
+		_, err = png.Decode(bytes.NewReader(res.Data))
+		require.NoError(t, err)
+	})
+
+	t.Run("gif", func(t *testing.T) {
+		t.Parallel()
+
+		b := encodeGIF(t, 2, 100, 50)
+		// a comment before the trailer
+		b = append(append(b[:len(b)-1:len(b)-1], "\x21\xfe\x06secret\x00"...), 0x3b)
+
+		res, err := Process(b, sizes)
+		require.NoError(t, err)
+		require.Equal(t, "image/gif", res.ContentType)
+		require.NotContains(t, string(res.Data), "secret")
+		require.Equal(t, Variant{Name: "small", Width: 40, Height: 20, ContentType: "image/png"}, withoutData(res.Variants[0]))
+
+		anim, err := gif.DecodeAll(bytes.NewReader(res.Data))
+		require.NoError(t, err)
+		require.Len(t, anim.Image, 2)
+	})
+
+	t.Run("gif_too_large", func(t *testing.T) {
+		t.Parallel()
+
+		// every frame fits but not all of them
+		b := encodeGIF(t, MaxPixels/(1000*1000)+1, 1000, 1000)
+
+		_, err := Process(b, sizes)
+		require.ErrorIs(t, err, domain.ErrImageTooLarge)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := Process([]byte("not an image"), sizes)
+		require.ErrorIs(t, err, domain.ErrImageInvalid)
+	})
+}
+
+func encodeGIF(t *testing.T, frames int, w int, h int) []byte {
+	t.Helper()
+
+	anim := &gif.GIF{}
+	for range frames {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&buf, anim))
+	return buf.Bytes()
+}
+
+func withoutData(v Variant) Variant {
+	v.Data = nil
+	return v
+}
+
+func TestResize(t *testing.T) {
+	t.Parallel()
+
+	// a uniform image stays uniform
+	src := image.NewRGBA(image.Rect(0, 0, 99, 33))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+
+	dst := resize(src, 10, 7)
+	require.Equal(t, image.Rect(0, 0, 10, 7), dst.Rect)
+	for _, p := range dst.Pix {
+		require.Equal(t, uint8(200), p)
+	}
+}
@@ -0,0 +1,220 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+const (
+	markerSOI  = 0xd8
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerAPPE = 0xee
+	markerAPPF = 0xef
+	markerCOM  = 0xfe
+
+	tagOrientation = 0x0112
+)
+
+var (
+	exifHeader   = []byte("Exif\x00\x00")
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// jpegSegment is a marker segment before the image data.
+type jpegSegment struct {
+	marker byte
+	data   []byte // the whole segment with marker and length
+}
+
+// jpegSegments splits the header of a jpeg into its segments, rest starts at
+// the image data.
+func jpegSegments(b []byte) ([]jpegSegment, []byte, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != markerSOI {
+		return nil, nil, domain.ErrImageInvalid
+	}
+
+	var segments []jpegSegment
+	for i := 2; ; {
+		// markers may be padded with any number of 0xff
+		for i+1 < len(b) && b[i] == 0xff && b[i+1] == 0xff {
+			i++
+		}
+		if i+4 > len(b) || b[i] != 0xff {
+			return nil, nil, domain.ErrImageInvalid
+		}
+
+		marker := b[i+1]
+		if marker == markerSOS {
+			return segments, b[i:], nil
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(b[i+2:]))
+		if end > len(b) {
+			return nil, nil, domain.ErrImageInvalid
+		}
+
+		segments = append(segments, jpegSegment{marker: marker, data: b[i:end]})
+		i = end
+	}
+}
+
+// stripJPEG drops the application segments carrying metadata such as exif
+// and xmp and the comments. The jfif header, the icc profile and the adobe
+// segment are kept since the colors depend on them.
+func stripJPEG(b []byte) ([]byte, error) {
+	segments, rest, err := jpegSegments(b)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(b))
+	out = append(out, 0xff, markerSOI)
+
+	for _, s := range segments {
+		switch {
+		case s.marker == markerAPP0, s.marker == markerAPP2, s.marker == markerAPPE:
+			// kept
+		case s.marker >= markerAPP1 && s.marker <= markerAPPF, s.marker == markerCOM:
+			continue
+		}
+		out = append(out, s.data...)
+	}
+
+	return append(out, rest...), nil
+}
+
+// jpegOrientation reads the exif orientation of a jpeg, 1 means upright.
+func jpegOrientation(b []byte) int {
+	segments, _, err := jpegSegments(b)
+	if err != nil {
+		return 1
+	}
+
+	for _, s := range segments {
+		if s.marker != markerAPP1 || !bytes.HasPrefix(s.data[4:], exifHeader) {
+			continue
+		}
+		return exifOrientation(s.data[4+len(exifHeader):])
+	}
+
+	return 1
+}
+
+// exifOrientation looks the orientation tag up in the first ifd of the tiff
+// structure holding the exif data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := range n {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == tagOrientation {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+
+	return 1
+}
+
+// stripPNG drops the chunks carrying exif, text and timestamps.
+func stripPNG(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, domain.ErrImageInvalid
+	}
+
+	out := make([]byte, 0, len(b))
+	out = append(out, pngSignature...)
+
+	for i := len(pngSignature); i < len(b); {
+		if i+12 > len(b) {
+			return nil, domain.ErrImageInvalid
+		}
+
+		end := i + 12 + int(binary.BigEndian.Uint32(b[i:]))
+		if end > len(b) || end < i {
+			return nil, domain.ErrImageInvalid
+		}
+
+		switch string(b[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, b[i:end]...)
+		}
+		i = end
+	}
+
+	return out, nil
+}
+
+// gifPixels sums the areas of the frames of a gif from their descriptors, the
+// frames are decoded one image each.
+func gifPixels(b []byte) (int, error) {
+	if len(b) < 13 || !bytes.HasPrefix(b, []byte("GIF8")) {
+		return 0, domain.ErrImageInvalid
+	}
+
+	i := 13
+	if b[10]&0x80 != 0 {
+		i += 3 << (b[10]&0x07 + 1)
+	}
+
+	pixels := 0
+	for i < len(b) {
+		switch b[i] {
+		case 0x21: // extension
+			i += 2
+		case 0x2c: // image descriptor
+			if i+10 > len(b) {
+				return 0, domain.ErrImageInvalid
+			}
+			w, h := int(binary.LittleEndian.Uint16(b[i+5:])), int(binary.LittleEndian.Uint16(b[i+7:]))
+			pixels += w * h
+			if b[i+9]&0x80 != 0 {
+				i += 3 << (b[i+9]&0x07 + 1)
+			}
+			i += 11 // descriptor and lzw code size
+		case 0x3b: // trailer
+			return pixels, nil
+		default:
+			return 0, domain.ErrImageInvalid
+		}
+
+		// both are followed by data sub-blocks
+		for i < len(b) && b[i] != 0 {
+			i += int(b[i]) + 1
+		}
+		i++
+	}
+
+	return pixels, nil
+}
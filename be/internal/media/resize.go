@@ -0,0 +1,128 @@
+package media
+
+import (
+	"image"
+	"math"
+)
+
+// contrib lists the source pixels covering a destination pixel with their
+// share of it.
+type contrib struct {
+	start   int
+	weights []float64
+}
+
+// contribs maps n source pixels onto m destination pixels by area, every
+// destination pixel averages the source pixels it covers.
+func contribs(n int, m int) []contrib {
+	scale := float64(n) / float64(m)
+
+	cs := make([]contrib, m)
+	for i := range cs {
+		lo := float64(i) * scale
+		hi := lo + scale
+
+		start := int(lo)
+		end := min(n, int(math.Ceil(hi)))
+
+		weights := make([]float64, end-start)
+		for j := start; j < end; j++ {
+			weights[j-start] = (min(hi, float64(j+1)) - max(lo, float64(j))) / scale
+		}
+
+		cs[i] = contrib{start: start, weights: weights}
+	}
+
+	return cs
+}
+
+// resize scales src down to w x h with a box filter, one axis at a time.
+// The pixels are premultiplied so transparent pixels do not bleed color.
+func resize(src *image.RGBA, w int, h int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+
+	tmp := image.NewRGBA(image.Rect(0, 0, w, sh))
+	for x, c := range contribs(sw, w) {
+		for y := range sh {
+			var px [4]float64
+			for k, weight := range c.weights {
+				i := src.PixOffset(c.start+k, y)
+				for ch := range px {
+					px[ch] += weight * float64(src.Pix[i+ch])
+				}
+			}
+			store(tmp.Pix[tmp.PixOffset(x, y):], px)
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y, c := range contribs(sh, h) {
+		for x := range w {
+			var px [4]float64
+			for k, weight := range c.weights {
+				i := tmp.PixOffset(x, c.start+k)
+				for ch := range px {
+					px[ch] += weight * float64(tmp.Pix[i+ch])
+				}
+			}
+			store(dst.Pix[dst.PixOffset(x, y):], px)
+		}
+	}
+
+	return dst
+}
+
+func store(pix []uint8, px [4]float64) {
+	for ch, v := range px {
+		pix[ch] = uint8(min(255, max(0, math.Round(v))))
+	}
+}
+
+// orient turns the image upright according to its exif orientation.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	return orientFunc(src.Rect.Dx(), src.Rect.Dy(), orientation, func(x int, y int, pix []uint8) {
+		copy(pix[:4], src.Pix[src.PixOffset(src.Rect.Min.X+x, src.Rect.Min.Y+y):])
+	})
+}
+
+// orientFunc renders a w x h image turned for the orientation, set stores
+// the source pixel at x, y into pix.
+func orientFunc(w int, h int, orientation int, set func(x int, y int, pix []uint8)) *image.RGBA {
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counterclockwise
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+
+			set(x, y, dst.Pix[dst.PixOffset(dx, dy):])
+		}
+	}
+
+	return dst
+}
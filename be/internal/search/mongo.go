@@ -0,0 +1,54 @@
+package search
+
+import (
+	"context"
+	"strings"
+
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+type database interface {
+	SearchMessages(ctx context.Context, search *domain.MessageSearch) ([]*domain.Message, error)
+}
+
+// Mongo searches through the text index of the messages collection, mongo
+// keeps the index up to date by itself.
+type Mongo struct {
+	db database
+}
+
+func NewMongo(db database) *Mongo {
+	return &Mongo{db: db}
+}
+
+func (m *Mongo) IndexMessage(context.Context, *domain.Message) error {
+	return nil
+}
+
+func (m *Mongo) RemoveMessage(context.Context, string) error {
+	return nil
+}
+
+// SearchMessages returns the best matches first.
+func (m *Mongo) SearchMessages(ctx context.Context, search *domain.MessageSearch) ([]*domain.SearchHit, error) {
+	terms := Terms(search.Query)
+	if len(terms) == 0 || len(search.RoomIDs) == 0 {
+		return []*domain.SearchHit{}, nil
+	}
+
+	// quoted terms must all match, unquoted ones would match any of them
+	q := *search
+	q.Query = `"` + strings.Join(terms, `" "`) + `"`
+
+	messages, err := m.db.SearchMessages(ctx, &q)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := make([]*domain.SearchHit, 0, len(messages))
+	for _, msg := range messages {
+		hits = append(hits, &domain.SearchHit{Message: msg, Snippet: Snippet(msg.Body, terms)})
+	}
+
+	return hits, nil
+}
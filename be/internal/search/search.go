@@ -0,0 +1,110 @@
+// Package search implements the message search indexes. Mongo relies on the
+// text index of the messages collection, SQLite keeps an FTS5 index of its
+// own and suits tests and single node deployments.
+package search
+
+import (
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	// matches are marked with control characters while the snippet is built
+	// and turned into tags once the text is escaped
+	markStart = "\x02"
+	markEnd   = "\x03"
+
+	snippetContext = 32 // runes shown before the first match
+	snippetLength  = 96 // runes shown in total
+)
+
+var (
+	stripMarks  = strings.NewReplacer(markStart, "", markEnd, "")
+	marksToTags = strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>")
+)
+
+// Terms splits the query into the lower cased words that are searched,
+// punctuation and operators are dropped.
+func Terms(q string) []string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !isWordRune(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if !slices.Contains(terms, w) {
+			terms = append(terms, w)
+		}
+	}
+
+	return terms
+}
+
+// Snippet returns an excerpt of body around the first word starting with
+// one of the terms, every such word prefix is highlighted.
+func Snippet(body string, terms []string) string {
+	text := []rune(stripMarks.Replace(body))
+	lower := make([]rune, len(text))
+	for i, r := range text {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	type match struct{ start, end int }
+
+	matches := make([]match, 0)
+	for i := 0; i < len(lower); i++ {
+		if i > 0 && isWordRune(lower[i-1]) {
+			continue
+		}
+		for _, t := range terms {
+			tr := []rune(t)
+			if len(tr) > 0 && len(lower)-i >= len(tr) && slices.Equal(lower[i:i+len(tr)], tr) {
+				matches = append(matches, match{i, i + len(tr)})
+				i += len(tr) - 1
+				break
+			}
+		}
+	}
+
+	start := 0
+	if len(matches) > 0 {
+		start = max(0, matches[0].start-snippetContext)
+	}
+	end := min(len(text), start+snippetLength)
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+
+	m := 0
+	for i := start; i < end; i++ {
+		for m < len(matches) && matches[m].end <= i {
+			m++
+		}
+		if m < len(matches) && matches[m].start == i {
+			b.WriteString(markStart)
+		}
+		b.WriteRune(text[i])
+		if m < len(matches) && (matches[m].end == i+1 || i+1 == end) && matches[m].start <= i {
+			b.WriteString(markEnd)
+		}
+	}
+
+	if end < len(text) {
+		b.WriteString("…")
+	}
+
+	return highlight(b.String())
+}
+
+// highlight escapes s and turns the match markers into <mark> tags.
+func highlight(s string) string {
+	return marksToTags.Replace(html.EscapeString(s))
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
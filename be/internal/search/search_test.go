@@ -0,0 +1,82 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTerms(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		query string
+		terms []string
+	}{
+		{name: "words", query: "Hello World", terms: []string{"hello", "world"}},
+		{name: "operators", query: `"deploy" OR -prod* NEAR(a)`, terms: []string{"deploy", "or", "prod", "near", "a"}},
+		{name: "duplicates", query: "go Go GO", terms: []string{"go"}},
+		{name: "unicode", query: "привет, мир", terms: []string{"привет", "мир"}},
+		{name: "punctuation_only", query: "?!", terms: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.terms, Terms(tt.query))
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("lorem ", 20) + "deploy " + strings.Repeat("ipsum ", 20)
+
+	tests := []struct {
+		name    string
+		body    string
+		terms   []string
+		snippet string
+	}{
+		{
+			name:    "highlight",
+			body:    "Deploy the release, then deploy again",
+			terms:   []string{"deploy"},
+			snippet: "<mark>Deploy</mark> the release, then <mark>deploy</mark> again",
+		},
+		{
+			name:    "word_prefix",
+			body:    "redeploy deployment",
+			terms:   []string{"deploy"},
+			snippet: "redeploy <mark>deploy</mark>ment",
+		},
+		{
+			name:    "escape",
+			body:    "<script>deploy</script>",
+			terms:   []string{"deploy"},
+			snippet: "&lt;script&gt;<mark>deploy</mark>&lt;/script&gt;",
+		},
+		{
+			name:    "stemmed_match",
+			body:    "she ran home",
+			terms:   []string{"run"},
+			snippet: "she ran home",
+		},
+		{
+			name:    "window",
+			body:    long,
+			terms:   []string{"deploy"},
+			snippet: "…" + strings.Repeat("lorem ", 6)[4:] + "<mark>deploy</mark> " + strings.Repeat("ipsum ", 10)[:57] + "…",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tt.snippet, Snippet(tt.body, tt.terms))
+		})
+	}
+}
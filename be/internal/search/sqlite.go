@@ -0,0 +1,185 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+// the fts table indexes the bodies of the messages table, the triggers keep
+// both in sync
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id         TEXT PRIMARY KEY,
+	room_id    TEXT NOT NULL,
+	user_id    TEXT NOT NULL,
+	parent_id  TEXT NOT NULL DEFAULT '',
+	seq        INTEGER NOT NULL,
+	body       TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS messages_room_id ON messages (room_id, created_at);
+
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+	body,
+	content = 'messages',
+	content_rowid = 'rowid',
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS messages_ai AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts (rowid, body) VALUES (new.rowid, new.body);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_ad AFTER DELETE ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, body) VALUES ('delete', old.rowid, old.body);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_au AFTER UPDATE ON messages BEGIN
+	INSERT INTO messages_fts (messages_fts, rowid, body) VALUES ('delete', old.rowid, old.body);
+	INSERT INTO messages_fts (rowid, body) VALUES (new.rowid, new.body);
+END;
+`
+
+// SQLite is a message index in an SQLite database using FTS5. The driver
+// compiles FTS5 in only with the sqlite_fts5 build tag.
+type SQLite struct {
+	db *sql.DB
+}
+
+// NewSQLite opens the index stored at path, ":memory:" keeps it in memory.
+func NewSQLite(ctx context.Context, path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, errors.New("open sqlite: " + err.Error())
+	}
+
+	// sqlite has a single writer, an in-memory database also lives in a
+	// single connection
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.ExecContext(ctx, sqliteSchema); err != nil {
+		_ = db.Close()
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil, errors.New("sqlite is built without fts5, build with -tags sqlite_fts5")
+		}
+		return nil, errors.New("create sqlite schema: " + err.Error())
+	}
+
+	return &SQLite{db: db}, nil
+}
+
+// IndexMessage adds the message or replaces the body of an indexed one.
+func (s *SQLite) IndexMessage(ctx context.Context, msg *domain.Message) error {
+	const q = `
+INSERT INTO messages (id, room_id, user_id, parent_id, seq, body, created_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET body = excluded.body`
+
+	_, err := s.db.ExecContext(ctx, q,
+		msg.ID, msg.RoomID, msg.UserID, msg.ParentID, msg.Seq,
+		stripMarks.Replace(msg.Body), msg.CreatedAt.UnixMilli(),
+	)
+	if err != nil {
+		log.Error("search.SQLite.IndexMessage", log.ChatID(msg.RoomID), log.Err(err))
+		return domain.ErrSearchIndex
+	}
+
+	return nil
+}
+
+func (s *SQLite) RemoveMessage(ctx context.Context, messageID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM messages WHERE id = ?`, messageID)
+	if err != nil {
+		log.Error("search.SQLite.RemoveMessage", log.Err(err))
+		return domain.ErrSearchIndex
+	}
+
+	return nil
+}
+
+// SearchMessages returns the best matches first.
+func (s *SQLite) SearchMessages(ctx context.Context, search *domain.MessageSearch) ([]*domain.SearchHit, error) {
+	terms := Terms(search.Query)
+	if len(terms) == 0 || len(search.RoomIDs) == 0 {
+		return []*domain.SearchHit{}, nil
+	}
+
+	// every term is quoted so that it is matched as a word and not parsed as
+	// an fts5 operator
+	match := `"` + strings.Join(terms, `" "`) + `"`
+
+	var b strings.Builder
+	b.WriteString(`
+SELECT m.id, m.room_id, m.user_id, m.parent_id, m.seq, m.body, m.created_at,
+	snippet(messages_fts, 0, char(2), char(3), '…', 16)
+FROM messages_fts
+JOIN messages m ON m.rowid = messages_fts.rowid
+WHERE messages_fts MATCH ? AND m.room_id IN (?` + strings.Repeat(", ?", len(search.RoomIDs)-1) + `)`)
+
+	args := []any{match}
+	for _, roomID := range search.RoomIDs {
+		args = append(args, roomID)
+	}
+
+	if search.UserID != "" {
+		b.WriteString(` AND m.user_id = ?`)
+		args = append(args, search.UserID)
+	}
+	if !search.After.IsZero() {
+		b.WriteString(` AND m.created_at > ?`)
+		args = append(args, search.After.UnixMilli())
+	}
+	if !search.Before.IsZero() {
+		b.WriteString(` AND m.created_at < ?`)
+		args = append(args, search.Before.UnixMilli())
+	}
+
+	b.WriteString(` ORDER BY rank LIMIT ?`)
+	args = append(args, search.Limit)
+
+	rows, err := s.db.QueryContext(ctx, b.String(), args...)
+	if err != nil {
+		log.Error("search.SQLite.SearchMessages", log.Err(err))
+		return nil, domain.ErrSearchIndex
+	}
+	defer func() { _ = rows.Close() }()
+
+	hits := make([]*domain.SearchHit, 0, search.Limit)
+	for rows.Next() {
+		var (
+			msg       domain.Message
+			createdAt int64
+			snippet   string
+		)
+
+		err = rows.Scan(&msg.ID, &msg.RoomID, &msg.UserID, &msg.ParentID, &msg.Seq, &msg.Body, &createdAt, &snippet)
+		if err != nil {
+			log.Error("search.SQLite.SearchMessages", log.Err(err))
+			return nil, domain.ErrSearchIndex
+		}
+		msg.CreatedAt = time.UnixMilli(createdAt).UTC()
+
+		hits = append(hits, &domain.SearchHit{Message: &msg, Snippet: highlight(snippet)})
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Error("search.SQLite.SearchMessages", log.Err(err))
+		return nil, domain.ErrSearchIndex
+	}
+
+	return hits, nil
+}
+
+func (s *SQLite) Close() {
+	if err := s.db.Close(); err != nil {
+		log.Error("search.SQLite.Close", log.Err(err))
+	}
+}
@@ -0,0 +1,120 @@
+package search
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLite(t *testing.T) *SQLite {
+	t.Helper()
+
+	s, err := NewSQLite(context.Background(), ":memory:")
+	if err != nil && strings.Contains(err.Error(), "fts5") {
+		t.Skip(err.Error())
+	}
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestSQLite(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	s := newTestSQLite(t)
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	messages := []*domain.Message{
+		{ID: "m1", RoomID: "room-1", UserID: "alice", Seq: 1, Body: "deploy the release today", CreatedAt: now.Add(-3 * time.Hour)},
+		{ID: "m2", RoomID: "room-1", UserID: "bob", Seq: 2, Body: "the release is <b>blocked</b>", CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "m3", RoomID: "room-2", UserID: "alice", Seq: 1, Body: "release notes", CreatedAt: now.Add(-time.Hour)},
+		{ID: "m4", RoomID: "room-3", UserID: "eve", Seq: 1, Body: "secret release", CreatedAt: now},
+	}
+	for _, msg := range messages {
+		require.NoError(t, s.IndexMessage(ctx, msg))
+	}
+
+	ids := func(hits []*domain.SearchHit) []string {
+		out := make([]string, 0, len(hits))
+		for _, h := range hits {
+			out = append(out, h.Message.ID)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		search domain.MessageSearch
+		ids    []string
+	}{
+		{
+			name:   "member_rooms_only",
+			search: domain.MessageSearch{Query: "release", RoomIDs: []string{"room-1", "room-2"}},
+			ids:    []string{"m1", "m2", "m3"},
+		},
+		{
+			name:   "all_terms",
+			search: domain.MessageSearch{Query: "Release, deploy!", RoomIDs: []string{"room-1", "room-2"}},
+			ids:    []string{"m1"},
+		},
+		{
+			name:   "author",
+			search: domain.MessageSearch{Query: "release", RoomIDs: []string{"room-1", "room-2"}, UserID: "alice"},
+			ids:    []string{"m1", "m3"},
+		},
+		{
+			name: "time_range",
+			search: domain.MessageSearch{
+				Query:   "release",
+				RoomIDs: []string{"room-1", "room-2"},
+				After:   now.Add(-150 * time.Minute),
+				Before:  now,
+			},
+			ids: []string{"m2", "m3"},
+		},
+		{
+			name:   "fts_syntax_is_ignored",
+			search: domain.MessageSearch{Query: `release" OR "secret`, RoomIDs: []string{"room-1"}},
+			ids:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			search := tt.search
+			search.Limit = domain.SearchDefaultLimit
+
+			hits, err := s.SearchMessages(ctx, &search)
+			require.NoError(t, err)
+			require.ElementsMatch(t, tt.ids, ids(hits))
+		})
+	}
+
+	t.Run("snippet", func(t *testing.T) {
+		hits, err := s.SearchMessages(ctx, &domain.MessageSearch{Query: "blocked", RoomIDs: []string{"room-1"}, Limit: 1})
+		require.NoError(t, err)
+		require.Len(t, hits, 1)
+		require.Equal(t, "the release is &lt;b&gt;<mark>blocked</mark>&lt;/b&gt;", hits[0].Snippet)
+	})
+
+	t.Run("edit_and_remove", func(t *testing.T) {
+		edited := *messages[0]
+		edited.Body = "rollback"
+		require.NoError(t, s.IndexMessage(ctx, &edited))
+		require.NoError(t, s.RemoveMessage(ctx, "m2"))
+
+		hits, err := s.SearchMessages(ctx, &domain.MessageSearch{Query: "release", RoomIDs: []string{"room-1"}, Limit: 10})
+		require.NoError(t, err)
+		require.Empty(t, hits)
+
+		hits, err = s.SearchMessages(ctx, &domain.MessageSearch{Query: "rollback", RoomIDs: []string{"room-1"}, Limit: 10})
+		require.NoError(t, err)
+		require.Equal(t, []string{"m1"}, ids(hits))
+	})
+}
@@ -0,0 +1,289 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/escalopa/chatterly/internal/media"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/google/uuid"
+)
+
+// sniffSize is how much of an upload is read to detect its content type.
+const sniffSize = 3072
+
+// attachmentSizes are the variants rendered for image attachments.
+var attachmentSizes = []media.Size{
+	{Name: "small", Max: 320},
+	{Name: "large", Max: 1280},
+}
+
+// UploadAttachment stores the content of r as an attachment of the room, its
+// content type is detected from the content and not taken from the client.
+func (s *Service) UploadAttachment(ctx context.Context, userID string, roomID string, name string, r io.Reader) (*domain.Attachment, error) {
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, domain.ErrAttachmentEmpty
+	}
+	head = head[:n]
+
+	attachment := &domain.Attachment{
+		ID:          uuid.NewString(),
+		RoomID:      roomID,
+		UserID:      userID,
+		Name:        attachmentName(name),
+		ContentType: mimetype.Detect(head).String(),
+		CreatedAt:   time.Now().UTC().Truncate(time.Millisecond),
+	}
+
+	src := &limitedReader{r: io.MultiReader(bytes.NewReader(head), r), limit: s.cfg.MaxAttachmentSize}
+
+	if media.Supported(attachment.ContentType) {
+		err = s.putImage(ctx, attachment, src)
+	} else {
+		err = s.blob.Put(ctx, attachment.ID, src)
+		attachment.Size = src.read
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.db.CreateAttachment(ctx, attachment); err != nil {
+		s.deleteBlobs(ctx, attachmentKeys(attachment))
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// putImage stores the image without its metadata along with its variants.
+func (s *Service) putImage(ctx context.Context, attachment *domain.Attachment, r io.Reader) error {
+	img, err := s.processImage(ctx, r, attachmentSizes)
+	if err != nil {
+		return err
+	}
+
+	attachment.ContentType = img.ContentType
+	attachment.Size = int64(len(img.Data))
+	attachment.Width = img.Width
+	attachment.Height = img.Height
+
+	if err = s.blob.Put(ctx, attachment.ID, bytes.NewReader(img.Data)); err != nil {
+		return err
+	}
+
+	for _, v := range img.Variants {
+		if err = s.blob.Put(ctx, variantKey(attachment.ID, v.Name), bytes.NewReader(v.Data)); err != nil {
+			s.deleteBlobs(ctx, attachmentKeys(attachment))
+			return err
+		}
+
+		attachment.Variants = append(attachment.Variants, domain.AttachmentVariant{
+			Name:        v.Name,
+			Width:       v.Width,
+			Height:      v.Height,
+			ContentType: v.ContentType,
+			Size:        int64(len(v.Data)),
+		})
+	}
+
+	return nil
+}
+
+// processImage buffers the image and renders its variants. An image takes
+// many times its size in memory while being processed, so only as many as
+// there are workers are buffered at once.
+func (s *Service) processImage(ctx context.Context, r io.Reader, sizes []media.Size) (*media.Image, error) {
+	select {
+	case s.images <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-s.images }()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return media.Process(b, sizes)
+}
+
+// GetAttachmentURL returns a download url of the attachment signed for the
+// user.
+func (s *Service) GetAttachmentURL(ctx context.Context, userID string, roomID string, attachmentID string) (*domain.AttachmentURL, error) {
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	attachment, err := s.db.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the attachments of deleted messages are gone with them
+	if attachment.RoomID != roomID || attachment.DeletedAt != nil {
+		return nil, domain.ErrDBAttachmentNotFound
+	}
+
+	q, expiresAt := s.urlSigner.Sign(attachment.ID, userID)
+
+	attachmentURL := &domain.AttachmentURL{
+		Attachment: attachment,
+		URL:        "/api/attachments/" + url.PathEscape(attachment.ID) + "?" + q.Encode(),
+		ExpiresAt:  expiresAt,
+	}
+
+	if len(attachment.Variants) > 0 {
+		attachmentURL.VariantURLs = make(map[string]string, len(attachment.Variants))
+		for _, v := range attachment.Variants {
+			attachmentURL.VariantURLs[v.Name] = attachmentURL.URL + "&variant=" + url.QueryEscape(v.Name)
+		}
+	}
+
+	return attachmentURL, nil
+}
+
+// OpenAttachment opens the attachment of a signed download url, the user it
+// was signed for must still be a member of the room. The signature covers
+// every variant, the returned attachment describes the opened one.
+func (s *Service) OpenAttachment(ctx context.Context, attachmentID string, variant string, q url.Values) (*domain.Attachment, io.ReadCloser, error) {
+	userID, err := s.urlSigner.Verify(attachmentID, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attachment, err := s.db.GetAttachment(ctx, attachmentID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// urls signed before the message was deleted stop working
+	if attachment.DeletedAt != nil {
+		return nil, nil, domain.ErrDBAttachmentNotFound
+	}
+
+	if err = s.checkRoomMember(ctx, attachment.RoomID, userID); err != nil {
+		return nil, nil, err
+	}
+
+	key := attachment.ID
+	if variant != "" {
+		v := attachment.Variant(variant)
+		if v == nil {
+			return nil, nil, domain.ErrDBAttachmentNotFound
+		}
+
+		key = variantKey(attachment.ID, v.Name)
+		attachment.ContentType = v.ContentType
+		attachment.Size = v.Size
+		attachment.Width = v.Width
+		attachment.Height = v.Height
+	}
+
+	rc, err := s.blob.Open(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return attachment, rc, nil
+}
+
+// checkAttachments fails unless every attachment was uploaded by the sender
+// to the room of the message and not deleted since.
+func (s *Service) checkAttachments(ctx context.Context, msg *domain.Message) error {
+	if len(msg.AttachmentIDs) > domain.MessageMaxAttachments {
+		return domain.ErrAttachmentLimit
+	}
+
+	slices.Sort(msg.AttachmentIDs)
+	msg.AttachmentIDs = slices.Compact(msg.AttachmentIDs)
+
+	attachments, err := s.db.ListAttachments(ctx, msg.AttachmentIDs)
+	if err != nil {
+		return err
+	}
+
+	if len(attachments) != len(msg.AttachmentIDs) {
+		return domain.ErrAttachmentInvalid
+	}
+
+	for _, a := range attachments {
+		if a.RoomID != msg.RoomID || a.UserID != msg.UserID || a.DeletedAt != nil {
+			return domain.ErrAttachmentInvalid
+		}
+	}
+
+	return nil
+}
+
+// attachmentKeys returns the blob keys of the attachment and its variants.
+func attachmentKeys(attachment *domain.Attachment) []string {
+	keys := []string{attachment.ID}
+	for _, v := range attachment.Variants {
+		keys = append(keys, variantKey(attachment.ID, v.Name))
+	}
+	return keys
+}
+
+func variantKey(id string, name string) string {
+	return id + "." + name
+}
+
+// deleteBlobs removes blobs that are no longer referenced, failures only
+// leave garbage behind.
+func (s *Service) deleteBlobs(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := s.blob.Delete(ctx, key); err != nil {
+			log.Warn("service: delete orphan blob", log.String("key", key), log.Err(err))
+		}
+	}
+}
+
+// attachmentName keeps the base name of the uploaded file.
+func attachmentName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == "/" || name == "" {
+		return "file"
+	}
+
+	if utf8.RuneCountInString(name) > domain.AttachmentNameMaxLength {
+		name = string([]rune(name)[:domain.AttachmentNameMaxLength])
+	}
+
+	return name
+}
+
+// limitedReader fails once more than limit bytes are read.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, domain.ErrAttachmentTooLarge
+	}
+	return n, err
+}
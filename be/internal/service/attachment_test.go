@@ -0,0 +1,87 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/auth"
+	"github.com/escalopa/chatterly/internal/blob"
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessImage_Workers(t *testing.T) {
+	t.Parallel()
+
+	s := New(Config{ImageWorkers: 1}, newFakeDB(), nil, nil, nil, nil, nil, nil, nil, nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 10, 10))))
+
+	// the only worker is busy
+	s.images <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := s.processImage(ctx, bytes.NewReader(buf.Bytes()), avatarSizes)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	<-s.images
+
+	img, err := s.processImage(context.Background(), bytes.NewReader(buf.Bytes()), avatarSizes)
+	require.NoError(t, err)
+	require.Len(t, img.Variants, len(avatarSizes))
+	require.Empty(t, s.images)
+}
+
+func TestAttachment_DeletedMessage(t *testing.T) {
+	t.Parallel()
+
+	db := newMessageDB()
+	db.message("alice-1").AttachmentIDs = []string{"file"}
+	db.attachments["file"] = &domain.Attachment{ID: "file", RoomID: "room", UserID: "alice", Name: "notes.txt"}
+
+	store, err := blob.NewLocal(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, store.Put(context.Background(), "file", strings.NewReader("notes")))
+
+	signer, err := auth.NewURLSigner(config.URLConfig{SecretKey: "test-secret"})
+	require.NoError(t, err)
+
+	b := newFakeBroker()
+	s := New(Config{}, db, nil, nil, nil, gateway.New(b), b, fakeSearch{}, store, signer)
+
+	attachmentURL, err := s.GetAttachmentURL(context.Background(), "bob", "room", "file")
+	require.NoError(t, err)
+
+	u, err := url.Parse(attachmentURL.URL)
+	require.NoError(t, err)
+
+	_, rc, err := s.OpenAttachment(context.Background(), "file", "", u.Query())
+	require.NoError(t, err)
+	content, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "notes", string(content))
+
+	msg, err := s.DeleteMessage(context.Background(), "alice", "room", "alice-1")
+	require.NoError(t, err)
+	require.Empty(t, msg.AttachmentIDs)
+
+	// neither a new url nor one signed before the deletion opens it
+	_, err = s.GetAttachmentURL(context.Background(), "bob", "room", "file")
+	require.ErrorIs(t, err, domain.ErrDBAttachmentNotFound)
+
+	_, _, err = s.OpenAttachment(context.Background(), "file", "", u.Query())
+	require.ErrorIs(t, err, domain.ErrDBAttachmentNotFound)
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/media"
+	"github.com/google/uuid"
+)
+
+const (
+	avatarMaxSize     = 5 << 20 // 5MB
+	avatarDefaultSize = "256"
+)
+
+// avatarSizes are the variants an avatar is served in, the original is not
+// kept.
+var avatarSizes = []media.Size{
+	{Name: "64", Max: 64},
+	{Name: "128", Max: 128},
+	{Name: "256", Max: 256},
+}
+
+// UploadAvatar replaces the avatar of the user with the image, later logins
+// keep it instead of the avatar of the provider.
+func (s *Service) UploadAvatar(ctx context.Context, userID string, r io.Reader) (*domain.User, error) {
+	img, err := s.processImage(ctx, &limitedReader{r: r, limit: avatarMaxSize}, avatarSizes)
+	if err != nil {
+		return nil, err
+	}
+
+	avatarID := uuid.NewString()
+
+	keys := make([]string, 0, len(img.Variants))
+	for _, v := range img.Variants {
+		key := variantKey(avatarID, v.Name)
+		if err = s.blob.Put(ctx, key, bytes.NewReader(v.Data)); err != nil {
+			s.deleteBlobs(ctx, keys)
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	prevID, err := s.db.SetAvatar(ctx, userID, avatarID, "/api/avatars/"+avatarID)
+	if err != nil {
+		s.deleteBlobs(ctx, keys)
+		return nil, err
+	}
+
+	if prevID != "" {
+		s.deleteBlobs(ctx, avatarKeys(prevID))
+	}
+
+	return s.db.GetUser(ctx, userID)
+}
+
+// OpenAvatar opens the avatar in one of the avatar sizes, the largest by
+// default. Avatar ids are random and avatars are public.
+func (s *Service) OpenAvatar(ctx context.Context, avatarID string, size string) (io.ReadCloser, error) {
+	if size == "" {
+		size = avatarDefaultSize
+	}
+
+	if !slices.ContainsFunc(avatarSizes, func(sz media.Size) bool { return sz.Name == size }) {
+		return nil, domain.ErrAvatarSizeInvalid
+	}
+
+	if _, err := uuid.Parse(avatarID); err != nil {
+		return nil, domain.ErrAvatarNotFound
+	}
+
+	rc, err := s.blob.Open(ctx, variantKey(avatarID, size))
+	if err != nil {
+		if errors.Is(err, domain.ErrBlobNotFound) {
+			return nil, domain.ErrAvatarNotFound
+		}
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+func avatarKeys(avatarID string) []string {
+	keys := make([]string, 0, len(avatarSizes))
+	for _, size := range avatarSizes {
+		keys = append(keys, variantKey(avatarID, size.Name))
+	}
+	return keys
+}
@@ -0,0 +1,291 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/google/uuid"
+)
+
+func (s *Service) handleFrame(ctx context.Context, c *gateway.Client, f *gateway.Frame) {
+	var err error
+
+	switch f.Type {
+	case gateway.FrameMessageSend:
+		err = s.sendMessage(ctx, c, f)
+	case gateway.FrameResume:
+		err = s.resume(ctx, c, f)
+	case gateway.FrameDelivered:
+		err = s.advanceReceipt(ctx, c, f, false)
+	case gateway.FrameRead:
+		err = s.advanceReceipt(ctx, c, f, true)
+	case gateway.FrameTypingStart:
+		err = s.startTyping(ctx, c.RoomID(), c.User().ID)
+	case gateway.FrameTypingStop:
+		err = s.stopTyping(ctx, c.RoomID(), c.User().ID)
+	case gateway.FramePresence:
+		err = s.setPresence(ctx, c, f)
+	case gateway.FrameThreadSubscribe:
+		err = s.subscribeThread(ctx, c, f)
+	case gateway.FrameThreadUnsubscribe:
+		err = unsubscribeThread(c, f)
+	default:
+		err = domain.ErrFrameUnknown
+	}
+
+	if err != nil {
+		c.SendError(err)
+	}
+}
+
+func (s *Service) sendMessage(ctx context.Context, c *gateway.Client, f *gateway.Frame) error {
+	var data gateway.MessageSendData
+	if err := f.Decode(&data); err != nil {
+		return domain.ErrFrameInvalid
+	}
+
+	// a message may consist of its attachments alone
+	body, err := messageBody(data.Body)
+	if err != nil && (!errors.Is(err, domain.ErrMessageEmpty) || len(data.AttachmentIDs) == 0) {
+		return err
+	}
+
+	msg := &domain.Message{
+		ID:            uuid.NewString(),
+		RoomID:        c.RoomID(),
+		UserID:        c.User().ID,
+		ClientID:      data.ClientID,
+		ParentID:      data.ParentID,
+		Body:          body,
+		AttachmentIDs: data.AttachmentIDs,
+		CreatedAt:     time.Now().UTC().Truncate(time.Millisecond), // mongo keeps milliseconds
+	}
+
+	if len(msg.AttachmentIDs) > 0 {
+		if err := s.checkAttachments(ctx, msg); err != nil {
+			return err
+		}
+	}
+
+	if msg.ParentID != "" {
+		parent, err := s.threadParent(ctx, msg.RoomID, msg.ParentID)
+		if err != nil {
+			return err
+		}
+		if parent.DeletedAt != nil {
+			return domain.ErrMessageDeleted
+		}
+	}
+
+	if msg.ClientID != "" {
+		if _, err := uuid.Parse(msg.ClientID); err != nil {
+			return domain.ErrClientIDInvalid
+		}
+
+		messageID, ok, err := s.db.ReserveClientID(ctx, msg.RoomID, msg.UserID, msg.ClientID, msg.ID, s.cfg.DedupWindow)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return s.ackDuplicate(ctx, c, msg.ClientID, messageID)
+		}
+	}
+
+	notifications, err := s.storeMessage(ctx, msg)
+	if err != nil {
+		if msg.ClientID != "" {
+			_ = s.db.ReleaseClientID(ctx, msg.RoomID, msg.UserID, msg.ClientID, msg.ID)
+		}
+		return err
+	}
+
+	// the message is stored and its client id taken, failing from here on
+	// would make a retry ack a message that was never announced. Clients
+	// missing it live get it on resume.
+	if msg.ParentID != "" {
+		err = s.db.AddReply(ctx, msg.ParentID, msg.CreatedAt)
+	} else {
+		err = s.db.SetDMLastMessage(ctx, msg)
+	}
+	if err != nil {
+		log.Warn("service: update conversation", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	// the sender has read the conversation up to their own message
+	s.readUpTo(ctx, msg.RoomID, msg.UserID, msg.Seq)
+
+	if err := s.broker.PublishMessage(ctx, msg); err != nil {
+		log.Warn("service: publish message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	ack(c, msg, false)
+
+	// the message is stored, a search index lagging behind is not fatal
+	if err := s.search.IndexMessage(ctx, msg); err != nil {
+		log.Warn("service: index message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	if err := s.notify(ctx, notifications); err != nil {
+		log.Warn("service: notify mentions", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	if err := s.stopTyping(ctx, msg.RoomID, msg.UserID); err != nil {
+		log.Warn("service: stop typing", log.UserID(msg.UserID), log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	return nil
+}
+
+// storeMessage resolves the mentions of the message and stores it, the
+// sender must still be a member. It returns the notifications to send.
+func (s *Service) storeMessage(ctx context.Context, msg *domain.Message) ([]*domain.Notification, error) {
+	members, err := s.members(ctx, msg.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ticket was checked on connect, the sender may have left since
+	if !slices.Contains(members, msg.UserID) {
+		return nil, domain.ErrRoomNotMember
+	}
+
+	notifications, err := s.resolveMentions(ctx, msg, members)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.db.CreateMessage(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	// the message is stored, the counts catch up on the next read
+	if err = s.db.CountUnread(ctx, msg, members); err != nil {
+		log.Warn("service: count unread", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	for _, n := range notifications {
+		n.Seq = msg.Seq
+	}
+
+	return notifications, nil
+}
+
+func messageBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", domain.ErrMessageEmpty
+	}
+	if utf8.RuneCountInString(body) > domain.MessageMaxLength {
+		return "", domain.ErrMessageTooLong
+	}
+	return body, nil
+}
+
+// ackDuplicate acknowledges a retried send with the original message.
+func (s *Service) ackDuplicate(ctx context.Context, c *gateway.Client, clientID string, messageID string) error {
+	msg, err := s.db.GetMessage(ctx, messageID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBMessageNotFound) {
+			// the original send has claimed the client id but is not stored yet
+			return domain.ErrMessagePending
+		}
+		return err
+	}
+
+	msg.ClientID = clientID
+	ack(c, msg, true)
+	return nil
+}
+
+func ack(c *gateway.Client, msg *domain.Message, duplicate bool) {
+	f, _ := gateway.NewFrame(gateway.FrameMessageAck, gateway.MessageAckData{
+		ClientID:  msg.ClientID,
+		ID:        msg.ID,
+		Seq:       msg.Seq,
+		Duplicate: duplicate,
+	})
+	c.Send(f)
+}
+
+const resumeBatchSize = 100
+
+// resume replays the changes to the messages the client has and the messages
+// it missed since the seq it has seen. A failed replay ends without
+// resume.done, the client resumes again.
+func (s *Service) resume(ctx context.Context, c *gateway.Client, f *gateway.Frame) error {
+	var data gateway.ResumeData
+	if err := f.Decode(&data); err != nil || data.Seq < 0 {
+		return domain.ErrFrameInvalid
+	}
+
+	c.StartReplay()
+
+	if err := s.replayChanges(ctx, c, data.Seq); err != nil {
+		c.AbortReplay(data.Seq)
+		return err
+	}
+
+	seq, err := s.replay(ctx, c, data.Seq)
+	if err != nil {
+		c.AbortReplay(seq)
+		return err
+	}
+
+	c.FinishReplay(seq)
+	return nil
+}
+
+// replayChanges queues the messages up to seq edited or deleted since.
+func (s *Service) replayChanges(ctx context.Context, c *gateway.Client, seq int64) error {
+	if seq == 0 {
+		return nil
+	}
+
+	var after int64
+	for {
+		messages, err := s.db.ListMessageChanges(ctx, c.RoomID(), seq, after, resumeBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			if err = c.ReplayChange(msg); err != nil {
+				return nil // client is gone
+			}
+			after = msg.Seq
+		}
+
+		if len(messages) < resumeBatchSize {
+			return nil
+		}
+	}
+}
+
+// replay queues the messages after seq and returns the last replayed seq.
+func (s *Service) replay(ctx context.Context, c *gateway.Client, seq int64) (int64, error) {
+	for {
+		messages, err := s.db.ListMessagesAfter(ctx, c.RoomID(), seq, resumeBatchSize)
+		if err != nil {
+			return seq, err
+		}
+
+		for _, msg := range messages {
+			if err = c.ReplayMessage(msg); err != nil {
+				return seq, nil // client is gone
+			}
+			seq = msg.Seq
+		}
+
+		if len(messages) < resumeBatchSize {
+			return seq, nil
+		}
+	}
+}
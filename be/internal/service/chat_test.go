@@ -0,0 +1,190 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendMessage_Retry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		publishErr error
+	}{
+		{
+			name: "published",
+		},
+		{
+			name:       "publish_failed",
+			publishErr: domain.ErrBrokerPublish,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("alice")
+			db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "alice", Role: domain.RoomRoleOwner}}}
+			s, b, url := newTestService(t, db)
+
+			conn, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+			require.NoError(t, err)
+
+			b.failPublish(tt.publishErr)
+
+			data := gateway.MessageSendData{Body: "hello", ClientID: uuid.NewString()}
+			send(t, conn, data)
+
+			// the message is stored, so it is acked even if not published
+			var first gateway.MessageAckData
+			require.NoError(t, readFrameOf(t, conn, gateway.FrameMessageAck).Decode(&first))
+			require.False(t, first.Duplicate)
+
+			b.failPublish(nil)
+			send(t, conn, data)
+
+			var retry gateway.MessageAckData
+			require.NoError(t, readFrameOf(t, conn, gateway.FrameMessageAck).Decode(&retry))
+			require.True(t, retry.Duplicate)
+			require.Equal(t, first.ID, retry.ID)
+			require.Equal(t, first.Seq, retry.Seq)
+
+			messages := db.listMessages("room")
+			require.Len(t, messages, 1)
+			require.Equal(t, first.ID, messages[0].ID)
+		})
+	}
+}
+
+func TestResume(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		listErr error
+	}{
+		{
+			name: "replayed",
+		},
+		{
+			name:    "list_failed",
+			listErr: domain.ErrDBQuery,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("alice")
+			db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "alice", Role: domain.RoomRoleOwner}}}
+			for seq := range int64(3) {
+				db.messages = append(db.messages, &domain.Message{ID: uuid.NewString(), RoomID: "room", UserID: "alice", Seq: seq + 1})
+			}
+			s, _, url := newTestService(t, db)
+
+			conn, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+			require.NoError(t, err)
+
+			db.failListMessages(tt.listErr)
+
+			resume := func() {
+				f, err := gateway.NewFrame(gateway.FrameResume, gateway.ResumeData{Seq: 1})
+				require.NoError(t, err)
+				require.NoError(t, conn.WriteJSON(f))
+			}
+			resume()
+
+			if tt.listErr != nil {
+				require.Equal(t, gateway.FrameError, readFrame(t, conn).Type)
+
+				// frames are handled in order, nothing but the error was sent
+				require.NoError(t, conn.WriteJSON(gateway.Frame{Type: "unknown"}))
+				require.Equal(t, gateway.FrameError, readFrame(t, conn).Type)
+
+				// the client resumes again once the failure is gone
+				db.failListMessages(nil)
+				resume()
+			}
+
+			var seqs []int64
+			for range 2 {
+				f := readFrame(t, conn)
+				require.Equal(t, gateway.FrameMessageNew, f.Type)
+
+				var msg domain.Message
+				require.NoError(t, f.Decode(&msg))
+				seqs = append(seqs, msg.Seq)
+			}
+			require.Equal(t, []int64{2, 3}, seqs)
+
+			var done gateway.ResumeData
+			require.NoError(t, readFrameOf(t, conn, gateway.FrameResumeDone).Decode(&done))
+			require.Equal(t, int64(3), done.Seq)
+		})
+	}
+}
+
+func TestResume_Changes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	db := newFakeDB()
+	db.addUsers("alice")
+	db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "alice", Role: domain.RoomRoleOwner}}}
+	db.messages = []*domain.Message{
+		// edited before the client saw seq 3
+		{ID: "1", RoomID: "room", UserID: "alice", Seq: 1, Body: "one!", EditedAt: &now, EditSeq: 2},
+		// edited while the last seq was 3, the client may have missed it
+		{ID: "2", RoomID: "room", UserID: "alice", Seq: 2, Body: "two!", EditedAt: &now, EditSeq: 3},
+		// deleted after the client saw seq 3
+		{ID: "3", RoomID: "room", UserID: "alice", Seq: 3, DeletedAt: &now, DeletedBy: "alice", EditSeq: 4},
+		// missed altogether, replayed in its current state
+		{ID: "4", RoomID: "room", UserID: "alice", Seq: 4, Body: "four!", EditedAt: &now, EditSeq: 4},
+	}
+	s, _, url := newTestService(t, db)
+
+	conn, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+	require.NoError(t, err)
+
+	f, err := gateway.NewFrame(gateway.FrameResume, gateway.ResumeData{Seq: 3})
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(f))
+
+	expected := []struct {
+		typ  string
+		id   string
+		body string
+	}{
+		{gateway.FrameMessageEdited, "2", "two!"},
+		{gateway.FrameMessageDeleted, "3", ""},
+		{gateway.FrameMessageNew, "4", "four!"},
+	}
+
+	for _, e := range expected {
+		f := readFrame(t, conn)
+		require.Equal(t, e.typ, f.Type)
+
+		var msg domain.Message
+		require.NoError(t, f.Decode(&msg))
+		require.Equal(t, e.id, msg.ID)
+		require.Equal(t, e.body, msg.Body)
+	}
+
+	f = readFrame(t, conn)
+	require.Equal(t, gateway.FrameResumeDone, f.Type)
+
+	var done gateway.ResumeData
+	require.NoError(t, f.Decode(&done))
+	require.Equal(t, int64(4), done.Seq)
+}
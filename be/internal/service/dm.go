@@ -0,0 +1,24 @@
+package service
+
+import (
+	"context"
+
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+func (s *Service) OpenDM(ctx context.Context, userID string, peerID string) (*domain.DM, error) {
+	if userID == peerID {
+		return nil, domain.ErrDMSelf
+	}
+
+	// make sure the peer exists before creating the dm
+	if _, err := s.db.GetUser(ctx, peerID); err != nil {
+		return nil, err
+	}
+
+	return s.db.OpenDM(ctx, userID, peerID)
+}
+
+func (s *Service) ListDMs(ctx context.Context, userID string) ([]*domain.DM, error) {
+	return s.db.ListDMs(ctx, userID)
+}
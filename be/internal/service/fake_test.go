@@ -0,0 +1,1145 @@
+package service
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/auth"
+	"github.com/escalopa/chatterly/internal/config"
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDB keeps the data of the service tests in memory, methods a test does
+// not reach are left to the embedded nil interface and panic.
+type fakeDB struct {
+	database
+
+	mu       sync.Mutex
+	users    []*domain.User
+	sessions map[string]*domain.Session
+	rooms    map[string]*domain.Room
+	dms      map[string]*domain.DM
+
+	messages      []*domain.Message
+	attachments   map[string]*domain.Attachment
+	listErr       error
+	dedup         map[string]string
+	receipts      map[string]*domain.Receipt
+	unreads       map[string]*fakeUnread
+	notifications []*domain.Notification
+}
+
+// fakeUnread keeps the seqs counted like the database does.
+type fakeUnread struct {
+	roomID      string
+	userID      string
+	lastSeq     int64
+	readSeq     int64
+	unreadSeqs  []int64
+	mentionSeqs []int64
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		sessions: make(map[string]*domain.Session),
+		rooms:    make(map[string]*domain.Room),
+		dms:      make(map[string]*domain.DM),
+		dedup:    make(map[string]string),
+		receipts: make(map[string]*domain.Receipt),
+		unreads:  make(map[string]*fakeUnread),
+
+		attachments: make(map[string]*domain.Attachment),
+	}
+}
+
+func (db *fakeDB) GetUser(_ context.Context, userID string) (*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if u.ID == userID {
+			return u, nil
+		}
+	}
+	return nil, domain.ErrDBUserNotFound
+}
+
+func (db *fakeDB) CreateUser(_ context.Context, user *domain.User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, identity := range user.Identities {
+		if db.owner(identity.Provider, identity.Subject) != nil {
+			return domain.ErrIdentityLinked
+		}
+	}
+	db.users = append(db.users, user)
+	return nil
+}
+
+func (db *fakeDB) SetProfile(_ context.Context, userID string, name string, avatar string) (*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if u.ID == userID {
+			u.Name = name
+			if u.AvatarID == "" {
+				u.Avatar = avatar
+			}
+			return u, nil
+		}
+	}
+	return nil, domain.ErrDBUserNotFound
+}
+
+func (db *fakeDB) SetLastSeen(_ context.Context, userID string, lastSeen time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if u.ID == userID {
+			u.LastSeen = &lastSeen
+			return nil
+		}
+	}
+	return domain.ErrDBUserNotFound
+}
+
+func (db *fakeDB) GetUserByIdentity(_ context.Context, provider string, subject string) (*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if u := db.owner(provider, subject); u != nil {
+		return u, nil
+	}
+	return nil, domain.ErrDBUserNotFound
+}
+
+func (db *fakeDB) UpdateIdentity(_ context.Context, identity *domain.Identity) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u := db.owner(identity.Provider, identity.Subject)
+	if u == nil {
+		return domain.ErrIdentityNotFound
+	}
+	for i := range u.Identities {
+		if u.Identities[i].Provider == identity.Provider && u.Identities[i].Subject == identity.Subject {
+			u.Identities[i].Email = identity.Email
+			u.Identities[i].EmailVerified = identity.EmailVerified
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) ClaimLegacyUser(_ context.Context, email string, identity *domain.Identity) (*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, u := range db.users {
+		if u.Email == email && u.Provider == identity.Provider && u.Identities == nil {
+			u.Identities = []domain.Identity{*identity}
+			return u, nil
+		}
+	}
+	return nil, domain.ErrDBUserNotFound
+}
+
+func (db *fakeDB) ListUsersByVerifiedEmail(_ context.Context, email string, limit int) ([]*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var users []*domain.User
+	for _, u := range db.users {
+		for _, identity := range u.Identities {
+			if identity.Email == email && identity.EmailVerified && len(users) < limit {
+				users = append(users, u)
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+func (db *fakeDB) LinkIdentity(_ context.Context, userID string, identity *domain.Identity) (*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if u := db.owner(identity.Provider, identity.Subject); u != nil {
+		if u.ID != userID {
+			return nil, domain.ErrIdentityLinked
+		}
+		return u, nil
+	}
+	for _, u := range db.users {
+		if u.ID == userID {
+			u.Identities = append(u.Identities, *identity)
+			return u, nil
+		}
+	}
+	return nil, domain.ErrDBUserNotFound
+}
+
+func (db *fakeDB) owner(provider string, subject string) *domain.User {
+	for _, u := range db.users {
+		for _, identity := range u.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) GetSession(_ context.Context, sessionID string) (*domain.Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	session, ok := db.sessions[sessionID]
+	if !ok {
+		return nil, domain.ErrDBSessionNotFound
+	}
+	c := *session
+	return &c, nil
+}
+
+func (db *fakeDB) RotateSession(_ context.Context, sessionID string, refreshID string, nextID string, rotatedAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	session, ok := db.sessions[sessionID]
+	if !ok || session.RefreshID != refreshID || session.RevokedAt != nil {
+		return domain.ErrDBSessionNotFound
+	}
+	session.PrevRefreshID, session.RefreshID, session.RotatedAt = refreshID, nextID, &rotatedAt
+	return nil
+}
+
+func (db *fakeDB) RevokeSession(_ context.Context, userID string, sessionID string, revokedAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	session, ok := db.sessions[sessionID]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return domain.ErrDBSessionNotFound
+	}
+	session.RevokedAt = &revokedAt
+	return nil
+}
+
+func (db *fakeDB) RevokeUserSessions(_ context.Context, userID string, keepID string, revokedAt time.Time) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var ids []string
+	for _, session := range db.sessions {
+		if session.UserID == userID && session.ID != keepID && session.RevokedAt == nil {
+			session.RevokedAt = &revokedAt
+			ids = append(ids, session.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (db *fakeDB) GetRoom(_ context.Context, roomID string) (*domain.Room, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	room, ok := db.rooms[roomID]
+	if !ok {
+		return nil, domain.ErrDBRoomNotFound
+	}
+	return copyRoom(room), nil
+}
+
+func (db *fakeDB) ListRooms(_ context.Context, userID string) ([]*domain.Room, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var rooms []*domain.Room
+	for _, room := range db.rooms {
+		if room.Member(userID) != nil {
+			rooms = append(rooms, copyRoom(room))
+		}
+	}
+	return rooms, nil
+}
+
+func (db *fakeDB) RemoveRoomMember(_ context.Context, roomID string, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	room, ok := db.rooms[roomID]
+	if !ok || room.Member(userID) == nil {
+		return domain.ErrRoomNotMember
+	}
+	room.Members = slices.DeleteFunc(slices.Clone(room.Members), func(m domain.RoomMember) bool { return m.UserID == userID })
+	return nil
+}
+
+func (db *fakeDB) CreateRoom(_ context.Context, room *domain.Room) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.rooms[room.ID] = copyRoom(room)
+	return nil
+}
+
+func (db *fakeDB) AddRoomInvite(_ context.Context, roomID string, userID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	room, ok := db.rooms[roomID]
+	if !ok {
+		return domain.ErrDBRoomNotFound
+	}
+	if !room.IsInvited(userID) {
+		room.Invites = append(slices.Clone(room.Invites), userID)
+	}
+	return nil
+}
+
+func (db *fakeDB) AddRoomMember(_ context.Context, roomID string, member domain.RoomMember) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	room, ok := db.rooms[roomID]
+	if !ok || room.Member(member.UserID) != nil {
+		return domain.ErrRoomAlreadyMember
+	}
+	room.Members = append(slices.Clone(room.Members), member)
+	room.Invites = slices.DeleteFunc(slices.Clone(room.Invites), func(id string) bool { return id == member.UserID })
+	return nil
+}
+
+// copyRoom keeps the rooms handed out apart from the ones changed later.
+func copyRoom(room *domain.Room) *domain.Room {
+	c := *room
+	c.Members = slices.Clone(room.Members)
+	c.Invites = slices.Clone(room.Invites)
+	c.Pins = slices.Clone(room.Pins)
+	return &c
+}
+
+func (db *fakeDB) GetDM(_ context.Context, dmID string) (*domain.DM, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dm, ok := db.dms[dmID]
+	if !ok {
+		return nil, domain.ErrDBDMNotFound
+	}
+	return dm, nil
+}
+
+func (db *fakeDB) ListDMs(_ context.Context, userID string) ([]*domain.DM, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var dms []*domain.DM
+	for _, dm := range db.dms {
+		if slices.Contains(dm.Members, userID) {
+			dms = append(dms, dm)
+		}
+	}
+	return dms, nil
+}
+
+func (db *fakeDB) SetUsername(_ context.Context, userID string, username string) (*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var user *domain.User
+	for _, u := range db.users {
+		switch {
+		case u.ID == userID:
+			user = u
+		case u.Username == username:
+			return nil, domain.ErrUsernameTaken
+		}
+	}
+	if user == nil {
+		return nil, domain.ErrDBUserNotFound
+	}
+
+	user.Username = username
+	c := *user
+	return &c, nil
+}
+
+func (db *fakeDB) ListUsersByUsername(_ context.Context, usernames []string) ([]*domain.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var users []*domain.User
+	for _, u := range db.users {
+		if slices.Contains(usernames, u.Username) {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (db *fakeDB) CreateMessage(_ context.Context, msg *domain.Message) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	msg.Seq = db.lastSeq(msg.RoomID) + 1
+	c := *msg
+	db.messages = append(db.messages, &c)
+	return nil
+}
+
+func (db *fakeDB) GetMessage(_ context.Context, messageID string) (*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if msg := db.message(messageID); msg != nil {
+		return copyMessage(msg), nil
+	}
+	return nil, domain.ErrDBMessageNotFound
+}
+
+func (db *fakeDB) ListMessagesAfter(_ context.Context, roomID string, seq int64, limit int) ([]*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.listErr != nil {
+		return nil, db.listErr
+	}
+
+	var messages []*domain.Message
+	for _, msg := range db.messages {
+		if msg.RoomID == roomID && msg.Seq > seq && len(messages) < limit {
+			c := *msg
+			messages = append(messages, &c)
+		}
+	}
+	return messages, nil
+}
+
+// ListMessages pages by seq, the cursor is the id of the last message of a
+// page.
+func (db *fakeDB) ListMessages(_ context.Context, roomID string, before string, limit int) (*domain.MessagePage, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	seq := int64(math.MaxInt64)
+	if before != "" {
+		msg := db.message(before)
+		if msg == nil {
+			return nil, domain.ErrCursorInvalid
+		}
+		seq = msg.Seq
+	}
+
+	var messages []*domain.Message
+	for _, msg := range db.messages {
+		if msg.RoomID == roomID && msg.ParentID == "" && msg.Seq < seq {
+			messages = append(messages, msg)
+		}
+	}
+	slices.SortFunc(messages, func(a, b *domain.Message) int { return int(b.Seq - a.Seq) })
+
+	page := &domain.MessagePage{}
+	for _, msg := range messages {
+		if len(page.Messages) == limit {
+			page.NextCursor = page.Messages[limit-1].ID
+			break
+		}
+		page.Messages = append(page.Messages, copyMessage(msg))
+	}
+	return page, nil
+}
+
+func (db *fakeDB) ListMessagesByID(_ context.Context, messageIDs []string) ([]*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var messages []*domain.Message
+	for _, msg := range db.messages {
+		if slices.Contains(messageIDs, msg.ID) {
+			messages = append(messages, copyMessage(msg))
+		}
+	}
+	return messages, nil
+}
+
+func (db *fakeDB) ListMessageChanges(_ context.Context, roomID string, seq int64, after int64, limit int) ([]*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.listErr != nil {
+		return nil, db.listErr
+	}
+
+	var messages []*domain.Message
+	for _, msg := range db.messages {
+		if msg.RoomID == roomID && msg.Seq > after && msg.Seq <= seq && msg.EditSeq >= seq && len(messages) < limit {
+			messages = append(messages, copyMessage(msg))
+		}
+	}
+	slices.SortFunc(messages, func(a, b *domain.Message) int { return int(a.Seq - b.Seq) })
+	return messages, nil
+}
+
+func (db *fakeDB) EditMessage(_ context.Context, messageID string, body string, editedAt time.Time, editSeq int64) (*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	msg := db.message(messageID)
+	if msg == nil || msg.DeletedAt != nil {
+		return nil, domain.ErrDBMessageNotFound
+	}
+
+	createdAt := msg.CreatedAt
+	if msg.EditedAt != nil {
+		createdAt = *msg.EditedAt
+	}
+	msg.Revisions = append(slices.Clone(msg.Revisions), domain.MessageRevision{Body: msg.Body, CreatedAt: createdAt})
+	msg.Body = body
+	msg.EditedAt = &editedAt
+	msg.EditSeq = editSeq
+
+	c := copyMessage(msg)
+	c.Revisions = nil
+	return c, nil
+}
+
+func (db *fakeDB) DeleteMessage(_ context.Context, messageID string, deletedBy string, deletedAt time.Time, editSeq int64) (*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	msg := db.message(messageID)
+	if msg == nil || msg.DeletedAt != nil {
+		return nil, domain.ErrDBMessageNotFound
+	}
+
+	msg.Body = ""
+	msg.DeletedAt = &deletedAt
+	msg.DeletedBy = deletedBy
+	msg.EditSeq = editSeq
+	msg.Revisions = nil
+	msg.Reactions = nil
+	msg.AttachmentIDs = nil
+	msg.MentionIDs = nil
+
+	return copyMessage(msg), nil
+}
+
+func (db *fakeDB) message(messageID string) *domain.Message {
+	for _, msg := range db.messages {
+		if msg.ID == messageID {
+			return msg
+		}
+	}
+	return nil
+}
+
+func copyMessage(msg *domain.Message) *domain.Message {
+	c := *msg
+	c.Revisions = slices.Clone(msg.Revisions)
+	c.Reactions = slices.Clone(msg.Reactions)
+	return &c
+}
+
+func (db *fakeDB) AddReaction(_ context.Context, messageID string, emoji string, userID string) (*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	msg := db.message(messageID)
+	switch {
+	case msg == nil:
+		return nil, domain.ErrDBMessageNotFound
+	case msg.DeletedAt != nil:
+		return nil, domain.ErrMessageDeleted
+	}
+
+	reactions := slices.Clone(msg.Reactions)
+	i := slices.IndexFunc(reactions, func(r domain.Reaction) bool { return r.Emoji == emoji })
+	switch {
+	case i >= 0 && !slices.Contains(reactions[i].UserIDs, userID):
+		reactions[i].UserIDs = append(slices.Clone(reactions[i].UserIDs), userID)
+	case i < 0 && len(reactions) >= domain.MessageMaxReactions:
+		return nil, domain.ErrReactionLimit
+	case i < 0:
+		reactions = append(reactions, domain.Reaction{Emoji: emoji, UserIDs: []string{userID}})
+	}
+	msg.Reactions = reactions
+
+	return copyMessage(msg), nil
+}
+
+func (db *fakeDB) RemoveReaction(_ context.Context, messageID string, emoji string, userID string) (*domain.Message, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	msg := db.message(messageID)
+	if msg == nil {
+		return nil, domain.ErrDBMessageNotFound
+	}
+
+	reactions := slices.Clone(msg.Reactions)
+	if i := slices.IndexFunc(reactions, func(r domain.Reaction) bool { return r.Emoji == emoji }); i >= 0 {
+		reactions[i].UserIDs = slices.DeleteFunc(slices.Clone(reactions[i].UserIDs), func(id string) bool { return id == userID })
+		if len(reactions[i].UserIDs) == 0 {
+			reactions = slices.Delete(reactions, i, i+1)
+		}
+	}
+	msg.Reactions = reactions
+
+	return copyMessage(msg), nil
+}
+
+func (db *fakeDB) GetAttachment(_ context.Context, attachmentID string) (*domain.Attachment, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	attachment, ok := db.attachments[attachmentID]
+	if !ok {
+		return nil, domain.ErrDBAttachmentNotFound
+	}
+	c := *attachment
+	return &c, nil
+}
+
+func (db *fakeDB) DeleteAttachments(_ context.Context, roomID string, attachmentIDs []string, deletedAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range attachmentIDs {
+		if attachment, ok := db.attachments[id]; ok && attachment.RoomID == roomID && attachment.DeletedAt == nil {
+			attachment.DeletedAt = &deletedAt
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) SetNotificationSnippet(_ context.Context, messageID string, snippet string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, n := range db.notifications {
+		if n.MessageID == messageID {
+			n.Snippet = snippet
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) UpdateDMLastMessage(context.Context, *domain.Message) error {
+	return nil
+}
+
+func (db *fakeDB) PinMessage(_ context.Context, roomID string, pin domain.Pin) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	room, ok := db.rooms[roomID]
+	switch {
+	case !ok:
+		return false, domain.ErrDBRoomNotFound
+	case room.Pin(pin.MessageID) != nil:
+		return false, nil
+	case len(room.Pins) >= domain.RoomMaxPins:
+		return false, domain.ErrPinLimit
+	}
+
+	room.Pins = append([]domain.Pin{pin}, room.Pins...)
+	return true, nil
+}
+
+func (db *fakeDB) UnpinMessage(_ context.Context, roomID string, messageID string) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	room, ok := db.rooms[roomID]
+	if !ok {
+		return false, domain.ErrDBRoomNotFound
+	}
+
+	n := len(room.Pins)
+	room.Pins = slices.DeleteFunc(room.Pins, func(p domain.Pin) bool { return p.MessageID == messageID })
+	return len(room.Pins) < n, nil
+}
+
+// failListMessages makes listing messages fail with err, nil lists them again.
+func (db *fakeDB) failListMessages(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.listErr = err
+}
+
+func (db *fakeDB) LastSeq(_ context.Context, roomID string) (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.lastSeq(roomID), nil
+}
+
+func (db *fakeDB) lastSeq(roomID string) int64 {
+	var seq int64
+	for _, msg := range db.messages {
+		if msg.RoomID == roomID {
+			seq = max(seq, msg.Seq)
+		}
+	}
+	return seq
+}
+
+// listMessages returns the stored messages of the room, oldest first.
+func (db *fakeDB) listMessages(roomID string) []*domain.Message {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var messages []*domain.Message
+	for _, msg := range db.messages {
+		if msg.RoomID == roomID {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (db *fakeDB) SetDMLastMessage(context.Context, *domain.Message) error {
+	return nil
+}
+
+func (db *fakeDB) AddReply(context.Context, string, time.Time) error {
+	return nil
+}
+
+func (db *fakeDB) ReserveClientID(_ context.Context, roomID string, userID string, clientID string, messageID string, _ time.Duration) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := roomID + ":" + userID + ":" + clientID
+	if id, ok := db.dedup[key]; ok {
+		return id, false, nil
+	}
+	db.dedup[key] = messageID
+	return messageID, true, nil
+}
+
+func (db *fakeDB) ReleaseClientID(_ context.Context, roomID string, userID string, clientID string, messageID string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key := roomID + ":" + userID + ":" + clientID
+	if db.dedup[key] == messageID {
+		delete(db.dedup, key)
+	}
+	return nil
+}
+
+func (db *fakeDB) AdvanceReceipt(_ context.Context, roomID string, userID string, deliveredSeq int64, readSeq int64) (*domain.Receipt, *domain.Receipt, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	deliveredSeq = max(deliveredSeq, readSeq)
+
+	r, ok := db.receipts[roomID+":"+userID]
+	if !ok {
+		r = &domain.Receipt{RoomID: roomID, UserID: userID}
+		db.receipts[roomID+":"+userID] = r
+	}
+	if r.DeliveredSeq >= deliveredSeq && r.ReadSeq >= readSeq {
+		return nil, nil, nil
+	}
+	prev := *r
+	r.DeliveredSeq, r.ReadSeq = max(r.DeliveredSeq, deliveredSeq), max(r.ReadSeq, readSeq)
+	next := *r
+	return &prev, &next, nil
+}
+
+func (db *fakeDB) ListMessageAuthors(_ context.Context, roomID string, from int64, to int64) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	authors := make([]string, 0)
+	for _, msg := range db.messages {
+		if msg.RoomID == roomID && msg.Seq > from && msg.Seq <= to && !slices.Contains(authors, msg.UserID) {
+			authors = append(authors, msg.UserID)
+		}
+	}
+	return authors, nil
+}
+
+func (db *fakeDB) CountUnread(_ context.Context, msg *domain.Message, memberIDs []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, userID := range memberIDs {
+		if userID == msg.UserID {
+			continue
+		}
+
+		u := db.unread(msg.RoomID, userID)
+		if u.readSeq >= msg.Seq || slices.Contains(u.unreadSeqs, msg.Seq) || slices.Contains(u.mentionSeqs, msg.Seq) {
+			continue
+		}
+
+		counted := false
+		if msg.ParentID == "" {
+			u.unreadSeqs, counted = append(u.unreadSeqs, msg.Seq), true
+		}
+		if msg.MentionsRoom || slices.Contains(msg.MentionIDs, userID) {
+			u.mentionSeqs, counted = append(u.mentionSeqs, msg.Seq), true
+		}
+		if counted {
+			u.lastSeq = max(u.lastSeq, msg.Seq)
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) ReadUnread(_ context.Context, roomID string, userID string, readSeq int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	u := db.unread(roomID, userID)
+	u.readSeq = max(u.readSeq, readSeq)
+
+	read := func(seq int64) bool { return seq <= readSeq }
+	u.unreadSeqs = slices.DeleteFunc(u.unreadSeqs, read)
+	u.mentionSeqs = slices.DeleteFunc(u.mentionSeqs, read)
+	return nil
+}
+
+func (db *fakeDB) UncountUnread(_ context.Context, roomID string, seq int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	deleted := func(s int64) bool { return s == seq }
+	for _, u := range db.unreads {
+		if u.roomID == roomID {
+			u.unreadSeqs = slices.DeleteFunc(u.unreadSeqs, deleted)
+			u.mentionSeqs = slices.DeleteFunc(u.mentionSeqs, deleted)
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) ListUnread(_ context.Context, userID string, roomIDs []string) ([]*domain.Unread, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	unreads := make([]*domain.Unread, 0)
+	for _, roomID := range roomIDs {
+		u, ok := db.unreads[roomID+":"+userID]
+		if !ok || len(u.unreadSeqs) == 0 && len(u.mentionSeqs) == 0 {
+			continue
+		}
+
+		unreads = append(unreads, &domain.Unread{
+			RoomID:       roomID,
+			UnreadCount:  int64(len(u.unreadSeqs)),
+			MentionCount: int64(len(u.mentionSeqs)),
+			LastSeq:      u.lastSeq,
+			ReadSeq:      u.readSeq,
+		})
+	}
+	slices.SortFunc(unreads, func(a, b *domain.Unread) int { return strings.Compare(a.RoomID, b.RoomID) })
+	return unreads, nil
+}
+
+// unread returns the counters of the user in the room, the caller holds the
+// lock.
+func (db *fakeDB) unread(roomID string, userID string) *fakeUnread {
+	u, ok := db.unreads[roomID+":"+userID]
+	if !ok {
+		u = &fakeUnread{roomID: roomID, userID: userID}
+		db.unreads[roomID+":"+userID] = u
+	}
+	return u
+}
+
+func (db *fakeDB) CreateNotifications(_ context.Context, notifications []*domain.Notification) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.notifications = append(db.notifications, notifications...)
+	return nil
+}
+
+// fakeSearch indexes nothing.
+type fakeSearch struct {
+	searchIndex
+}
+
+func (fakeSearch) IndexMessage(context.Context, *domain.Message) error {
+	return nil
+}
+
+func (fakeSearch) RemoveMessage(context.Context, string) error {
+	return nil
+}
+
+// fakeBroker delivers in memory what the service publishes to the hub
+// subscribed to it.
+type fakeBroker struct {
+	mu       sync.Mutex
+	messages map[string]func(*domain.Message)
+	events   map[string]func(*domain.Event)
+	users    map[string]func(*domain.Event)
+	presence map[string]string
+
+	// userEvents records every published user event
+	userEvents []*domain.Event
+	// publishErr fails the publishing of messages and room events
+	publishErr error
+	// setting runs before every presence change, outside of the lock
+	setting func(userID string)
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		messages: make(map[string]func(*domain.Message)),
+		events:   make(map[string]func(*domain.Event)),
+		users:    make(map[string]func(*domain.Event)),
+		presence: make(map[string]string),
+	}
+}
+
+func (b *fakeBroker) PublishMessage(_ context.Context, msg *domain.Message) error {
+	b.mu.Lock()
+	fn, ok := b.messages[msg.RoomID]
+	err := b.publishErr
+	b.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		fn(msg)
+	}
+	return nil
+}
+
+func (b *fakeBroker) PublishEvent(_ context.Context, event *domain.Event) error {
+	b.mu.Lock()
+	fn, ok := b.events[event.RoomID]
+	err := b.publishErr
+	b.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		fn(event)
+	}
+	return nil
+}
+
+func (b *fakeBroker) PublishUserEvent(_ context.Context, event *domain.Event) error {
+	b.mu.Lock()
+	b.userEvents = append(b.userEvents, event)
+	fn, ok := b.users[event.UserID]
+	b.mu.Unlock()
+
+	if ok {
+		fn(event)
+	}
+	return nil
+}
+
+func (b *fakeBroker) SetPresence(_ context.Context, userID string, status string) error {
+	b.mu.Lock()
+	setting := b.setting
+	b.mu.Unlock()
+
+	if setting != nil {
+		setting(userID)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.presence[userID] = status
+	return nil
+}
+
+func (b *fakeBroker) ClearPresence(_ context.Context, userID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.presence, userID)
+	return nil
+}
+
+func (b *fakeBroker) ListPresence(_ context.Context, userID string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if status, ok := b.presence[userID]; ok {
+		return []string{status}, nil
+	}
+	return []string{}, nil
+}
+
+func (b *fakeBroker) SubscribeMessages(_ context.Context, roomID string, fn func(*domain.Message)) (func(), error) {
+	return subscribe(b, b.messages, roomID, fn), nil
+}
+
+func (b *fakeBroker) SubscribeEvents(_ context.Context, roomID string, fn func(*domain.Event)) (func(), error) {
+	return subscribe(b, b.events, roomID, fn), nil
+}
+
+func (b *fakeBroker) SubscribeUserEvents(_ context.Context, userID string, fn func(*domain.Event)) (func(), error) {
+	return subscribe(b, b.users, userID, fn), nil
+}
+
+func (b *fakeBroker) failPublish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.publishErr = err
+}
+
+func (b *fakeBroker) onSetPresence(fn func(userID string)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setting = fn
+}
+
+func (b *fakeBroker) status(userID string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.presence[userID]
+}
+
+func (b *fakeBroker) userSubscribed(userID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.users[userID]
+	return ok
+}
+
+func (b *fakeBroker) listUserEvents(typ string) []*domain.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var events []*domain.Event
+	for _, event := range b.userEvents {
+		if event.Type == typ {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func subscribe[T any](b *fakeBroker, subs map[string]func(T), key string, fn func(T)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs[key] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(subs, key)
+	}
+}
+
+// addUsers stores the users named after their ids, each with an active
+// session of the same id.
+func (db *fakeDB) addUsers(userIDs ...string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, id := range userIDs {
+		db.users = append(db.users, &domain.User{ID: id})
+		db.sessions[id] = &domain.Session{ID: id, UserID: id, ExpiresAt: time.Now().Add(time.Hour)}
+	}
+}
+
+// newTestService returns a service on db whose gateway runs on an in-memory
+// broker, and the url of a server accepting its websocket connections as the
+// app does.
+func newTestService(t *testing.T, db *fakeDB) (*Service, *fakeBroker, string) {
+	t.Helper()
+
+	b := newFakeBroker()
+	chat := auth.NewChatProvider(config.JWTChat{SecretKey: "test-secret", TokenTTL: time.Minute})
+	s := New(Config{}, db, nil, refreshTokens{}, chat, gateway.New(b), b, fakeSearch{}, nil, nil)
+
+	upg := &websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		user, sessionID, err := s.AuthenticateWS(r.Context(), q.Get("token"), q.Get("room_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		conn, err := upg.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.HandleWS(context.Background(), user, sessionID, q.Get("room_id"), conn)
+	}))
+	t.Cleanup(srv.Close)
+
+	return s, b, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialRoom opens a gateway connection of the session to the room.
+func dialRoom(t *testing.T, s *Service, url string, userID string, sessionID string, roomID string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+
+	token, err := s.CreateRoomToken(context.Background(), userID, sessionID, roomID)
+	require.NoError(t, err)
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"?room_id="+roomID+"&token="+token, nil)
+	if err == nil {
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// readFrame reads the next frame sent by the server.
+func readFrame(t *testing.T, conn *websocket.Conn) *gateway.Frame {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var f gateway.Frame
+	require.NoError(t, conn.ReadJSON(&f))
+	return &f
+}
+
+// send writes a message.send frame.
+func send(t *testing.T, conn *websocket.Conn, data gateway.MessageSendData) {
+	t.Helper()
+
+	f, err := gateway.NewFrame(gateway.FrameMessageSend, data)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(f))
+}
+
+// readFrameOf skips the frames of other types until one of typ arrives.
+func readFrameOf(t *testing.T, conn *websocket.Conn, typ string) *gateway.Frame {
+	t.Helper()
+
+	for {
+		f := readFrame(t, conn)
+		if f.Type == typ {
+			return f
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/google/uuid"
+)
+
+// loginRetries bounds the rounds of loginUser, a round is lost only to a
+// concurrent login of the same identity which is found in the next one.
+const loginRetries = 3
+
+// loginUser returns the user owning the identity of the profile. Without an
+// owner the identity is attached to the legacy user of the provider with the
+// email, or linked to the single user with the same verified email. Otherwise
+// a new user is created.
+func (s *Service) loginUser(ctx context.Context, provider string, profile *domain.OAuthProfile) (*domain.User, error) {
+	identity := newIdentity(provider, profile)
+
+	for range loginRetries {
+		user, err := s.db.GetUserByIdentity(ctx, provider, identity.Subject)
+		if err == nil {
+			s.refreshIdentity(ctx, user, identity)
+			return s.refreshProfile(ctx, user, profile), nil
+		}
+		if !errors.Is(err, domain.ErrDBUserNotFound) {
+			return nil, err
+		}
+
+		user, err = s.claimLegacyUser(ctx, profile.Email, identity)
+		switch {
+		case err == nil:
+			return s.refreshProfile(ctx, user, profile), nil
+		case errors.Is(err, domain.ErrIdentityLinked):
+			continue
+		case !errors.Is(err, domain.ErrDBUserNotFound):
+			return nil, err
+		}
+
+		user, err = s.autoLink(ctx, identity)
+		switch {
+		case err == nil:
+			return user, nil
+		case errors.Is(err, domain.ErrIdentityLinked):
+			continue
+		case !errors.Is(err, domain.ErrDBUserNotFound):
+			return nil, err
+		}
+
+		user = &domain.User{
+			ID:         uuid.NewString(),
+			Name:       profile.Name,
+			Email:      profile.Email,
+			Avatar:     profile.Avatar,
+			Provider:   provider,
+			Identities: []domain.Identity{*identity},
+		}
+
+		err = s.db.CreateUser(ctx, user)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, domain.ErrIdentityLinked) {
+			return nil, err
+		}
+	}
+
+	return nil, domain.ErrIdentityLinked
+}
+
+// claimLegacyUser attaches the identity to the user created for the email by
+// the provider before users had identities. Users without an email were all
+// stored as one and are never claimed.
+func (s *Service) claimLegacyUser(ctx context.Context, email string, identity *domain.Identity) (*domain.User, error) {
+	if email == "" {
+		return nil, domain.ErrDBUserNotFound
+	}
+	return s.db.ClaimLegacyUser(ctx, email, identity)
+}
+
+// autoLink links the identity to the user holding its email, both the
+// identity and the user's identity with the email must be verified by their
+// providers. An unverified or ambiguous email is never linked as anyone could
+// claim it.
+func (s *Service) autoLink(ctx context.Context, identity *domain.Identity) (*domain.User, error) {
+	if !identity.EmailVerified || identity.Email == "" {
+		return nil, domain.ErrDBUserNotFound
+	}
+
+	users, err := s.db.ListUsersByVerifiedEmail(ctx, identity.Email, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) != 1 {
+		return nil, domain.ErrDBUserNotFound
+	}
+
+	return s.db.LinkIdentity(ctx, users[0].ID, identity)
+}
+
+// refreshIdentity keeps the email of the identity as the provider reports it
+// now, it decides later automatic links.
+func (s *Service) refreshIdentity(ctx context.Context, user *domain.User, identity *domain.Identity) {
+	for _, linked := range user.Identities {
+		if linked.Provider != identity.Provider || linked.Subject != identity.Subject {
+			continue
+		}
+		if linked.Email == identity.Email && linked.EmailVerified == identity.EmailVerified {
+			return
+		}
+		break
+	}
+
+	if err := s.db.UpdateIdentity(ctx, identity); err != nil {
+		log.Warn("service: refresh identity", log.UserID(user.ID), log.Err(err))
+	}
+}
+
+// refreshProfile keeps the name and avatar of the user as the provider they
+// log in with reports them, the user is returned as is when that fails.
+func (s *Service) refreshProfile(ctx context.Context, user *domain.User, profile *domain.OAuthProfile) *domain.User {
+	name, avatar := user.Name, user.Avatar
+	if profile.Name != "" {
+		name = profile.Name
+	}
+	if profile.Avatar != "" && user.AvatarID == "" {
+		avatar = profile.Avatar
+	}
+	if name == user.Name && avatar == user.Avatar {
+		return user
+	}
+
+	updated, err := s.db.SetProfile(ctx, user.ID, name, avatar)
+	if err != nil {
+		log.Warn("service: refresh profile", log.UserID(user.ID), log.Err(err))
+		return user
+	}
+
+	return updated
+}
+
+// LinkIdentity links the provider account of the callback to the user.
+func (s *Service) LinkIdentity(ctx context.Context, userID string, provider string, callback *domain.OAuthCallback) (*domain.User, error) {
+	profile, err := s.oauthProvider.HandleCallback(ctx, provider, callback)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := newIdentity(provider, profile)
+
+	owner, err := s.db.GetUserByIdentity(ctx, provider, identity.Subject)
+	switch {
+	case err == nil && owner.ID != userID:
+		return nil, domain.ErrIdentityLinked
+	case err == nil:
+		return owner, nil
+	case !errors.Is(err, domain.ErrDBUserNotFound):
+		return nil, err
+	}
+
+	return s.db.LinkIdentity(ctx, userID, identity)
+}
+
+// UnlinkIdentity removes the provider account from the user, the last one
+// cannot be removed. The sessions logged in with the account end as well.
+func (s *Service) UnlinkIdentity(ctx context.Context, userID string, provider string, subject string) (*domain.User, error) {
+	user, err := s.db.UnlinkIdentity(ctx, userID, provider, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.db.RevokeIdentitySessions(ctx, userID, provider, subject, time.Now().UTC().Truncate(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	s.closeSessions(ctx, userID, ids...)
+
+	return user, nil
+}
+
+func newIdentity(provider string, profile *domain.OAuthProfile) *domain.Identity {
+	return &domain.Identity{
+		Provider:      provider,
+		Subject:       profile.Subject,
+		Email:         strings.ToLower(strings.TrimSpace(profile.Email)),
+		EmailVerified: profile.EmailVerified,
+		LinkedAt:      time.Now().UTC().Truncate(time.Millisecond),
+	}
+}
@@ -0,0 +1,185 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginUser(t *testing.T) {
+	t.Parallel()
+
+	newDB := func() *fakeDB {
+		db := newFakeDB()
+		db.users = []*domain.User{
+			{
+				ID:    "alice",
+				Email: "alice@example.com",
+				Identities: []domain.Identity{
+					{Provider: "google", Subject: "g-alice", Email: "alice@example.com", EmailVerified: true},
+				},
+			},
+			{
+				ID:    "bob",
+				Email: "bob@example.com",
+				Identities: []domain.Identity{
+					{Provider: "github", Subject: "gh-bob", Email: "bob@example.com"},
+				},
+			},
+			{
+				// created before users had identities
+				ID:       "carol",
+				Email:    "carol@example.com",
+				Provider: "github",
+			},
+			{
+				ID: "dave1",
+				Identities: []domain.Identity{
+					{Provider: "google", Subject: "g-dave1", Email: "dave@example.com", EmailVerified: true},
+				},
+			},
+			{
+				ID: "dave2",
+				Identities: []domain.Identity{
+					{Provider: "gitlab", Subject: "gl-dave2", Email: "dave@example.com", EmailVerified: true},
+				},
+			},
+		}
+		return db
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		profile  domain.OAuthProfile
+		expectID string // empty for a new user
+	}{
+		{
+			name:     "linked_identity",
+			provider: "google",
+			profile:  domain.OAuthProfile{Subject: "g-alice", Email: "alice@example.com", EmailVerified: true},
+			expectID: "alice",
+		},
+		{
+			name:     "verified_email",
+			provider: "gitlab",
+			profile:  domain.OAuthProfile{Subject: "gl-alice", Email: "Alice@Example.com", EmailVerified: true},
+			expectID: "alice",
+		},
+		{
+			name:     "unverified_email",
+			provider: "gitlab",
+			profile:  domain.OAuthProfile{Subject: "gl-alice", Email: "alice@example.com"},
+		},
+		{
+			name:     "unverified_owner",
+			provider: "google",
+			profile:  domain.OAuthProfile{Subject: "g-bob", Email: "bob@example.com", EmailVerified: true},
+		},
+		{
+			name:     "ambiguous_email",
+			provider: "github",
+			profile:  domain.OAuthProfile{Subject: "gh-dave", Email: "dave@example.com", EmailVerified: true},
+		},
+		{
+			name:     "legacy_user",
+			provider: "github",
+			profile:  domain.OAuthProfile{Subject: "gh-carol", Email: "carol@example.com"},
+			expectID: "carol",
+		},
+		{
+			name:     "legacy_user_other_provider",
+			provider: "google",
+			profile:  domain.OAuthProfile{Subject: "g-carol", Email: "carol@example.com", EmailVerified: true},
+		},
+		{
+			name:     "new_user",
+			provider: "google",
+			profile:  domain.OAuthProfile{Subject: "g-eve", Email: "eve@example.com", EmailVerified: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newDB()
+			s := &Service{db: db}
+
+			user, err := s.loginUser(context.Background(), tt.provider, &tt.profile)
+			require.NoError(t, err)
+
+			if tt.expectID != "" {
+				require.Equal(t, tt.expectID, user.ID)
+			} else {
+				require.Len(t, db.users, 6)
+				require.Equal(t, db.users[5], user)
+			}
+
+			owner, err := db.GetUserByIdentity(context.Background(), tt.provider, tt.profile.Subject)
+			require.NoError(t, err)
+			require.Equal(t, user.ID, owner.ID)
+
+			// the next login finds the same user
+			again, err := s.loginUser(context.Background(), tt.provider, &tt.profile)
+			require.NoError(t, err)
+			require.Equal(t, user.ID, again.ID)
+		})
+	}
+}
+
+func TestLoginUser_Profile(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		user         domain.User
+		profile      domain.OAuthProfile
+		expectName   string
+		expectAvatar string
+	}{
+		{
+			name:         "provider_profile",
+			user:         domain.User{Name: "Alice", Avatar: "https://example.com/old.png"},
+			profile:      domain.OAuthProfile{Name: "Alice Liddell", Avatar: "https://example.com/new.png"},
+			expectName:   "Alice Liddell",
+			expectAvatar: "https://example.com/new.png",
+		},
+		{
+			name:         "custom_avatar_kept",
+			user:         domain.User{Name: "Alice", Avatar: "/api/avatars/a1", AvatarID: "a1"},
+			profile:      domain.OAuthProfile{Name: "Alice Liddell", Avatar: "https://example.com/new.png"},
+			expectName:   "Alice Liddell",
+			expectAvatar: "/api/avatars/a1",
+		},
+		{
+			name:         "missing_claims_kept",
+			user:         domain.User{Name: "Alice", Avatar: "https://example.com/old.png"},
+			profile:      domain.OAuthProfile{},
+			expectName:   "Alice",
+			expectAvatar: "https://example.com/old.png",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			user := tt.user
+			user.ID = "alice"
+			user.Identities = []domain.Identity{{Provider: "google", Subject: "g-alice"}}
+
+			db := newFakeDB()
+			db.users = []*domain.User{&user}
+			s := &Service{db: db}
+
+			tt.profile.Subject = "g-alice"
+			got, err := s.loginUser(context.Background(), "google", &tt.profile)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectName, got.Name)
+			require.Equal(t, tt.expectAvatar, got.Avatar)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/google/uuid"
+)
+
+const (
+	roomMention       = "room"
+	mentionMaxLength  = 64
+	mentionTrailChars = ".-" // sentence punctuation right after a mention
+)
+
+// mentionPattern matches @name at the start of the body or after a non word
+// character, so that email addresses are not taken for mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w[\w.-]*)`)
+
+// parseMentions returns the distinct usernames mentioned in the body
+// lowercase, at most domain.MessageMaxMentions of them, and whether it
+// mentions @room.
+func parseMentions(body string) ([]string, bool) {
+	var (
+		usernames []string
+		room      bool
+	)
+
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		name := strings.ToLower(strings.TrimRight(m[1], mentionTrailChars))
+		switch {
+		case name == roomMention:
+			room = true
+		case len(name) > mentionMaxLength, slices.Contains(usernames, name):
+		case len(usernames) < domain.MessageMaxMentions:
+			usernames = append(usernames, name)
+		}
+	}
+
+	return usernames, room
+}
+
+// resolveMentions records the members mentioned by the message on it and
+// returns the notifications to send once it is stored. Mentions of users
+// outside of the conversation and of the sender are ignored, so is @room
+// unless the sender is an admin of the room.
+func (s *Service) resolveMentions(ctx context.Context, msg *domain.Message, members []string) ([]*domain.Notification, error) {
+	usernames, room := parseMentions(msg.Body)
+	if room {
+		var err error
+		if room, err = s.canMentionRoom(ctx, msg.RoomID, msg.UserID); err != nil {
+			return nil, err
+		}
+	}
+	if len(usernames) == 0 && !room {
+		return nil, nil
+	}
+
+	if len(usernames) > 0 {
+		users, err := s.db.ListUsersByUsername(ctx, usernames)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			if u.ID != msg.UserID && slices.Contains(members, u.ID) && !slices.Contains(msg.MentionIDs, u.ID) {
+				msg.MentionIDs = append(msg.MentionIDs, u.ID)
+			}
+		}
+	}
+	msg.MentionsRoom = room
+
+	var notifications []*domain.Notification
+	for _, userID := range members {
+		typ := domain.NotificationRoomMention
+		switch {
+		case userID == msg.UserID:
+			continue
+		case slices.Contains(msg.MentionIDs, userID):
+			typ = domain.NotificationMention
+		case !room:
+			continue
+		}
+
+		notifications = append(notifications, &domain.Notification{
+			ID:        uuid.NewString(),
+			UserID:    userID,
+			Type:      typ,
+			RoomID:    msg.RoomID,
+			MessageID: msg.ID,
+			ParentID:  msg.ParentID,
+			ActorID:   msg.UserID,
+			Snippet:   snippet(msg.Body),
+			CreatedAt: msg.CreatedAt,
+		})
+	}
+
+	return notifications, nil
+}
+
+// canMentionRoom reports whether the user may notify the whole room, only
+// its owners and admins may. Direct messages have no one to notify beyond
+// the other member.
+func (s *Service) canMentionRoom(ctx context.Context, roomID string, userID string) (bool, error) {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBRoomNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	m := room.Member(userID)
+	return m != nil && m.IsAdmin(), nil
+}
+
+func snippet(body string) string {
+	runes := []rune(body)
+	if len(runes) <= domain.NotificationSnippetLength {
+		return body
+	}
+	return string(runes[:domain.NotificationSnippetLength]) + "…"
+}
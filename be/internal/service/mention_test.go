@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMentions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		body      string
+		usernames []string
+		room      bool
+	}{
+		{name: "none", body: "hello there"},
+		{name: "single", body: "@bob hi", usernames: []string{"bob"}},
+		{name: "case", body: "@Bob and @BOB", usernames: []string{"bob"}},
+		{name: "punctuation", body: "thanks @bob. and @alice-, (@carol)", usernames: []string{"bob", "alice", "carol"}},
+		{name: "dotted", body: "cc @jane.doe", usernames: []string{"jane.doe"}},
+		{name: "duplicate", body: "@bob @bob", usernames: []string{"bob"}},
+		{name: "email", body: "mail bob@example.com"},
+		{name: "double_at", body: "@@bob"},
+		{name: "room", body: "@room standup in 5", room: true},
+		{name: "room_and_user", body: "@room ping @bob", usernames: []string{"bob"}, room: true},
+		{name: "room_prefix", body: "@roommate", usernames: []string{"roommate"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			usernames, room := parseMentions(tt.body)
+			require.Equal(t, tt.usernames, usernames)
+			require.Equal(t, tt.room, room)
+		})
+	}
+}
+
+func TestResolveMentions(t *testing.T) {
+	t.Parallel()
+
+	db := newFakeDB()
+	db.addUsers("alice", "bob", "carol", "dave")
+	db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{
+		{UserID: "alice", Role: domain.RoomRoleOwner},
+		{UserID: "bob", Role: domain.RoomRoleAdmin},
+		{UserID: "carol", Role: domain.RoomRoleMember},
+	}}
+	db.dms["dm"] = &domain.DM{ID: "dm", Members: []string{"alice", "carol"}}
+	s := &Service{db: db}
+	for _, username := range []string{"Alice", "bob", "Carol", "dave"} {
+		_, err := s.SetUsername(context.Background(), strings.ToLower(username), username)
+		require.NoError(t, err)
+	}
+
+	type notified struct {
+		userID string
+		typ    string
+	}
+
+	tests := []struct {
+		name     string
+		roomID   string
+		userID   string
+		body     string
+		mentions []string
+		room     bool
+		notified []notified
+	}{
+		{
+			name:     "user",
+			roomID:   "room",
+			userID:   "alice",
+			body:     "hi @CAROL",
+			mentions: []string{"carol"},
+			notified: []notified{{"carol", domain.NotificationMention}},
+		},
+		{
+			name:   "self",
+			roomID: "room",
+			userID: "alice",
+			body:   "note to @alice",
+		},
+		{
+			name:   "not_a_member",
+			roomID: "room",
+			userID: "alice",
+			body:   "hi @dave",
+		},
+		{
+			name:   "room_by_owner",
+			roomID: "room",
+			userID: "alice",
+			body:   "@room standup",
+			room:   true,
+			notified: []notified{
+				{"bob", domain.NotificationRoomMention},
+				{"carol", domain.NotificationRoomMention},
+			},
+		},
+		{
+			name:     "room_by_admin",
+			roomID:   "room",
+			userID:   "bob",
+			body:     "@room ping @carol",
+			mentions: []string{"carol"},
+			room:     true,
+			notified: []notified{
+				{"alice", domain.NotificationRoomMention},
+				{"carol", domain.NotificationMention},
+			},
+		},
+		{
+			name:   "room_by_member",
+			roomID: "room",
+			userID: "carol",
+			body:   "@room anyone?",
+		},
+		{
+			name:     "room_by_member_with_user",
+			roomID:   "room",
+			userID:   "carol",
+			body:     "@room ping @bob",
+			mentions: []string{"bob"},
+			notified: []notified{{"bob", domain.NotificationMention}},
+		},
+		{
+			name:   "room_in_dm",
+			roomID: "dm",
+			userID: "alice",
+			body:   "@room hi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			members, err := s.members(context.Background(), tt.roomID)
+			require.NoError(t, err)
+
+			msg := &domain.Message{ID: "message", RoomID: tt.roomID, UserID: tt.userID, Body: tt.body}
+			notifications, err := s.resolveMentions(context.Background(), msg, members)
+			require.NoError(t, err)
+
+			require.Equal(t, tt.mentions, msg.MentionIDs)
+			require.Equal(t, tt.room, msg.MentionsRoom)
+
+			var got []notified
+			for _, n := range notifications {
+				require.Equal(t, tt.userID, n.ActorID)
+				got = append(got, notified{n.UserID, n.Type})
+			}
+			require.Equal(t, tt.notified, got)
+		})
+	}
+}
+
+func TestSetUsername(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		username  string
+		expect    string
+		expectErr error
+	}{
+		{name: "lowercased", username: " Jane.Doe ", expect: "jane.doe"},
+		{name: "underscore", username: "jane_1", expect: "jane_1"},
+		{name: "taken", username: "BOB", expectErr: domain.ErrUsernameTaken},
+		{name: "room", username: "Room", expectErr: domain.ErrUsernameInvalid},
+		{name: "too_short", username: "jd", expectErr: domain.ErrUsernameInvalid},
+		{name: "too_long", username: strings.Repeat("j", domain.UsernameMaxLength+1), expectErr: domain.ErrUsernameInvalid},
+		{name: "space", username: "jane doe", expectErr: domain.ErrUsernameInvalid},
+		{name: "trailing_dot", username: "jane.", expectErr: domain.ErrUsernameInvalid},
+		{name: "leading_dash", username: "-jane", expectErr: domain.ErrUsernameInvalid},
+		{name: "not_ascii", username: "jäne", expectErr: domain.ErrUsernameInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("jane", "bob")
+			s := &Service{db: db}
+
+			_, err := s.SetUsername(context.Background(), "bob", "bob")
+			require.NoError(t, err)
+
+			user, err := s.SetUsername(context.Background(), "jane", tt.username)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, user.Username)
+
+			// mentions match whatever the case
+			users, err := db.ListUsersByUsername(context.Background(), parseUsernames("hi @"+strings.ToUpper(tt.expect)))
+			require.NoError(t, err)
+			require.Len(t, users, 1)
+			require.Equal(t, "jane", users[0].ID)
+		})
+	}
+}
+
+func parseUsernames(body string) []string {
+	usernames, _ := parseMentions(body)
+	return usernames
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// ListMessages returns a page of the room history older than the cursor before.
+func (s *Service) ListMessages(ctx context.Context, userID string, roomID string, before string, limit int) (*domain.MessagePage, error) {
+	switch {
+	case limit == 0:
+		limit = domain.MessagePageDefaultLimit
+	case limit < 0 || limit > domain.MessagePageMaxLimit:
+		return nil, domain.ErrLimitInvalid
+	}
+
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	return s.db.ListMessages(ctx, roomID, before, limit)
+}
+
+// EditMessage replaces the body of the user's own message.
+func (s *Service) EditMessage(ctx context.Context, userID string, roomID string, messageID string, body string) (*domain.Message, error) {
+	body, err := messageBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := s.roomMessage(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.UserID != userID {
+		return nil, domain.ErrMessageNotAuthor
+	}
+
+	// clients resuming from before the edit replay it
+	editSeq, err := s.db.LastSeq(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = s.db.EditMessage(ctx, messageID, body, time.Now().UTC().Truncate(time.Millisecond), editSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	// the edit is stored, clients missing it live get it on resume
+	if err = s.messageChanged(ctx, gateway.FrameMessageEdited, msg); err != nil {
+		log.Warn("service: announce edited message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	if err = s.search.IndexMessage(ctx, msg); err != nil {
+		log.Warn("service: index message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	if err = s.db.SetNotificationSnippet(ctx, msg.ID, snippet(msg.Body)); err != nil {
+		log.Warn("service: refresh notification snippets", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	return msg, nil
+}
+
+// DeleteMessage leaves a tombstone in place of the message, authors delete
+// their own messages and room admins anyone's.
+func (s *Service) DeleteMessage(ctx context.Context, userID string, roomID string, messageID string) (*domain.Message, error) {
+	msg, err := s.roomMessage(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.UserID != userID {
+		if err = s.checkRoomAdmin(ctx, roomID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	editSeq, err := s.db.LastSeq(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	deletedAt := time.Now().UTC().Truncate(time.Millisecond)
+
+	// the attachments and the copies of the body in the inboxes go first, a
+	// failure must not leave them behind a tombstone
+	if len(msg.AttachmentIDs) > 0 {
+		if err = s.db.DeleteAttachments(ctx, roomID, msg.AttachmentIDs, deletedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(msg.MentionIDs) > 0 || msg.MentionsRoom {
+		if err = s.db.SetNotificationSnippet(ctx, msg.ID, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err = s.db.DeleteMessage(ctx, messageID, userID, deletedAt, editSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	// the tombstone is stored, clients missing it live get it on resume
+	if err = s.messageChanged(ctx, gateway.FrameMessageDeleted, msg); err != nil {
+		log.Warn("service: announce deleted message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	if err = s.db.UncountUnread(ctx, roomID, msg.Seq); err != nil {
+		log.Warn("service: uncount deleted message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	if err = s.search.RemoveMessage(ctx, msg.ID); err != nil {
+		log.Warn("service: remove message from index", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	// dms have no pins
+	if err = s.unpin(ctx, userID, roomID, msg.ID); err != nil && !errors.Is(err, domain.ErrDBRoomNotFound) {
+		log.Warn("service: unpin deleted message", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	return msg, nil
+}
+
+// ListMessageRevisions returns the prior bodies of the message, oldest first.
+func (s *Service) ListMessageRevisions(ctx context.Context, userID string, roomID string, messageID string) ([]domain.MessageRevision, error) {
+	msg, err := s.roomMessage(ctx, userID, roomID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Revisions == nil {
+		return []domain.MessageRevision{}, nil
+	}
+
+	return msg.Revisions, nil
+}
+
+// roomMessage loads a message of the room the user is a member of, deleted
+// messages cannot be changed and are reported as such.
+func (s *Service) roomMessage(ctx context.Context, userID string, roomID string, messageID string) (*domain.Message, error) {
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	msg, err := s.db.GetMessage(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.RoomID != roomID {
+		return nil, domain.ErrDBMessageNotFound
+	}
+
+	if msg.DeletedAt != nil {
+		return nil, domain.ErrMessageDeleted
+	}
+
+	return msg, nil
+}
+
+// messageChanged refreshes the dm preview and pushes the new state of the
+// message to the connected clients.
+func (s *Service) messageChanged(ctx context.Context, typ string, msg *domain.Message) error {
+	if err := s.db.UpdateDMLastMessage(ctx, msg); err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.broker.PublishEvent(ctx, &domain.Event{
+		Type:   typ,
+		RoomID: msg.RoomID,
+		Data:   raw,
+	})
+}
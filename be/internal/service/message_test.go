@@ -0,0 +1,336 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// newMessageDB returns a room of an owner, alice, and a member, bob, holding
+// one message of each and a message of another room.
+func newMessageDB() *fakeDB {
+	createdAt := time.Now().UTC().Truncate(time.Millisecond)
+	deletedAt := createdAt
+
+	db := newFakeDB()
+	db.addUsers("alice", "bob", "eve")
+	db.rooms["room"] = &domain.Room{
+		ID: "room",
+		Members: []domain.RoomMember{
+			{UserID: "alice", Role: domain.RoomRoleOwner},
+			{UserID: "bob", Role: domain.RoomRoleMember},
+		},
+		Pins: []domain.Pin{{MessageID: "bob-1", PinnedBy: "alice"}},
+	}
+	db.rooms["other"] = &domain.Room{ID: "other", Members: []domain.RoomMember{{UserID: "alice", Role: domain.RoomRoleOwner}}}
+	db.messages = []*domain.Message{
+		{ID: "alice-1", RoomID: "room", UserID: "alice", Seq: 1, Body: "hello", CreatedAt: createdAt},
+		{ID: "bob-1", RoomID: "room", UserID: "bob", Seq: 2, Body: "hi", CreatedAt: createdAt},
+		{ID: "deleted", RoomID: "room", UserID: "alice", Seq: 3, CreatedAt: createdAt, DeletedAt: &deletedAt, DeletedBy: "alice"},
+		{ID: "other-1", RoomID: "other", UserID: "alice", Seq: 1, Body: "elsewhere", CreatedAt: createdAt},
+	}
+	// the messages of alice and bob mention each other
+	db.message("alice-1").MentionIDs = []string{"bob"}
+	db.message("bob-1").MentionIDs = []string{"alice"}
+	db.notifications = []*domain.Notification{
+		{ID: "to-bob", UserID: "bob", Type: domain.NotificationMention, RoomID: "room", MessageID: "alice-1", Seq: 1, ActorID: "alice", Snippet: "hello"},
+		{ID: "to-alice", UserID: "alice", Type: domain.NotificationMention, RoomID: "room", MessageID: "bob-1", Seq: 2, ActorID: "bob", Snippet: "hi"},
+	}
+	return db
+}
+
+func TestEditMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		userID    string
+		roomID    string
+		messageID string
+		body      string
+		// publishErr fails announcing the edit, which is stored anyway
+		publishErr error
+		expectErr  error
+	}{
+		{
+			name:      "author",
+			userID:    "alice",
+			roomID:    "room",
+			messageID: "alice-1",
+			body:      " hello there ",
+		},
+		{
+			name:       "publish_failed",
+			userID:     "alice",
+			roomID:     "room",
+			messageID:  "alice-1",
+			body:       " hello there ",
+			publishErr: domain.ErrBrokerPublish,
+		},
+		{
+			name:      "other_author",
+			userID:    "alice",
+			roomID:    "room",
+			messageID: "bob-1",
+			body:      "hijacked",
+			expectErr: domain.ErrMessageNotAuthor,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			roomID:    "room",
+			messageID: "alice-1",
+			body:      "hijacked",
+			expectErr: domain.ErrRoomNotMember,
+		},
+		{
+			name:      "deleted",
+			userID:    "alice",
+			roomID:    "room",
+			messageID: "deleted",
+			body:      "back",
+			expectErr: domain.ErrMessageDeleted,
+		},
+		{
+			name:      "other_room",
+			userID:    "alice",
+			roomID:    "room",
+			messageID: "other-1",
+			body:      "moved",
+			expectErr: domain.ErrDBMessageNotFound,
+		},
+		{
+			name:      "empty_body",
+			userID:    "alice",
+			roomID:    "room",
+			messageID: "alice-1",
+			body:      "  ",
+			expectErr: domain.ErrMessageEmpty,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newMessageDB()
+			s, b, _ := newTestService(t, db)
+			b.failPublish(tt.publishErr)
+
+			msg, err := s.EditMessage(context.Background(), tt.userID, tt.roomID, tt.messageID, tt.body)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "hello there", msg.Body)
+			require.NotNil(t, msg.EditedAt)
+			// the last seq of the room at the time of the edit
+			require.Equal(t, int64(3), msg.EditSeq)
+
+			revisions, err := s.ListMessageRevisions(context.Background(), tt.userID, tt.roomID, tt.messageID)
+			require.NoError(t, err)
+			require.Len(t, revisions, 1)
+			require.Equal(t, "hello", revisions[0].Body)
+
+			// the inbox of the mentioned user shows the new body
+			require.Equal(t, "hello there", db.notifications[0].Snippet)
+		})
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		userID    string
+		messageID string
+		// publishErr fails announcing the deletion, which is stored anyway
+		publishErr error
+		expectErr  error
+	}{
+		{
+			name:      "author",
+			userID:    "bob",
+			messageID: "bob-1",
+		},
+		{
+			name:      "admin",
+			userID:    "alice",
+			messageID: "bob-1",
+		},
+		{
+			name:       "publish_failed",
+			userID:     "bob",
+			messageID:  "bob-1",
+			publishErr: domain.ErrBrokerPublish,
+		},
+		{
+			name:      "other_author",
+			userID:    "bob",
+			messageID: "alice-1",
+			expectErr: domain.ErrRoomPermissionDenied,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			messageID: "alice-1",
+			expectErr: domain.ErrRoomNotMember,
+		},
+		{
+			name:      "deleted",
+			userID:    "alice",
+			messageID: "deleted",
+			expectErr: domain.ErrMessageDeleted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newMessageDB()
+			s, b, _ := newTestService(t, db)
+			b.failPublish(tt.publishErr)
+
+			msg, err := s.DeleteMessage(context.Background(), tt.userID, "room", tt.messageID)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Empty(t, msg.Body)
+			require.NotNil(t, msg.DeletedAt)
+			require.Equal(t, tt.userID, msg.DeletedBy)
+			require.Equal(t, int64(3), msg.EditSeq)
+
+			// a deleted message can no longer be changed and is unpinned
+			_, err = s.EditMessage(context.Background(), msg.UserID, "room", tt.messageID, "back")
+			require.ErrorIs(t, err, domain.ErrMessageDeleted)
+
+			room, err := db.GetRoom(context.Background(), "room")
+			require.NoError(t, err)
+			require.Nil(t, room.Pin(tt.messageID))
+
+			// no copy of the body is left in the inbox of the mentioned user
+			require.Empty(t, db.notifications[1].Snippet)
+		})
+	}
+}
+
+func TestListMessageRevisions(t *testing.T) {
+	t.Parallel()
+
+	db := newMessageDB()
+	s, _, _ := newTestService(t, db)
+	ctx := context.Background()
+
+	revisions, err := s.ListMessageRevisions(ctx, "bob", "room", "alice-1")
+	require.NoError(t, err)
+	require.Empty(t, revisions)
+
+	first, err := s.EditMessage(ctx, "alice", "room", "alice-1", "hello!")
+	require.NoError(t, err)
+	_, err = s.EditMessage(ctx, "alice", "room", "alice-1", "hello!!")
+	require.NoError(t, err)
+
+	// oldest first, every revision dated from when it was written
+	revisions, err = s.ListMessageRevisions(ctx, "bob", "room", "alice-1")
+	require.NoError(t, err)
+	require.Equal(t, []domain.MessageRevision{
+		{Body: "hello", CreatedAt: first.CreatedAt},
+		{Body: "hello!", CreatedAt: *first.EditedAt},
+	}, revisions)
+
+	_, err = s.ListMessageRevisions(ctx, "eve", "room", "alice-1")
+	require.ErrorIs(t, err, domain.ErrRoomNotMember)
+}
+
+func TestListMessages(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		userID string
+		limit  int
+		// expect is the length of every page of the 120 messages
+		expect    []int
+		expectErr error
+	}{
+		{
+			name:   "default_limit",
+			userID: "bob",
+			expect: []int{50, 50, 20},
+		},
+		{
+			name:   "max_limit",
+			userID: "bob",
+			limit:  domain.MessagePageMaxLimit,
+			expect: []int{100, 20},
+		},
+		{
+			name:      "over_max_limit",
+			userID:    "bob",
+			limit:     domain.MessagePageMaxLimit + 1,
+			expectErr: domain.ErrLimitInvalid,
+		},
+		{
+			name:      "negative_limit",
+			userID:    "bob",
+			limit:     -1,
+			expectErr: domain.ErrLimitInvalid,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			expectErr: domain.ErrRoomNotMember,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newMessageDB()
+			db.messages = db.messages[:0]
+			for i := range 120 {
+				db.messages = append(db.messages, &domain.Message{ID: fmt.Sprint(i + 1), RoomID: "room", UserID: "alice", Seq: int64(i + 1)})
+			}
+			// replies stay in their thread
+			db.messages = append(db.messages, &domain.Message{ID: "reply", RoomID: "room", UserID: "bob", ParentID: "1", Seq: 121})
+			s, _, _ := newTestService(t, db)
+
+			page, err := s.ListMessages(context.Background(), tt.userID, "room", "", tt.limit)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+
+			seq := int64(121)
+			for i, n := range tt.expect {
+				if i > 0 {
+					require.NotEmpty(t, page.NextCursor)
+					page, err = s.ListMessages(context.Background(), tt.userID, "room", page.NextCursor, tt.limit)
+					require.NoError(t, err)
+				}
+				require.Len(t, page.Messages, n)
+
+				// newest first, continuing the previous page
+				for _, msg := range page.Messages {
+					require.Less(t, msg.Seq, seq)
+					seq = msg.Seq
+				}
+			}
+			require.Empty(t, page.NextCursor)
+			require.Equal(t, int64(1), seq)
+		})
+	}
+}
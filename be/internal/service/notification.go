@@ -0,0 +1,58 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// notify stores the notifications and pushes them to the connections of
+// their users.
+func (s *Service) notify(ctx context.Context, notifications []*domain.Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	if err := s.db.CreateNotifications(ctx, notifications); err != nil {
+		return err
+	}
+
+	for _, n := range notifications {
+		f, err := gateway.NewFrame(gateway.FrameNotification, n)
+		if err != nil {
+			return err
+		}
+
+		err = s.broker.PublishUserEvent(ctx, &domain.Event{Type: f.Type, RoomID: n.RoomID, UserID: n.UserID, Data: f.Data})
+		if err != nil {
+			log.Warn("service: publish notification", log.UserID(n.UserID), log.Err(err))
+		}
+	}
+
+	return nil
+}
+
+// ListNotifications returns the inbox of the user, newest first.
+func (s *Service) ListNotifications(ctx context.Context, userID string, unreadOnly bool, before string, limit int) (*domain.NotificationPage, error) {
+	switch {
+	case limit == 0:
+		limit = domain.NotificationPageDefaultLimit
+	case limit < 0 || limit > domain.NotificationPageMaxLimit:
+		return nil, domain.ErrLimitInvalid
+	}
+
+	return s.db.ListNotifications(ctx, userID, unreadOnly, before, limit)
+}
+
+// MarkNotificationsRead marks the notifications read, all of the user's when
+// ids is empty.
+func (s *Service) MarkNotificationsRead(ctx context.Context, userID string, ids []string) (int64, error) {
+	if len(ids) > domain.NotificationPageMaxLimit {
+		return 0, domain.ErrNotificationIDsInvalid
+	}
+
+	return s.db.MarkNotificationsRead(ctx, userID, ids, time.Now().UTC())
+}
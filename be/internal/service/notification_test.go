@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		body     string
+		notified []string
+	}{
+		{
+			name:     "mention",
+			body:     "hi @bob",
+			notified: []string{"bob"},
+		},
+		{
+			name: "self_mention",
+			body: "note to @alice",
+		},
+		{
+			name: "no_mention",
+			body: "hi all",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("alice", "bob")
+			db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{
+				{UserID: "alice", Role: domain.RoomRoleOwner},
+				{UserID: "bob", Role: domain.RoomRoleMember},
+			}}
+			s, b, url := newTestService(t, db)
+			for _, id := range []string{"alice", "bob"} {
+				_, err := s.SetUsername(context.Background(), id, id)
+				require.NoError(t, err)
+			}
+
+			conn, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+			require.NoError(t, err)
+
+			send(t, conn, gateway.MessageSendData{Body: tt.body, ClientID: uuid.NewString()})
+
+			var ack gateway.MessageAckData
+			require.NoError(t, readFrameOf(t, conn, gateway.FrameMessageAck).Decode(&ack))
+
+			// frames are handled in order, the error of an unknown one marks the
+			// notifications done
+			require.NoError(t, conn.WriteJSON(gateway.Frame{Type: "unknown"}))
+			readFrameOf(t, conn, gateway.FrameError)
+
+			var notified []string
+			for _, event := range b.listUserEvents(gateway.FrameNotification) {
+				var n domain.Notification
+				require.NoError(t, (&gateway.Frame{Type: event.Type, Data: event.Data}).Decode(&n))
+				require.Equal(t, ack.ID, n.MessageID)
+				require.Equal(t, ack.Seq, n.Seq)
+				notified = append(notified, event.UserID)
+			}
+			require.Equal(t, tt.notified, notified)
+
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			require.Len(t, db.notifications, len(tt.notified))
+		})
+	}
+}
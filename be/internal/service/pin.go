@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// PinMessage pins the message of the room, pinning it again is a no-op.
+func (s *Service) PinMessage(ctx context.Context, userID string, roomID string, messageID string) error {
+	if err := s.checkRoomAdmin(ctx, roomID, userID); err != nil {
+		return err
+	}
+
+	if _, err := s.roomMessage(ctx, userID, roomID, messageID); err != nil {
+		return err
+	}
+
+	pin := domain.Pin{
+		MessageID: messageID,
+		PinnedBy:  userID,
+		PinnedAt:  time.Now().UTC().Truncate(time.Millisecond),
+	}
+
+	pinned, err := s.db.PinMessage(ctx, roomID, pin)
+	if err != nil || !pinned {
+		return err
+	}
+
+	// the pin is stored, clients missing the change see it on reload
+	err = s.pinChanged(ctx, gateway.FramePinAdded, roomID, gateway.PinData{
+		MessageID: messageID,
+		UserID:    userID,
+		PinnedAt:  &pin.PinnedAt,
+	})
+	if err != nil {
+		log.Warn("service: announce pin", log.ChatID(roomID), log.Err(err))
+	}
+
+	return nil
+}
+
+// UnpinMessage unpins the message of the room, the message may be gone
+// already.
+func (s *Service) UnpinMessage(ctx context.Context, userID string, roomID string, messageID string) error {
+	if err := s.checkRoomAdmin(ctx, roomID, userID); err != nil {
+		return err
+	}
+
+	return s.unpin(ctx, userID, roomID, messageID)
+}
+
+// ListPins returns the pinned messages of the room newest pin first, dms have
+// no pins.
+func (s *Service) ListPins(ctx context.Context, userID string, roomID string) ([]domain.Pin, error) {
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBRoomNotFound) {
+			return []domain.Pin{}, nil
+		}
+		return nil, err
+	}
+
+	if len(room.Pins) == 0 {
+		return []domain.Pin{}, nil
+	}
+
+	ids := make([]string, len(room.Pins))
+	for i, pin := range room.Pins {
+		ids[i] = pin.MessageID
+	}
+
+	messages, err := s.db.ListMessagesByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*domain.Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	pins := make([]domain.Pin, 0, len(room.Pins))
+	for _, pin := range room.Pins {
+		// a message deleted while being pinned is skipped
+		if msg := byID[pin.MessageID]; msg != nil && msg.DeletedAt == nil {
+			pin.Message = msg
+			pins = append(pins, pin)
+		}
+	}
+
+	return pins, nil
+}
+
+// unpin removes the pin and pushes the change if the message was pinned.
+func (s *Service) unpin(ctx context.Context, userID string, roomID string, messageID string) error {
+	unpinned, err := s.db.UnpinMessage(ctx, roomID, messageID)
+	if err != nil || !unpinned {
+		return err
+	}
+
+	err = s.pinChanged(ctx, gateway.FramePinRemoved, roomID, gateway.PinData{
+		MessageID: messageID,
+		UserID:    userID,
+	})
+	if err != nil {
+		log.Warn("service: announce unpin", log.ChatID(roomID), log.Err(err))
+	}
+
+	return nil
+}
+
+func (s *Service) pinChanged(ctx context.Context, typ string, roomID string, data gateway.PinData) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.broker.PublishEvent(ctx, &domain.Event{
+		Type:   typ,
+		RoomID: roomID,
+		Data:   raw,
+	})
+}
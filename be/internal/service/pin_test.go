@@ -0,0 +1,256 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		userID    string
+		messageID string
+		// pins of other messages beforehand
+		pins       int
+		publishErr error
+		expectErr  error
+	}{
+		{
+			name:      "owner",
+			userID:    "alice",
+			messageID: "alice-1",
+		},
+		{
+			name:       "publish_failed",
+			userID:     "alice",
+			messageID:  "alice-1",
+			publishErr: domain.ErrBrokerPublish,
+		},
+		{
+			name:      "admin",
+			userID:    "adam",
+			messageID: "alice-1",
+		},
+		{
+			name:      "below_limit",
+			userID:    "alice",
+			messageID: "alice-1",
+			pins:      domain.RoomMaxPins - 2,
+		},
+		{
+			name:      "at_limit",
+			userID:    "alice",
+			messageID: "alice-1",
+			pins:      domain.RoomMaxPins - 1,
+			expectErr: domain.ErrPinLimit,
+		},
+		{
+			name:      "member",
+			userID:    "bob",
+			messageID: "alice-1",
+			expectErr: domain.ErrRoomPermissionDenied,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			messageID: "alice-1",
+			expectErr: domain.ErrRoomNotMember,
+		},
+		{
+			name:      "other_room",
+			userID:    "alice",
+			messageID: "other-1",
+			expectErr: domain.ErrDBMessageNotFound,
+		},
+		{
+			name:      "deleted",
+			userID:    "alice",
+			messageID: "deleted",
+			expectErr: domain.ErrMessageDeleted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newPinDB()
+			for i := range tt.pins {
+				db.rooms["room"].Pins = append(db.rooms["room"].Pins, domain.Pin{MessageID: fmt.Sprint(i), PinnedBy: "alice"})
+			}
+			s, b, url := newTestService(t, db)
+
+			conn, _, err := dialRoom(t, s, url, "bob", "bob", "room")
+			require.NoError(t, err)
+
+			b.failPublish(tt.publishErr)
+
+			err = s.PinMessage(context.Background(), tt.userID, "room", tt.messageID)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+
+			// the pin is stored even if it was not announced
+			if tt.publishErr == nil {
+				var data gateway.PinData
+				require.NoError(t, readFrameOf(t, conn, gateway.FramePinAdded).Decode(&data))
+				require.Equal(t, tt.messageID, data.MessageID)
+				require.Equal(t, tt.userID, data.UserID)
+			}
+
+			// the newest pin comes first, pinning again changes nothing
+			require.NoError(t, s.PinMessage(context.Background(), tt.userID, "room", tt.messageID))
+
+			room, err := db.GetRoom(context.Background(), "room")
+			require.NoError(t, err)
+			require.Len(t, room.Pins, tt.pins+2)
+			require.Equal(t, tt.messageID, room.Pins[0].MessageID)
+			require.Equal(t, tt.userID, room.Pins[0].PinnedBy)
+		})
+	}
+}
+
+func TestUnpinMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		userID    string
+		messageID string
+		unpinned  bool
+		// pins is the number of pins left of the one of bob-1
+		pins       int
+		publishErr error
+		expectErr  error
+	}{
+		{
+			name:      "admin",
+			userID:    "adam",
+			messageID: "bob-1",
+			unpinned:  true,
+		},
+		{
+			name:       "publish_failed",
+			userID:     "adam",
+			messageID:  "bob-1",
+			publishErr: domain.ErrBrokerPublish,
+		},
+		{
+			name:      "not_pinned",
+			userID:    "alice",
+			messageID: "alice-1",
+			pins:      1,
+		},
+		{
+			name:      "member",
+			userID:    "bob",
+			messageID: "bob-1",
+			expectErr: domain.ErrRoomPermissionDenied,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			messageID: "bob-1",
+			expectErr: domain.ErrRoomNotMember,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newPinDB()
+			s, b, url := newTestService(t, db)
+
+			conn, _, err := dialRoom(t, s, url, "bob", "bob", "room")
+			require.NoError(t, err)
+
+			b.failPublish(tt.publishErr)
+
+			err = s.UnpinMessage(context.Background(), tt.userID, "room", tt.messageID)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+
+			room, err := db.GetRoom(context.Background(), "room")
+			require.NoError(t, err)
+			require.Len(t, room.Pins, tt.pins)
+
+			if tt.unpinned {
+				var data gateway.PinData
+				require.NoError(t, readFrameOf(t, conn, gateway.FramePinRemoved).Decode(&data))
+				require.Equal(t, gateway.PinData{MessageID: tt.messageID, UserID: tt.userID}, data)
+			}
+		})
+	}
+}
+
+func TestListPins(t *testing.T) {
+	t.Parallel()
+
+	db := newPinDB()
+	db.rooms["room"].Pins = []domain.Pin{
+		{MessageID: "deleted", PinnedBy: "alice"},
+		{MessageID: "alice-1", PinnedBy: "adam"},
+		{MessageID: "bob-1", PinnedBy: "alice"},
+	}
+	s, _, _ := newTestService(t, db)
+
+	tests := []struct {
+		name      string
+		userID    string
+		expect    []string
+		expectErr error
+	}{
+		{
+			name:   "member",
+			userID: "bob",
+			// the deleted message is skipped
+			expect: []string{"alice-1", "bob-1"},
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			expectErr: domain.ErrRoomNotMember,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pins, err := s.ListPins(context.Background(), tt.userID, "room")
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+
+			ids := make([]string, len(pins))
+			for i, pin := range pins {
+				ids[i] = pin.MessageID
+				require.Equal(t, pin.MessageID, pin.Message.ID)
+			}
+			require.Equal(t, tt.expect, ids)
+		})
+	}
+}
+
+// newPinDB adds an admin, adam, to the room of newMessageDB.
+func newPinDB() *fakeDB {
+	db := newMessageDB()
+	db.addUsers("adam")
+	db.rooms["room"].Members = append(db.rooms["room"].Members, domain.RoomMember{UserID: "adam", Role: domain.RoomRoleAdmin})
+	return db
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// presence tracks the status of every connection served by this instance,
+// the broker merges the instances into the status of a user.
+type presence struct {
+	mu    sync.Mutex
+	users map[string]*userPresence
+}
+
+// userPresence holds the connections of a user, it is dropped once no
+// connection and no update is left.
+type userPresence struct {
+	refs int // updates holding it, guarded by presence.mu
+
+	// held while the change reaches the broker so that updates of the user
+	// on this instance are never applied out of order
+	mu    sync.Mutex
+	conns map[*gateway.Client]string
+}
+
+func newPresence() *presence {
+	return &presence{users: make(map[string]*userPresence)}
+}
+
+// acquire locks the presence of the user, other users are not held up.
+func (p *presence) acquire(userID string) *userPresence {
+	p.mu.Lock()
+	u, ok := p.users[userID]
+	if !ok {
+		u = &userPresence{conns: make(map[*gateway.Client]string)}
+		p.users[userID] = u
+	}
+	u.refs++
+	p.mu.Unlock()
+
+	u.mu.Lock()
+	return u
+}
+
+func (p *presence) release(userID string, u *userPresence) {
+	u.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u.refs--
+	if u.refs == 0 && len(u.conns) == 0 {
+		delete(p.users, userID)
+	}
+}
+
+// GetPresence returns the status of the user, only to users they share a
+// room or dm with.
+func (s *Service) GetPresence(ctx context.Context, callerID string, userID string) (*domain.Presence, error) {
+	user, err := s.db.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.sharesConversation(ctx, callerID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, domain.ErrDBUserNotFound
+	}
+
+	statuses, err := s.broker.ListPresence(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &domain.Presence{UserID: userID, Status: domain.MergePresence(statuses...)}
+	if p.Status == domain.PresenceOffline {
+		p.LastSeen = user.LastSeen
+	}
+
+	return p, nil
+}
+
+// sharesConversation reports whether both users are members of a room or
+// dm.
+func (s *Service) sharesConversation(ctx context.Context, userID string, otherID string) (bool, error) {
+	if userID == otherID {
+		return true, nil
+	}
+
+	rooms, err := s.db.ListRooms(ctx, otherID)
+	if err != nil {
+		return false, err
+	}
+	for _, room := range rooms {
+		if room.Member(userID) != nil {
+			return true, nil
+		}
+	}
+
+	dms, err := s.db.ListDMs(ctx, otherID)
+	if err != nil {
+		return false, err
+	}
+	for _, dm := range dms {
+		if slices.Contains(dm.Members, userID) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Service) connect(ctx context.Context, c *gateway.Client) {
+	s.updatePresence(ctx, c, domain.PresenceOnline)
+}
+
+func (s *Service) disconnect(ctx context.Context, c *gateway.Client) {
+	s.updatePresence(ctx, c, "")
+
+	if err := s.db.SetLastSeen(ctx, c.User().ID, time.Now().UTC()); err != nil {
+		log.Warn("service: set last seen", log.UserID(c.User().ID), log.Err(err))
+	}
+}
+
+// setPresence lets the client switch between online and away, e.g. when the
+// user is idle or the app goes to the background.
+func (s *Service) setPresence(ctx context.Context, c *gateway.Client, f *gateway.Frame) error {
+	var data gateway.PresenceData
+	if err := f.Decode(&data); err != nil {
+		return domain.ErrFrameInvalid
+	}
+
+	if data.Status != domain.PresenceOnline && data.Status != domain.PresenceAway {
+		return domain.ErrPresenceInvalid
+	}
+
+	s.updatePresence(ctx, c, data.Status)
+	return nil
+}
+
+// updatePresence sets the status of the connection, an empty status removes
+// it. Contacts are notified when the status of the user changes.
+func (s *Service) updatePresence(ctx context.Context, c *gateway.Client, status string) {
+	userID := c.User().ID
+
+	changed, p := func() (bool, *domain.Presence) {
+		u := s.presence.acquire(userID)
+		defer s.presence.release(userID, u)
+
+		before := mergeConns(u.conns)
+		if status == "" {
+			delete(u.conns, c)
+		} else {
+			u.conns[c] = status
+		}
+		after := mergeConns(u.conns)
+
+		if before == after {
+			return false, nil
+		}
+
+		prev, err := s.broker.ListPresence(ctx, userID)
+		if err != nil {
+			log.Warn("service: list presence", log.UserID(userID), log.Err(err))
+		}
+
+		if after == domain.PresenceOffline {
+			err = s.broker.ClearPresence(ctx, userID)
+		} else {
+			err = s.broker.SetPresence(ctx, userID, after)
+		}
+		if err != nil {
+			log.Warn("service: update presence", log.UserID(userID), log.Err(err))
+			return false, nil
+		}
+
+		next, err := s.broker.ListPresence(ctx, userID)
+		if err != nil {
+			log.Warn("service: list presence", log.UserID(userID), log.Err(err))
+			return false, nil
+		}
+
+		p := &domain.Presence{UserID: userID, Status: domain.MergePresence(next...)}
+		if p.Status == domain.PresenceOffline {
+			now := time.Now().UTC()
+			p.LastSeen = &now
+		}
+
+		return domain.MergePresence(prev...) != p.Status, p
+	}()
+
+	if changed {
+		s.publishPresence(ctx, p)
+	}
+}
+
+// publishPresence pushes the status to every room and dm the user is in.
+func (s *Service) publishPresence(ctx context.Context, p *domain.Presence) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		log.Error("service.publishPresence", log.Err(err))
+		return
+	}
+
+	roomIDs, err := s.conversations(ctx, p.UserID)
+	if err != nil {
+		log.Warn("service: publish presence", log.UserID(p.UserID), log.Err(err))
+		return
+	}
+
+	for _, roomID := range roomIDs {
+		err = s.broker.PublishEvent(ctx, &domain.Event{
+			Type:          gateway.FramePresence,
+			RoomID:        roomID,
+			Data:          raw,
+			ExcludeUserID: p.UserID,
+		})
+		if err != nil {
+			log.Warn("service: publish presence", log.UserID(p.UserID), log.ChatID(roomID), log.Err(err))
+		}
+	}
+}
+
+func mergeConns(conns map[*gateway.Client]string) string {
+	statuses := make([]string, 0, len(conns))
+	for _, status := range conns {
+		statuses = append(statuses, status)
+	}
+	return domain.MergePresence(statuses...)
+}
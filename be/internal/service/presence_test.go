@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPresence(t *testing.T) {
+	t.Parallel()
+
+	lastSeen := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	db := newFakeDB()
+	db.addUsers("alice", "bob", "carol", "dave")
+	db.users[0].LastSeen = &lastSeen
+	db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "alice"}, {UserID: "bob"}}}
+	db.dms["dm"] = &domain.DM{ID: "dm", Members: []string{"alice", "carol"}}
+	s := &Service{db: db, broker: newFakeBroker()}
+
+	tests := []struct {
+		name     string
+		callerID string
+		userID   string
+		err      error
+	}{
+		{name: "self", callerID: "alice", userID: "alice"},
+		{name: "room", callerID: "bob", userID: "alice"},
+		{name: "dm", callerID: "carol", userID: "alice"},
+		{name: "stranger", callerID: "dave", userID: "alice", err: domain.ErrDBUserNotFound},
+		{name: "unknown", callerID: "alice", userID: "erin", err: domain.ErrDBUserNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := s.GetPresence(context.Background(), tt.callerID, tt.userID)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, &domain.Presence{UserID: tt.userID, Status: domain.PresenceOffline, LastSeen: &lastSeen}, p)
+		})
+	}
+}
+
+func TestUpdatePresence_PerUser(t *testing.T) {
+	t.Parallel()
+
+	db := newFakeDB()
+	db.addUsers("alice", "bob")
+	db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "alice"}, {UserID: "bob"}}}
+	s, b, url := newTestService(t, db)
+
+	release := make(chan struct{})
+	b.onSetPresence(func(userID string) {
+		if userID == "alice" {
+			<-release
+		}
+	})
+
+	alice, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+	require.NoError(t, err)
+
+	// bob goes online while the update of alice is stuck in the broker
+	_, _, err = dialRoom(t, s, url, "bob", "bob", "room")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return b.status("bob") == domain.PresenceOnline }, time.Second, 10*time.Millisecond)
+	require.Empty(t, b.status("alice"))
+
+	close(release)
+	require.Eventually(t, func() bool { return b.status("alice") == domain.PresenceOnline }, time.Second, 10*time.Millisecond)
+
+	// the state of a user is dropped with their last connection
+	require.NoError(t, alice.Close())
+	require.Eventually(t, func() bool {
+		s.presence.mu.Lock()
+		defer s.presence.mu.Unlock()
+		_, ok := s.presence.users["alice"]
+		return !ok && b.status("alice") == ""
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// AddReaction reacts to the message with the emoji and returns the
+// reactions of the message.
+func (s *Service) AddReaction(ctx context.Context, userID string, roomID string, messageID string, emoji string) ([]domain.Reaction, error) {
+	if !validReaction(emoji) {
+		return nil, domain.ErrReactionInvalid
+	}
+
+	if _, err := s.roomMessage(ctx, userID, roomID, messageID); err != nil {
+		return nil, err
+	}
+
+	msg, err := s.db.AddReaction(ctx, messageID, emoji, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reaction is stored, clients missing the change see it on reload
+	if err = s.reactionChanged(ctx, gateway.FrameReactionAdded, msg, emoji, userID); err != nil {
+		log.Warn("service: announce added reaction", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	return reactions(msg), nil
+}
+
+// RemoveReaction withdraws the user's reaction with the emoji and returns the
+// reactions of the message.
+func (s *Service) RemoveReaction(ctx context.Context, userID string, roomID string, messageID string, emoji string) ([]domain.Reaction, error) {
+	if !validReaction(emoji) {
+		return nil, domain.ErrReactionInvalid
+	}
+
+	if _, err := s.roomMessage(ctx, userID, roomID, messageID); err != nil {
+		return nil, err
+	}
+
+	msg, err := s.db.RemoveReaction(ctx, messageID, emoji, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the removal is stored, clients missing the change see it on reload
+	if err = s.reactionChanged(ctx, gateway.FrameReactionRemoved, msg, emoji, userID); err != nil {
+		log.Warn("service: announce removed reaction", log.ChatID(msg.RoomID), log.Err(err))
+	}
+
+	return reactions(msg), nil
+}
+
+// reactionChanged pushes the change with the new count instead of the whole
+// message.
+func (s *Service) reactionChanged(ctx context.Context, typ string, msg *domain.Message, emoji string, userID string) error {
+	data := gateway.ReactionData{
+		MessageID: msg.ID,
+		Seq:       msg.Seq,
+		Emoji:     emoji,
+		UserID:    userID,
+	}
+	if r := msg.Reaction(emoji); r != nil {
+		data.Count = len(r.UserIDs)
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.broker.PublishEvent(ctx, &domain.Event{
+		Type:   typ,
+		RoomID: msg.RoomID,
+		Data:   raw,
+	})
+}
+
+func validReaction(emoji string) bool {
+	return emoji != "" && len(emoji) <= domain.ReactionMaxLength && !strings.ContainsAny(emoji, " \t\r\n")
+}
+
+func reactions(msg *domain.Message) []domain.Reaction {
+	if msg.Reactions == nil {
+		return []domain.Reaction{}
+	}
+	return msg.Reactions
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddReaction(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		userID    string
+		messageID string
+		emoji     string
+		// reactions to the message beforehand, by alice
+		emojis     int
+		publishErr error
+		expect     int
+		expectErr  error
+	}{
+		{
+			name:      "new",
+			userID:    "bob",
+			messageID: "alice-1",
+			emoji:     "👍",
+			expect:    1,
+		},
+		{
+			name:       "publish_failed",
+			userID:     "bob",
+			messageID:  "alice-1",
+			emoji:      "👍",
+			publishErr: domain.ErrBrokerPublish,
+			expect:     1,
+		},
+		{
+			name:      "join",
+			userID:    "bob",
+			messageID: "alice-1",
+			emoji:     "0",
+			emojis:    1,
+			expect:    2,
+		},
+		{
+			name:      "again",
+			userID:    "alice",
+			messageID: "alice-1",
+			emoji:     "0",
+			emojis:    1,
+			expect:    1,
+		},
+		{
+			name:      "join_at_limit",
+			userID:    "bob",
+			messageID: "alice-1",
+			emoji:     "0",
+			emojis:    domain.MessageMaxReactions,
+			expect:    2,
+		},
+		{
+			name:      "new_at_limit",
+			userID:    "bob",
+			messageID: "alice-1",
+			emoji:     "👍",
+			emojis:    domain.MessageMaxReactions,
+			expectErr: domain.ErrReactionLimit,
+		},
+		{
+			name:      "empty",
+			userID:    "bob",
+			messageID: "alice-1",
+			expectErr: domain.ErrReactionInvalid,
+		},
+		{
+			name:      "space",
+			userID:    "bob",
+			messageID: "alice-1",
+			emoji:     "👍 👍",
+			expectErr: domain.ErrReactionInvalid,
+		},
+		{
+			name:      "too_long",
+			userID:    "bob",
+			messageID: "alice-1",
+			emoji:     strings.Repeat("x", domain.ReactionMaxLength+1),
+			expectErr: domain.ErrReactionInvalid,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			messageID: "alice-1",
+			emoji:     "👍",
+			expectErr: domain.ErrRoomNotMember,
+		},
+		{
+			name:      "other_room",
+			userID:    "alice",
+			messageID: "other-1",
+			emoji:     "👍",
+			expectErr: domain.ErrDBMessageNotFound,
+		},
+		{
+			name:      "deleted",
+			userID:    "alice",
+			messageID: "deleted",
+			emoji:     "👍",
+			expectErr: domain.ErrMessageDeleted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newMessageDB()
+			for i := range tt.emojis {
+				db.message(tt.messageID).Reactions = append(db.message(tt.messageID).Reactions, domain.Reaction{
+					Emoji:   fmt.Sprint(i),
+					UserIDs: []string{"alice"},
+				})
+			}
+			s, b, url := newTestService(t, db)
+
+			conn, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+			require.NoError(t, err)
+
+			b.failPublish(tt.publishErr)
+
+			reactions, err := s.AddReaction(context.Background(), tt.userID, "room", tt.messageID, tt.emoji)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+
+			i := slices.IndexFunc(reactions, func(r domain.Reaction) bool { return r.Emoji == tt.emoji })
+			require.GreaterOrEqual(t, i, 0)
+			require.Len(t, reactions[i].UserIDs, tt.expect)
+			require.Contains(t, reactions[i].UserIDs, tt.userID)
+			require.LessOrEqual(t, len(reactions), domain.MessageMaxReactions)
+
+			// the reaction is stored even if it was not announced
+			if tt.publishErr != nil {
+				return
+			}
+
+			var data gateway.ReactionData
+			require.NoError(t, readFrameOf(t, conn, gateway.FrameReactionAdded).Decode(&data))
+			require.Equal(t, gateway.ReactionData{
+				MessageID: tt.messageID,
+				Seq:       1,
+				Emoji:     tt.emoji,
+				UserID:    tt.userID,
+				Count:     tt.expect,
+			}, data)
+		})
+	}
+}
+
+func TestRemoveReaction(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		userID     string
+		emoji      string
+		publishErr error
+		expect     []domain.Reaction
+		expectErr  error
+	}{
+		{
+			name:   "leave",
+			userID: "bob",
+			emoji:  "👍",
+			expect: []domain.Reaction{{Emoji: "👍", UserIDs: []string{"alice"}}, {Emoji: "🎉", UserIDs: []string{"alice"}}},
+		},
+		{
+			name:       "publish_failed",
+			userID:     "bob",
+			emoji:      "👍",
+			publishErr: domain.ErrBrokerPublish,
+			expect:     []domain.Reaction{{Emoji: "👍", UserIDs: []string{"alice"}}, {Emoji: "🎉", UserIDs: []string{"alice"}}},
+		},
+		{
+			name:   "last",
+			userID: "alice",
+			emoji:  "🎉",
+			expect: []domain.Reaction{{Emoji: "👍", UserIDs: []string{"alice", "bob"}}},
+		},
+		{
+			name:   "not_reacted",
+			userID: "bob",
+			emoji:  "🎉",
+			expect: []domain.Reaction{{Emoji: "👍", UserIDs: []string{"alice", "bob"}}, {Emoji: "🎉", UserIDs: []string{"alice"}}},
+		},
+		{
+			name:      "invalid",
+			userID:    "bob",
+			emoji:     "",
+			expectErr: domain.ErrReactionInvalid,
+		},
+		{
+			name:      "not_a_member",
+			userID:    "eve",
+			emoji:     "👍",
+			expectErr: domain.ErrRoomNotMember,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newMessageDB()
+			db.message("alice-1").Reactions = []domain.Reaction{
+				{Emoji: "👍", UserIDs: []string{"alice", "bob"}},
+				{Emoji: "🎉", UserIDs: []string{"alice"}},
+			}
+			s, b, _ := newTestService(t, db)
+			b.failPublish(tt.publishErr)
+
+			reactions, err := s.RemoveReaction(context.Background(), tt.userID, "room", "alice-1", tt.emoji)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, reactions)
+		})
+	}
+}
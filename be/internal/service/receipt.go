@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// advanceReceipt records the delivered or read watermark reported by the
+// client and sends it to the authors of the messages it covers when it moved.
+func (s *Service) advanceReceipt(ctx context.Context, c *gateway.Client, f *gateway.Frame, read bool) error {
+	var data gateway.ReceiptData
+	if err := f.Decode(&data); err != nil || data.Seq < 0 {
+		return domain.ErrFrameInvalid
+	}
+
+	// never acknowledge messages that do not exist yet
+	lastSeq, err := s.db.LastSeq(ctx, c.RoomID())
+	if err != nil {
+		return err
+	}
+	seq := min(data.Seq, lastSeq)
+
+	var deliveredSeq, readSeq int64
+	if read {
+		readSeq = seq
+	} else {
+		deliveredSeq = seq
+	}
+
+	prev, receipt, err := s.db.AdvanceReceipt(ctx, c.RoomID(), c.User().ID, deliveredSeq, readSeq)
+	if err != nil || receipt == nil {
+		return err
+	}
+
+	if receipt.ReadSeq > prev.ReadSeq {
+		s.readUnread(ctx, receipt.RoomID, receipt.UserID, receipt.ReadSeq)
+	}
+
+	// the messages newly delivered or read, the read watermark trails
+	from, to := prev.DeliveredSeq, receipt.DeliveredSeq
+	if receipt.ReadSeq > prev.ReadSeq {
+		from = prev.ReadSeq
+	}
+	if receipt.DeliveredSeq == prev.DeliveredSeq {
+		to = receipt.ReadSeq
+	}
+
+	authors, err := s.db.ListMessageAuthors(ctx, receipt.RoomID, from, to)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+
+	for _, authorID := range authors {
+		if authorID == receipt.UserID {
+			continue
+		}
+
+		err = s.broker.PublishUserEvent(ctx, &domain.Event{
+			Type:   gateway.FrameReceipt,
+			RoomID: receipt.RoomID,
+			UserID: authorID,
+			Data:   raw,
+		})
+		if err != nil {
+			log.Warn("service: publish receipt", log.UserID(authorID), log.ChatID(receipt.RoomID), log.Err(err))
+		}
+	}
+
+	return nil
+}
+
+// ListReceipts returns the receipt of every member of the room, members
+// without one yet get zero watermarks.
+func (s *Service) ListReceipts(ctx context.Context, userID string, roomID string) ([]*domain.Receipt, error) {
+	members, err := s.members(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(members, userID) {
+		return nil, domain.ErrRoomNotMember
+	}
+
+	receipts, err := s.db.ListReceipts(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string]*domain.Receipt, len(receipts))
+	for _, r := range receipts {
+		byUser[r.UserID] = r
+	}
+
+	out := make([]*domain.Receipt, 0, len(members))
+	for _, memberID := range members {
+		r, ok := byUser[memberID]
+		if !ok {
+			r = &domain.Receipt{RoomID: roomID, UserID: memberID}
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+// ListUnread returns the unread and mention counts of the conversations of
+// the user with anything unread.
+func (s *Service) ListUnread(ctx context.Context, userID string) ([]*domain.Unread, error) {
+	roomIDs, err := s.conversations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.ListUnread(ctx, userID, roomIDs)
+}
+
+// readUpTo marks the messages of the room up to seq read by the user without
+// announcing it, e.g. for the sender of a message.
+func (s *Service) readUpTo(ctx context.Context, roomID string, userID string, seq int64) {
+	if seq == 0 {
+		return
+	}
+
+	if _, _, err := s.db.AdvanceReceipt(ctx, roomID, userID, seq, seq); err != nil {
+		log.Warn("service: advance receipt", log.UserID(userID), log.ChatID(roomID), log.Err(err))
+	}
+
+	s.readUnread(ctx, roomID, userID, seq)
+}
+
+// readUnread drops the messages up to readSeq from the unread counts of the
+// user, the receipt is stored already and the next read drops what a failure
+// left behind.
+func (s *Service) readUnread(ctx context.Context, roomID string, userID string, readSeq int64) {
+	if err := s.db.ReadUnread(ctx, roomID, userID, readSeq); err != nil {
+		log.Warn("service: read unread", log.UserID(userID), log.ChatID(roomID), log.Err(err))
+	}
+}
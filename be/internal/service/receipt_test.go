@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListUnread(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	db := newFakeDB()
+	db.addUsers("alice", "bob", "carol")
+	db.rooms["room"] = &domain.Room{ID: "room", Visibility: domain.RoomVisibilityPublic, Members: []domain.RoomMember{
+		{UserID: "alice", Role: domain.RoomRoleOwner},
+		{UserID: "bob", Role: domain.RoomRoleMember},
+	}}
+	s, _, url := newTestService(t, db)
+	_, err := s.SetUsername(ctx, "alice", "alice")
+	require.NoError(t, err)
+
+	alice, _, err := dialRoom(t, s, url, "alice", "alice", "room")
+	require.NoError(t, err)
+	bob, _, err := dialRoom(t, s, url, "bob", "bob", "room")
+	require.NoError(t, err)
+
+	acks := make([]gateway.MessageAckData, 3)
+	for i, body := range []string{"hi", "hey @alice", "how are you?"} {
+		send(t, bob, gateway.MessageSendData{Body: body})
+		require.NoError(t, readFrameOf(t, bob, gateway.FrameMessageAck).Decode(&acks[i]))
+	}
+
+	// joining after the messages leaves them read
+	require.NoError(t, s.JoinRoom(ctx, "carol", "room"))
+
+	steps := []struct {
+		name   string
+		run    func()
+		userID string
+		want   []*domain.Unread
+	}{
+		{
+			name:   "unread",
+			userID: "alice",
+			want:   []*domain.Unread{{RoomID: "room", UnreadCount: 3, MentionCount: 1, LastSeq: 3}},
+		},
+		{
+			name:   "sender",
+			userID: "bob",
+			want:   []*domain.Unread{},
+		},
+		{
+			name:   "joined_later",
+			userID: "carol",
+			want:   []*domain.Unread{},
+		},
+		{
+			name: "read_past_mention",
+			run: func() {
+				f, err := gateway.NewFrame(gateway.FrameRead, gateway.ReceiptData{Seq: 2})
+				require.NoError(t, err)
+				require.NoError(t, alice.WriteJSON(f))
+				readFrameOf(t, bob, gateway.FrameReceipt)
+			},
+			userID: "alice",
+			want:   []*domain.Unread{{RoomID: "room", UnreadCount: 1, LastSeq: 3, ReadSeq: 2}},
+		},
+		{
+			name: "new_message",
+			run: func() {
+				send(t, bob, gateway.MessageSendData{Body: "still there?"})
+				readFrameOf(t, bob, gateway.FrameMessageAck)
+			},
+			userID: "carol",
+			want:   []*domain.Unread{{RoomID: "room", UnreadCount: 1, LastSeq: 4, ReadSeq: 3}},
+		},
+		{
+			name: "reply_reads_all",
+			run: func() {
+				send(t, alice, gateway.MessageSendData{Body: "yes"})
+				readFrameOf(t, alice, gateway.FrameMessageAck)
+			},
+			userID: "alice",
+			want:   []*domain.Unread{},
+		},
+		{
+			name: "reply",
+			run: func() {
+				send(t, bob, gateway.MessageSendData{Body: "great", ParentID: acks[0].ID})
+				readFrameOf(t, bob, gateway.FrameMessageAck)
+			},
+			userID: "alice",
+			want:   []*domain.Unread{},
+		},
+		{
+			name: "reply_mention",
+			run: func() {
+				send(t, bob, gateway.MessageSendData{Body: "right @alice?", ParentID: acks[0].ID})
+				readFrameOf(t, bob, gateway.FrameMessageAck)
+			},
+			userID: "alice",
+			want:   []*domain.Unread{{RoomID: "room", MentionCount: 1, LastSeq: 7, ReadSeq: 5}},
+		},
+		{
+			name: "deleted",
+			run: func() {
+				send(t, bob, gateway.MessageSendData{Body: "oops"})
+				var ack gateway.MessageAckData
+				require.NoError(t, readFrameOf(t, bob, gateway.FrameMessageAck).Decode(&ack))
+
+				_, err := s.DeleteMessage(ctx, "bob", "room", ack.ID)
+				require.NoError(t, err)
+			},
+			userID: "alice",
+			want:   []*domain.Unread{{RoomID: "room", MentionCount: 1, LastSeq: 8, ReadSeq: 5}},
+		},
+	}
+
+	// the steps build on each other and run in order
+	for _, step := range steps {
+		if step.run != nil {
+			step.run()
+		}
+
+		unreads, err := s.ListUnread(ctx, step.userID)
+		require.NoError(t, err, step.name)
+		require.Equal(t, step.want, unreads, step.name)
+	}
+}
+
+func TestAdvanceReceipt(t *testing.T) {
+	t.Parallel()
+
+	db := newFakeDB()
+	db.addUsers("alice", "bob", "carol")
+	db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{
+		{UserID: "alice", Role: domain.RoomRoleOwner},
+		{UserID: "bob", Role: domain.RoomRoleMember},
+		{UserID: "carol", Role: domain.RoomRoleMember},
+	}}
+	s, b, url := newTestService(t, db)
+
+	conns := make(map[string]*websocket.Conn)
+	for _, userID := range []string{"alice", "bob", "carol"} {
+		conn, _, err := dialRoom(t, s, url, userID, userID, "room")
+		require.NoError(t, err)
+		conns[userID] = conn
+	}
+
+	// seqs 1 and 2 by bob, 3 by carol
+	for _, userID := range []string{"bob", "bob", "carol"} {
+		send(t, conns[userID], gateway.MessageSendData{Body: "hello"})
+		readFrameOf(t, conns[userID], gateway.FrameMessageAck)
+	}
+
+	steps := []struct {
+		name   string
+		userID string
+		typ    string
+		seq    int64
+		// want holds the receipts each author got by the step
+		want map[string]int
+	}{
+		{
+			name:   "delivered",
+			userID: "alice",
+			typ:    gateway.FrameDelivered,
+			seq:    2,
+			want:   map[string]int{"bob": 1},
+		},
+		{
+			name:   "read_delivered",
+			userID: "alice",
+			typ:    gateway.FrameRead,
+			seq:    1,
+			want:   map[string]int{"bob": 2},
+		},
+		{
+			name:   "unchanged",
+			userID: "alice",
+			typ:    gateway.FrameDelivered,
+			seq:    2,
+			want:   map[string]int{"bob": 2},
+		},
+		{
+			name:   "read_authors",
+			userID: "alice",
+			typ:    gateway.FrameRead,
+			seq:    3,
+			want:   map[string]int{"bob": 3, "carol": 1},
+		},
+		{
+			name:   "past_last_seq",
+			userID: "alice",
+			typ:    gateway.FrameDelivered,
+			seq:    9,
+			want:   map[string]int{"bob": 3, "carol": 1},
+		},
+		{
+			name:   "other_reader",
+			userID: "bob",
+			typ:    gateway.FrameRead,
+			seq:    3,
+			want:   map[string]int{"bob": 3, "carol": 2},
+		},
+	}
+
+	// the steps build on each other and run in order
+	for _, step := range steps {
+		f, err := gateway.NewFrame(step.typ, gateway.ReceiptData{Seq: step.seq})
+		require.NoError(t, err)
+
+		conn := conns[step.userID]
+		require.NoError(t, conn.WriteJSON(f))
+
+		// frames are handled in order, the error of an unknown one marks the
+		// receipt done
+		require.NoError(t, conn.WriteJSON(gateway.Frame{Type: "unknown"}))
+		readFrameOf(t, conn, gateway.FrameError)
+
+		got := make(map[string]int)
+		for _, event := range b.listUserEvents(gateway.FrameReceipt) {
+			got[event.UserID]++
+		}
+		require.Equal(t, step.want, got, step.name)
+	}
+}
@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/google/uuid"
+)
+
+func (s *Service) CreateRoom(ctx context.Context, userID string, name string, topic string, visibility string) (*domain.Room, error) {
+	name = strings.TrimSpace(name)
+	topic = strings.TrimSpace(topic)
+
+	switch {
+	case name == "":
+		return nil, domain.ErrRoomNameEmpty
+	case utf8.RuneCountInString(name) > domain.RoomNameMaxLength:
+		return nil, domain.ErrRoomNameTooLong
+	case utf8.RuneCountInString(topic) > domain.RoomTopicMaxLength:
+		return nil, domain.ErrRoomTopicTooLong
+	}
+
+	switch visibility {
+	case "":
+		visibility = domain.RoomVisibilityPublic
+	case domain.RoomVisibilityPublic, domain.RoomVisibilityPrivate:
+	default:
+		return nil, domain.ErrRoomVisibilityInvalid
+	}
+
+	now := time.Now().UTC()
+	room := &domain.Room{
+		ID:         uuid.NewString(),
+		Name:       name,
+		Topic:      topic,
+		Visibility: visibility,
+		Members: []domain.RoomMember{
+			{UserID: userID, Role: domain.RoomRoleOwner, JoinedAt: now},
+		},
+		Invites:   []string{},
+		CreatedBy: userID,
+		CreatedAt: now,
+	}
+
+	if err := s.db.CreateRoom(ctx, room); err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+// GetRoom returns the room if the user can see it, private rooms are only
+// visible to their members and invitees.
+func (s *Service) GetRoom(ctx context.Context, userID string, roomID string) (*domain.Room, error) {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if room.Visibility == domain.RoomVisibilityPrivate && room.Member(userID) == nil && !room.IsInvited(userID) {
+		return nil, domain.ErrDBRoomNotFound
+	}
+
+	return room, nil
+}
+
+func (s *Service) ListRooms(ctx context.Context, userID string) ([]*domain.Room, error) {
+	return s.db.ListRooms(ctx, userID)
+}
+
+func (s *Service) InviteToRoom(ctx context.Context, userID string, roomID string, inviteeID string) error {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if room.Member(userID) == nil {
+		return domain.ErrRoomNotMember
+	}
+
+	if room.Member(inviteeID) != nil {
+		return domain.ErrRoomAlreadyMember
+	}
+
+	if _, err = s.db.GetUser(ctx, inviteeID); err != nil {
+		return err
+	}
+
+	return s.db.AddRoomInvite(ctx, roomID, inviteeID)
+}
+
+func (s *Service) JoinRoom(ctx context.Context, userID string, roomID string) error {
+	room, err := s.GetRoom(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+
+	if room.Member(userID) != nil {
+		return domain.ErrRoomAlreadyMember
+	}
+
+	if room.Visibility == domain.RoomVisibilityPrivate && !room.IsInvited(userID) {
+		return domain.ErrRoomNotInvited
+	}
+
+	member := domain.RoomMember{
+		UserID:   userID,
+		Role:     domain.RoomRoleMember,
+		JoinedAt: time.Now().UTC(),
+	}
+
+	if err = s.db.AddRoomMember(ctx, roomID, member); err != nil {
+		return err
+	}
+
+	// the history before joining is not unread
+	lastSeq, err := s.db.LastSeq(ctx, roomID)
+	if err != nil {
+		log.Warn("service: last seq", log.UserID(userID), log.ChatID(roomID), log.Err(err))
+		return nil
+	}
+	s.readUpTo(ctx, roomID, userID, lastSeq)
+
+	return nil
+}
+
+func (s *Service) LeaveRoom(ctx context.Context, userID string, roomID string) error {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	member := room.Member(userID)
+	if member == nil {
+		return domain.ErrRoomNotMember
+	}
+
+	if member.Role == domain.RoomRoleOwner {
+		return domain.ErrRoomOwnerLeave
+	}
+
+	if err = s.db.RemoveRoomMember(ctx, roomID, userID); err != nil {
+		return err
+	}
+	s.closeRoom(ctx, roomID, userID)
+
+	return nil
+}
+
+// RemoveRoomMember kicks memberID out of the room, only admins can remove
+// members and only members with a lower role.
+func (s *Service) RemoveRoomMember(ctx context.Context, userID string, roomID string, memberID string) error {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	actor := room.Member(userID)
+	if actor == nil {
+		return domain.ErrRoomNotMember
+	}
+
+	target := room.Member(memberID)
+	if target == nil {
+		return domain.ErrRoomNotMember
+	}
+
+	if !actor.IsAdmin() || !actor.Outranks(target) {
+		return domain.ErrRoomPermissionDenied
+	}
+
+	if err = s.db.RemoveRoomMember(ctx, roomID, memberID); err != nil {
+		return err
+	}
+	s.closeRoom(ctx, roomID, memberID)
+
+	return nil
+}
+
+// closeRoom closes the gateway connections of a former member to the room on
+// every instance, a connection missed here can no longer send to the room.
+func (s *Service) closeRoom(ctx context.Context, roomID string, userID string) {
+	f, err := gateway.NewFrame(gateway.FrameRoomRemoved, gateway.RoomRemovedData{RoomID: roomID})
+	if err != nil {
+		log.Error("service.closeRoom", log.Err(err))
+		return
+	}
+
+	err = s.broker.PublishUserEvent(ctx, &domain.Event{Type: f.Type, RoomID: roomID, UserID: userID, Data: f.Data})
+	if err != nil {
+		log.Warn("service: close room", log.UserID(userID), log.ChatID(roomID), log.Err(err))
+	}
+}
+
+// checkRoomMember fails unless the user is a member of the room or dm.
+func (s *Service) checkRoomMember(ctx context.Context, roomID string, userID string) error {
+	members, err := s.members(ctx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(members, userID) {
+		return domain.ErrRoomNotMember
+	}
+
+	return nil
+}
+
+// checkRoomAdmin fails unless the user is an admin of the room, dms have no
+// admins.
+func (s *Service) checkRoomAdmin(ctx context.Context, roomID string, userID string) error {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBRoomNotFound) {
+			return domain.ErrRoomPermissionDenied
+		}
+		return err
+	}
+
+	member := room.Member(userID)
+	if member == nil {
+		return domain.ErrRoomNotMember
+	}
+
+	if !member.IsAdmin() {
+		return domain.ErrRoomPermissionDenied
+	}
+
+	return nil
+}
+
+// members returns the ids of the members of the room or dm.
+func (s *Service) members(ctx context.Context, roomID string) ([]string, error) {
+	room, err := s.db.GetRoom(ctx, roomID)
+	if err == nil {
+		members := make([]string, 0, len(room.Members))
+		for _, m := range room.Members {
+			members = append(members, m.UserID)
+		}
+		return members, nil
+	}
+
+	if !errors.Is(err, domain.ErrDBRoomNotFound) {
+		return nil, err
+	}
+
+	dm, err := s.db.GetDM(ctx, roomID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBDMNotFound) {
+			return nil, domain.ErrDBRoomNotFound
+		}
+		return nil, err
+	}
+
+	return dm.Members, nil
+}
@@ -0,0 +1,364 @@
+package service
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoom_Membership(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		run  func(s *Service) error
+		// removed is the member whose connection to the room is closed
+		removed string
+		err     error
+	}{
+		{
+			name:    "leave",
+			run:     func(s *Service) error { return s.LeaveRoom(context.Background(), "mia", "room") },
+			removed: "mia",
+		},
+		{
+			name: "leave_owner",
+			run:  func(s *Service) error { return s.LeaveRoom(context.Background(), "olga", "room") },
+			err:  domain.ErrRoomOwnerLeave,
+		},
+		{
+			name: "leave_not_member",
+			run:  func(s *Service) error { return s.LeaveRoom(context.Background(), "nina", "room") },
+			err:  domain.ErrRoomNotMember,
+		},
+		{
+			name:    "remove_by_admin",
+			run:     func(s *Service) error { return s.RemoveRoomMember(context.Background(), "adam", "room", "mia") },
+			removed: "mia",
+		},
+		{
+			name:    "remove_admin_by_owner",
+			run:     func(s *Service) error { return s.RemoveRoomMember(context.Background(), "olga", "room", "adam") },
+			removed: "adam",
+		},
+		{
+			name: "remove_by_member",
+			run:  func(s *Service) error { return s.RemoveRoomMember(context.Background(), "max", "room", "mia") },
+			err:  domain.ErrRoomPermissionDenied,
+		},
+		{
+			name: "remove_owner_by_admin",
+			run:  func(s *Service) error { return s.RemoveRoomMember(context.Background(), "adam", "room", "olga") },
+			err:  domain.ErrRoomPermissionDenied,
+		},
+		{
+			name: "remove_not_member",
+			run:  func(s *Service) error { return s.RemoveRoomMember(context.Background(), "adam", "room", "nina") },
+			err:  domain.ErrRoomNotMember,
+		},
+		{
+			name: "remove_by_not_member",
+			run:  func(s *Service) error { return s.RemoveRoomMember(context.Background(), "nina", "room", "mia") },
+			err:  domain.ErrRoomNotMember,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("olga", "adam", "mia", "max", "nina")
+			db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{
+				{UserID: "olga", Role: domain.RoomRoleOwner},
+				{UserID: "adam", Role: domain.RoomRoleAdmin},
+				{UserID: "mia", Role: domain.RoomRoleMember},
+				{UserID: "max", Role: domain.RoomRoleMember},
+			}}
+			db.rooms["lobby"] = &domain.Room{ID: "lobby", Members: []domain.RoomMember{
+				{UserID: "mia", Role: domain.RoomRoleMember},
+				{UserID: "adam", Role: domain.RoomRoleMember},
+			}}
+			s, b, url := newTestService(t, db)
+
+			var conn, lobby *websocket.Conn
+			if tt.removed != "" {
+				var err error
+				conn, _, err = dialRoom(t, s, url, tt.removed, tt.removed, "room")
+				require.NoError(t, err)
+				lobby, _, err = dialRoom(t, s, url, tt.removed, tt.removed, "lobby")
+				require.NoError(t, err)
+				require.Eventually(t, func() bool { return b.userSubscribed(tt.removed) }, time.Second, 10*time.Millisecond)
+			}
+
+			err := tt.run(s)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				require.Empty(t, b.listUserEvents(gateway.FrameRoomRemoved))
+				return
+			}
+			require.NoError(t, err)
+
+			room, err := db.GetRoom(context.Background(), "room")
+			require.NoError(t, err)
+			require.Nil(t, room.Member(tt.removed))
+
+			f := readFrame(t, conn)
+			require.Equal(t, gateway.FrameRoomRemoved, f.Type)
+
+			_, _, err = conn.ReadMessage()
+			require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+
+			// connections to other rooms stay open
+			_ = lobby.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, _, err = lobby.ReadMessage()
+			var netErr net.Error
+			require.ErrorAs(t, err, &netErr)
+			require.True(t, netErr.Timeout())
+		})
+	}
+}
+
+func TestRoom_SendAfterRemoval(t *testing.T) {
+	t.Parallel()
+
+	db := newFakeDB()
+	db.addUsers("mia")
+	db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "mia", Role: domain.RoomRoleMember}}}
+	s, _, url := newTestService(t, db)
+
+	conn, _, err := dialRoom(t, s, url, "mia", "mia", "room")
+	require.NoError(t, err)
+
+	// removed by another instance whose event did not reach this one
+	require.NoError(t, db.RemoveRoomMember(context.Background(), "room", "mia"))
+
+	send(t, conn, gateway.MessageSendData{Body: "hello"})
+
+	out := readFrame(t, conn)
+	require.Equal(t, gateway.FrameError, out.Type)
+
+	var data gateway.ErrorData
+	require.NoError(t, out.Decode(&data))
+	require.Equal(t, domain.ErrRoomNotMember.Error(), data.Error)
+}
+
+func TestCreateRoom(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		roomName   string
+		topic      string
+		visibility string
+		expect     string
+		expectErr  error
+	}{
+		{
+			name:     "default_visibility",
+			roomName: " general ",
+			expect:   domain.RoomVisibilityPublic,
+		},
+		{
+			name:       "private",
+			roomName:   "secret",
+			visibility: domain.RoomVisibilityPrivate,
+			expect:     domain.RoomVisibilityPrivate,
+		},
+		{
+			name:      "empty_name",
+			roomName:  "  ",
+			expectErr: domain.ErrRoomNameEmpty,
+		},
+		{
+			name:      "long_name",
+			roomName:  strings.Repeat("ä", domain.RoomNameMaxLength+1),
+			expectErr: domain.ErrRoomNameTooLong,
+		},
+		{
+			name:      "long_topic",
+			roomName:  "general",
+			topic:     strings.Repeat("ä", domain.RoomTopicMaxLength+1),
+			expectErr: domain.ErrRoomTopicTooLong,
+		},
+		{
+			name:       "unknown_visibility",
+			roomName:   "general",
+			visibility: "hidden",
+			expectErr:  domain.ErrRoomVisibilityInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("olga")
+			s, _, _ := newTestService(t, db)
+
+			room, err := s.CreateRoom(context.Background(), "olga", tt.roomName, tt.topic, tt.visibility)
+			if tt.expectErr != nil {
+				require.ErrorIs(t, err, tt.expectErr)
+				require.Empty(t, db.rooms)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, strings.TrimSpace(tt.roomName), room.Name)
+			require.Equal(t, tt.expect, room.Visibility)
+
+			// the creator owns the room
+			stored, err := db.GetRoom(context.Background(), room.ID)
+			require.NoError(t, err)
+			require.Equal(t, domain.RoomRoleOwner, stored.Member("olga").Role)
+		})
+	}
+}
+
+func TestRoom_Invites(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		run  func(s *Service) error
+		// joined is the user who is a member of roomID afterwards
+		roomID string
+		joined string
+		err    error
+	}{
+		{
+			name:   "join_public",
+			run:    func(s *Service) error { return s.JoinRoom(context.Background(), "nina", "public") },
+			roomID: "public",
+			joined: "nina",
+		},
+		{
+			name: "join_private_uninvited",
+			run:  func(s *Service) error { return s.JoinRoom(context.Background(), "nina", "private") },
+			err:  domain.ErrDBRoomNotFound,
+		},
+		{
+			name: "join_private_invited",
+			run: func(s *Service) error {
+				if err := s.InviteToRoom(context.Background(), "mia", "private", "nina"); err != nil {
+					return err
+				}
+				return s.JoinRoom(context.Background(), "nina", "private")
+			},
+			roomID: "private",
+			joined: "nina",
+		},
+		{
+			name: "join_twice",
+			run:  func(s *Service) error { return s.JoinRoom(context.Background(), "mia", "public") },
+			err:  domain.ErrRoomAlreadyMember,
+		},
+		{
+			name: "join_unknown",
+			run:  func(s *Service) error { return s.JoinRoom(context.Background(), "nina", "unknown") },
+			err:  domain.ErrDBRoomNotFound,
+		},
+		{
+			name: "invite_by_not_member",
+			run:  func(s *Service) error { return s.InviteToRoom(context.Background(), "nina", "private", "max") },
+			err:  domain.ErrRoomNotMember,
+		},
+		{
+			name: "invite_member",
+			run:  func(s *Service) error { return s.InviteToRoom(context.Background(), "olga", "private", "mia") },
+			err:  domain.ErrRoomAlreadyMember,
+		},
+		{
+			name: "invite_unknown_user",
+			run:  func(s *Service) error { return s.InviteToRoom(context.Background(), "olga", "private", "ghost") },
+			err:  domain.ErrDBUserNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.addUsers("olga", "mia", "max", "nina")
+			db.rooms["public"] = &domain.Room{ID: "public", Visibility: domain.RoomVisibilityPublic, Members: []domain.RoomMember{
+				{UserID: "olga", Role: domain.RoomRoleOwner},
+				{UserID: "mia", Role: domain.RoomRoleMember},
+			}}
+			db.rooms["private"] = &domain.Room{ID: "private", Visibility: domain.RoomVisibilityPrivate, Members: []domain.RoomMember{
+				{UserID: "olga", Role: domain.RoomRoleOwner},
+				{UserID: "mia", Role: domain.RoomRoleMember},
+			}}
+			for _, roomID := range []string{"public", "private"} {
+				db.messages = append(db.messages, &domain.Message{ID: roomID + "-1", RoomID: roomID, UserID: "olga", Seq: 1})
+			}
+			s, _, _ := newTestService(t, db)
+
+			err := tt.run(s)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+
+			room, err := db.GetRoom(context.Background(), tt.roomID)
+			require.NoError(t, err)
+
+			member := room.Member(tt.joined)
+			require.NotNil(t, member)
+			require.Equal(t, domain.RoomRoleMember, member.Role)
+			// the invite is used up
+			require.False(t, room.IsInvited(tt.joined))
+
+			// the history before joining is not unread
+			unread, err := s.ListUnread(context.Background(), tt.joined)
+			require.NoError(t, err)
+			require.Empty(t, unread)
+		})
+	}
+}
+
+func TestGetRoom(t *testing.T) {
+	t.Parallel()
+
+	db := newFakeDB()
+	db.rooms["private"] = &domain.Room{
+		ID:         "private",
+		Visibility: domain.RoomVisibilityPrivate,
+		Members:    []domain.RoomMember{{UserID: "olga", Role: domain.RoomRoleOwner}},
+		Invites:    []string{"nina"},
+	}
+	s := &Service{db: db}
+
+	tests := []struct {
+		name   string
+		userID string
+		err    error
+	}{
+		{name: "member", userID: "olga"},
+		{name: "invitee", userID: "nina"},
+		{name: "stranger", userID: "max", err: domain.ErrDBRoomNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			room, err := s.GetRoom(context.Background(), tt.userID, "private")
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "private", room.ID)
+		})
+	}
+}
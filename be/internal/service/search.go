@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+// SearchMessages searches the conversations the user is a member of, the
+// rooms in search.RoomIDs narrow it further.
+func (s *Service) SearchMessages(ctx context.Context, userID string, search *domain.MessageSearch) ([]*domain.SearchHit, error) {
+	search.Query = strings.TrimSpace(search.Query)
+
+	switch {
+	case search.Query == "":
+		return nil, domain.ErrSearchQueryEmpty
+	case utf8.RuneCountInString(search.Query) > domain.SearchQueryMaxLength:
+		return nil, domain.ErrSearchQueryTooLong
+	case !search.After.IsZero() && !search.Before.IsZero() && !search.After.Before(search.Before):
+		return nil, domain.ErrSearchTimeInvalid
+	}
+
+	switch {
+	case search.Limit == 0:
+		search.Limit = domain.SearchDefaultLimit
+	case search.Limit < 0 || search.Limit > domain.SearchMaxLimit:
+		return nil, domain.ErrLimitInvalid
+	}
+
+	roomIDs, err := s.conversations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, roomID := range search.RoomIDs {
+		if !slices.Contains(roomIDs, roomID) {
+			return nil, domain.ErrRoomNotMember
+		}
+	}
+
+	if len(search.RoomIDs) == 0 {
+		search.RoomIDs = roomIDs
+	}
+
+	if len(search.RoomIDs) == 0 {
+		return []*domain.SearchHit{}, nil
+	}
+
+	return s.search.SearchMessages(ctx, search)
+}
+
+// conversations returns the ids of the rooms and dms of the user.
+func (s *Service) conversations(ctx context.Context, userID string) ([]string, error) {
+	rooms, err := s.db.ListRooms(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	dms, err := s.db.ListDMs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(rooms)+len(dms))
+	for _, room := range rooms {
+		ids = append(ids, room.ID)
+	}
+	for _, dm := range dms {
+		ids = append(ids, dm.ID)
+	}
+
+	return ids, nil
+}
@@ -3,137 +3,323 @@ package service
 import (
 	"context"
 	"errors"
+	"io"
+	"net/url"
+	"runtime"
+	"time"
 
 	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/gorilla/websocket"
 )
 
 type (
 	database interface {
 		GetUser(ctx context.Context, userID string) (*domain.User, error)
-		CreateUser(ctx context.Context, user *domain.User, provider string) (string, error)
-		SetUsername(ctx context.Context, userID string, username string) error
+		CreateUser(ctx context.Context, user *domain.User) error
+		SetUsername(ctx context.Context, userID string, username string) (*domain.User, error)
+		SetLastSeen(ctx context.Context, userID string, lastSeen time.Time) error
+		SetAvatar(ctx context.Context, userID string, avatarID string, avatar string) (string, error)
+		SetProfile(ctx context.Context, userID string, name string, avatar string) (*domain.User, error)
+		ListUsersByUsername(ctx context.Context, usernames []string) ([]*domain.User, error)
+
+		GetUserByIdentity(ctx context.Context, provider string, subject string) (*domain.User, error)
+		UpdateIdentity(ctx context.Context, identity *domain.Identity) error
+		ClaimLegacyUser(ctx context.Context, email string, identity *domain.Identity) (*domain.User, error)
+		ListUsersByVerifiedEmail(ctx context.Context, email string, limit int) ([]*domain.User, error)
+		LinkIdentity(ctx context.Context, userID string, identity *domain.Identity) (*domain.User, error)
+		UnlinkIdentity(ctx context.Context, userID string, provider string, subject string) (*domain.User, error)
+
+		CreateSession(ctx context.Context, session *domain.Session) error
+		GetSession(ctx context.Context, sessionID string) (*domain.Session, error)
+		ListSessions(ctx context.Context, userID string, now time.Time) ([]*domain.Session, error)
+		RotateSession(ctx context.Context, sessionID string, refreshID string, nextID string, rotatedAt time.Time) error
+		RevokeSession(ctx context.Context, userID string, sessionID string, revokedAt time.Time) error
+		RevokeUserSessions(ctx context.Context, userID string, keepID string, revokedAt time.Time) ([]string, error)
+		RevokeIdentitySessions(ctx context.Context, userID string, provider string, subject string, revokedAt time.Time) ([]string, error)
+
+		OpenDM(ctx context.Context, userID string, peerID string) (*domain.DM, error)
+		GetDM(ctx context.Context, dmID string) (*domain.DM, error)
+		ListDMs(ctx context.Context, userID string) ([]*domain.DM, error)
+		SetDMLastMessage(ctx context.Context, msg *domain.Message) error
+		UpdateDMLastMessage(ctx context.Context, msg *domain.Message) error
+
+		CreateRoom(ctx context.Context, room *domain.Room) error
+		GetRoom(ctx context.Context, roomID string) (*domain.Room, error)
+		ListRooms(ctx context.Context, userID string) ([]*domain.Room, error)
+		AddRoomInvite(ctx context.Context, roomID string, userID string) error
+		AddRoomMember(ctx context.Context, roomID string, member domain.RoomMember) error
+		RemoveRoomMember(ctx context.Context, roomID string, userID string) error
+		PinMessage(ctx context.Context, roomID string, pin domain.Pin) (bool, error)
+		UnpinMessage(ctx context.Context, roomID string, messageID string) (bool, error)
+
+		CreateMessage(ctx context.Context, msg *domain.Message) error
+		ListMessages(ctx context.Context, roomID string, before string, limit int) (*domain.MessagePage, error)
+		GetMessage(ctx context.Context, messageID string) (*domain.Message, error)
+		ListMessagesByID(ctx context.Context, messageIDs []string) ([]*domain.Message, error)
+		EditMessage(ctx context.Context, messageID string, body string, editedAt time.Time, editSeq int64) (*domain.Message, error)
+		DeleteMessage(ctx context.Context, messageID string, deletedBy string, deletedAt time.Time, editSeq int64) (*domain.Message, error)
+		AddReaction(ctx context.Context, messageID string, emoji string, userID string) (*domain.Message, error)
+		RemoveReaction(ctx context.Context, messageID string, emoji string, userID string) (*domain.Message, error)
+		ListReplies(ctx context.Context, parentID string, before string, limit int) (*domain.MessagePage, error)
+		AddReply(ctx context.Context, parentID string, repliedAt time.Time) error
+		ListMessagesAfter(ctx context.Context, roomID string, seq int64, limit int) ([]*domain.Message, error)
+		ListMessageChanges(ctx context.Context, roomID string, seq int64, after int64, limit int) ([]*domain.Message, error)
+		ReserveClientID(ctx context.Context, roomID string, userID string, clientID string, messageID string, window time.Duration) (string, bool, error)
+		ReleaseClientID(ctx context.Context, roomID string, userID string, clientID string, messageID string) error
+		LastSeq(ctx context.Context, roomID string) (int64, error)
+		ListMessageAuthors(ctx context.Context, roomID string, from int64, to int64) ([]string, error)
+
+		AdvanceReceipt(ctx context.Context, roomID string, userID string, deliveredSeq int64, readSeq int64) (*domain.Receipt, *domain.Receipt, error)
+		ListReceipts(ctx context.Context, roomID string) ([]*domain.Receipt, error)
+
+		CountUnread(ctx context.Context, msg *domain.Message, memberIDs []string) error
+		ReadUnread(ctx context.Context, roomID string, userID string, readSeq int64) error
+		UncountUnread(ctx context.Context, roomID string, seq int64) error
+		ListUnread(ctx context.Context, userID string, roomIDs []string) ([]*domain.Unread, error)
+
+		CreateAttachment(ctx context.Context, attachment *domain.Attachment) error
+		GetAttachment(ctx context.Context, attachmentID string) (*domain.Attachment, error)
+		ListAttachments(ctx context.Context, attachmentIDs []string) ([]*domain.Attachment, error)
+		DeleteAttachments(ctx context.Context, roomID string, attachmentIDs []string, deletedAt time.Time) error
+
+		CreateNotifications(ctx context.Context, notifications []*domain.Notification) error
+		SetNotificationSnippet(ctx context.Context, messageID string, snippet string) error
+		ListNotifications(ctx context.Context, userID string, unreadOnly bool, before string, limit int) (*domain.NotificationPage, error)
+		MarkNotificationsRead(ctx context.Context, userID string, ids []string, readAt time.Time) (int64, error)
 	}
 
 	oauthProvider interface {
-		GetRedirectURL(provider string) (string, error)
-		HandleCallback(ctx context.Context, provider string, code string) (*domain.User, error)
+		GetRedirectURL(ctx context.Context, provider string) (*domain.OAuthRedirect, error)
+		HandleCallback(ctx context.Context, provider string, callback *domain.OAuthCallback) (*domain.OAuthProfile, error)
 	}
 
 	userTokenProvider interface {
-		CreateToken(userID string, email string) (*domain.Token, error)
+		CreateToken(userID string, email string, sessionID string, refreshID string) (*domain.Token, error)
 		VerifyToken(token string) (*domain.UserTokenPayload, error)
+		VerifyRefreshToken(token string) (*domain.UserTokenPayload, error)
 	}
 
 	chatTokenProvider interface {
-		CreateToken(userID string, sessionID string) (string, error)
-		VerifyToken(token string) (*domain.ChatTokenPayload, error)
+		CreateToken(userID string, sessionID string, roomID string) (string, error)
+		VerifyToken(token string, roomID string) (*domain.ChatTokenPayload, error)
+	}
+
+	hub interface {
+		Handle(ctx context.Context, c *gateway.Client, handler gateway.Handler)
+	}
+
+	searchIndex interface {
+		IndexMessage(ctx context.Context, msg *domain.Message) error
+		RemoveMessage(ctx context.Context, messageID string) error
+		SearchMessages(ctx context.Context, search *domain.MessageSearch) ([]*domain.SearchHit, error)
+	}
+
+	blobStore interface {
+		Put(ctx context.Context, key string, r io.Reader) error
+		Open(ctx context.Context, key string) (io.ReadCloser, error)
+		Delete(ctx context.Context, key string) error
 	}
+
+	urlSigner interface {
+		Sign(resource string, userID string) (url.Values, time.Time)
+		Verify(resource string, q url.Values) (string, error)
+	}
+
+	broker interface {
+		PublishMessage(ctx context.Context, msg *domain.Message) error
+		PublishEvent(ctx context.Context, event *domain.Event) error
+		PublishUserEvent(ctx context.Context, event *domain.Event) error
+
+		SetPresence(ctx context.Context, userID string, status string) error
+		ClearPresence(ctx context.Context, userID string) error
+		ListPresence(ctx context.Context, userID string) ([]string, error)
+	}
+)
+
+const (
+	defaultDedupWindow       = 2 * time.Minute
+	defaultMaxAttachmentSize = 25 << 20 // 25MB
+	defaultSessionTTL        = 720 * time.Hour
 )
 
+type Config struct {
+	// DedupWindow is how long a client message id is remembered to ignore retries
+	DedupWindow time.Duration
+	// MaxAttachmentSize is the largest upload accepted in bytes
+	MaxAttachmentSize int64
+	// ImageWorkers is how many images are buffered and processed at once
+	ImageWorkers int
+	// SessionTTL is how long a login lasts, it matches the refresh token ttl
+	SessionTTL time.Duration
+}
+
 type Service struct {
+	cfg Config
+
 	db                database
 	oauthProvider     oauthProvider
 	userTokenProvider userTokenProvider
 	chatTokenProvider chatTokenProvider
+	hub               hub
+	broker            broker
+	search            searchIndex
+	blob              blobStore
+	urlSigner         urlSigner
+
+	typing   *typing
+	presence *presence
+	// images holds a slot per image being processed
+	images chan struct{}
 }
 
 func New(
+	cfg Config,
 	db database,
 	oauthProvider oauthProvider,
 	userTokenProvider userTokenProvider,
 	chatTokenProvider chatTokenProvider,
+	hub hub,
+	broker broker,
+	search searchIndex,
+	blob blobStore,
+	urlSigner urlSigner,
 ) *Service {
+	if cfg.DedupWindow <= 0 {
+		cfg.DedupWindow = defaultDedupWindow
+	}
+	if cfg.MaxAttachmentSize <= 0 {
+		cfg.MaxAttachmentSize = defaultMaxAttachmentSize
+	}
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = defaultSessionTTL
+	}
+	if cfg.ImageWorkers <= 0 {
+		cfg.ImageWorkers = runtime.GOMAXPROCS(0)
+	}
+
 	return &Service{
+		cfg: cfg,
+
 		db:                db,
 		oauthProvider:     oauthProvider,
 		userTokenProvider: userTokenProvider,
 		chatTokenProvider: chatTokenProvider,
+		hub:               hub,
+		broker:            broker,
+		search:            search,
+		blob:              blob,
+		urlSigner:         urlSigner,
+
+		typing:   newTyping(),
+		presence: newPresence(),
+		images:   make(chan struct{}, cfg.ImageWorkers),
 	}
 }
 
-func (s *Service) GetOAuthRedirectURL(provider string) (string, error) {
-	return s.oauthProvider.GetRedirectURL(provider)
+func (s *Service) GetOAuthRedirectURL(ctx context.Context, provider string) (*domain.OAuthRedirect, error) {
+	return s.oauthProvider.GetRedirectURL(ctx, provider)
 }
 
-func (s *Service) RegisterUser(ctx context.Context, provider string, code string) (*domain.Token, error) {
-	user, err := s.oauthProvider.HandleCallback(ctx, provider, code)
-	if err != nil {
-		return nil, err
-	}
-
-	userID, err := s.db.CreateUser(ctx, user, provider)
+func (s *Service) RegisterUser(ctx context.Context, provider string, callback *domain.OAuthCallback) (*domain.Token, error) {
+	profile, err := s.oauthProvider.HandleCallback(ctx, provider, callback)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := s.userTokenProvider.CreateToken(userID, user.Email)
+	user, err := s.loginUser(ctx, provider, profile)
 	if err != nil {
 		return nil, err
 	}
 
-	return token, nil
+	return s.createSession(ctx, user, newIdentity(provider, profile))
 }
 
-func (s *Service) AuthenticateUser(ctx context.Context, token *domain.Token) (*domain.User, *domain.Token, error) {
-	userID, token, err := s.verifyUserToken(token)
+// AuthenticateUser returns the user and session of the token, the token is
+// refreshed if its access token is expired.
+func (s *Service) AuthenticateUser(ctx context.Context, token *domain.Token) (*domain.User, string, *domain.Token, error) {
+	payload, token, err := s.verifyUserToken(ctx, token)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", nil, err
 	}
 
-	user, err := s.db.GetUser(ctx, userID)
+	user, err := s.db.GetUser(ctx, payload.UserID)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", nil, err
 	}
 
-	return user, token, nil
+	return user, payload.SessionID, token, nil
 }
 
-func (s *Service) verifyUserToken(token *domain.Token) (string, *domain.Token, error) {
+func (s *Service) verifyUserToken(ctx context.Context, token *domain.Token) (*domain.UserTokenPayload, *domain.Token, error) {
 	payload, err := s.userTokenProvider.VerifyToken(token.Access)
 	if err != nil && !errors.Is(err, domain.ErrTokenExpired) {
-		return "", nil, err
+		return nil, nil, err
 	}
 
 	// refresh token if access token is expired
 	if errors.Is(err, domain.ErrTokenExpired) {
-		payload, err = s.userTokenProvider.VerifyToken(token.Refresh)
+		payload, err = s.userTokenProvider.VerifyRefreshToken(token.Refresh)
 		if err != nil {
-			return "", nil, err
+			return nil, nil, err
 		}
 
-		token, err = s.userTokenProvider.CreateToken(payload.UserID, payload.Email)
+		token, err = s.rotateSession(ctx, payload)
 		if err != nil {
-			return "", nil, err
+			return nil, nil, err
 		}
 
-		return payload.UserID, token, nil
+		return payload, token, nil
+	}
+
+	if _, err = s.checkSession(ctx, payload.UserID, payload.SessionID); err != nil {
+		return nil, nil, err
+	}
+
+	return payload, nil, nil
+}
+
+// CreateRoomToken issues a chat ticket of the login session for a gateway
+// connection to the room.
+func (s *Service) CreateRoomToken(ctx context.Context, userID string, sessionID string, roomID string) (string, error) {
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return "", err
 	}
 
-	return payload.UserID, nil, nil
+	return s.chatTokenProvider.CreateToken(userID, sessionID, roomID)
 }
 
-func (s *Service) CreateRoomToken(userID string, sessionID string) (string, error) {
-	return s.chatTokenProvider.CreateToken(userID, sessionID)
+// AuthenticateWS returns the user and login session of the chat ticket, the
+// session must still be active.
+func (s *Service) AuthenticateWS(ctx context.Context, token string, roomID string) (*domain.User, string, error) {
+	payload, err := s.chatTokenProvider.VerifyToken(token, roomID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err = s.checkSession(ctx, payload.UserID, payload.SessionID); err != nil {
+		return nil, "", err
+	}
+
+	user, err := s.db.GetUser(ctx, payload.UserID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, payload.SessionID, nil
 }
 
-//func (s *Service) AuthenticateWS(ctx context.Context, token string, roomID string) (*domain.User, error) {
-//	payload, err := s.roomTokenProvider.VerifyToken(token)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	if payload.RoomID != roomID {
-//		return nil, domain.ErrRoomIDTokenMismatch
-//	}
-//
-//	user, err := s.db.GetUser(ctx, payload.UserID)
-//	if err != nil {
-//		return nil, err
-//	}
-//
-//	return user, nil
-//}
-//
-//func (s *Service) HandleWS(user *domain.User, roomID string, conn *websocket.Conn) {
-//	s.hub.Handle(user, roomID, conn)
-//}
+func (s *Service) HandleWS(ctx context.Context, user *domain.User, sessionID string, roomID string, conn *websocket.Conn) {
+	c := gateway.NewClient(conn, user, roomID, sessionID)
+
+	s.connect(ctx, c)
+	s.hub.Handle(ctx, c, s.handleFrame)
+
+	ctx = context.WithoutCancel(ctx)
+	s.disconnect(ctx, c)
+
+	if err := s.stopTyping(ctx, roomID, user.ID); err != nil {
+		log.Warn("service: stop typing", log.UserID(user.ID), log.ChatID(roomID), log.Err(err))
+	}
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+	"github.com/google/uuid"
+)
+
+// refreshReuseGrace is how long the previous refresh token of a session is
+// tolerated after a rotation, requests sent together by one client present
+// the same token and only the first of them rotates it.
+const refreshReuseGrace = 10 * time.Second
+
+// createSession starts a session of the user logged in with the identity
+// and issues its tokens.
+func (s *Service) createSession(ctx context.Context, user *domain.User, identity *domain.Identity) (*domain.Token, error) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	session := &domain.Session{
+		ID:        uuid.NewString(),
+		UserID:    user.ID,
+		Provider:  identity.Provider,
+		Subject:   identity.Subject,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.cfg.SessionTTL),
+		RefreshID: uuid.NewString(),
+	}
+
+	if err := s.db.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return s.userTokenProvider.CreateToken(user.ID, user.Email, session.ID, session.RefreshID)
+}
+
+// checkSession returns the session of the user unless it is no longer
+// active, tokens issued without a session are not accepted.
+func (s *Service) checkSession(ctx context.Context, userID string, sessionID string) (*domain.Session, error) {
+	if sessionID == "" {
+		return nil, domain.ErrSessionRevoked
+	}
+
+	session, err := s.db.GetSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBSessionNotFound) {
+			return nil, domain.ErrSessionRevoked
+		}
+		return nil, err
+	}
+
+	if session.UserID != userID || !session.Active(time.Now()) {
+		return nil, domain.ErrSessionRevoked
+	}
+
+	return session, nil
+}
+
+// rotateSession exchanges the refresh token of the payload for a new token
+// pair. A refresh token is good for a single rotation, presenting a rotated
+// one again means it was stolen and ends the session for the thief and the
+// user alike. Requests racing a rotation get the pair it rotated to, so the
+// client keeps presenting a current token.
+func (s *Service) rotateSession(ctx context.Context, payload *domain.UserTokenPayload) (*domain.Token, error) {
+	session, err := s.checkSession(ctx, payload.UserID, payload.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	switch {
+	case payload.RefreshID == session.RefreshID:
+		nextID := uuid.NewString()
+
+		err = s.db.RotateSession(ctx, session.ID, payload.RefreshID, nextID, now)
+		if err != nil {
+			// another request rotated the token in the meantime
+			if errors.Is(err, domain.ErrDBSessionNotFound) {
+				return s.currentToken(ctx, payload)
+			}
+			return nil, err
+		}
+
+		return s.userTokenProvider.CreateToken(payload.UserID, payload.Email, session.ID, nextID)
+	case payload.RefreshID == session.PrevRefreshID && session.RotatedAt != nil && now.Sub(*session.RotatedAt) < refreshReuseGrace:
+		return s.userTokenProvider.CreateToken(payload.UserID, payload.Email, session.ID, session.RefreshID)
+	}
+
+	log.Warn("service.rotateSession: refresh token reused", log.UserID(payload.UserID), log.String("session_id", session.ID))
+
+	err = s.db.RevokeSession(ctx, payload.UserID, session.ID, now)
+	if err != nil && !errors.Is(err, domain.ErrDBSessionNotFound) {
+		return nil, err
+	}
+	s.closeSessions(ctx, payload.UserID, session.ID)
+
+	return nil, domain.ErrSessionRevoked
+}
+
+// currentToken issues the token pair of the current refresh token of the
+// session, the session may have been revoked instead of rotated.
+func (s *Service) currentToken(ctx context.Context, payload *domain.UserTokenPayload) (*domain.Token, error) {
+	session, err := s.checkSession(ctx, payload.UserID, payload.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.userTokenProvider.CreateToken(payload.UserID, payload.Email, session.ID, session.RefreshID)
+}
+
+// Logout revokes the session, a revoked session stays revoked.
+func (s *Service) Logout(ctx context.Context, userID string, sessionID string) error {
+	err := s.RevokeSession(ctx, userID, sessionID)
+	if err != nil && !errors.Is(err, domain.ErrDBSessionNotFound) {
+		return err
+	}
+	return nil
+}
+
+// ListSessions returns the active sessions of the user, newest first.
+func (s *Service) ListSessions(ctx context.Context, userID string) ([]*domain.Session, error) {
+	return s.db.ListSessions(ctx, userID, time.Now())
+}
+
+// RevokeSession ends one of the user's sessions, its tokens are rejected from
+// the next request on.
+func (s *Service) RevokeSession(ctx context.Context, userID string, sessionID string) error {
+	err := s.db.RevokeSession(ctx, userID, sessionID, time.Now().UTC().Truncate(time.Millisecond))
+	if err != nil {
+		return err
+	}
+
+	s.closeSessions(ctx, userID, sessionID)
+	return nil
+}
+
+// RevokeUserSessions ends every session of the user but keepID, which may be
+// empty to end them all, and returns how many were ended.
+func (s *Service) RevokeUserSessions(ctx context.Context, userID string, keepID string) (int64, error) {
+	ids, err := s.db.RevokeUserSessions(ctx, userID, keepID, time.Now().UTC().Truncate(time.Millisecond))
+	if err != nil {
+		return 0, err
+	}
+
+	s.closeSessions(ctx, userID, ids...)
+	return int64(len(ids)), nil
+}
+
+// closeSessions closes the gateway connections of the revoked sessions on
+// every instance, a connection missed here still ends with its ticket.
+func (s *Service) closeSessions(ctx context.Context, userID string, sessionIDs ...string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+
+	f, err := gateway.NewFrame(gateway.FrameSessionRevoked, gateway.SessionRevokedData{SessionIDs: sessionIDs})
+	if err != nil {
+		log.Error("service.closeSessions", log.Err(err))
+		return
+	}
+
+	err = s.broker.PublishUserEvent(ctx, &domain.Event{Type: f.Type, UserID: userID, Data: f.Data})
+	if err != nil {
+		log.Warn("service: close sessions", log.UserID(userID), log.Err(err))
+	}
+}
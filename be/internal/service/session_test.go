@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// refreshTokens issues tokens whose refresh token is the rotation id.
+type refreshTokens struct {
+	userTokenProvider
+}
+
+func (refreshTokens) CreateToken(_ string, _ string, _ string, refreshID string) (*domain.Token, error) {
+	return &domain.Token{Access: "access", Refresh: refreshID}, nil
+}
+
+func TestCheckSession(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	revokedAt := now.Add(-time.Minute)
+
+	db := newFakeDB()
+	db.sessions = map[string]*domain.Session{
+		"active":  {ID: "active", UserID: "alice", ExpiresAt: now.Add(time.Hour)},
+		"revoked": {ID: "revoked", UserID: "alice", ExpiresAt: now.Add(time.Hour), RevokedAt: &revokedAt},
+		"expired": {ID: "expired", UserID: "alice", ExpiresAt: now.Add(-time.Hour)},
+	}
+	s := &Service{db: db}
+
+	tests := []struct {
+		name    string
+		payload domain.UserTokenPayload
+		err     error
+	}{
+		{
+			name:    "active",
+			payload: domain.UserTokenPayload{UserID: "alice", SessionID: "active"},
+		},
+		{
+			name:    "revoked",
+			payload: domain.UserTokenPayload{UserID: "alice", SessionID: "revoked"},
+			err:     domain.ErrSessionRevoked,
+		},
+		{
+			name:    "expired",
+			payload: domain.UserTokenPayload{UserID: "alice", SessionID: "expired"},
+			err:     domain.ErrSessionRevoked,
+		},
+		{
+			name:    "unknown",
+			payload: domain.UserTokenPayload{UserID: "alice", SessionID: "unknown"},
+			err:     domain.ErrSessionRevoked,
+		},
+		{
+			name:    "other_user",
+			payload: domain.UserTokenPayload{UserID: "bob", SessionID: "active"},
+			err:     domain.ErrSessionRevoked,
+		},
+		{
+			name:    "no_session",
+			payload: domain.UserTokenPayload{UserID: "alice"},
+			err:     domain.ErrSessionRevoked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := s.checkSession(context.Background(), tt.payload.UserID, tt.payload.SessionID)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRotateSession(t *testing.T) {
+	t.Parallel()
+
+	newService := func(rotatedAgo time.Duration) (*Service, *domain.Session) {
+		rotatedAt := time.Now().Add(-rotatedAgo)
+		session := &domain.Session{
+			ID:            "session",
+			UserID:        "alice",
+			ExpiresAt:     time.Now().Add(time.Hour),
+			RefreshID:     "current",
+			PrevRefreshID: "previous",
+			RotatedAt:     &rotatedAt,
+		}
+		db := newFakeDB()
+		db.sessions[session.ID] = session
+		return &Service{db: db, userTokenProvider: refreshTokens{}, broker: newFakeBroker()}, session
+	}
+
+	tests := []struct {
+		name       string
+		refreshID  string
+		rotatedAgo time.Duration
+		rotated    bool
+		revoked    bool
+	}{
+		{
+			name:       "current",
+			refreshID:  "current",
+			rotatedAgo: time.Hour,
+			rotated:    true,
+		},
+		{
+			name:       "previous_within_grace",
+			refreshID:  "previous",
+			rotatedAgo: time.Second,
+		},
+		{
+			name:       "previous_reused",
+			refreshID:  "previous",
+			rotatedAgo: time.Hour,
+			revoked:    true,
+		},
+		{
+			name:       "older_reused",
+			refreshID:  "older",
+			rotatedAgo: time.Second,
+			revoked:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s, session := newService(tt.rotatedAgo)
+			payload := &domain.UserTokenPayload{UserID: "alice", SessionID: session.ID, RefreshID: tt.refreshID}
+
+			token, err := s.rotateSession(context.Background(), payload)
+			switch {
+			case tt.revoked:
+				require.ErrorIs(t, err, domain.ErrSessionRevoked)
+				require.NotNil(t, session.RevokedAt)
+				require.Len(t, s.broker.(*fakeBroker).listUserEvents(gateway.FrameSessionRevoked), 1)
+
+				// the current token of the session is of no use anymore
+				payload.RefreshID = session.RefreshID
+				_, err = s.rotateSession(context.Background(), payload)
+				require.ErrorIs(t, err, domain.ErrSessionRevoked)
+			case tt.rotated:
+				require.NoError(t, err)
+				require.Equal(t, session.RefreshID, token.Refresh)
+				require.Equal(t, tt.refreshID, session.PrevRefreshID)
+				require.NotEqual(t, tt.refreshID, session.RefreshID)
+			default:
+				// the client gets the current pair and is not revoked by
+				// refreshing with it once the grace has ended
+				require.NoError(t, err)
+				require.Equal(t, "current", token.Refresh)
+				require.Equal(t, "current", session.RefreshID)
+
+				rotatedAt := time.Now().Add(-time.Hour)
+				session.RotatedAt = &rotatedAt
+
+				payload.RefreshID = token.Refresh
+				token, err = s.rotateSession(context.Background(), payload)
+				require.NoError(t, err)
+				require.Equal(t, session.RefreshID, token.Refresh)
+				require.Nil(t, session.RevokedAt)
+			}
+		})
+	}
+}
+
+func TestRotateSession_Race(t *testing.T) {
+	t.Parallel()
+
+	db := newFakeDB()
+	db.sessions["session"] = &domain.Session{
+		ID:        "session",
+		UserID:    "alice",
+		ExpiresAt: time.Now().Add(time.Hour),
+		RefreshID: "current",
+	}
+	s := &Service{db: db, userTokenProvider: refreshTokens{}, broker: newFakeBroker()}
+
+	// requests sent together present the same token, whichever loses the
+	// race gets the pair the winner rotated to
+	tokens := make(chan *domain.Token, 2)
+	for range 2 {
+		go func() {
+			payload := &domain.UserTokenPayload{UserID: "alice", SessionID: "session", RefreshID: "current"}
+			token, err := s.rotateSession(context.Background(), payload)
+			if err != nil {
+				token = nil
+			}
+			tokens <- token
+		}()
+	}
+
+	for range 2 {
+		token := <-tokens
+		require.NotNil(t, token)
+
+		session, err := db.GetSession(context.Background(), "session")
+		require.NoError(t, err)
+		require.Equal(t, session.RefreshID, token.Refresh)
+		require.Nil(t, session.RevokedAt)
+	}
+}
+
+func TestSession_Socket(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		revoke func(s *Service) error
+		// dialed tells whether the socket is open before the revocation
+		dialed bool
+	}{
+		{
+			name:   "revoked_before_dial",
+			revoke: func(s *Service) error { return s.RevokeSession(context.Background(), "alice", "phone") },
+		},
+		{
+			name:   "logout",
+			revoke: func(s *Service) error { return s.Logout(context.Background(), "alice", "phone") },
+			dialed: true,
+		},
+		{
+			name:   "revoke_session",
+			revoke: func(s *Service) error { return s.RevokeSession(context.Background(), "alice", "phone") },
+			dialed: true,
+		},
+		{
+			name: "revoke_other_sessions",
+			revoke: func(s *Service) error {
+				_, err := s.RevokeUserSessions(context.Background(), "alice", "laptop")
+				return err
+			},
+			dialed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			db := newFakeDB()
+			db.users = []*domain.User{{ID: "alice"}}
+			db.rooms["room"] = &domain.Room{ID: "room", Members: []domain.RoomMember{{UserID: "alice"}}}
+			for _, id := range []string{"phone", "laptop"} {
+				db.sessions[id] = &domain.Session{ID: id, UserID: "alice", ExpiresAt: time.Now().Add(time.Hour)}
+			}
+			s, b, url := newTestService(t, db)
+
+			laptop, _, err := dialRoom(t, s, url, "alice", "laptop", "room")
+			require.NoError(t, err)
+
+			var phone *websocket.Conn
+			if tt.dialed {
+				phone, _, err = dialRoom(t, s, url, "alice", "phone", "room")
+				require.NoError(t, err)
+				require.Eventually(t, func() bool { return b.userSubscribed("alice") }, time.Second, 10*time.Millisecond)
+			}
+
+			require.NoError(t, tt.revoke(s))
+
+			if !tt.dialed {
+				_, resp, err := dialRoom(t, s, url, "alice", "phone", "room")
+				require.Error(t, err)
+				require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+				return
+			}
+
+			f := readFrame(t, phone)
+			require.Equal(t, gateway.FrameSessionRevoked, f.Type)
+
+			_, _, err = phone.ReadMessage()
+			require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+
+			// the other session keeps its socket
+			_ = laptop.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, _, err = laptop.ReadMessage()
+			var netErr net.Error
+			require.ErrorAs(t, err, &netErr)
+			require.True(t, netErr.Timeout())
+		})
+	}
+}
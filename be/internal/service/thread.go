@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+)
+
+// ListReplies returns a page of the thread started by the message, newest
+// first.
+func (s *Service) ListReplies(ctx context.Context, userID string, roomID string, parentID string, before string, limit int) (*domain.MessagePage, error) {
+	switch {
+	case limit == 0:
+		limit = domain.MessagePageDefaultLimit
+	case limit < 0 || limit > domain.MessagePageMaxLimit:
+		return nil, domain.ErrLimitInvalid
+	}
+
+	if err := s.checkRoomMember(ctx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.threadParent(ctx, roomID, parentID); err != nil {
+		return nil, err
+	}
+
+	return s.db.ListReplies(ctx, parentID, before, limit)
+}
+
+func (s *Service) subscribeThread(ctx context.Context, c *gateway.Client, f *gateway.Frame) error {
+	var data gateway.ThreadData
+	if err := f.Decode(&data); err != nil || data.ParentID == "" {
+		return domain.ErrFrameInvalid
+	}
+
+	if _, err := s.threadParent(ctx, c.RoomID(), data.ParentID); err != nil {
+		return err
+	}
+
+	return c.SubscribeThread(data.ParentID)
+}
+
+func unsubscribeThread(c *gateway.Client, f *gateway.Frame) error {
+	var data gateway.ThreadData
+	if err := f.Decode(&data); err != nil || data.ParentID == "" {
+		return domain.ErrFrameInvalid
+	}
+
+	c.UnsubscribeThread(data.ParentID)
+	return nil
+}
+
+// threadParent loads the message that starts the thread, replies cannot
+// start threads of their own.
+func (s *Service) threadParent(ctx context.Context, roomID string, parentID string) (*domain.Message, error) {
+	parent, err := s.db.GetMessage(ctx, parentID)
+	if err != nil {
+		if errors.Is(err, domain.ErrDBMessageNotFound) {
+			return nil, domain.ErrThreadParentInvalid
+		}
+		return nil, err
+	}
+
+	if parent.RoomID != roomID || parent.ParentID != "" {
+		return nil, domain.ErrThreadParentInvalid
+	}
+
+	return parent, nil
+}
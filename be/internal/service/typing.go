@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/escalopa/chatterly/internal/domain"
+	"github.com/escalopa/chatterly/internal/gateway"
+	"github.com/escalopa/chatterly/internal/log"
+)
+
+// typingTTL is how long a typing.start lasts without being repeated.
+const typingTTL = 5 * time.Second
+
+// typing tracks the users typing through the connections of this instance,
+// keyed by room and user.
+type typing struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newTyping() *typing {
+	return &typing{timers: make(map[string]*time.Timer)}
+}
+
+// startTyping announces the user as typing, a repeated start only extends
+// the expiry.
+func (s *Service) startTyping(ctx context.Context, roomID string, userID string) error {
+	key := roomID + ":" + userID
+
+	s.typing.mu.Lock()
+	if t, ok := s.typing.timers[key]; ok && t.Reset(typingTTL) {
+		s.typing.mu.Unlock()
+		return nil
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(typingTTL, func() {
+		s.typing.mu.Lock()
+		if s.typing.timers[key] != t {
+			// stopped or restarted meanwhile
+			s.typing.mu.Unlock()
+			return
+		}
+		delete(s.typing.timers, key)
+		s.typing.mu.Unlock()
+
+		if err := s.publishTyping(context.Background(), gateway.FrameTypingStop, roomID, userID); err != nil {
+			log.Warn("service: expire typing", log.UserID(userID), log.ChatID(roomID), log.Err(err))
+		}
+	})
+	s.typing.timers[key] = t
+	s.typing.mu.Unlock()
+
+	return s.publishTyping(ctx, gateway.FrameTypingStart, roomID, userID)
+}
+
+// stopTyping announces the user stopped typing, it does nothing unless the
+// user is typing.
+func (s *Service) stopTyping(ctx context.Context, roomID string, userID string) error {
+	key := roomID + ":" + userID
+
+	s.typing.mu.Lock()
+	t, ok := s.typing.timers[key]
+	if !ok {
+		s.typing.mu.Unlock()
+		return nil
+	}
+	t.Stop()
+	delete(s.typing.timers, key)
+	s.typing.mu.Unlock()
+
+	return s.publishTyping(ctx, gateway.FrameTypingStop, roomID, userID)
+}
+
+func (s *Service) publishTyping(ctx context.Context, typ string, roomID string, userID string) error {
+	data := gateway.TypingData{UserID: userID}
+	if typ == gateway.FrameTypingStart {
+		data.TTLMs = typingTTL.Milliseconds()
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.broker.PublishEvent(ctx, &domain.Event{
+		Type:          typ,
+		RoomID:        roomID,
+		Data:          raw,
+		ExcludeUserID: userID,
+	})
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/escalopa/chatterly/internal/domain"
+)
+
+// usernamePattern matches what a mention parses as a name, without the
+// punctuation taken for the end of a sentence.
+var usernamePattern = regexp.MustCompile(`^\w[\w.-]*\w$`)
+
+// SetUsername sets the name other users mention the user by, it is stored
+// lowercase.
+func (s *Service) SetUsername(ctx context.Context, userID string, username string) (*domain.User, error) {
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.db.SetUsername(ctx, userID, username)
+}
+
+func normalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+
+	switch {
+	case len(username) < domain.UsernameMinLength, len(username) > domain.UsernameMaxLength:
+		return "", domain.ErrUsernameInvalid
+	case !usernamePattern.MatchString(username):
+		return "", domain.ErrUsernameInvalid
+	case username == roomMention:
+		return "", domain.ErrUsernameInvalid
+	}
+
+	return username, nil
+}